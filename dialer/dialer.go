@@ -16,10 +16,19 @@ type ExtraOption struct {
 	TlsFragment         bool
 	TlsFragmentLength   string
 	TlsFragmentInterval string
-	UtlsImitate         string
-	BandwidthMaxTx      string
-	BandwidthMaxRx      string
-	UDPHopInterval    time.Duration
+	TlsSplit            string
+	// TlsMinVersion and TlsMaxVersion bound the TLS version, e.g. "1.2" or
+	// "1.3"; empty leaves the crypto/tls default.
+	TlsMinVersion string
+	TlsMaxVersion string
+	// TlsCipherSuites is a comma-separated list of TLS 1.2 and earlier cipher
+	// suite names, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"; empty leaves
+	// the crypto/tls default. TLS 1.3 suites cannot be chosen.
+	TlsCipherSuites string
+	UtlsImitate     string
+	BandwidthMaxTx  string
+	BandwidthMaxRx  string
+	UDPHopInterval  time.Duration
 }
 
 type Property struct {
@@ -36,6 +36,11 @@ type Trojan struct {
 	ServiceName   string `json:"serviceName"`
 	AllowInsecure bool   `json:"allowInsecure"`
 	Protocol      string `json:"protocol"`
+	Security      string `json:"security"`
+	Fingerprint   string `json:"fp"`
+	PublicKey     string `json:"pbk"`
+	ShortId       string `json:"sid"`
+	SpiderX       string `json:"spx"`
 }
 
 func NewTrojan(option *dialer.ExtraOption, nextDialer netproxy.Dialer, link string) (netproxy.Dialer, *dialer.Property, error) {
@@ -49,7 +54,25 @@ func NewTrojan(option *dialer.ExtraOption, nextDialer netproxy.Dialer, link stri
 func (s *Trojan) Dialer(option *dialer.ExtraOption, nextDialer netproxy.Dialer) (netproxy.Dialer, *dialer.Property, error) {
 	d := nextDialer
 	var err error
-	if s.Type != "grpc" {
+	if s.Security == "reality" {
+		if s.Type == "grpc" {
+			return nil, nil, fmt.Errorf("%w: reality over grpc", dialer.UnexpectedFieldErr)
+		}
+		u := url.URL{
+			Scheme: "reality",
+			Host:   net.JoinHostPort(s.Server, strconv.Itoa(s.Port)),
+			RawQuery: url.Values{
+				"sni": []string{s.Sni},
+				"fp":  []string{s.Fingerprint},
+				"sid": []string{s.ShortId},
+				"pbk": []string{s.PublicKey},
+				"spx": []string{s.SpiderX},
+			}.Encode(),
+		}
+		if d, err = tls.NewReality(u.String(), d); err != nil {
+			return nil, nil, err
+		}
+	} else if s.Type != "grpc" {
 		// grpc contains tls
 		u := url.URL{
 			Scheme: option.TlsImplementation,
@@ -58,6 +81,7 @@ func (s *Trojan) Dialer(option *dialer.ExtraOption, nextDialer netproxy.Dialer)
 				"sni":           []string{s.Sni},
 				"allowInsecure": []string{common.BoolToString(s.AllowInsecure || option.AllowInsecure)},
 				"utlsImitate":   []string{option.UtlsImitate},
+				"fp":            []string{s.Fingerprint},
 			}.Encode(),
 		}
 		if d, _, err = tls.NewTls(option, d, u.String()); err != nil {
@@ -165,6 +189,11 @@ func ParseTrojanURL(u string) (data *Trojan, err error) {
 		Sni:           sni,
 		AllowInsecure: allowInsecure,
 		Protocol:      "trojan",
+		Security:      t.Query().Get("security"),
+		Fingerprint:   t.Query().Get("fp"),
+		PublicKey:     t.Query().Get("pbk"),
+		ShortId:       t.Query().Get("sid"),
+		SpiderX:       t.Query().Get("spx"),
 	}
 	if t.Query().Get("type") != "" {
 		t.Scheme = "trojan-go"
@@ -195,6 +224,11 @@ func (t *Trojan) ExportToURL() string {
 		q.Set("allowInsecure", "1")
 	}
 	common.SetValue(&q, "sni", t.Sni)
+	common.SetValue(&q, "security", t.Security)
+	common.SetValue(&q, "fp", t.Fingerprint)
+	common.SetValue(&q, "pbk", t.PublicKey)
+	common.SetValue(&q, "sid", t.ShortId)
+	common.SetValue(&q, "spx", t.SpiderX)
 
 	if t.Protocol == "trojan-go" {
 		u.Scheme = "trojan-go"
@@ -107,6 +107,7 @@ func (s *V2Ray) Dialer(option *dialer.ExtraOption, nextDialer netproxy.Dialer) (
 				"host":          []string{s.Host},
 				"sni":           []string{sni},
 				"allowInsecure": []string{common.BoolToString(s.AllowInsecure || option.AllowInsecure)},
+				"fp":            []string{s.Fingerprint},
 			}.Encode(),
 		}
 		d, _, err = ws.NewWs(option, d, u.String())
@@ -140,6 +141,7 @@ func (s *V2Ray) Dialer(option *dialer.ExtraOption, nextDialer netproxy.Dialer) (
 						"sni":           []string{sni},
 						"allowInsecure": []string{common.BoolToString(s.AllowInsecure || option.AllowInsecure)},
 						"utlsImitate":   []string{option.UtlsImitate},
+						"fp":            []string{s.Fingerprint},
 					}.Encode(),
 				}
 				d, _, err = tls.NewTls(option, d, u.String())
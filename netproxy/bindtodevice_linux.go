@@ -0,0 +1,30 @@
+//go:build linux
+
+package netproxy
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindToDeviceSupported tells whether BindToDeviceControl is implemented on
+// this platform.
+const BindToDeviceSupported = true
+
+// BindToDeviceControl binds the socket to the network interface iface with
+// SO_BINDTODEVICE, so that its packets leave through iface whatever the
+// routing table says. Kernels before 5.7 require CAP_NET_RAW.
+func BindToDeviceControl(c syscall.RawConn, iface string) error {
+	var sockOptErr error
+	controlErr := c.Control(func(fd uintptr) {
+		if err := unix.BindToDevice(int(fd), iface); err != nil {
+			sockOptErr = fmt.Errorf("error setting SO_BINDTODEVICE socket option to %q: %w", iface, err)
+		}
+	})
+	if controlErr != nil {
+		return fmt.Errorf("error invoking socket control function: %w", controlErr)
+	}
+	return sockOptErr
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package netproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// BindToDeviceSupported tells whether BindToDeviceControl is implemented on
+// this platform.
+const BindToDeviceSupported = false
+
+// BindToDeviceControl always fails: SO_BINDTODEVICE is Linux only.
+func BindToDeviceControl(c syscall.RawConn, iface string) error {
+	return errors.New("binding to a network interface is only supported on Linux")
+}
@@ -0,0 +1,109 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrUnderlayNotUsed is the error of a hop of a ChainDialer that built its
+// conn without dialing through the hops before it, e.g. over its own socket.
+var ErrUnderlayNotUsed = errors.New("hop did not dial through the previous hops")
+
+// HopError is returned by a ChainDialer when a hop fails to dial.
+type HopError struct {
+	// Hop is the index of the failing dialer in the chain.
+	Hop int
+	Err error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("hop %d: %v", e.Hop, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+type underlayKey struct{}
+
+// underlay is the value of underlayKey: the dialer the direct dialer of a hop
+// dials through instead of the network. A nil Dialer means the network.
+type underlay struct {
+	Dialer
+}
+
+// UnderlayFromContext returns the dialer set by a ChainDialer for the hop
+// being dialed, through which the direct dialer at the bottom of the hop dials
+// instead of the network, and whether there is one.
+func UnderlayFromContext(ctx context.Context) (d Dialer, ok bool) {
+	u, _ := ctx.Value(underlayKey{}).(underlay)
+	return u.Dialer, u.Dialer != nil
+}
+
+// ChainDialer returns a Dialer that dials through hops in order, e.g. proxy A,
+// then proxy B, then the target: every hop after the first reaches its server
+// through the conn the previous hops build, the first one through the
+// network. The hops are the dialers of single proxies as built on the direct
+// dialer, which makes the chain work: the direct dialer dials through the
+// previous hops when asked to by the chain. Hops whose protocol runs over QUIC
+// open their own sockets, and hops that reuse a conn of an earlier dial do not
+// dial at all, so neither can be chained after another hop: the chain closes
+// the conn of such a hop and fails with ErrUnderlayNotUsed rather than let it
+// bypass the hops before it. When a hop fails, the error is a *HopError naming
+// it.
+func ChainDialer(hops []Dialer) Dialer {
+	return &chainDialer{hops: hops}
+}
+
+type chainDialer struct {
+	hops []Dialer
+}
+
+func (c *chainDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	if len(c.hops) == 0 {
+		return nil, fmt.Errorf("empty dialer chain")
+	}
+	var failed atomic.Int64
+	failed.Store(-1)
+	conn, err := c.dialHop(ctx, len(c.hops)-1, network, addr, &failed)
+	if err != nil {
+		return nil, &HopError{Hop: int(failed.Load()), Err: err}
+	}
+	return conn, nil
+}
+
+// dialHop dials addr through the hops up to i. failed records the index of the
+// hop that failed first, which is the innermost one.
+func (c *chainDialer) dialHop(ctx context.Context, i int, network, addr string, failed *atomic.Int64) (Conn, error) {
+	var u underlay
+	var prev *hopDialer
+	if i > 0 {
+		prev = &hopDialer{chain: c, hop: i - 1, failed: failed}
+		u.Dialer = prev
+	}
+	conn, err := c.hops[i].DialContext(context.WithValue(ctx, underlayKey{}, u), network, addr)
+	if err == nil && prev != nil && !prev.used.Load() {
+		_ = conn.Close()
+		conn, err = nil, ErrUnderlayNotUsed
+	}
+	if err != nil {
+		failed.CompareAndSwap(-1, int64(i))
+	}
+	return conn, err
+}
+
+// hopDialer dials through the hops of chain up to hop. used records whether
+// the hop after them dialed through it.
+type hopDialer struct {
+	chain  *chainDialer
+	hop    int
+	failed *atomic.Int64
+	used   atomic.Bool
+}
+
+func (d *hopDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	d.used.Store(true)
+	return d.chain.dialHop(ctx, d.hop, network, addr, d.failed)
+}
@@ -0,0 +1,113 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// logConn records what is written to it.
+type logConn struct {
+	net.Conn
+	log    *strings.Builder
+	closed bool
+}
+
+func (c *logConn) Write(p []byte) (int, error) {
+	return c.log.Write(p)
+}
+
+func (c *logConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// chainNet is the direct dialer of the hops: it records the addresses it dials.
+// If ownSocket is set, it ignores the underlay like a hop over QUIC would.
+type chainNet struct {
+	dialed    []string
+	log       strings.Builder
+	ownSocket bool
+	conns     []*logConn
+}
+
+func (d *chainNet) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	if underlay, ok := UnderlayFromContext(ctx); ok && !d.ownSocket {
+		return underlay.DialContext(ctx, network, addr)
+	}
+	d.dialed = append(d.dialed, addr)
+	conn := &logConn{log: &d.log}
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+// chainProxy asks its server for addr by writing "name>addr;".
+type chainProxy struct {
+	name   string
+	server string
+	next   Dialer
+	fail   bool
+}
+
+func (p *chainProxy) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	conn, err := p.next.DialContext(ctx, network, p.server)
+	if err != nil {
+		// Not wrapped, to check that the hop is found anyway.
+		return nil, fmt.Errorf("%s: %v", p.name, err)
+	}
+	if p.fail {
+		return nil, errors.New(p.name + ": handshake failed")
+	}
+	_, _ = fmt.Fprintf(conn, "%s>%s;", p.name, addr)
+	return conn, nil
+}
+
+func TestChainDialer(t *testing.T) {
+	network := &chainNet{}
+	a := &chainProxy{name: "A", server: "a:1", next: network}
+	b := &chainProxy{name: "B", server: "b:1", next: network}
+	c := &chainProxy{name: "C", server: "c:1", next: network}
+	if _, err := ChainDialer([]Dialer{a, b, c}).DialContext(context.Background(), "tcp", "target:80"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(network.dialed) != "[a:1]" {
+		t.Errorf("the network dialed %v, want only the first hop", network.dialed)
+	}
+	if got := network.log.String(); got != "A>b:1;B>c:1;C>target:80;" {
+		t.Errorf("the hops were asked %q, want every hop for the next one", got)
+	}
+
+	for hop, failing := range []*chainProxy{a, b, c} {
+		failing.fail = true
+		_, err := ChainDialer([]Dialer{a, b, c}).DialContext(context.Background(), "tcp", "target:80")
+		failing.fail = false
+		var hopErr *HopError
+		if !errors.As(err, &hopErr) || hopErr.Hop != hop {
+			t.Errorf("DialContext() with hop %v failing = %v, want a HopError for it", hop, err)
+		}
+	}
+}
+
+func TestChainDialerUnderlayNotUsed(t *testing.T) {
+	network := &chainNet{}
+	own := &chainNet{ownSocket: true}
+	a := &chainProxy{name: "A", server: "a:1", next: network}
+	b := &chainProxy{name: "B", server: "b:1", next: own}
+	_, err := ChainDialer([]Dialer{a, b}).DialContext(context.Background(), "tcp", "target:80")
+	var hopErr *HopError
+	if !errors.As(err, &hopErr) || hopErr.Hop != 1 || !errors.Is(err, ErrUnderlayNotUsed) {
+		t.Fatalf("DialContext() with hop 1 on its own socket = %v, want a HopError for it with ErrUnderlayNotUsed", err)
+	}
+	if fmt.Sprint(own.dialed) != "[b:1]" || !own.conns[0].closed {
+		t.Errorf("the conn of hop 1 was not closed")
+	}
+
+	// The first hop dials the network anyway.
+	_, err = ChainDialer([]Dialer{b, a}).DialContext(context.Background(), "tcp", "target:80")
+	if err != nil {
+		t.Errorf("DialContext() with hop 0 on its own socket = %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package netproxy
+
+import (
+	"context"
+)
+
+type concurrencyLimitDialer struct {
+	Dialer
+	sem chan struct{}
+}
+
+// ConcurrencyLimitDialer returns a Dialer that allows at most max dials of inner
+// to be in flight at once. Further dials block until a slot frees up or their
+// context is done. A slot is released as soon as the dial returns, whether it
+// succeeded or not, not when the connection is closed.
+func ConcurrencyLimitDialer(inner Dialer, max int) Dialer {
+	if max <= 0 {
+		return inner
+	}
+	return &concurrencyLimitDialer{
+		Dialer: inner,
+		sem:    make(chan struct{}, max),
+	}
+}
+
+func (d *concurrencyLimitDialer) DialContext(ctx context.Context, network, addr string) (c Conn, err error) {
+	select {
+	case d.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-d.sem }()
+	return d.Dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,112 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gateDialer blocks every dial until release is closed, then fails it if fail
+// is set. It records the most dials in flight at once.
+type gateDialer struct {
+	release  chan struct{}
+	fail     bool
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+	started  chan struct{}
+}
+
+func newGateDialer() *gateDialer {
+	return &gateDialer{release: make(chan struct{}), started: make(chan struct{}, 16)}
+}
+
+func (d *gateDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	n := d.inFlight.Add(1)
+	defer d.inFlight.Add(-1)
+	for {
+		seen := d.maxSeen.Load()
+		if n <= seen || d.maxSeen.CompareAndSwap(seen, n) {
+			break
+		}
+	}
+	d.started <- struct{}{}
+	<-d.release
+	if d.fail {
+		return nil, errors.New("dial failed")
+	}
+	a, _ := net.Pipe()
+	return a, nil
+}
+
+func TestConcurrencyLimitDialer(t *testing.T) {
+	inner := newGateDialer()
+	d := ConcurrencyLimitDialer(inner, 2)
+
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			c, err := d.DialContext(context.Background(), "tcp", "1.1.1.1:80")
+			if err == nil {
+				c.Close()
+			}
+			errs <- err
+		}()
+	}
+	<-inner.started
+	<-inner.started
+	select {
+	case <-inner.started:
+		t.Fatal("a third dial started while two were in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(inner.release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := inner.maxSeen.Load(); n != 2 {
+		t.Errorf("%v dials were in flight at once, want 2", n)
+	}
+}
+
+func TestConcurrencyLimitDialerReleasesOnFailure(t *testing.T) {
+	inner := newGateDialer()
+	inner.fail = true
+	close(inner.release)
+	d := ConcurrencyLimitDialer(inner, 1)
+
+	// Every failed dial gives its slot back, or the second one would block.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := d.DialContext(ctx, "tcp", "1.1.1.1:80")
+		cancel()
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("DialContext() #%v = %v, want the error of the inner dialer", i, err)
+		}
+	}
+}
+
+func TestConcurrencyLimitDialerContext(t *testing.T) {
+	inner := newGateDialer()
+	defer close(inner.release)
+	d := ConcurrencyLimitDialer(inner, 1)
+
+	go func() {
+		_, _ = d.DialContext(context.Background(), "tcp", "1.1.1.1:80")
+	}()
+	<-inner.started
+
+	// A dial waiting for a slot gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "1.1.1.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext() waiting for a slot = %v, want context.DeadlineExceeded", err)
+	}
+	if n := inner.inFlight.Load(); n != 1 {
+		t.Errorf("%v dials in flight, want only the first one", n)
+	}
+}
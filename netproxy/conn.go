@@ -1,6 +1,7 @@
 package netproxy
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
@@ -37,6 +38,56 @@ type PacketConn interface {
 	SetWriteDeadline(t time.Time) error
 }
 
+// StreamTyper is optionally implemented by a Conn to tell whether it is
+// stream oriented like TCP (IsStream returns true), where data is a byte stream
+// without message boundaries, or packet oriented like UDP (IsStream returns
+// false), where every Write is delivered as one message or not at all.
+// Wrappers should forward the answer of the Conn they wrap.
+type StreamTyper interface {
+	IsStream() bool
+}
+
+// IsStreamConn reports whether c is stream oriented. TCP and UDP conns of the
+// standard library are recognized as well. ok is false if c does not implement
+// StreamTyper and is of none of those types, in which case stream is
+// meaningless.
+func IsStreamConn(c Conn) (stream bool, ok bool) {
+	switch c := c.(type) {
+	case StreamTyper:
+		return c.IsStream(), true
+	case *net.TCPConn:
+		return true, true
+	case *net.UDPConn:
+		return false, true
+	}
+	return false, false
+}
+
+// CloseWriter is optionally implemented by a stream Conn that can shut down
+// its writing side, so that the peer reads EOF while the Conn can still be
+// read from. Wrappers should forward it.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite half-closes c if it implements CloseWriter. Otherwise it returns
+// errors.ErrUnsupported and leaves c open; callers that need the peer to see
+// EOF anyway have to Close it.
+func CloseWrite(c Conn) error {
+	if cw, ok := c.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// AsNetConn returns c as a net.Conn, e.g. to hand it to http.Transport or
+// tls.Client, and whether c implements net.Conn. Conns without addresses can
+// be wrapped in a FakeNetConn instead.
+func AsNetConn(c Conn) (net.Conn, bool) {
+	nc, ok := c.(net.Conn)
+	return nc, ok
+}
+
 type FakeNetConn struct {
 	Conn
 	LAddr net.Addr
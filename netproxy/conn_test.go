@@ -0,0 +1,75 @@
+package netproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+
+	// Wrappers forward the half-close.
+	if err := CloseWrite(NewPeekConn(client)); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(server); err != nil || len(b) != 0 {
+		t.Fatalf("peer ReadAll() = %q, %v, want EOF", b, err)
+	}
+	// The other direction still works.
+	go server.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("Read() = %q, %v, want pong", buf, err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := CloseWrite(a); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseWrite() = %v, want errors.ErrUnsupported", err)
+	}
+	// An unsupported conn is left open.
+	go a.Write([]byte("x"))
+	if _, err := b.Read(buf); err != nil {
+		t.Errorf("Read() = %v", err)
+	}
+}
+
+func TestAsNetConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if nc, ok := AsNetConn(client); !ok || nc != client {
+		t.Errorf("AsNetConn(net.Pipe()) = %v, %v, want the conn itself", nc, ok)
+	}
+	// A Conn without addresses is not a net.Conn.
+	if _, ok := AsNetConn(struct{ Conn }{client}); ok {
+		t.Error("AsNetConn() of a Conn without addresses succeeded")
+	}
+}
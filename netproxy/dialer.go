@@ -2,6 +2,8 @@ package netproxy
 
 import (
 	"context"
+	"net"
+	"net/netip"
 	"time"
 )
 
@@ -22,3 +24,43 @@ func NewDialTimeoutContext() (context.Context, context.CancelFunc) {
 type Dialer interface {
 	DialContext(ctx context.Context, network, addr string) (c Conn, err error)
 }
+
+type dialIPKey struct{}
+
+// WithDialIP returns a copy of ctx that makes the direct dialer connect to ip
+// instead of resolving the host of the address it dials, e.g. to use an
+// address resolved by split-horizon DNS or to reach one backend behind a load
+// balancer. Dialers above it keep using the host name, so TLS still sends it
+// as SNI and verifies the certificate against it. The IP replaces the first
+// hop: with a proxy in the chain, it is the address of the proxy server.
+// Protocols over QUIC resolve their server when they are created and ignore
+// it.
+func WithDialIP(ctx context.Context, ip netip.Addr) context.Context {
+	return context.WithValue(ctx, dialIPKey{}, ip)
+}
+
+// DialIPFromContext returns the IP set by WithDialIP, if any.
+func DialIPFromContext(ctx context.Context) (ip netip.Addr, ok bool) {
+	ip, ok = ctx.Value(dialIPKey{}).(netip.Addr)
+	return ip, ok && ip.IsValid()
+}
+
+// DialWithIP dials addr with d, connecting to ip instead, see WithDialIP.
+func DialWithIP(ctx context.Context, d Dialer, network, addr string, ip netip.Addr) (Conn, error) {
+	return d.DialContext(WithDialIP(ctx, ip), network, addr)
+}
+
+// OverrideDialAddr returns addr with its host replaced by the IP set by
+// WithDialIP, if any. Dialers that connect sockets call it on the address
+// they are asked to dial.
+func OverrideDialAddr(ctx context.Context, addr string) (string, error) {
+	ip, ok := DialIPFromContext(ctx)
+	if !ok {
+		return addr, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
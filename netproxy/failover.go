@@ -0,0 +1,122 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FailoverDialer tries a list of upstream dialers in order until one succeeds.
+type FailoverDialer struct {
+	dialers []Dialer
+	// attemptTimeout caps each attempt; zero means no cap.
+	attemptTimeout time.Duration
+	// cooldown is how long a failed upstream is skipped; zero disables it.
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	failedAt []time.Time
+}
+
+// NewFailoverDialer returns a dialer that tries dialers in order.
+//
+// If the context has a deadline, the remaining time is split evenly between the
+// upstreams left to try, so a hanging upstream cannot starve the others.
+// attemptTimeout, if non-zero, further caps every attempt. If cooldown is
+// non-zero, an upstream that failed is skipped for that long unless all
+// upstreams are cooling down.
+func NewFailoverDialer(dialers []Dialer, attemptTimeout, cooldown time.Duration) *FailoverDialer {
+	return &FailoverDialer{
+		dialers:        dialers,
+		attemptTimeout: attemptTimeout,
+		cooldown:       cooldown,
+		failedAt:       make([]time.Time, len(dialers)),
+	}
+}
+
+func (d *FailoverDialer) DialContext(ctx context.Context, network, addr string) (c Conn, err error) {
+	if len(d.dialers) == 0 {
+		return nil, fmt.Errorf("failover: no upstream dialers")
+	}
+	candidates := d.candidates()
+	var errs []error
+	for i, idx := range candidates {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		attemptCtx, cancel := d.attemptContext(ctx, len(candidates)-i)
+		c, err = d.dialers[idx].DialContext(attemptCtx, network, addr)
+		cancel()
+		if err == nil {
+			d.markSucceeded(idx)
+			return c, nil
+		}
+		errs = append(errs, fmt.Errorf("upstream %d: %w", idx, err))
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about the upstream.
+			break
+		}
+		d.markFailed(idx)
+	}
+	return nil, fmt.Errorf("failover: all upstreams failed: %w", errors.Join(errs...))
+}
+
+// candidates returns the indexes of upstreams to try, in order.
+func (d *FailoverDialer) candidates() []int {
+	all := make([]int, len(d.dialers))
+	for i := range all {
+		all[i] = i
+	}
+	if d.cooldown <= 0 {
+		return all
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	available := make([]int, 0, len(d.dialers))
+	for i, t := range d.failedAt {
+		if t.IsZero() || now.Sub(t) >= d.cooldown {
+			available = append(available, i)
+		}
+	}
+	if len(available) == 0 {
+		// Everything is cooling down; trying them anyway beats failing blindly.
+		return all
+	}
+	return available
+}
+
+func (d *FailoverDialer) attemptContext(ctx context.Context, left int) (context.Context, context.CancelFunc) {
+	timeout := d.attemptTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		share := time.Until(deadline) / time.Duration(left)
+		if timeout <= 0 || share < timeout {
+			timeout = share
+		}
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (d *FailoverDialer) markFailed(idx int) {
+	if d.cooldown <= 0 {
+		return
+	}
+	d.mu.Lock()
+	d.failedAt[idx] = time.Now()
+	d.mu.Unlock()
+}
+
+func (d *FailoverDialer) markSucceeded(idx int) {
+	if d.cooldown <= 0 {
+		return
+	}
+	d.mu.Lock()
+	d.failedAt[idx] = time.Time{}
+	d.mu.Unlock()
+}
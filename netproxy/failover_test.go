@@ -0,0 +1,145 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeDialer struct {
+	name string
+	err  error
+	// block makes the dial wait for the context instead of returning.
+	block bool
+	// calls records the dial order shared by all fake dialers.
+	calls *[]string
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	*d.calls = append(*d.calls, d.name)
+	if d.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func newFakeDialers(calls *[]string, errs ...error) []Dialer {
+	dialers := make([]Dialer, len(errs))
+	for i, err := range errs {
+		dialers[i] = &fakeDialer{name: fmt.Sprint(i), err: err, calls: calls}
+	}
+	return dialers
+}
+
+func TestFailoverDialerOrder(t *testing.T) {
+	var calls []string
+	errA := errors.New("a is down")
+	d := NewFailoverDialer(newFakeDialers(&calls, errA, nil, nil), 0, 0)
+	c, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := strings.Join(calls, ","); got != "0,1" {
+		t.Errorf("calls = %v, want 0,1", got)
+	}
+}
+
+func TestFailoverDialerCooldown(t *testing.T) {
+	var calls []string
+	dialers := newFakeDialers(&calls, errors.New("down"), nil)
+	d := NewFailoverDialer(dialers, 0, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		c, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	// The failed upstream is skipped on the second dial.
+	if got := strings.Join(calls, ","); got != "0,1,1" {
+		t.Errorf("calls = %v, want 0,1,1", got)
+	}
+}
+
+func TestFailoverDialerAllCoolingDown(t *testing.T) {
+	var calls []string
+	errA, errB := errors.New("a is down"), errors.New("b is down")
+	d := NewFailoverDialer(newFakeDialers(&calls, errA, errB), 0, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		_, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		// All upstreams are tried and reported.
+		if !errors.Is(err, errA) || !errors.Is(err, errB) {
+			t.Errorf("err = %v, want both upstream errors", err)
+		}
+	}
+	// Everything is cooling down on the second dial, so everything is tried.
+	if got := strings.Join(calls, ","); got != "0,1,0,1" {
+		t.Errorf("calls = %v, want 0,1,0,1", got)
+	}
+}
+
+func TestFailoverDialerCallerCancel(t *testing.T) {
+	var calls []string
+	dialers := []Dialer{
+		&fakeDialer{name: "0", block: true, calls: &calls},
+		&fakeDialer{name: "1", calls: &calls},
+	}
+	d := NewFailoverDialer(dialers, 0, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := d.DialContext(ctx, "tcp", "example.com:80"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	// The caller giving up must not put the upstream into cooldown.
+	dialers[0].(*fakeDialer).block = false
+	c, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := strings.Join(calls, ","); got != "0,0" {
+		t.Errorf("calls = %v, want 0,0", got)
+	}
+}
+
+func TestFailoverDialerSplitsDeadline(t *testing.T) {
+	var calls []string
+	dialers := []Dialer{
+		&fakeDialer{name: "0", block: true, calls: &calls},
+		&fakeDialer{name: "1", calls: &calls},
+	}
+	d := NewFailoverDialer(dialers, 0, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	c, err := d.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// The hanging upstream only gets its share of the deadline.
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("dial took %v, want about 500ms", elapsed)
+	}
+	if got := strings.Join(calls, ","); got != "0,1" {
+		t.Errorf("calls = %v, want 0,1", got)
+	}
+}
@@ -0,0 +1,136 @@
+package netproxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNegativeCached is wrapped, along with the error of the failed dial, by
+// the errors a NegativeCacheDialer returns without dialing.
+var ErrNegativeCached = errors.New("destination failed recently")
+
+// NegativeCacheDialer remembers the destinations its dials failed to reach
+// and fails further dials to them at once, so that clients hammering a dead
+// destination do not cost a dial, and a timeout, each. Once the entry of a
+// destination expires, one dial goes through to probe it while the others
+// keep failing fast: a success forgets the destination, a failure caches it
+// again. Dials the caller cancels are not cached.
+type NegativeCacheDialer struct {
+	Dialer
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[negativeCacheKey]*list.Element
+	// lru holds the entries, least recently failed at the back.
+	lru *list.List
+}
+
+type negativeCacheKey struct {
+	network, addr string
+}
+
+type negativeCacheEntry struct {
+	key     negativeCacheKey
+	err     error
+	expires time.Time
+	// probing is set while a dial probes the expired entry.
+	probing bool
+}
+
+// NewNegativeCacheDialer returns a NegativeCacheDialer dialing with d that
+// remembers a failure for ttl and at most size destinations, forgetting the
+// least recently failed ones first.
+func NewNegativeCacheDialer(d Dialer, ttl time.Duration, size int) *NegativeCacheDialer {
+	return &NegativeCacheDialer{
+		Dialer:  d,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[negativeCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (d *NegativeCacheDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	key := negativeCacheKey{network: network, addr: addr}
+	if err := d.check(key); err != nil {
+		return nil, err
+	}
+	c, err := d.Dialer.DialContext(ctx, network, addr)
+	switch {
+	case err == nil:
+		d.forget(key)
+	case ctx.Err() != nil:
+		// The caller gave up; that says nothing about the destination.
+		d.endProbe(key)
+	default:
+		d.remember(key, err)
+	}
+	return c, err
+}
+
+// check returns the cached error of key, or nil if the dial may go through,
+// in which case it may be the probe of an expired entry.
+func (d *NegativeCacheDialer) check(key negativeCacheKey) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	elem, ok := d.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*negativeCacheEntry)
+	if entry.probing || time.Now().Before(entry.expires) {
+		return fmt.Errorf("%w: %w", ErrNegativeCached, entry.err)
+	}
+	entry.probing = true
+	return nil
+}
+
+func (d *NegativeCacheDialer) remember(key negativeCacheKey, err error) {
+	if d.size <= 0 || d.ttl <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry := &negativeCacheEntry{key: key, err: err, expires: time.Now().Add(d.ttl)}
+	if elem, ok := d.entries[key]; ok {
+		elem.Value = entry
+		d.lru.MoveToFront(elem)
+		return
+	}
+	for d.lru.Len() >= d.size {
+		oldest := d.lru.Back()
+		delete(d.entries, oldest.Value.(*negativeCacheEntry).key)
+		d.lru.Remove(oldest)
+	}
+	d.entries[key] = d.lru.PushFront(entry)
+}
+
+func (d *NegativeCacheDialer) forget(key negativeCacheKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if elem, ok := d.entries[key]; ok {
+		delete(d.entries, key)
+		d.lru.Remove(elem)
+	}
+}
+
+// endProbe lets another dial probe key, whose probe ended without a verdict.
+func (d *NegativeCacheDialer) endProbe(key negativeCacheKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if elem, ok := d.entries[key]; ok {
+		elem.Value.(*negativeCacheEntry).probing = false
+	}
+}
+
+// Len returns the number of destinations cached as failing.
+func (d *NegativeCacheDialer) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lru.Len()
+}
@@ -0,0 +1,68 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNegativeCacheDialer(t *testing.T) {
+	var calls []string
+	errDown := errors.New("connection refused")
+	upstream := &fakeDialer{name: "up", err: errDown, calls: &calls}
+	d := NewNegativeCacheDialer(upstream, 50*time.Millisecond, 2)
+	ctx := context.Background()
+
+	// The failure is cached, with its error.
+	for i := 0; i < 3; i++ {
+		if _, err := d.DialContext(ctx, "tcp", "10.0.0.1:80"); !errors.Is(err, errDown) {
+			t.Fatalf("DialContext() = %v, want %v", err, errDown)
+		}
+	}
+	if len(calls) != 1 {
+		t.Fatalf("dialed %v times, want 1", len(calls))
+	}
+	if _, err := d.DialContext(ctx, "tcp", "10.0.0.1:80"); !errors.Is(err, ErrNegativeCached) {
+		t.Errorf("DialContext() = %v, want ErrNegativeCached", err)
+	}
+
+	// Once expired, a probe goes through; its success clears the entry.
+	time.Sleep(60 * time.Millisecond)
+	upstream.err = nil
+	c, err := d.DialContext(ctx, "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if d.Len() != 0 || len(calls) != 2 {
+		t.Errorf("Len() = %v after %v dials, want 0 after 2", d.Len(), len(calls))
+	}
+
+	// A canceled dial is not cached.
+	upstream.block = true
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := d.DialContext(canceled, "tcp", "10.0.0.2:80"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("DialContext() = %v, want context.Canceled", err)
+	}
+	if d.Len() != 0 {
+		t.Errorf("Len() = %v after a canceled dial, want 0", d.Len())
+	}
+
+	// The least recently failed destination makes room.
+	upstream.block = false
+	upstream.err = errDown
+	for _, addr := range []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"} {
+		_, _ = d.DialContext(ctx, "tcp", addr)
+	}
+	if d.Len() != 2 {
+		t.Errorf("Len() = %v, want 2", d.Len())
+	}
+	calls = calls[:0]
+	_, _ = d.DialContext(ctx, "tcp", "10.0.0.1:80")
+	_, _ = d.DialContext(ctx, "tcp", "10.0.0.3:80")
+	if len(calls) != 1 {
+		t.Errorf("dialed %v times, want 1 for the evicted destination", len(calls))
+	}
+}
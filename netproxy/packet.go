@@ -0,0 +1,41 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUDPUnsupported is returned by DialPacketContext when the dialer cannot
+// relay UDP, e.g. an HTTP proxy.
+var ErrUDPUnsupported = errors.New("udp relaying unsupported")
+
+// PacketDialer is optionally implemented by a Dialer that relays UDP in a way
+// of its own instead of through a dial of the "udp" network.
+// DialPacketContext returns an error wrapping ErrUDPUnsupported if it cannot.
+type PacketDialer interface {
+	DialPacketContext(ctx context.Context, addr string) (PacketConn, error)
+}
+
+// DialPacketContext asks d for a UDP relay to addr, whatever the protocol of
+// d, so that callers can dispatch UDP the same way for every upstream. It
+// uses the PacketDialer of d if any, and dials the "udp" network otherwise.
+// The error wraps ErrUDPUnsupported if d cannot relay UDP.
+func DialPacketContext(ctx context.Context, d Dialer, addr string) (PacketConn, error) {
+	if pd, ok := d.(PacketDialer); ok {
+		return pd.DialPacketContext(ctx, addr)
+	}
+	c, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		if errors.Is(err, UnsupportedTunnelTypeError) {
+			return nil, fmt.Errorf("%w: %w", ErrUDPUnsupported, err)
+		}
+		return nil, err
+	}
+	pc, ok := c.(PacketConn)
+	if !ok {
+		_ = c.Close()
+		return nil, fmt.Errorf("%w: %T is not a packet conn", ErrUDPUnsupported, c)
+	}
+	return pc, nil
+}
@@ -0,0 +1,67 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type relayPacketConn struct {
+	PacketConn
+	addr string
+}
+
+func (c *relayPacketConn) Close() error { return nil }
+
+type fakePacketDialer struct {
+	Dialer
+	err error
+}
+
+func (d *fakePacketDialer) DialPacketContext(ctx context.Context, addr string) (PacketConn, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &relayPacketConn{addr: addr}, nil
+}
+
+type udpDialer struct{}
+
+func (udpDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	if network != "udp" {
+		return nil, fmt.Errorf("%w: %v", UnsupportedTunnelTypeError, network)
+	}
+	return &relayPacketConn{addr: addr}, nil
+}
+
+func TestDialPacketContext(t *testing.T) {
+	var calls []string
+	ctx := context.Background()
+
+	pc, err := DialPacketContext(ctx, udpDialer{}, "1.1.1.1:53")
+	if err != nil || pc.(*relayPacketConn).addr != "1.1.1.1:53" {
+		t.Errorf("DialPacketContext() of a udp dialer = %v, %v", pc, err)
+	}
+	pc, err = DialPacketContext(ctx, &fakePacketDialer{}, "1.1.1.1:53")
+	if err != nil || pc.(*relayPacketConn).addr != "1.1.1.1:53" {
+		t.Errorf("DialPacketContext() of a PacketDialer = %v, %v", pc, err)
+	}
+
+	for _, d := range []Dialer{
+		// Refuses the udp network.
+		&fakeDialer{err: fmt.Errorf("%w: udp", UnsupportedTunnelTypeError), calls: &calls},
+		// Returns a stream conn.
+		&fakeDialer{calls: &calls},
+		&fakePacketDialer{err: ErrUDPUnsupported},
+	} {
+		if _, err := DialPacketContext(ctx, d, "1.1.1.1:53"); !errors.Is(err, ErrUDPUnsupported) {
+			t.Errorf("DialPacketContext() of %T = %v, want ErrUDPUnsupported", d, err)
+		}
+	}
+
+	errDown := errors.New("connection refused")
+	if _, err := DialPacketContext(ctx, &fakeDialer{err: errDown, calls: &calls}, "1.1.1.1:53"); !errors.Is(err, errDown) || errors.Is(err, ErrUDPUnsupported) {
+		t.Errorf("DialPacketContext() = %v, want %v", err, errDown)
+	}
+}
@@ -0,0 +1,84 @@
+package netproxy
+
+import (
+	"net"
+	"slices"
+)
+
+// PeekConn wraps a stream Conn so that its first bytes can be inspected, e.g.
+// to sniff a TLS ClientHello or an HTTP Host header, before deciding what to
+// do with the connection. Peeked bytes are not consumed: Read returns them
+// first. Like the wrapped Conn, a PeekConn is not safe for concurrent reads.
+type PeekConn struct {
+	Conn
+	buf []byte
+}
+
+// NewPeekConn returns a PeekConn reading from conn. conn should be stream
+// oriented; peeking a packet conn would merge datagrams.
+func NewPeekConn(conn Conn) *PeekConn {
+	return &PeekConn{Conn: conn}
+}
+
+// Peek returns the next n bytes without consuming them, reading from the
+// wrapped Conn as needed. The read deadline of the conn applies. If fewer
+// than n bytes arrive before an error, Peek returns what it got and the error.
+// The returned slice is only valid until the next Read.
+func (c *PeekConn) Peek(n int) ([]byte, error) {
+	if n > len(c.buf) {
+		c.buf = slices.Grow(c.buf, n-len(c.buf))
+	}
+	for len(c.buf) < n {
+		m, err := c.Conn.Read(c.buf[len(c.buf):n])
+		c.buf = c.buf[:len(c.buf)+m]
+		if err != nil {
+			return c.buf, err
+		}
+	}
+	return c.buf[:n], nil
+}
+
+// Buffered returns the number of peeked bytes not yet read.
+func (c *PeekConn) Buffered() int {
+	return len(c.buf)
+}
+
+func (c *PeekConn) Read(b []byte) (n int, err error) {
+	if len(c.buf) == 0 {
+		return c.Conn.Read(b)
+	}
+	n = copy(b, c.buf)
+	c.buf = c.buf[n:]
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+	return n, nil
+}
+
+// IsStream forwards the answer of the wrapped conn, assuming a stream if it
+// does not tell.
+func (c *PeekConn) IsStream() bool {
+	if stream, ok := IsStreamConn(c.Conn); ok {
+		return stream
+	}
+	return true
+}
+
+// CloseWrite half-closes the wrapped conn if it supports that.
+func (c *PeekConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *PeekConn) LocalAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *PeekConn) RemoteAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package netproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPeekConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewPeekConn(client)
+	defer c.Close()
+	go func() {
+		// The bytes to peek arrive in pieces.
+		_, _ = server.Write([]byte("\x16\x03"))
+		_, _ = server.Write([]byte("\x01 hello"))
+		_ = server.Close()
+	}()
+
+	b, err := c.Peek(3)
+	if err != nil || string(b) != "\x16\x03\x01" {
+		t.Fatalf("Peek(3) = %q, %v", b, err)
+	}
+	if b, err = c.Peek(2); err != nil || string(b) != "\x16\x03" {
+		t.Fatalf("Peek(2) = %q, %v", b, err)
+	}
+	if got := c.Buffered(); got != 3 {
+		t.Errorf("Buffered() = %v, want 3", got)
+	}
+	// Reads see the peeked bytes first.
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "\x16\x03\x01 hello" {
+		t.Errorf("ReadAll() = %q, %v", got, err)
+	}
+	if stream := c.IsStream(); !stream {
+		t.Error("IsStream() = false, want true")
+	}
+}
+
+func TestPeekConnShort(t *testing.T) {
+	client, server := net.Pipe()
+	c := NewPeekConn(client)
+	defer c.Close()
+	go func() {
+		_, _ = server.Write([]byte("GET"))
+		_ = server.Close()
+	}()
+	b, err := c.Peek(16)
+	if !errors.Is(err, io.EOF) || string(b) != "GET" {
+		t.Fatalf("Peek(16) = %q, %v, want GET, EOF", b, err)
+	}
+	p := make([]byte, 16)
+	if n, err := c.Read(p); err != nil || string(p[:n]) != "GET" {
+		t.Errorf("Read() = %q, %v, want GET", p[:n], err)
+	}
+}
+
+func TestPeekConnDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewPeekConn(client)
+	defer c.Close()
+	go func() {
+		_, _ = server.Write([]byte("a"))
+	}()
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if b, err := c.Peek(2); !errors.Is(err, os.ErrDeadlineExceeded) || string(b) != "a" {
+		t.Fatalf("Peek(2) = %q, %v, want a, os.ErrDeadlineExceeded", b, err)
+	}
+	// Peeking again after a new deadline picks up where it stopped.
+	_ = c.SetReadDeadline(time.Time{})
+	go func() {
+		_, _ = server.Write([]byte("b"))
+	}()
+	if b, err := c.Peek(2); err != nil || string(b) != "ab" {
+		t.Fatalf("Peek(2) = %q, %v, want ab", b, err)
+	}
+}
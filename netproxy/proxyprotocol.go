@@ -0,0 +1,145 @@
+package netproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+// proxyProtocolV2Sig starts every PROXY protocol v2 header.
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolHeader returns the PROXY protocol header of the given version
+// (1 for the text format, 2 for the binary one) announcing a TCP connection
+// from src to dst. If the addresses are of different families, the IPv4 one
+// is sent as an IPv4-mapped IPv6 address.
+func ProxyProtocolHeader(src, dst netip.AddrPort, version int) ([]byte, error) {
+	if !src.IsValid() || !dst.IsValid() {
+		return nil, fmt.Errorf("PROXY protocol: invalid address %v -> %v", src, dst)
+	}
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if srcIP.Is4() != dstIP.Is4() {
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	switch version {
+	case 1:
+		family := "TCP4"
+		if !srcIP.Is4() {
+			family = "TCP6"
+		}
+		return []byte("PROXY " + family + " " + srcIP.String() + " " + dstIP.String() + " " +
+			strconv.Itoa(int(src.Port())) + " " + strconv.Itoa(int(dst.Port())) + "\r\n"), nil
+	case 2:
+		header := append([]byte{}, proxyProtocolV2Sig...)
+		// Version 2, PROXY command.
+		header = append(header, 0x21)
+		if srcIP.Is4() {
+			// AF_INET, STREAM; 2*4 bytes of addresses and 2*2 of ports.
+			header = append(header, 0x11, 0, 12)
+		} else {
+			// AF_INET6, STREAM; 2*16 bytes of addresses and 2*2 of ports.
+			header = append(header, 0x21, 0, 36)
+		}
+		header = append(header, srcIP.AsSlice()...)
+		header = append(header, dstIP.AsSlice()...)
+		header = binary.BigEndian.AppendUint16(header, src.Port())
+		header = binary.BigEndian.AppendUint16(header, dst.Port())
+		return header, nil
+	default:
+		return nil, fmt.Errorf("PROXY protocol: unsupported version %v", version)
+	}
+}
+
+// ProxyProtocolConn returns a Conn that sends the PROXY protocol header of the
+// given version (1 or 2, see ProxyProtocolHeader) over conn before anything
+// else, so that the backend learns that the connection comes from srcAddr and
+// was made to dstAddr. The header goes out with the first Write, or on its own
+// before the first Read or CloseWrite for protocols where the server speaks
+// first.
+func ProxyProtocolConn(conn Conn, srcAddr, dstAddr netip.AddrPort, version int) (Conn, error) {
+	header, err := ProxyProtocolHeader(srcAddr, dstAddr, version)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, header: header}, nil
+}
+
+type proxyProtocolConn struct {
+	Conn
+	// mu protects header, which is set to nil once it was written.
+	mu     sync.Mutex
+	header []byte
+}
+
+// sendHeader writes the header if it was not yet.
+func (c *proxyProtocolConn) sendHeader() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.header == nil {
+		return nil
+	}
+	if _, err := c.Conn.Write(c.header); err != nil {
+		return err
+	}
+	c.header = nil
+	return nil
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (n int, err error) {
+	if err := c.sendHeader(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyProtocolConn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	if c.header == nil {
+		c.mu.Unlock()
+		return c.Conn.Write(b)
+	}
+	defer c.mu.Unlock()
+	// Send the header and the first payload together.
+	header := c.header
+	n, err = c.Conn.Write(append(header, b...))
+	if n < len(header) {
+		return 0, err
+	}
+	c.header = nil
+	return n - len(header), err
+}
+
+// IsStream forwards the answer of the wrapped conn, assuming a stream if it
+// does not tell.
+func (c *proxyProtocolConn) IsStream() bool {
+	if stream, ok := IsStreamConn(c.Conn); ok {
+		return stream
+	}
+	return true
+}
+
+// CloseWrite sends the header if needed and half-closes the wrapped conn if
+// it supports that.
+func (c *proxyProtocolConn) CloseWrite() error {
+	if err := c.sendHeader(); err != nil {
+		return err
+	}
+	return CloseWrite(c.Conn)
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
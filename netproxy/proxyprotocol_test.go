@@ -0,0 +1,81 @@
+package netproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4src := netip.MustParseAddrPort("192.0.2.1:56324")
+	v4dst := netip.MustParseAddrPort("198.51.100.7:443")
+	v6dst := netip.MustParseAddrPort("[2001:db8::1]:443")
+	tests := []struct {
+		src, dst netip.AddrPort
+		version  int
+		want     string
+	}{
+		{v4src, v4dst, 1, "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n"},
+		{v4src, v6dst, 1, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::1 56324 443\r\n"},
+		{v4src, v4dst, 2, "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01\xc6\x33\x64\x07\xdc\x04\x01\xbb"},
+	}
+	for _, tt := range tests {
+		got, err := ProxyProtocolHeader(tt.src, tt.dst, tt.version)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("ProxyProtocolHeader(%v, %v, %v) = %q, %v, want %q", tt.src, tt.dst, tt.version, got, err, tt.want)
+		}
+	}
+	v6, err := ProxyProtocolHeader(v4src, v6dst, 2)
+	if err != nil || len(v6) != 16+36 || v6[13] != 0x21 {
+		t.Errorf("ProxyProtocolHeader(v6, 2) = %x, %v", v6, err)
+	}
+	if _, err := ProxyProtocolHeader(v4src, v4dst, 3); err == nil {
+		t.Error("ProxyProtocolHeader(version 3) succeeded")
+	}
+	if _, err := ProxyProtocolHeader(netip.AddrPort{}, v4dst, 1); err == nil {
+		t.Error("ProxyProtocolHeader(invalid address) succeeded")
+	}
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	src := netip.MustParseAddrPort("192.0.2.1:56324")
+	dst := netip.MustParseAddrPort("198.51.100.7:443")
+	header, _ := ProxyProtocolHeader(src, dst, 1)
+
+	for _, serverFirst := range []bool{false, true} {
+		client, server := net.Pipe()
+		conn, err := ProxyProtocolConn(client, src, dst, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			if serverFirst {
+				// Reading sends the header on its own.
+				_, _ = conn.Read(make([]byte, 1))
+			}
+			if n, err := conn.Write([]byte("hello")); n != 5 || err != nil {
+				t.Errorf("Write() = %v, %v", n, err)
+			}
+			_, _ = conn.Write([]byte(" world"))
+			_ = conn.Close()
+		}()
+		if serverFirst {
+			got := make([]byte, len(header))
+			if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, header) {
+				t.Fatalf("header = %q, %v", got, err)
+			}
+			_, _ = server.Write([]byte("!"))
+		}
+		got, _ := io.ReadAll(server)
+		want := string(header) + "hello world"
+		if serverFirst {
+			want = "hello world"
+		}
+		if string(got) != want {
+			t.Errorf("server read %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package netproxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/pkg/tokenbucket"
+)
+
+// RateLimitConn returns a Conn whose Read and Write are throttled to readBps
+// and writeBps bytes per second. Zero means unlimited in that direction.
+// Waiting for tokens honors the deadlines set on the returned Conn and fails
+// with os.ErrDeadlineExceeded once they pass.
+//
+// Stream conns are read and written in chunks of at most one second worth of
+// bytes. Packet conns, i.e. conns implementing PacketConn or reporting
+// IsStream() == false, keep their message boundaries: every datagram is read
+// and written whole and the limiter goes into debt for large ones. The
+// returned Conn implements PacketConn if conn does.
+func RateLimitConn(conn Conn, readBps, writeBps uint64) Conn {
+	c := &rateLimitConn{
+		Conn:     conn,
+		deadline: make(chan struct{}),
+	}
+	if readBps > 0 {
+		c.readBucket = tokenbucket.New(readBps, 0)
+	}
+	if writeBps > 0 {
+		c.writeBucket = tokenbucket.New(writeBps, 0)
+	}
+	pc, isPacketConn := conn.(PacketConn)
+	if stream, ok := IsStreamConn(conn); ok {
+		c.packet = !stream
+	} else {
+		c.packet = isPacketConn
+	}
+	if isPacketConn {
+		return &rateLimitPacketConn{rateLimitConn: c, pc: pc}
+	}
+	return c
+}
+
+type rateLimitConn struct {
+	Conn
+	readBucket  *tokenbucket.Bucket
+	writeBucket *tokenbucket.Bucket
+	// packet is whether message boundaries must be preserved.
+	packet bool
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// deadline is closed and replaced whenever a deadline changes, to wake up
+	// waiters so that they pick up the new value.
+	deadline chan struct{}
+}
+
+func (c *rateLimitConn) deadlines() (read, write time.Time, changed chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readDeadline, c.writeDeadline, c.deadline
+}
+
+// wait sleeps for d, returning os.ErrDeadlineExceeded if the read or write
+// deadline, as chosen by read, passes first.
+func (c *rateLimitConn) wait(d time.Duration, read bool) error {
+	until := time.Now().Add(d)
+	for {
+		readDeadline, writeDeadline, changed := c.deadlines()
+		deadline := writeDeadline
+		if read {
+			deadline = readDeadline
+		}
+		if !deadline.IsZero() && !deadline.After(time.Now()) {
+			return os.ErrDeadlineExceeded
+		}
+		sleep := time.Until(until)
+		if sleep <= 0 {
+			return nil
+		}
+		if !deadline.IsZero() && deadline.Before(until) {
+			sleep = time.Until(deadline)
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+func (c *rateLimitConn) Read(b []byte) (n int, err error) {
+	if c.readBucket == nil {
+		return c.Conn.Read(b)
+	}
+	return c.read(b, c.Conn.Read)
+}
+
+// read throttles a single call of read.
+func (c *rateLimitConn) read(b []byte, read func([]byte) (int, error)) (n int, err error) {
+	// Pay for the previous read before reading more, so that no data is lost
+	// if the deadline fires while waiting.
+	if err = c.wait(c.readBucket.Delay(), true); err != nil {
+		return 0, err
+	}
+	if burst := c.readBucket.Burst(); !c.packet && len(b) > burst {
+		b = b[:burst]
+	}
+	n, err = read(b)
+	c.readBucket.Take(n)
+	return n, err
+}
+
+func (c *rateLimitConn) Write(b []byte) (n int, err error) {
+	if c.writeBucket == nil {
+		return c.Conn.Write(b)
+	}
+	if c.packet {
+		return c.writePacket(b, c.Conn.Write)
+	}
+	burst := c.writeBucket.Burst()
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		if err = c.wait(c.writeBucket.Take(len(chunk)), false); err != nil {
+			c.writeBucket.Refund(len(chunk))
+			return n, err
+		}
+		m, err := c.Conn.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writePacket throttles a single call of write, which is never split.
+func (c *rateLimitConn) writePacket(b []byte, write func([]byte) (int, error)) (n int, err error) {
+	if err = c.wait(c.writeBucket.Take(len(b)), false); err != nil {
+		c.writeBucket.Refund(len(b))
+		return 0, err
+	}
+	return write(b)
+}
+
+func (c *rateLimitConn) IsStream() bool {
+	return !c.packet
+}
+
+// CloseWrite half-closes the wrapped conn if it supports that.
+func (c *rateLimitConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *rateLimitConn) LocalAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *rateLimitConn) RemoteAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *rateLimitConn) setDeadline(read, write bool, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if read {
+		c.readDeadline = t
+	}
+	if write {
+		c.writeDeadline = t
+	}
+	close(c.deadline)
+	c.deadline = make(chan struct{})
+}
+
+func (c *rateLimitConn) SetDeadline(t time.Time) error {
+	c.setDeadline(true, true, t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *rateLimitConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(true, false, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *rateLimitConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(false, true, t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+type rateLimitPacketConn struct {
+	*rateLimitConn
+	pc PacketConn
+}
+
+func (c *rateLimitPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	if c.readBucket == nil {
+		return c.pc.ReadFrom(p)
+	}
+	n, err = c.read(p, func(b []byte) (n int, err error) {
+		n, addr, err = c.pc.ReadFrom(b)
+		return n, err
+	})
+	return n, addr, err
+}
+
+func (c *rateLimitPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	if c.writeBucket == nil {
+		return c.pc.WriteTo(p, addr)
+	}
+	return c.writePacket(p, func(b []byte) (int, error) {
+		return c.pc.WriteTo(b, addr)
+	})
+}
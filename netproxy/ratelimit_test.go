@@ -0,0 +1,169 @@
+package netproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimitConnWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := RateLimitConn(client, 0, 1000)
+	defer c.Close()
+	go io.Copy(io.Discard, server)
+
+	// The first second worth of bytes goes out at once, the rest waits.
+	start := time.Now()
+	if n, err := c.Write(make([]byte, 1500)); err != nil || n != 1500 {
+		t.Fatalf("Write() = %v, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 800*time.Millisecond {
+		t.Errorf("Write() took %v, want about 500ms", elapsed)
+	}
+}
+
+func TestRateLimitConnWriteDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := RateLimitConn(client, 0, 100)
+	defer c.Close()
+	go io.Copy(io.Discard, server)
+
+	_ = c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := c.Write(make([]byte, 300))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write() error = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if n != 100 {
+		t.Errorf("Write() = %v, want the first chunk of 100 bytes", n)
+	}
+
+	// The chunk that timed out was refunded, so only the bytes actually
+	// written are owed: 100 bytes at 100/s.
+	_ = c.SetWriteDeadline(time.Time{})
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("Write() took %v, the timed out chunk was not refunded", elapsed)
+	}
+}
+
+func TestRateLimitConnReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := RateLimitConn(client, 100, 0)
+	defer c.Close()
+	go server.Write(make([]byte, 300))
+
+	buf := make([]byte, 300)
+	if n, err := c.Read(buf); err != nil || n != 100 {
+		t.Fatalf("Read() = %v, %v, want 100 bytes", n, err)
+	}
+	if n, err := c.Read(buf); err != nil || n != 100 {
+		t.Fatalf("Read() = %v, %v, want 100 bytes", n, err)
+	}
+	// The previous read is still being paid for.
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() error = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+type fakePacketConn struct {
+	net.Conn
+	in  [][]byte
+	out [][]byte
+}
+
+func (c *fakePacketConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *fakePacketConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, "")
+}
+
+func (c *fakePacketConn) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	if len(c.in) == 0 {
+		return 0, netip.AddrPort{}, io.EOF
+	}
+	n := copy(b, c.in[0])
+	c.in = c.in[1:]
+	return n, netip.MustParseAddrPort("1.1.1.1:53"), nil
+}
+
+func (c *fakePacketConn) WriteTo(b []byte, addr string) (int, error) {
+	c.out = append(c.out, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *fakePacketConn) IsStream() bool {
+	return false
+}
+
+func TestRateLimitPacketConn(t *testing.T) {
+	fake := &fakePacketConn{in: [][]byte{make([]byte, 300)}}
+	c := RateLimitConn(fake, 100, 100)
+	pc, ok := c.(PacketConn)
+	if !ok {
+		t.Fatal("RateLimitConn() does not implement PacketConn")
+	}
+	if stream, ok := IsStreamConn(c); !ok || stream {
+		t.Errorf("IsStreamConn() = %v, %v, want false, true", stream, ok)
+	}
+
+	// Datagrams larger than the burst are neither truncated nor split.
+	buf := make([]byte, 500)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil || n != 300 {
+		t.Fatalf("ReadFrom() = %v, %v, want 300 bytes", n, err)
+	}
+	if addr.String() != "1.1.1.1:53" {
+		t.Errorf("ReadFrom() addr = %v", addr)
+	}
+	if n, err := pc.WriteTo(make([]byte, 300), "1.1.1.1:53"); err != nil || n != 300 {
+		t.Fatalf("WriteTo() = %v, %v", n, err)
+	}
+	if len(fake.out) != 1 || len(fake.out[0]) != 300 {
+		t.Errorf("wrote %v datagrams, want one of 300 bytes", len(fake.out))
+	}
+}
+
+type closeWriteConn struct {
+	net.Conn
+	closedWrite bool
+}
+
+func (c *closeWriteConn) CloseWrite() error {
+	c.closedWrite = true
+	return nil
+}
+
+func TestRateLimitConnForwards(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	inner := &closeWriteConn{Conn: client}
+	c := RateLimitConn(inner, 100, 100)
+	if err := c.(interface{ CloseWrite() error }).CloseWrite(); err != nil || !inner.closedWrite {
+		t.Errorf("CloseWrite() = %v, forwarded = %v", err, inner.closedWrite)
+	}
+	if got := c.(interface{ RemoteAddr() net.Addr }).RemoteAddr(); got != client.RemoteAddr() {
+		t.Errorf("RemoteAddr() = %v, want %v", got, client.RemoteAddr())
+	}
+
+	plain := RateLimitConn(server, 100, 100)
+	if err := plain.(interface{ CloseWrite() error }).CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseWrite() = %v, want errors.ErrUnsupported", err)
+	}
+	if _, ok := c.(PacketConn); ok {
+		t.Error("RateLimitConn() of a stream conn implements PacketConn")
+	}
+}
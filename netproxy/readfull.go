@@ -0,0 +1,75 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// BufferedReader is optionally implemented by a Conn that holds bytes already
+// received but not yet read, e.g. the rest of a message, so that they can be
+// taken without waiting and without touching the deadlines. ReadBuffered
+// returns 0 if there are none.
+type BufferedReader interface {
+	ReadBuffered(p []byte) int
+}
+
+// aLongTimeAgo is a deadline in the past, which unblocks a Read at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ReadFull reads exactly len(buf) bytes from conn, like io.ReadFull, within
+// ctx, e.g. to read a fixed-length protocol header. Bytes conn already holds
+// are taken first if it implements BufferedReader. If more are needed and
+// ctx can end, the read deadline of conn is set to the deadline of ctx, and
+// to the past once ctx is done, and cleared before ReadFull returns; a
+// deadline set on conn before is lost. If ctx ends first, ReadFull returns
+// the number of bytes read and ctx.Err(). It returns io.ErrUnexpectedEOF if
+// conn ends after some but not all bytes.
+func ReadFull(ctx context.Context, conn Conn, buf []byte) (n int, err error) {
+	if br, ok := conn.(BufferedReader); ok {
+		n = br.ReadBuffered(buf)
+	}
+	if n == len(buf) {
+		return n, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return n, err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if ctx.Done() != nil {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return n, err
+		}
+		fired := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			_ = conn.SetReadDeadline(aLongTimeAgo)
+			close(fired)
+		})
+		defer func() {
+			if !stop() {
+				// Clearing the deadline must not race with setting it.
+				<-fired
+			}
+			_ = conn.SetReadDeadline(time.Time{})
+		}()
+	}
+	for n < len(buf) && err == nil {
+		var m int
+		m, err = conn.Read(buf[n:])
+		n += m
+	}
+	switch {
+	case n == len(buf):
+		return n, nil
+	case ctx.Err() != nil:
+		return n, ctx.Err()
+	case hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(deadline):
+		// The conn noticed the deadline before ctx did.
+		return n, context.DeadlineExceeded
+	case err == io.EOF && n > 0:
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
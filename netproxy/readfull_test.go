@@ -0,0 +1,69 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// leftoverConn holds bytes of an earlier message, like a grpc ServerConn.
+type leftoverConn struct {
+	net.Conn
+	left []byte
+}
+
+func (c *leftoverConn) ReadBuffered(p []byte) int {
+	n := copy(p, c.left)
+	c.left = c.left[n:]
+	return n
+}
+
+func TestReadFull(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &leftoverConn{Conn: client, left: []byte("he")}
+
+	go func() {
+		_, _ = server.Write([]byte("ll"))
+		_, _ = server.Write([]byte("o"))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	buf := make([]byte, 5)
+	if n, err := ReadFull(ctx, conn, buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("ReadFull() = %q, %v, want hello", buf[:n], err)
+	}
+
+	// Cancelling ctx stops the read and leaves the conn usable.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, _ = server.Write([]byte("x"))
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if n, err := ReadFull(ctx, conn, buf); n != 1 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("ReadFull() = %v, %v, want 1, context.Canceled", n, err)
+	}
+	go func() { _, _ = server.Write([]byte("y")) }()
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "y" {
+		t.Fatalf("Read() after ReadFull() = %q, %v, want y", buf[:n], err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := ReadFull(ctx, conn, buf); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ReadFull() = %v, want context.DeadlineExceeded", err)
+	}
+
+	go func() {
+		_, _ = server.Write([]byte("ab"))
+		_ = server.Close()
+	}()
+	if n, err := ReadFull(context.Background(), conn, buf); n != 2 || err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadFull() = %v, %v, want 2, io.ErrUnexpectedEOF", n, err)
+	}
+}
@@ -0,0 +1,302 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// resumeAttempts is how many times a failed transport is re-dialed
+	// before the conn gives up.
+	resumeAttempts = 3
+	// resumeTimeout bounds every attempt to dial and resume.
+	resumeTimeout = 10 * time.Second
+)
+
+// ErrResumeGap is returned when the peer has lost more written bytes than the
+// replay buffer of a ResumableConn holds, so the stream cannot be resumed
+// without a gap.
+var ErrResumeGap = errors.New("resumable conn: peer is behind the replay buffer")
+
+// ResumeState is the position of a ResumableConn in both directions of the
+// stream, in bytes since it was created.
+type ResumeState struct {
+	// ReadOffset is how many bytes were read. The peer must continue sending
+	// from there.
+	ReadOffset uint64
+	// WriteOffset is how many bytes were written.
+	WriteOffset uint64
+}
+
+// ResumeFunc runs the resume handshake of a protocol on a freshly dialed
+// conn: it tells the peer which session to resume and state.ReadOffset, and
+// returns how many of the written bytes the peer has received, so that the
+// rest is sent again. It should give up once ctx is done.
+type ResumeFunc func(ctx context.Context, conn Conn, state ResumeState) (peerReceived uint64, err error)
+
+// ResumableConn is a stream Conn that survives the failure of its transport:
+// when a Read or Write fails, it dials a new transport, runs the resume
+// handshake of the protocol and continues where it left off. Deadline
+// errors and io.EOF are returned as is; a clean EOF ends the stream.
+//
+// Delivery depends on what the peer reports to ResumeFunc:
+//   - Read bytes are delivered exactly once, provided the peer resends
+//     everything after ReadOffset.
+//   - Written bytes are delivered exactly once if peerReceived is the true
+//     count. The conn keeps the last maxReplay written bytes to send again;
+//     if the peer is further behind, the conn fails with ErrResumeGap rather
+//     than leaving a gap.
+//   - A protocol that cannot tell may report state.WriteOffset, making
+//     writes at-most-once: bytes in flight when the transport failed are
+//     lost. Reporting less than the peer got makes them at-least-once.
+//
+// A Write returns once its bytes are handed to the transport, not once the
+// peer has them.
+type ResumableConn struct {
+	dial      func(ctx context.Context) (Conn, error)
+	resume    ResumeFunc
+	maxReplay int
+
+	// mu protects conn, gen, closed, err and the deadlines. It is held
+	// while reconnecting.
+	mu            sync.Mutex
+	conn          Conn
+	gen           uint64 // incremented by every reconnect
+	closed        bool
+	err           error // set once resuming failed for good
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// readOp and writeOp serialize Read and Write calls, including their
+	// reconnects. readMu and writeMu protect the offsets and the replay
+	// buffer; they are held during the I/O on the transport and taken by
+	// reconnect once the old transport is closed.
+	readOp      sync.Mutex
+	writeOp     sync.Mutex
+	readMu      sync.Mutex
+	writeMu     sync.Mutex
+	readOffset  uint64
+	writeOffset uint64
+	replay      []byte // the last written bytes, ending at writeOffset
+}
+
+// NewResumableConn returns a ResumableConn over conn, an established
+// transport of the session. dial opens a new transport to the same peer and
+// resume resumes the session on it. maxReplay is how many written bytes are
+// kept for resending; it should cover what can be in flight, e.g. the send
+// buffers of both ends.
+func NewResumableConn(conn Conn, dial func(ctx context.Context) (Conn, error), resume ResumeFunc, maxReplay int) *ResumableConn {
+	return &ResumableConn{
+		dial:      dial,
+		resume:    resume,
+		maxReplay: maxReplay,
+		conn:      conn,
+	}
+}
+
+// current returns the transport and its generation.
+func (c *ResumableConn) current() (Conn, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, 0, net.ErrClosed
+	}
+	if c.err != nil {
+		return nil, 0, c.err
+	}
+	return c.conn, c.gen, nil
+}
+
+// transportFailed reports whether err is a failure of the transport rather
+// than the end of the stream or a deadline.
+func transportFailed(err error) bool {
+	return !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (c *ResumableConn) Read(b []byte) (n int, err error) {
+	c.readOp.Lock()
+	defer c.readOp.Unlock()
+	for {
+		conn, gen, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+		c.readMu.Lock()
+		n, err = conn.Read(b)
+		c.readOffset += uint64(n)
+		c.readMu.Unlock()
+		if err == nil || !transportFailed(err) {
+			return n, err
+		}
+		if n > 0 {
+			// Deliver what arrived; the next Read resumes.
+			return n, nil
+		}
+		if err := c.reconnect(gen, err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *ResumableConn) Write(b []byte) (n int, err error) {
+	c.writeOp.Lock()
+	defer c.writeOp.Unlock()
+	for {
+		conn, gen, err := c.current()
+		if err != nil {
+			return n, err
+		}
+		c.writeMu.Lock()
+		m, err := conn.Write(b[n:])
+		c.record(b[n : n+m])
+		c.writeMu.Unlock()
+		n += m
+		if err == nil || !transportFailed(err) {
+			return n, err
+		}
+		if err := c.reconnect(gen, err); err != nil {
+			return n, err
+		}
+		if n == len(b) {
+			return n, nil
+		}
+	}
+}
+
+// record adds written bytes to the replay buffer. c.writeMu must be held.
+func (c *ResumableConn) record(b []byte) {
+	c.writeOffset += uint64(len(b))
+	c.replay = append(c.replay, b...)
+	if extra := len(c.replay) - c.maxReplay; extra > 0 {
+		c.replay = c.replay[:copy(c.replay, c.replay[extra:])]
+	}
+}
+
+// reconnect replaces the transport of generation gen, which failed with
+// cause. It does nothing if another call already replaced it.
+func (c *ResumableConn) reconnect(gen uint64, cause error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if c.gen != gen {
+		return nil
+	}
+	// Closing the transport unblocks the I/O of the other direction, which
+	// then releases its lock.
+	_ = c.conn.Close()
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	state := ResumeState{ReadOffset: c.readOffset, WriteOffset: c.writeOffset}
+	errs := []error{cause}
+	for i := 0; i < resumeAttempts; i++ {
+		conn, err := c.resumeOnce(state)
+		if err == nil {
+			c.conn = conn
+			c.gen++
+			return nil
+		}
+		errs = append(errs, err)
+		if errors.Is(err, ErrResumeGap) {
+			break
+		}
+	}
+	c.err = fmt.Errorf("resumable conn: resume failed: %w", errors.Join(errs...))
+	return c.err
+}
+
+// resumeOnce dials and resumes a new transport and sends again what the peer
+// missed. c.mu, c.readMu and c.writeMu must be held.
+func (c *ResumableConn) resumeOnce(state ResumeState) (Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resumeTimeout)
+	defer cancel()
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	peerReceived, err := c.resume(ctx, conn, state)
+	if err == nil && (peerReceived > state.WriteOffset || state.WriteOffset-peerReceived > uint64(len(c.replay))) {
+		err = fmt.Errorf("%w: peer has %v of %v bytes, %v kept", ErrResumeGap, peerReceived, state.WriteOffset, len(c.replay))
+	}
+	if err == nil {
+		missed := c.replay[len(c.replay)-int(state.WriteOffset-peerReceived):]
+		_, err = conn.Write(missed)
+	}
+	if err == nil {
+		err = conn.SetReadDeadline(c.readDeadline)
+	}
+	if err == nil {
+		err = conn.SetWriteDeadline(c.writeDeadline)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *ResumableConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *ResumableConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *ResumableConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *ResumableConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *ResumableConn) IsStream() bool {
+	return true
+}
+
+func (c *ResumableConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *ResumableConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package netproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resumeServer is the peer of a resumable session over net.Pipe transports.
+// A resumed transport starts with the read offset of the client; the server
+// answers with how many bytes it received and resends what the client
+// missed.
+type resumeServer struct {
+	mu       sync.Mutex
+	received []byte
+	sent     []byte
+	conn     net.Conn
+}
+
+func (s *resumeServer) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		s.mu.Lock()
+		s.received = append(s.received, buf[:n]...)
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *resumeServer) dial(ctx context.Context) (Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		var offset [8]byte
+		if _, err := io.ReadFull(server, offset[:]); err != nil {
+			return
+		}
+		s.mu.Lock()
+		reply := binary.BigEndian.AppendUint64(nil, uint64(len(s.received)))
+		reply = append(reply, s.sent[binary.BigEndian.Uint64(offset[:]):]...)
+		s.mu.Unlock()
+		go server.Write(reply)
+		s.serve(server)
+	}()
+	return client, nil
+}
+
+func resume(ctx context.Context, conn Conn, state ResumeState) (uint64, error) {
+	if _, err := conn.Write(binary.BigEndian.AppendUint64(nil, state.ReadOffset)); err != nil {
+		return 0, err
+	}
+	var received [8]byte
+	if _, err := io.ReadFull(conn, received[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(received[:]), nil
+}
+
+// send sends p to the client, or only records it if the transport is down.
+func (s *resumeServer) send(p string, deliver bool) {
+	s.mu.Lock()
+	s.sent = append(s.sent, p...)
+	conn := s.conn
+	s.mu.Unlock()
+	if deliver {
+		go conn.Write([]byte(p))
+	}
+}
+
+// fail breaks the transport and forgets the last lost received bytes, as if
+// they were in flight.
+func (s *resumeServer) fail(lost int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.conn.Close()
+	s.received = s.received[:len(s.received)-lost]
+}
+
+func (s *resumeServer) waitReceived(t *testing.T, want string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		got := string(s.received)
+		s.mu.Unlock()
+		if got == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.Fatalf("server received %q, want %q", s.received, want)
+}
+
+func newResumeTest(maxReplay int) (*resumeServer, *ResumableConn) {
+	s := &resumeServer{}
+	client, server := net.Pipe()
+	go s.serve(server)
+	for {
+		s.mu.Lock()
+		ready := s.conn != nil
+		s.mu.Unlock()
+		if ready {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return s, NewResumableConn(client, s.dial, resume, maxReplay)
+}
+
+func TestResumableConn(t *testing.T) {
+	s, c := newResumeTest(1024)
+	defer c.Close()
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s.waitReceived(t, "hello")
+	s.send("abc", true)
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "abc" {
+		t.Fatalf("Read() = %q, %v, want abc", buf, err)
+	}
+
+	// The transport dies with "lo" in flight and "def" not yet delivered.
+	s.fail(2)
+	s.send("def", false)
+	if n, err := c.Write([]byte(" world")); err != nil || n != 6 {
+		t.Fatalf("Write() = %v, %v", n, err)
+	}
+	s.waitReceived(t, "hello world")
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "def" {
+		t.Fatalf("Read() = %q, %v, want def", buf, err)
+	}
+}
+
+func TestResumableConnGap(t *testing.T) {
+	s, c := newResumeTest(2)
+	defer c.Close()
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s.waitReceived(t, "hello")
+	// The server lost more than the conn kept.
+	s.fail(3)
+	if _, err := c.Write([]byte("!")); !errors.Is(err, ErrResumeGap) {
+		t.Fatalf("Write() = %v, want ErrResumeGap", err)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrResumeGap) {
+		t.Errorf("Read() = %v, want ErrResumeGap", err)
+	}
+}
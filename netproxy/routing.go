@@ -0,0 +1,245 @@
+package netproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// RoutingRule maps destinations to a named child dialer of a RoutingDialer.
+// Empty conditions are ignored; non-empty ones must all match, e.g. a rule with
+// both CIDRs and Ports matches only destinations in one of the CIDRs and on one
+// of the ports. CIDRs and DomainSuffixes together are one condition on the
+// address, which is either an IP or a hostname: a rule with both matches
+// destinations in one of the CIDRs or under one of the suffixes. A rule with
+// no conditions matches everything.
+type RoutingRule struct {
+	// CIDRs matches destinations given as IP addresses.
+	CIDRs []netip.Prefix
+	// DomainSuffixes matches destinations given as hostnames. "example.com"
+	// matches both "example.com" and "www.example.com".
+	DomainSuffixes []string
+	// Ports matches the destination port.
+	Ports []uint16
+	// Dialer is the name of the child dialer to use.
+	Dialer string
+}
+
+// RoutingDialer dispatches dials to one of several named dialers by the
+// destination address. Rules are evaluated in order and the first matching rule
+// wins; if none matches, the default dialer is used. Hostnames are matched as
+// is and are not resolved for CIDR matching.
+type RoutingDialer struct {
+	rules         []RoutingRule
+	dialers       []Dialer // indexed by rule
+	defaultName   string
+	defaultDialer Dialer
+
+	ipv4    *cidrNode
+	ipv6    *cidrNode
+	domains *domainNode
+	ports   map[uint16][]int
+}
+
+// NewRoutingDialer compiles rules into a RoutingDialer. Every dialer named by a
+// rule, as well as defaultDialer, must be present in dialers.
+func NewRoutingDialer(rules []RoutingRule, dialers map[string]Dialer, defaultDialer string) (*RoutingDialer, error) {
+	d := &RoutingDialer{
+		rules:       rules,
+		dialers:     make([]Dialer, len(rules)),
+		defaultName: defaultDialer,
+		ipv4:        &cidrNode{},
+		ipv6:        &cidrNode{},
+		domains:     &domainNode{},
+		ports:       make(map[uint16][]int),
+	}
+	var ok bool
+	if d.defaultDialer, ok = dialers[defaultDialer]; !ok {
+		return nil, fmt.Errorf("unknown default dialer: %v", defaultDialer)
+	}
+	for i, rule := range rules {
+		if d.dialers[i], ok = dialers[rule.Dialer]; !ok {
+			return nil, fmt.Errorf("rule %d: unknown dialer: %v", i, rule.Dialer)
+		}
+		for _, prefix := range rule.CIDRs {
+			if !prefix.IsValid() {
+				return nil, fmt.Errorf("rule %d: invalid CIDR: %v", i, prefix)
+			}
+			prefix = unmapPrefix(prefix).Masked()
+			root := d.ipv6
+			if prefix.Addr().Is4() {
+				root = d.ipv4
+			}
+			root.insert(prefix, i)
+		}
+		for _, suffix := range rule.DomainSuffixes {
+			suffix = normalizeDomain(suffix)
+			if suffix == "" {
+				return nil, fmt.Errorf("rule %d: empty domain suffix", i)
+			}
+			d.domains.insert(suffix, i)
+		}
+		for _, port := range rule.Ports {
+			d.ports[port] = append(d.ports[port], i)
+		}
+	}
+	return d, nil
+}
+
+// Match returns the name of the dialer that addr is routed to.
+func (d *RoutingDialer) Match(addr string) (name string, err error) {
+	i, err := d.match(addr)
+	if err != nil {
+		return "", err
+	}
+	if i < 0 {
+		return d.defaultName, nil
+	}
+	return d.rules[i].Dialer, nil
+}
+
+func (d *RoutingDialer) DialContext(ctx context.Context, network, addr string) (c Conn, err error) {
+	i, err := d.match(addr)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return d.defaultDialer.DialContext(ctx, network, addr)
+	}
+	return d.dialers[i].DialContext(ctx, network, addr)
+}
+
+// match returns the index of the first matching rule, or -1.
+func (d *RoutingDialer) match(addr string) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port: %v", portStr)
+	}
+
+	n := len(d.rules)
+	cidrHits := newRuleSet(n)
+	domainHits := newRuleSet(n)
+	portHits := newRuleSet(n)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.WithZone("").Unmap()
+		root := d.ipv6
+		if ip.Is4() {
+			root = d.ipv4
+		}
+		root.lookup(ip, cidrHits)
+	} else {
+		d.domains.lookup(normalizeDomain(host), domainHits)
+	}
+	for _, i := range d.ports[uint16(port)] {
+		portHits.add(i)
+	}
+
+	for i, rule := range d.rules {
+		if (len(rule.CIDRs) > 0 || len(rule.DomainSuffixes) > 0) && !cidrHits.has(i) && !domainHits.has(i) {
+			continue
+		}
+		if len(rule.Ports) > 0 && !portHits.has(i) {
+			continue
+		}
+		return i, nil
+	}
+	return -1, nil
+}
+
+type ruleSet []uint64
+
+func newRuleSet(n int) ruleSet {
+	return make(ruleSet, (n+63)/64)
+}
+
+func (s ruleSet) add(i int) {
+	s[i/64] |= 1 << (i % 64)
+}
+
+func (s ruleSet) has(i int) bool {
+	return s[i/64]&(1<<(i%64)) != 0
+}
+
+// cidrNode is a node of a binary trie keyed by address bits.
+type cidrNode struct {
+	children [2]*cidrNode
+	rules    []int
+}
+
+func (n *cidrNode) insert(prefix netip.Prefix, rule int) {
+	b := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &cidrNode{}
+		}
+		n = n.children[bit]
+	}
+	n.rules = append(n.rules, rule)
+}
+
+func (n *cidrNode) lookup(ip netip.Addr, hits ruleSet) {
+	b := ip.AsSlice()
+	for i := 0; n != nil; i++ {
+		for _, rule := range n.rules {
+			hits.add(rule)
+		}
+		if i == len(b)*8 {
+			break
+		}
+		n = n.children[b[i/8]>>(7-i%8)&1]
+	}
+}
+
+// domainNode is a node of a trie keyed by domain labels from right to left.
+type domainNode struct {
+	children map[string]*domainNode
+	rules    []int
+}
+
+func (n *domainNode) insert(domain string, rule int) {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*domainNode)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &domainNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	n.rules = append(n.rules, rule)
+}
+
+func (n *domainNode) lookup(domain string, hits ruleSet) {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		n = n.children[labels[i]]
+		if n == nil {
+			return
+		}
+		for _, rule := range n.rules {
+			hits.add(rule)
+		}
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.Trim(domain, "."))
+}
+
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix
+}
@@ -0,0 +1,86 @@
+package netproxy
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRoutingDialerMatch(t *testing.T) {
+	dialers := map[string]Dialer{"direct": nil, "proxy": nil, "block": nil}
+	rules := []RoutingRule{
+		{DomainSuffixes: []string{"ads.example.com"}, Dialer: "block"},
+		{DomainSuffixes: []string{"example.com"}, Ports: []uint16{443}, Dialer: "proxy"},
+		{CIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}, Dialer: "direct"},
+		{Ports: []uint16{22}, Dialer: "proxy"},
+	}
+	d, err := NewRoutingDialer(rules, dialers, "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"ads.example.com:443", "block"},
+		{"x.ads.example.com:80", "block"},
+		{"www.example.com:443", "proxy"},
+		{"Example.COM.:443", "proxy"},
+		{"www.example.com:80", "direct"},
+		{"badexample.com:443", "direct"},
+		{"10.1.2.3:22", "direct"},
+		{"[::ffff:10.1.2.3]:80", "direct"},
+		{"[fd00::1%eth0]:80", "direct"},
+		{"11.1.2.3:22", "proxy"},
+		{"11.1.2.3:80", "direct"},
+	} {
+		got, err := d.Match(tc.addr)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.addr, err)
+		}
+		if got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestRoutingDialerUnknownDialer(t *testing.T) {
+	_, err := NewRoutingDialer([]RoutingRule{{Dialer: "missing"}}, map[string]Dialer{"direct": nil}, "direct")
+	if err == nil {
+		t.Fatal("expected error for unknown dialer")
+	}
+}
+
+func TestRoutingDialerAddressConditions(t *testing.T) {
+	dialers := map[string]Dialer{"direct": nil, "proxy": nil}
+	rules := []RoutingRule{
+		{
+			CIDRs:          []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			DomainSuffixes: []string{"example.com"},
+			Ports:          []uint16{443},
+			Dialer:         "proxy",
+		},
+	}
+	d, err := NewRoutingDialer(rules, dialers, "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1:443", "proxy"},
+		{"www.example.com:443", "proxy"},
+		{"192.0.2.1:80", "direct"},
+		{"www.example.com:80", "direct"},
+		{"198.51.100.1:443", "direct"},
+		{"example.org:443", "direct"},
+	} {
+		got, err := d.Match(tc.addr)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.addr, err)
+		}
+		if got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+}
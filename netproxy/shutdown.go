@@ -0,0 +1,58 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDialerClosed is returned by the dials of a ShutdownDialer that was shut
+// down, including those that were in flight.
+var ErrDialerClosed = errors.New("dialer closed")
+
+// ShutdownDialer is a Dialer that can abort all its dials at once, e.g. to
+// swap out a dialer on a config reload without waiting for the timeout of
+// every dial in progress. Any protocol dialer can be wrapped in one.
+type ShutdownDialer struct {
+	Dialer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewShutdownDialer returns a ShutdownDialer dialing with d.
+func NewShutdownDialer(d Dialer) *ShutdownDialer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ShutdownDialer{
+		Dialer: d,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// DialContext dials with a context that is also done once Shutdown is called.
+// Connections already established are not affected.
+func (d *ShutdownDialer) DialContext(ctx context.Context, network, addr string) (c Conn, err error) {
+	if d.ctx.Err() != nil {
+		return nil, ErrDialerClosed
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stop := context.AfterFunc(d.ctx, func() { cancel(ErrDialerClosed) })
+	defer stop()
+	c, err = d.Dialer.DialContext(ctx, network, addr)
+	if err != nil && d.ctx.Err() != nil {
+		return nil, ErrDialerClosed
+	}
+	return c, err
+}
+
+// Shutdown cancels the dials in flight, which return ErrDialerClosed as soon
+// as the wrapped dialer gives up on them, and makes further dials fail with
+// it. It does not wait for them and may be called more than once.
+func (d *ShutdownDialer) Shutdown() {
+	d.cancel()
+}
+
+// Closed reports whether Shutdown was called.
+func (d *ShutdownDialer) Closed() bool {
+	return d.ctx.Err() != nil
+}
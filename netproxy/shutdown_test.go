@@ -0,0 +1,77 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type blockingDialer struct {
+	started chan struct{}
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	d.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type pipeDialer struct{}
+
+func (pipeDialer) DialContext(ctx context.Context, network, addr string) (Conn, error) {
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestShutdownDialer(t *testing.T) {
+	inner := &blockingDialer{started: make(chan struct{})}
+	d := NewShutdownDialer(inner)
+
+	const n = 3
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+			errs <- err
+		}()
+		<-inner.started
+	}
+	d.Shutdown()
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrDialerClosed) {
+				t.Errorf("in-flight dial: err = %v, want ErrDialerClosed", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("in-flight dial did not return after Shutdown")
+		}
+	}
+
+	if !d.Closed() {
+		t.Error("Closed() = false after Shutdown")
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:80"); !errors.Is(err, ErrDialerClosed) {
+		t.Errorf("dial after Shutdown: err = %v, want ErrDialerClosed", err)
+	}
+	d.Shutdown()
+}
+
+func TestShutdownDialerCallerContext(t *testing.T) {
+	inner := &blockingDialer{started: make(chan struct{}, 1)}
+	d := NewShutdownDialer(inner)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+
+	d = NewShutdownDialer(pipeDialer{})
+	c, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
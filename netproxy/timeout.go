@@ -0,0 +1,156 @@
+package netproxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// TimeoutConn returns a Conn that sets a fresh deadline of readTimeout before
+// every Read and of writeTimeout before every Write, so that an operation
+// that stalls for that long fails with the deadline error of conn, usually
+// os.ErrDeadlineExceeded, instead of blocking forever. Zero means no timeout
+// in that direction. Deadlines set on the returned Conn still apply: the
+// earlier of the two wins, and clearing them with the zero time leaves the
+// timeouts in place. The returned Conn implements PacketConn if conn does.
+func TimeoutConn(conn Conn, readTimeout, writeTimeout time.Duration) Conn {
+	c := &timeoutConn{
+		Conn:         conn,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+	if pc, ok := conn.(PacketConn); ok {
+		return &timeoutPacketConn{timeoutConn: c, pc: pc}
+	}
+	return c
+}
+
+type timeoutConn struct {
+	Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// opDeadline returns the deadline of an operation starting now: timeout from
+// now, or the one set by the user if that is earlier. The setters apply it at
+// once too, so that a new deadline also reaches an operation in flight.
+func opDeadline(timeout time.Duration, user time.Time) time.Time {
+	if timeout <= 0 {
+		return user
+	}
+	t := time.Now().Add(timeout)
+	if !user.IsZero() && user.Before(t) {
+		return user
+	}
+	return t
+}
+
+func (c *timeoutConn) armRead() error {
+	if c.readTimeout <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetReadDeadline(opDeadline(c.readTimeout, c.readDeadline))
+}
+
+func (c *timeoutConn) armWrite() error {
+	if c.writeTimeout <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(opDeadline(c.writeTimeout, c.writeDeadline))
+}
+
+func (c *timeoutConn) Read(b []byte) (n int, err error) {
+	if err = c.armRead(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (n int, err error) {
+	if err = c.armWrite(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	if c.readTimeout == c.writeTimeout {
+		return c.Conn.SetDeadline(opDeadline(c.readTimeout, t))
+	}
+	if err := c.Conn.SetReadDeadline(opDeadline(c.readTimeout, t)); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(opDeadline(c.writeTimeout, t))
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(opDeadline(c.readTimeout, t))
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.Conn.SetWriteDeadline(opDeadline(c.writeTimeout, t))
+}
+
+func (c *timeoutConn) IsStream() bool {
+	if stream, ok := IsStreamConn(c.Conn); ok {
+		return stream
+	}
+	_, isPacketConn := c.Conn.(PacketConn)
+	return !isPacketConn
+}
+
+// CloseWrite half-closes the wrapped conn if it supports that.
+func (c *timeoutConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func (c *timeoutConn) LocalAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *timeoutConn) RemoteAddr() net.Addr {
+	if conn, ok := c.Conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+type timeoutPacketConn struct {
+	*timeoutConn
+	pc PacketConn
+}
+
+func (c *timeoutPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	if err = c.armRead(); err != nil {
+		return 0, addr, err
+	}
+	return c.pc.ReadFrom(p)
+}
+
+func (c *timeoutPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	if err = c.armWrite(); err != nil {
+		return 0, err
+	}
+	return c.pc.WriteTo(p, addr)
+}
@@ -0,0 +1,64 @@
+package netproxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimeoutConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := TimeoutConn(a, 100*time.Millisecond, 0)
+
+	// Each Read gets a fresh timeout: these reads take 60ms each, more than
+	// the timeout in total.
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(60 * time.Millisecond)
+			_, _ = b.Write([]byte{byte(i)})
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Read(buf); err != nil {
+			t.Fatalf("Read() #%v = %v", i, err)
+		}
+	}
+
+	// A stalled Read times out, even with the deadline cleared.
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Read() timed out after %v, want 100ms", elapsed)
+	}
+
+	// An earlier deadline of the user wins.
+	if err := c.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 80*time.Millisecond {
+		t.Errorf("Read() timed out after %v, want 20ms", elapsed)
+	}
+
+	// Without a write timeout, Write waits for the reader.
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		_, _ = b.Read(buf)
+	}()
+	if _, err := c.Write([]byte{1}); err != nil {
+		t.Errorf("Write() = %v", err)
+	}
+}
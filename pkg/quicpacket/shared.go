@@ -0,0 +1,321 @@
+// Package quicpacket shares one UDP socket between several QUIC connections,
+// to save ports and keep firewall rules simple in dense deployments.
+//
+// A SharedConn reads the socket and hands every packet to one of its views,
+// PacketConns, by the destination connection ID of the packet. The connection
+// IDs of a view start with the ID of the view, so QUIC connections must be
+// dialed with the Transport of the view, which generates them.
+package quicpacket
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/pkg/fastrand"
+	"github.com/daeuniverse/outbound/pool"
+	"github.com/daeuniverse/quic-go"
+)
+
+const (
+	// viewIDLen is the length of the view ID every connection ID starts with.
+	viewIDLen = 4
+	// ConnectionIDLen is the length of the connection IDs of the views.
+	ConnectionIDLen = 8
+	// queueSize is the number of packets queued for a view. Further packets
+	// are dropped, like a full socket buffer does.
+	queueSize = 256
+	maxPacketSize = 1<<16 - 1
+)
+
+// SharedConn multiplexes the QUIC connections of its views over one socket.
+// Packets that belong to no view are dropped.
+//
+// Every connection ID of a view starts with the same view ID, so an observer
+// can link the connection IDs a connection migrates to. Do not share a socket
+// where that matters.
+type SharedConn struct {
+	conn net.PacketConn
+
+	mu    sync.Mutex
+	views map[uint32]*PacketConn
+	// err is why the socket can no longer be read, set before done is
+	// closed.
+	err  error
+	done chan struct{}
+}
+
+// NewSharedConn returns a SharedConn over conn and starts reading it. Closing
+// the SharedConn closes conn.
+func NewSharedConn(conn net.PacketConn) *SharedConn {
+	s := &SharedConn{
+		conn:  conn,
+		views: make(map[uint32]*PacketConn),
+		done:  make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// ListenUDP returns a SharedConn over a new UDP socket bound to laddr.
+func ListenUDP(laddr *net.UDPAddr) (*SharedConn, error) {
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSharedConn(conn), nil
+}
+
+// NewPacketConn returns a new view of s, to be used by one QUIC transport.
+func (s *SharedConn) NewPacketConn() (*PacketConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	id := fastrand.Uint32()
+	for s.views[id] != nil {
+		id = fastrand.Uint32()
+	}
+	p := &PacketConn{
+		shared:       s,
+		id:           id,
+		queue:        make(chan packet, queueSize),
+		closed:       make(chan struct{}),
+		readDeadline: newDeadline(),
+	}
+	s.views[id] = p
+	return p, nil
+}
+
+// LocalAddr returns the address of the socket.
+func (s *SharedConn) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close closes the socket. Reads of the views fail afterwards.
+func (s *SharedConn) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SharedConn) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			close(s.done)
+			return
+		}
+		id, ok := viewID(buf[:n])
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		p := s.views[id]
+		s.mu.Unlock()
+		if p != nil {
+			p.deliver(buf[:n], addr)
+		}
+	}
+}
+
+// viewID returns the view ID at the start of the destination connection ID of
+// the QUIC packet b.
+func viewID(b []byte) (uint32, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var connID []byte
+	if b[0]&0x80 != 0 {
+		// Long header: the length-prefixed connection ID follows the first
+		// byte and the version.
+		if len(b) < 6 || len(b) < 6+int(b[5]) {
+			return 0, false
+		}
+		connID = b[6 : 6+int(b[5])]
+	} else {
+		// Short header: the connection ID has the length the views chose.
+		connID = b[1:min(len(b), 1+ConnectionIDLen)]
+	}
+	if len(connID) < viewIDLen {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(connID), true
+}
+
+type packet struct {
+	buf  pool.PB
+	addr net.Addr
+}
+
+// PacketConn is a view of a SharedConn: it reads the packets of the QUIC
+// connections of its Transport and writes to the shared socket.
+type PacketConn struct {
+	shared *SharedConn
+	id     uint32
+	queue  chan packet
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	readDeadline *deadline
+
+	transportOnce sync.Once
+	transport     *quic.Transport
+}
+
+// Transport returns the QUIC transport over p. Its connection IDs lead the
+// packets of its connections back to p, unlike those of quic.Dial on p, so
+// dial with it.
+func (p *PacketConn) Transport() *quic.Transport {
+	p.transportOnce.Do(func() {
+		p.transport = &quic.Transport{
+			Conn:                  p,
+			ConnectionIDGenerator: connIDGenerator{viewID: p.id},
+		}
+	})
+	return p.transport
+}
+
+func (p *PacketConn) deliver(b []byte, addr net.Addr) {
+	buf := pool.Get(len(b))
+	copy(buf, b)
+	select {
+	case p.queue <- packet{buf: buf, addr: addr}:
+	default:
+		buf.Put()
+	}
+}
+
+func (p *PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	select {
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	default:
+	}
+	select {
+	case pkt := <-p.queue:
+		n = copy(b, pkt.buf)
+		pkt.buf.Put()
+		return n, pkt.addr, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-p.shared.done:
+		return 0, nil, p.shared.err
+	case <-p.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return p.shared.conn.WriteTo(b, addr)
+}
+
+// Close detaches p from the SharedConn. The socket stays open.
+func (p *PacketConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.shared.mu.Lock()
+		delete(p.shared.views, p.id)
+		p.shared.mu.Unlock()
+	})
+	return nil
+}
+
+func (p *PacketConn) LocalAddr() net.Addr {
+	return p.shared.conn.LocalAddr()
+}
+
+func (p *PacketConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *PacketConn) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing: the deadline of the socket would apply to
+// all the views.
+func (p *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// connIDGenerator generates connection IDs starting with the view ID.
+type connIDGenerator struct {
+	viewID uint32
+}
+
+func (g connIDGenerator) GenerateConnectionID() (quic.ConnectionID, error) {
+	b := make([]byte, ConnectionIDLen)
+	binary.BigEndian.PutUint32(b, g.viewID)
+	if _, err := fastrand.Read(b[viewIDLen:]); err != nil {
+		return quic.ConnectionID{}, err
+	}
+	return quic.ConnectionIDFromBytes(b), nil
+}
+
+func (g connIDGenerator) ConnectionIDLen() int {
+	return ConnectionIDLen
+}
+
+// deadline is a channel closed once a deadline passes.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	done  chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{done: make(chan struct{})}
+}
+
+// set sets the deadline to t, or clears it if t is zero.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// Wait for the timer to close done.
+		<-d.done
+	}
+	d.timer = nil
+	expired := false
+	select {
+	case <-d.done:
+		expired = true
+	default:
+	}
+	if t.IsZero() {
+		if expired {
+			d.done = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.done = make(chan struct{})
+		}
+		done := d.done
+		d.timer = time.AfterFunc(dur, func() { close(done) })
+		return
+	}
+	if !expired {
+		close(d.done)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.done
+}
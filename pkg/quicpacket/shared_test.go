@@ -0,0 +1,142 @@
+package quicpacket
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func longHeaderPacket(connID []byte, payload string) []byte {
+	b := []byte{0xc0, 0, 0, 0, 1, byte(len(connID))}
+	b = append(b, connID...)
+	return append(b, payload...)
+}
+
+func shortHeaderPacket(connID []byte, payload string) []byte {
+	b := append([]byte{0x40}, connID...)
+	return append(b, payload...)
+}
+
+func newConnID(t *testing.T, p *PacketConn) []byte {
+	t.Helper()
+	id, err := connIDGenerator{viewID: p.id}.GenerateConnectionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Len() != ConnectionIDLen {
+		t.Fatalf("connection ID length = %v, want %v", id.Len(), ConnectionIDLen)
+	}
+	return id.Bytes()
+}
+
+func readPacket(t *testing.T, p *PacketConn) []byte {
+	t.Helper()
+	_ = p.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := p.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestSharedConn(t *testing.T) {
+	s, err := ListenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	a, _ := s.NewPacketConn()
+	b, _ := s.NewPacketConn()
+	defer b.Close()
+
+	// Writes of a view leave from the shared socket.
+	if _, err := a.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, from, err := peer.ReadFrom(buf); err != nil || from.String() != s.LocalAddr().String() {
+		t.Fatalf("peer read from %v, %v, want %v", from, err, s.LocalAddr())
+	}
+
+	// Packets go to the view their connection ID belongs to, whatever the
+	// header form.
+	toA := longHeaderPacket(newConnID(t, a), "initial for a")
+	toB := shortHeaderPacket(newConnID(t, b), "1-RTT for b")
+	unknown := shortHeaderPacket([]byte{1, 2, 3, 4, 5, 6, 7, 8}, "nobody")
+	for _, pkt := range [][]byte{unknown, toB, toA} {
+		if _, err := peer.WriteTo(pkt, s.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readPacket(t, a); !bytes.Equal(got, toA) {
+		t.Errorf("a read %q, want %q", got, toA)
+	}
+	if got := readPacket(t, b); !bytes.Equal(got, toB) {
+		t.Errorf("b read %q, want %q", got, toB)
+	}
+
+	// Nothing else arrived.
+	_ = a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := a.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom() = %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	// A closed view is detached, the others keep working.
+	a.Close()
+	if _, _, err := a.ReadFrom(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom() after Close() = %v, want net.ErrClosed", err)
+	}
+	s.mu.Lock()
+	_, attached := s.views[a.id]
+	s.mu.Unlock()
+	if attached {
+		t.Error("closed view still attached")
+	}
+	if _, err := peer.WriteTo(toB, s.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readPacket(t, b); !bytes.Equal(got, toB) {
+		t.Errorf("b read %q, want %q", got, toB)
+	}
+
+	// Closing the shared conn fails the views.
+	s.Close()
+	_ = b.SetReadDeadline(time.Time{})
+	if _, _, err := b.ReadFrom(buf); err == nil {
+		t.Error("ReadFrom() succeeded after the shared conn was closed")
+	}
+	if _, err := s.NewPacketConn(); err == nil {
+		t.Error("NewPacketConn() succeeded after the shared conn was closed")
+	}
+}
+
+func TestViewID(t *testing.T) {
+	connID := []byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4}
+	for _, tt := range []struct {
+		name   string
+		packet []byte
+		ok     bool
+	}{
+		{"long", longHeaderPacket(connID, "x"), true},
+		{"short", shortHeaderPacket(connID, "x"), true},
+		{"empty", nil, false},
+		{"truncated long", longHeaderPacket(connID, "")[:8], false},
+		{"short connection ID", longHeaderPacket(connID[:2], "x"), false},
+	} {
+		id, ok := viewID(tt.packet)
+		if ok != tt.ok || (ok && id != 0xdeadbeef) {
+			t.Errorf("%v: viewID() = %x, %v, want deadbeef, %v", tt.name, id, ok, tt.ok)
+		}
+	}
+}
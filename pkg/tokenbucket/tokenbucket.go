@@ -0,0 +1,82 @@
+// Package tokenbucket implements a simple token bucket rate limiter.
+package tokenbucket
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at a constant rate. It may go into debt:
+// Take always succeeds and reports how long the caller should wait before the
+// balance is non-negative again, which lets callers honor their own deadlines.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a full bucket refilled with rate tokens per second and holding at
+// most burst tokens. A zero burst means rate, i.e. one second worth of tokens.
+func New(rate, burst uint64) *Bucket {
+	if burst == 0 {
+		burst = rate
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Burst returns the capacity of the bucket.
+func (b *Bucket) Burst() int {
+	return int(b.burst)
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *Bucket) delay() time.Duration {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Take consumes n tokens and returns how long until the balance is
+// non-negative.
+func (b *Bucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	return b.delay()
+}
+
+// Refund gives back n tokens, e.g. after a caller gave up waiting.
+func (b *Bucket) Refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Delay returns how long until the balance is non-negative, without taking
+// any tokens.
+func (b *Bucket) Delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.delay()
+}
@@ -0,0 +1,57 @@
+package tokenbucket
+
+import (
+	"testing"
+	"time"
+)
+
+func near(got, want time.Duration) bool {
+	const tolerance = 20 * time.Millisecond
+	return got > want-tolerance && got < want+tolerance
+}
+
+func TestBucket(t *testing.T) {
+	b := New(1000, 100)
+	if got := b.Burst(); got != 100 {
+		t.Fatalf("Burst() = %v, want 100", got)
+	}
+	// Starts full.
+	if d := b.Take(100); d != 0 {
+		t.Errorf("Take(100) = %v, want 0", d)
+	}
+	// Goes into debt: 100 tokens at 1000/s take 100ms to pay back.
+	if d := b.Take(100); !near(d, 100*time.Millisecond) {
+		t.Errorf("Take(100) = %v, want about 100ms", d)
+	}
+	if d := b.Delay(); !near(d, 100*time.Millisecond) {
+		t.Errorf("Delay() = %v, want about 100ms", d)
+	}
+	b.Refund(100)
+	if d := b.Delay(); d != 0 {
+		t.Errorf("Delay() after Refund = %v, want 0", d)
+	}
+
+	// Refills over time but never beyond the burst.
+	time.Sleep(200 * time.Millisecond)
+	if d := b.Take(100); d != 0 {
+		t.Errorf("Take(100) after refill = %v, want 0", d)
+	}
+	if d := b.Take(1); d == 0 {
+		t.Error("Take(1) = 0, want the burst to cap the refill")
+	}
+}
+
+func TestBucketDefaultBurst(t *testing.T) {
+	b := New(500, 0)
+	if got := b.Burst(); got != 500 {
+		t.Errorf("Burst() = %v, want 500", got)
+	}
+}
+
+func TestBucketRefundCap(t *testing.T) {
+	b := New(1000, 100)
+	b.Refund(1000)
+	if d := b.Take(101); d == 0 {
+		t.Error("Refund filled the bucket beyond its burst")
+	}
+}
@@ -1,6 +1,15 @@
 package protocol
 
-import "net"
+import (
+	"errors"
+	"net"
+)
+
+// ErrZonedAddr is returned when an IPv6 address with a zone, e.g.
+// "[fe80::1%eth0]:80", is sent in a binary address format: the zone is only
+// meaningful on the host that names it and those formats have no room for it.
+// Protocols that send the address as a string, like hysteria2, keep the zone.
+var ErrZonedAddr = errors.New("IPv6 zone cannot be sent in this address format")
 
 func TCPAddrToUDPAddr(addr *net.TCPAddr) *net.UDPAddr {
 	return &net.UDPAddr{
@@ -70,6 +70,10 @@ func (c *directPacketConn) Read(b []byte) (int, error) {
 	return n, err
 }
 
+func (c *directPacketConn) IsStream() bool {
+	return false
+}
+
 var _ interface {
 	SyscallConn() (syscall.RawConn, error)
 	SetReadBuffer(int) error
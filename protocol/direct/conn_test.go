@@ -2,7 +2,10 @@ package direct
 
 import (
 	"context"
+	"io"
 	"net"
+	"net/netip"
+	"sync"
 	"testing"
 
 	"github.com/daeuniverse/outbound/netproxy"
@@ -13,7 +16,7 @@ import (
 
 func TestFakeNetPacketConn(t *testing.T) {
 	t.Run("positive", func(t *testing.T) {
-		c, err := SymmetricDirect.DialContext(context.TODO(), "udp", "223.5.5.5:53")
+		c, err := NewDirectDialerLaddr(netip.Addr{}, Option{}).DialContext(context.TODO(), "udp", "223.5.5.5:53")
 		require.NoError(t, err)
 		fc := netproxy.NewFakeNetPacketConn(c.(netproxy.PacketConn), nil, nil)
 		_, ok := fc.(quic.OOBCapablePacketConn)
@@ -30,3 +33,145 @@ func TestFakeNetPacketConn(t *testing.T) {
 		require.True(t, ok)
 	})
 }
+
+func TestDialTFO(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+
+	// Whether or not the kernel supports TCP_FASTOPEN_CONNECT, the dial
+	// must succeed.
+	d := NewDirectDialerLaddr(netip.Addr{}, Option{TFO: true})
+	c, err := d.DialContext(context.TODO(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestIsStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	symmetric := NewDirectDialerLaddr(netip.Addr{}, Option{})
+	fullcone := NewDirectDialerLaddr(netip.Addr{}, Option{FullCone: true})
+	tcp, err := symmetric.DialContext(context.TODO(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer tcp.Close()
+	stream, ok := netproxy.IsStreamConn(tcp)
+	require.True(t, ok)
+	require.True(t, stream)
+
+	for _, d := range []netproxy.Dialer{symmetric, fullcone} {
+		udp, err := d.DialContext(context.TODO(), "udp", "127.0.0.1:53")
+		require.NoError(t, err)
+		stream, ok := netproxy.IsStreamConn(udp)
+		require.True(t, ok)
+		require.False(t, stream)
+		udp.Close()
+	}
+}
+
+func TestDialWithIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	// The host is never resolved.
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	d := NewDirectDialerLaddr(netip.Addr{}, Option{})
+	c, err := netproxy.DialWithIP(context.TODO(), d, "tcp", net.JoinHostPort("backend.invalid", port), netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, l.Addr().String(), c.(net.Conn).RemoteAddr().String())
+}
+
+func TestSourcePortRange(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// A port that was free a moment ago.
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	port := uint16(free.LocalAddr().(*net.UDPAddr).Port)
+	require.NoError(t, free.Close())
+
+	lAddr := netip.MustParseAddr("127.0.0.1")
+	d := NewDirectDialerLaddr(lAddr, Option{MinSourcePort: port, MaxSourcePort: port})
+	udp, err := d.DialContext(context.TODO(), "udp", "127.0.0.1:53")
+	require.NoError(t, err)
+	require.Equal(t, int(port), udp.(*directPacketConn).LocalAddr().(*net.UDPAddr).Port)
+
+	// The port is in use by the first conn now.
+	_, err = d.DialContext(context.TODO(), "udp", "127.0.0.1:53")
+	require.ErrorIs(t, err, ErrSourcePortsExhausted)
+	require.NoError(t, udp.Close())
+
+	tcp, err := d.DialContext(context.TODO(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer tcp.Close()
+	require.Equal(t, int(port), tcp.(net.Conn).LocalAddr().(*net.TCPAddr).Port)
+	_, err = d.DialContext(context.TODO(), "tcp", l.Addr().String())
+	require.ErrorIs(t, err, ErrSourcePortsExhausted)
+}
+
+func TestDialTcpConcurrentMarks(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	d := NewDirectDialerLaddr(netip.Addr{}, Option{TFO: true}).(*directDialer)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := d.DialContext(context.TODO(), "tcp", l.Addr().String())
+			if err == nil {
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	// The dials leave the shared dialer as it was built.
+	require.Nil(t, d.tcpDialer.Control)
+	require.Nil(t, d.tcpDialer.Resolver)
+}
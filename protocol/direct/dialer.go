@@ -24,9 +24,22 @@ func InitDirectDialers(fallbackDNS string) {
 type Option struct {
 	FullCone    bool
 	FallbackDNS string
+	// TFO enables client-side TCP Fast Open on Linux. The first write is sent
+	// with the SYN when the kernel has a cookie for the server, and the dial
+	// falls back to a normal handshake otherwise. Connection errors may then
+	// only surface on the first write. It is ignored on other platforms.
+	TFO bool
+	// MinSourcePort and MaxSourcePort, if MaxSourcePort is not zero, bind TCP
+	// and UDP sockets to a free source port between them, inclusive, e.g. for
+	// egress firewalls that only let some source ports through. Ports in use
+	// are skipped; when all of them are, the dial fails with
+	// ErrSourcePortsExhausted.
+	MinSourcePort uint16
+	MaxSourcePort uint16
 }
 
 type directDialer struct {
+	lAddr          netip.Addr
 	tcpDialer      *net.Dialer
 	tcpDialerMptcp *net.Dialer
 	udpLocalAddr   *net.UDPAddr
@@ -44,6 +57,7 @@ func NewDirectDialerLaddr(lAddr netip.Addr, option Option) netproxy.Dialer {
 	tcpDialerMptcp := &net.Dialer{LocalAddr: tcpLocalAddr}
 	tcpDialerMptcp.SetMultipathTCP(true)
 	d := &directDialer{
+		lAddr:          lAddr,
 		tcpDialer:      tcpDialer,
 		tcpDialerMptcp: tcpDialerMptcp,
 		udpLocalAddr:   udpLocalAddr,
@@ -100,16 +114,29 @@ func (d *directDialer) dialUdp(ctx context.Context, addr string, mark int, fallb
 			})
 		}()
 	}
+	err = d.withSourcePort(ctx, func(port int) (err error) {
+		udpLocalAddr := d.udpLocalAddr
+		if port != 0 {
+			udpLocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(d.lAddr, uint16(port)))
+		}
+		c, err = d.dialUdpFrom(ctx, addr, mark, fallback, udpLocalAddr)
+		return err
+	})
+	return c, err
+}
+
+// dialUdpFrom is dialUdp from udpLocalAddr.
+func (d *directDialer) dialUdpFrom(ctx context.Context, addr string, mark int, fallback bool, udpLocalAddr *net.UDPAddr) (netproxy.PacketConn, error) {
 	if mark == 0 {
 		if d.Option.FullCone {
-			conn, err := net.ListenUDP("udp", d.udpLocalAddr)
+			conn, err := net.ListenUDP("udp", udpLocalAddr)
 			if err != nil {
 				return nil, err
 			}
 			return &directPacketConn{UDPConn: conn, FullCone: true, dialTgt: addr, resolver: d.createResolver(mark, fallback)}, nil
 		} else {
 			dialer := net.Dialer{
-				LocalAddr: d.udpLocalAddr,
+				LocalAddr: udpLocalAddr,
 				Resolver:  d.createResolver(mark, fallback),
 			}
 			conn, err := dialer.DialContext(ctx, "udp", addr)
@@ -129,8 +156,8 @@ func (d *directDialer) dialUdp(ctx context.Context, addr string, mark int, fallb
 				KeepAlive: 0,
 			}
 			laddr := ""
-			if d.udpLocalAddr != nil {
-				laddr = d.udpLocalAddr.String()
+			if udpLocalAddr != nil {
+				laddr = udpLocalAddr.String()
 			}
 			_conn, err := c.ListenPacket(context.Background(), "udp", laddr)
 			if err != nil {
@@ -142,7 +169,7 @@ func (d *directDialer) dialUdp(ctx context.Context, addr string, mark int, fallb
 				Control: func(network, address string, c syscall.RawConn) error {
 					return netproxy.SoMarkControl(c, mark)
 				},
-				LocalAddr: d.udpLocalAddr,
+				LocalAddr: udpLocalAddr,
 				Resolver:  d.createResolver(mark, fallback),
 			}
 			c, err := dialer.DialContext(ctx, "udp", addr)
@@ -174,19 +201,39 @@ func (d *directDialer) dialTcp(ctx context.Context, addr string, mark int, mptcp
 			})
 		}()
 	}
-	var dialer *net.Dialer
+	// Copied, so that concurrent dials with other marks do not share the
+	// control function and the resolver.
+	var dialer net.Dialer
 	if mptcp {
-		dialer = d.tcpDialerMptcp
+		dialer = *d.tcpDialerMptcp
 	} else {
-		dialer = d.tcpDialer
+		dialer = *d.tcpDialer
 	}
-	if mark != 0 {
+	if mark != 0 || d.Option.TFO {
 		dialer.Control = func(network, address string, c syscall.RawConn) error {
-			return netproxy.SoMarkControl(c, mark)
+			if mark != 0 {
+				if err := netproxy.SoMarkControl(c, mark); err != nil {
+					return err
+				}
+			}
+			if d.Option.TFO {
+				return tfoControl(c)
+			}
+			return nil
 		}
 	}
 	dialer.Resolver = d.createResolver(mark, fallback)
-	return dialer.DialContext(ctx, "tcp", addr)
+	err = d.withSourcePort(ctx, func(port int) (err error) {
+		if port == 0 {
+			c, err = dialer.DialContext(ctx, "tcp", addr)
+			return err
+		}
+		portDialer := dialer
+		portDialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(d.lAddr, uint16(port)))
+		c, err = portDialer.DialContext(ctx, "tcp", addr)
+		return err
+	})
+	return c, err
 }
 
 func (d *directDialer) DialContext(ctx context.Context, network, addr string) (c netproxy.Conn, err error) {
@@ -194,6 +241,13 @@ func (d *directDialer) DialContext(ctx context.Context, network, addr string) (c
 	if err != nil {
 		return nil, err
 	}
+	if underlay, ok := netproxy.UnderlayFromContext(ctx); ok {
+		// A hop of a chain reaches its server through the hops before it.
+		return underlay.DialContext(ctx, network, addr)
+	}
+	if addr, err = netproxy.OverrideDialAddr(ctx, addr); err != nil {
+		return nil, err
+	}
 	switch magicNetwork.Network {
 	case "tcp":
 		return d.dialTcp(ctx, addr, int(magicNetwork.Mark), magicNetwork.Mptcp, false)
@@ -0,0 +1,44 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/daeuniverse/outbound/pkg/fastrand"
+)
+
+// ErrSourcePortsExhausted is returned when every port of
+// Option.MinSourcePort-Option.MaxSourcePort is in use.
+var ErrSourcePortsExhausted = errors.New("no free source port")
+
+// isPortConflict reports whether err is a failure to bind or connect from a
+// source port that is in use, the latter for TCP when the same 4-tuple is.
+func isPortConflict(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// withSourcePort calls dial with the source port to bind to: 0, i.e. any,
+// without a source port range, or else the ports of the range from a random
+// one on until dial does not fail for a port conflict.
+func (d *directDialer) withSourcePort(ctx context.Context, dial func(port int) error) error {
+	if d.Option.MaxSourcePort == 0 {
+		return dial(0)
+	}
+	lo, hi := int(d.Option.MinSourcePort), int(d.Option.MaxSourcePort)
+	if lo == 0 || lo > hi {
+		return fmt.Errorf("invalid source port range %d-%d", lo, hi)
+	}
+	n := hi - lo + 1
+	start := fastrand.Intn(n)
+	for i := 0; i < n; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := dial(lo + (start+i)%n); !isPortConflict(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w in %d-%d", ErrSourcePortsExhausted, lo, hi)
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package direct
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/daeuniverse/outbound/pkg/logger"
+	"golang.org/x/sys/unix"
+)
+
+var tfoWarnOnce sync.Once
+
+// tfoControl enables client-side TCP Fast Open with TCP_FASTOPEN_CONNECT. The
+// kernel then defers the SYN to the first write and sends the data along with
+// it if a cookie for the server is cached, or does a normal handshake if not.
+// Kernels without TCP_FASTOPEN_CONNECT (before 4.11) reject the option; the
+// dial then goes on with a normal connect.
+func tfoControl(c syscall.RawConn) error {
+	controlErr := c.Control(func(fd uintptr) {
+		err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		if err != nil {
+			tfoWarnOnce.Do(func() {
+				logger.Logger.Warnf("direct: TCP Fast Open is unavailable, falling back to a normal connect: %v", err)
+			})
+		}
+	})
+	if controlErr != nil {
+		return fmt.Errorf("error invoking socket control function: %w", controlErr)
+	}
+	return nil
+}
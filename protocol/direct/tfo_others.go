@@ -0,0 +1,11 @@
+//go:build !linux
+
+package direct
+
+import "syscall"
+
+// tfoControl is a no-op where TCP Fast Open is not supported, so that dials
+// fall back to a normal connect.
+func tfoControl(c syscall.RawConn) error {
+	return nil
+}
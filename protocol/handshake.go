@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+// ErrConnUsed is returned when the protocol of Handshake dials more than once,
+// which the conn given to it cannot serve.
+var ErrConnUsed = errors.New("the conn of the handshake is already used")
+
+// Handshake runs the client handshake of the protocol registered as name over
+// conn, which is already connected to the server of header, e.g. accepted by
+// a listener or dialed by another dialer, and returns the conn to addr over
+// network. The protocol does not dial the server itself: where it would,
+// it gets conn, which works for the protocols that run over a single conn
+// per dial, like trojanc, vless, vmess, shadowsocks and shadowsocks_stream.
+// For one that dials again, e.g. to reconnect, the second dial fails with
+// ErrConnUsed. If Handshake fails, conn may have been closed already; closing
+// it again is fine.
+func Handshake(ctx context.Context, name string, conn netproxy.Conn, header Header, network, addr string) (netproxy.Conn, error) {
+	d, err := NewDialer(name, &connDialer{conn: conn}, header)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// connDialer hands out conn to the first dial.
+type connDialer struct {
+	mu   sync.Mutex
+	conn netproxy.Conn
+}
+
+func (d *connDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		return nil, ErrConnUsed
+	}
+	conn := d.conn
+	d.conn = nil
+	return conn, nil
+}
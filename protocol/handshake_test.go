@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+// greetDialer dials its server and greets it with the target.
+type greetDialer struct {
+	next   netproxy.Dialer
+	server string
+}
+
+func (d *greetDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	conn, err := d.next.DialContext(ctx, network, d.server)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s;", network, addr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestHandshake(t *testing.T) {
+	var d *greetDialer
+	Register("test-greet", func(next netproxy.Dialer, header Header) (netproxy.Dialer, error) {
+		d = &greetDialer{next: next, server: header.ProxyAddress}
+		return d, nil
+	})
+	defer delete(Mapper, "test-greet")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, len("tcp example.com:80;"))
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "tcp example.com:80;" {
+			t.Errorf("the server got %q, %v", buf, err)
+		}
+	}()
+	conn, err := Handshake(context.Background(), "test-greet", client, Header{ProxyAddress: "proxy:1"}, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if conn != client {
+		t.Errorf("Handshake() = %v, want the conn of the protocol over the given one", conn)
+	}
+
+	// The conn serves a single dial.
+	if _, err := d.DialContext(context.Background(), "tcp", "example.com:80"); !errors.Is(err, ErrConnUsed) {
+		t.Errorf("second dial = %v, want ErrConnUsed", err)
+	}
+	if _, err := Handshake(context.Background(), "no-such-protocol", client, Header{}, "tcp", "example.com:80"); err == nil {
+		t.Error("Handshake() of an unknown protocol succeeded")
+	}
+}
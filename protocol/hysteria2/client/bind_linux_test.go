@@ -0,0 +1,39 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestBindInterface(t *testing.T) {
+	pc, err := (&UdpConnFactory{}).New(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if err := bindInterface(pc, "lo"); err != nil {
+		t.Skipf("cannot bind to lo, missing CAP_NET_RAW? %v", err)
+	}
+	rc, err := pc.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	_ = rc.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	})
+	if err != nil || got != "lo" {
+		t.Errorf("SO_BINDTODEVICE = %q, %v, want lo", got, err)
+	}
+
+	if err := bindInterface(pc, "no-such-interface0"); err == nil {
+		t.Error("binding to a missing interface should fail")
+	}
+	// Conns that hide their socket cannot be bound.
+	if err := bindInterface(struct{ net.PacketConn }{pc}, "lo"); err == nil {
+		t.Error("binding a conn without SyscallConn should fail")
+	}
+}
@@ -1,16 +1,23 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pkg/logger"
+	"github.com/daeuniverse/outbound/pkg/quicpacket"
+	"github.com/daeuniverse/outbound/pool"
 	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/utils"
@@ -18,6 +25,7 @@ import (
 
 	"github.com/daeuniverse/quic-go"
 	"github.com/daeuniverse/quic-go/http3"
+	"github.com/daeuniverse/quic-go/quicvarint"
 )
 
 const (
@@ -25,14 +33,83 @@ const (
 	closeErrCodeProtocolError = 0x101 // HTTP3 ErrCodeGeneralProtocolError
 )
 
+var (
+	errAcceptStreamsDisabled = errors.New("hysteria2: AcceptStreams is not enabled")
+	errUDPDisabled           = errors.New("hysteria2: UDP is disabled by Config.EnableDatagrams")
+	errNoClientCertificate   = errors.New("hysteria2: the server asked for a client certificate, but TLSConfig.GetClientCertificate returned none")
+)
+
 type Client interface {
+	// TCP opens a stream to addr. The conns returned by TCP and its variants
+	// also implement net.Conn, e.g. for http.Transport or tls.Client, see
+	// netproxy.AsNetConn; the addresses are those of the QUIC connection.
 	TCP(addr string, ctx context.Context) (netproxy.Conn, error)
+	// TCPWithPriority is like TCP, but gives the stream a priority: with a
+	// quic-go that supports stream priorities, streams with higher values
+	// are sent first, e.g. interactive traffic ahead of bulk downloads on
+	// the same connection. Otherwise it is the same as TCP.
+	TCPWithPriority(addr string, priority int, ctx context.Context) (netproxy.Conn, error)
+	// TCPWithInitialData is like TCP, but sends data in the same write as
+	// the request to open the stream, so that the server gets both in the
+	// first flight and a small request, e.g. an HTTP GET, saves a round trip.
+	// With FastOpen, the returned conn still reads the response of the server
+	// on the first Read. data has been sent once it returns.
+	TCPWithInitialData(addr string, data []byte, ctx context.Context) (netproxy.Conn, error)
+	// UDP opens a UDP session to addr. The conns returned by UDP and
+	// UDPWithKey also implement ReadContext(ctx, p) (int, error), which
+	// gives up on a read once ctx is done without closing the session.
 	UDP(addr string, ctx context.Context) (netproxy.Conn, error)
+	// UDPWithKey is like UDP, but callers passing the same non-empty key
+	// share one UDP session, so the server keeps relaying the flow from the
+	// same source. A key is bound to the addr it was first used with. Sessions
+	// do not survive a reconnect of the underlying QUIC connection.
+	UDPWithKey(addr string, key string, ctx context.Context) (netproxy.Conn, error)
+	// AcceptStream waits for the server to open a stream, for reverse
+	// tunnels, and returns it once its TCP request is read and acknowledged.
+	// The returned conn implements Target() string, the address the server
+	// asked for; the caller dispatches it. It fails unless
+	// Config.AcceptStreams is set.
+	AcceptStream(ctx context.Context) (netproxy.Conn, error)
+	// IsHealthy reports whether the last connection attempt succeeded and,
+	// with Config.HealthCheckInterval set, whether the connection was alive at
+	// the last check. A client that has not connected yet is healthy.
+	IsHealthy() bool
+	// NegotiatedProtocol returns the ALPN protocol the server agreed to in the
+	// TLS handshake of the current connection, normally "h3", or "" if the
+	// client has not connected yet. Fronting CDNs may rewrite it.
+	NegotiatedProtocol() string
+	// ProbeBandwidth measures the bandwidth to and from the server with the
+	// speed test of the server, which must enable it. It sends and receives
+	// as fast as possible for a few seconds, so it only runs when called.
+	ProbeBandwidth(ctx context.Context) (tx, rx uint64, err error)
+	// UDPSessionCount returns the number of UDP sessions open on the current
+	// connection. Handles sharing a key count as one session.
+	UDPSessionCount() int
+	// ActiveConns returns a snapshot of the TCP streams and UDP sessions the
+	// client carries, oldest first, e.g. for an admin endpoint. A stream is
+	// listed until it is closed, even if the server closed it first.
+	ActiveConns() []ConnInfo
+	// Stats returns the payload relayed so far, split between TCP and UDP.
+	Stats() Stats
+	// SetKeepAlivePeriod changes the QUIC keep-alive period, e.g. shorter to
+	// keep NAT mappings alive while a mobile app is in the background and
+	// longer to save battery in the foreground. d must be between 2s and
+	// 60s. quic-go cannot change the period of a live connection, so it
+	// applies from the next connection on, and errors.ErrKeepAliveNotLive is
+	// returned if the current connection keeps another period.
+	SetKeepAlivePeriod(d time.Duration) error
+	// KeepAlivePeriod returns the keep-alive period set by
+	// Config.QUICConfig.KeepAlivePeriod or SetKeepAlivePeriod.
+	KeepAlivePeriod() time.Duration
+	// Close closes the connection and stops the health monitor. TCP and UDP
+	// fail afterwards.
+	Close() error
 }
 
 type HandshakeInfo struct {
-	UDPEnabled bool
-	Tx         uint64 // 0 if using BBR
+	UDPEnabled         bool
+	Tx                 uint64 // 0 if using BBR
+	NegotiatedProtocol string
 }
 
 func NewClient(config *Config) (Client, error) {
@@ -41,10 +118,63 @@ func NewClient(config *Config) (Client, error) {
 	}
 	c := &clientImpl{
 		config: config,
+		closed: make(chan struct{}),
+	}
+	c.healthy.Store(true)
+	c.keepAlive.Store(int64(config.QUICConfig.KeepAlivePeriod))
+	if config.HealthCheckInterval > 0 {
+		go c.monitor()
+	}
+	return c, nil
+}
+
+// NewClientContext is like NewClient, but connects at once instead of on the
+// first TCP or UDP call, and within ctx: once ctx is done, the QUIC dial or
+// the auth in progress is aborted, its sockets are closed and the error is
+// returned, e.g. to bound how long applying a config can hang on a bad
+// server. ctx does not apply to the client afterwards.
+func NewClientContext(ctx context.Context, config *Config) (Client, error) {
+	cl, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	c := cl.(*clientImpl)
+	c.m.Lock()
+	err = c.reconnect(ctx)
+	c.m.Unlock()
+	if err != nil {
+		_ = c.Close()
+		return nil, err
 	}
 	return c, nil
 }
 
+// Connect is like NewClientContext, but also returns what the server agreed
+// to and how long each step of the connect took, e.g. to benchmark servers.
+// The timings are returned even if the connect fails. With
+// Config.HandshakeRetries, the steps are those of the last attempt and Total
+// covers all of them. Config.Trace is called as usual.
+func Connect(ctx context.Context, config *Config) (Client, *HandshakeInfo, ConnectTimings, error) {
+	cl, err := NewClient(config)
+	if err != nil {
+		return nil, nil, ConnectTimings{}, err
+	}
+	c := cl.(*clientImpl)
+	var recorder connectTimings
+	start := time.Now()
+	c.m.Lock()
+	info, err := c.connectRetrying(withConnectTimings(ctx, &recorder))
+	c.healthy.Store(err == nil)
+	c.m.Unlock()
+	timings := recorder.get()
+	timings.Total = time.Since(start)
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, timings, err
+	}
+	return c, info, timings, nil
+}
+
 // TODO: 同一个 dialer 不同 mark 如何处理 quic conn?
 
 type clientImpl struct {
@@ -54,43 +184,185 @@ type clientImpl struct {
 	conn    quic.Connection
 
 	udpSM *udpSessionManager
+	// udpIO is the UDP of the current connection while its session manager
+	// is not set up yet, see Config.LazyUDP.
+	udpIO udpIO
+	// connKeepAlive is the keep-alive period of the current connection.
+	connKeepAlive time.Duration
 
 	m sync.Mutex
+
+	healthy atomic.Bool
+	// keepAlive is the keep-alive period of new connections.
+	keepAlive atomic.Int64
+	// alpn is the protocol negotiated by the current connection, read
+	// without c.m so that it does not wait for a reconnect.
+	alpn      atomic.Pointer[string]
+	traffic   trafficCounters
+	conns     connRegistry
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// tlsConfig converts the config to the TLS config of the QUIC connection.
+func (c *Config) tlsConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName:            c.TLSConfig.ServerName,
+		InsecureSkipVerify:    c.TLSConfig.InsecureSkipVerify,
+		VerifyPeerCertificate: c.TLSConfig.VerifyPeerCertificate,
+		VerifyConnection:      c.TLSConfig.VerifyConnection,
+		RootCAs:               c.TLSConfig.RootCAs,
+		Certificates:          c.TLSConfig.Certificates,
+	}
+	if getCert := c.TLSConfig.GetClientCertificate; getCert != nil {
+		tlsConfig.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := getCert(cri)
+			if err == nil && (cert == nil || len(cert.Certificate) == 0) {
+				return nil, errNoClientCertificate
+			}
+			return cert, err
+		}
+	}
+	if c.TLSConfig.SessionTicketsDisabled {
+		tlsConfig.SessionTicketsDisabled = true
+	} else {
+		tlsConfig.ClientSessionCache = c.TLSConfig.ClientSessionCache
+	}
+	return tlsConfig
+}
+
+// quicConfig converts the config to the QUIC config of the connection.
+func (c *Config) quicConfig() *quic.Config {
+	return &quic.Config{
+		InitialStreamReceiveWindow:     c.QUICConfig.InitialStreamReceiveWindow,
+		MaxStreamReceiveWindow:         c.QUICConfig.MaxStreamReceiveWindow,
+		InitialConnectionReceiveWindow: c.QUICConfig.InitialConnectionReceiveWindow,
+		MaxConnectionReceiveWindow:     c.QUICConfig.MaxConnectionReceiveWindow,
+		MaxIdleTimeout:                 c.QUICConfig.MaxIdleTimeout,
+		KeepAlivePeriod:                c.QUICConfig.KeepAlivePeriod,
+		DisablePathMTUDiscovery:        c.QUICConfig.DisablePathMTUDiscovery,
+		EnableDatagrams:                c.datagramsEnabled(),
+		Versions:                       c.QUICConfig.Versions,
+	}
+}
+
+// dialQUIC dials the server over pktConn.
+func (c *Config) dialQUIC(ctx context.Context, pktConn net.PacketConn, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	if shared, ok := pktConn.(*quicpacket.PacketConn); ok {
+		return shared.Transport().DialEarly(ctx, c.ServerAddr, tlsCfg, cfg)
+	}
+	if n := c.QUICConfig.ConnectionIDLength; n > 0 {
+		// The transport stops once pktConn is closed.
+		t := &quic.Transport{Conn: pktConn, ConnectionIDLength: n}
+		return t.DialEarly(ctx, c.ServerAddr, tlsCfg, cfg)
+	}
+	return quic.DialEarly(ctx, pktConn, c.ServerAddr, tlsCfg, cfg)
+}
+
+// connectRetrying is connect, retried as set by Config.HandshakeRetries.
+func (c *clientImpl) connectRetrying(ctx context.Context) (*HandshakeInfo, error) {
+	delay := c.config.HandshakeRetryDelay
+	for retry := 0; ; retry++ {
+		info, err := c.connect(ctx)
+		if err == nil || retry == c.config.HandshakeRetries || ctx.Err() != nil || !isTransientConnectError(err) {
+			return info, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-c.closed:
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// isTransientConnectError reports whether err, returned by connect, may not
+// happen again on the next attempt: the QUIC dial or the auth timed out or
+// was reset.
+func isTransientConnectError(err error) bool {
+	var connectErr coreErrs.ConnectError
+	if !errors.As(err, &connectErr) {
+		return false
+	}
+	var resetErr *quic.StatelessResetError
+	if errors.As(err, &resetErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
 func (c *clientImpl) connect(ctx context.Context) (*HandshakeInfo, error) {
+	trace := c.newConnectTrace(ctx)
 	pktConn, err := c.config.ConnFactory.New(ctx)
 	if err != nil {
 		return nil, err
 	}
-	// Convert config to TLS config & QUIC config
-	tlsConfig := &tls.Config{
-		ServerName:            c.config.TLSConfig.ServerName,
-		InsecureSkipVerify:    c.config.TLSConfig.InsecureSkipVerify,
-		VerifyPeerCertificate: c.config.TLSConfig.VerifyPeerCertificate,
-		RootCAs:               c.config.TLSConfig.RootCAs,
-	}
-	quicConfig := &quic.Config{
-		InitialStreamReceiveWindow:     c.config.QUICConfig.InitialStreamReceiveWindow,
-		MaxStreamReceiveWindow:         c.config.QUICConfig.MaxStreamReceiveWindow,
-		InitialConnectionReceiveWindow: c.config.QUICConfig.InitialConnectionReceiveWindow,
-		MaxConnectionReceiveWindow:     c.config.QUICConfig.MaxConnectionReceiveWindow,
-		MaxIdleTimeout:                 c.config.QUICConfig.MaxIdleTimeout,
-		KeepAlivePeriod:                c.config.QUICConfig.KeepAlivePeriod,
-		DisablePathMTUDiscovery:        c.config.QUICConfig.DisablePathMTUDiscovery,
-		EnableDatagrams:                true,
+	trace.packetConnCreated(pktConn.LocalAddr())
+	if c.config.BindInterface != "" {
+		if err := bindInterface(pktConn, c.config.BindInterface); err != nil {
+			_ = pktConn.Close()
+			return nil, coreErrs.ConnectError{Err: err}
+		}
+	}
+	// With AuthTimeout, the auth request runs without the deadline of ctx,
+	// which only bounds the handshake, and gets one of its own once the
+	// handshake is complete.
+	reqCtx := ctx
+	var startAuthTimer func(qc quic.EarlyConnection)
+	if c.config.AuthTimeout > 0 {
+		var cancel context.CancelCauseFunc
+		reqCtx, cancel = context.WithCancelCause(context.WithoutCancel(ctx))
+		defer cancel(nil)
+		stop := context.AfterFunc(ctx, func() {
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				cancel(context.Cause(ctx))
+			}
+		})
+		defer stop()
+		timer := time.AfterFunc(c.config.AuthTimeout, func() { cancel(coreErrs.ErrAuthTimeout) })
+		timer.Stop()
+		defer timer.Stop()
+		startAuthTimer = func(qc quic.EarlyConnection) {
+			// DialEarly returns before the handshake is complete with 0-RTT.
+			go func() {
+				select {
+				case <-qc.HandshakeComplete():
+					timer.Reset(c.config.AuthTimeout)
+				case <-reqCtx.Done():
+				}
+			}()
+		}
 	}
 	// Prepare Transport
 	var conn quic.EarlyConnection
+	quicConfig := c.config.quicConfig()
+	quicConfig.KeepAlivePeriod = c.KeepAlivePeriod()
 	rt := &http3.Transport{
-		TLSClientConfig: tlsConfig,
+		TLSClientConfig: c.config.tlsConfig(),
 		QUICConfig:      quicConfig,
-		Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-			qc, err := quic.DialEarly(ctx, pktConn, c.config.ServerAddr, tlsCfg, cfg)
+		Dial: func(dialCtx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			if startAuthTimer != nil {
+				// dialCtx derives from reqCtx, without the deadline.
+				dialCtx = ctx
+			}
+			trace.quicHandshakeStart()
+			qc, err := c.config.dialQUIC(dialCtx, pktConn, tlsCfg, cfg)
+			trace.quicHandshakeDone(err)
 			if err != nil {
 				return nil, err
 			}
 			conn = qc
+			if startAuthTimer != nil {
+				startAuthTimer(qc)
+			}
+			// http3 writes the request as soon as it has the connection.
+			trace.authRequestSent()
 			return qc, nil
 		},
 	}
@@ -100,27 +372,57 @@ func (c *clientImpl) connect(ctx context.Context) (*HandshakeInfo, error) {
 		Host:   protocol.URLHost,
 		Path:   protocol.URLPath,
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, u.String(), nil)
 	if err != nil {
+		_ = pktConn.Close()
 		return nil, err
 	}
-	req.Header = make(http.Header)
-	protocol.AuthRequestToHeader(req.Header, protocol.AuthRequest{
-		Auth: c.config.Auth,
-		Rx:   c.config.BandwidthConfig.MaxRx,
-	})
-	resp, err := rt.RoundTrip(req)
-	if err != nil {
-		if conn != nil {
+	req.Header = c.config.AuthHeaders.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	var resp *http.Response
+	auths := append([]string{c.config.Auth}, c.config.AuthFallbacks...)
+	for i, auth := range auths {
+		authReq := protocol.AuthRequest{
+			Auth: auth,
+			Rx:   c.config.BandwidthConfig.MaxRx,
+		}
+		if c.config.AuthTimestamp {
+			authReq.Timestamp = protocol.NewAuthTimestamp()
+			authReq.Nonce = protocol.NewAuthNonce()
+		}
+		attempt := req.Clone(reqCtx)
+		protocol.AuthRequestToHeader(attempt.Header, authReq)
+		if i > 0 {
+			// Fallbacks go over the connection dialed for the first attempt.
+			trace.authRequestSent()
+		}
+		resp, err = rt.RoundTrip(attempt)
+		if err != nil {
+			trace.authResponseReceived(0, err)
+			if conn != nil {
+				_ = conn.CloseWithError(closeErrCodeProtocolError, "")
+			}
+			_ = pktConn.Close()
+			var versionErr *quic.VersionNegotiationError
+			if errors.As(err, &versionErr) {
+				err = fmt.Errorf("no common QUIC version, offered %v, server supports %v: %w", versionErr.Ours, versionErr.Theirs, err)
+			} else if context.Cause(reqCtx) == coreErrs.ErrAuthTimeout {
+				err = fmt.Errorf("%w after %v: %w", coreErrs.ErrAuthTimeout, c.config.AuthTimeout, err)
+			}
+			return nil, coreErrs.ConnectError{Err: err}
+		}
+		trace.authResponseReceived(resp.StatusCode, nil)
+		if resp.StatusCode == protocol.StatusAuthOK {
+			break
+		}
+		_ = resp.Body.Close()
+		if i == len(auths)-1 {
 			_ = conn.CloseWithError(closeErrCodeProtocolError, "")
+			_ = pktConn.Close()
+			return nil, coreErrs.AuthError{StatusCode: resp.StatusCode}
 		}
-		_ = pktConn.Close()
-		return nil, coreErrs.ConnectError{Err: err}
-	}
-	if resp.StatusCode != protocol.StatusAuthOK {
-		_ = conn.CloseWithError(closeErrCodeProtocolError, "")
-		_ = pktConn.Close()
-		return nil, coreErrs.AuthError{StatusCode: resp.StatusCode}
 	}
 	// Auth OK
 	authResp := protocol.AuthResponseFromHeader(resp.Header)
@@ -129,6 +431,7 @@ func (c *clientImpl) connect(ctx context.Context) (*HandshakeInfo, error) {
 		// Server asks client to use bandwidth detection,
 		// ignore local bandwidth config and use BBR
 		congestion.UseBBR(conn)
+		trace.congestionControllerSelected("bbr", 0)
 	} else {
 		// actualTx = min(serverRx, clientTx)
 		actualTx = authResp.Rx
@@ -138,24 +441,60 @@ func (c *clientImpl) connect(ctx context.Context) (*HandshakeInfo, error) {
 		}
 		if actualTx > 0 {
 			congestion.UseBrutal(conn, actualTx)
+			trace.congestionControllerSelected("brutal", actualTx)
 		} else {
 			// We don't know our own bandwidth either, use BBR
 			congestion.UseBBR(conn)
+			trace.congestionControllerSelected("bbr", 0)
 		}
 	}
 	_ = resp.Body.Close()
 
 	c.pktConn = pktConn
 	c.conn = conn
-	if authResp.UDPEnabled {
-		c.udpSM = newUDPSessionManager(&udpIOImpl{Conn: conn})
+	c.connKeepAlive = quicConfig.KeepAlivePeriod
+	c.watchStatelessReset(conn)
+	alpn := conn.ConnectionState().TLS.NegotiatedProtocol
+	c.alpn.Store(&alpn)
+	udpEnabled := authResp.UDPEnabled && c.config.datagramsEnabled()
+	c.udpSM, c.udpIO = nil, nil
+	if udpEnabled {
+		c.udpIO = &udpIOImpl{
+			Conn:           conn,
+			datagramHint:   c.config.QUICConfig.MaxDatagramSize,
+			traffic:        &c.traffic,
+			maxParseErrors: c.config.MaxUDPParseErrors,
+		}
+		if !c.config.LazyUDP {
+			c.startUDP()
+		}
 	}
 	return &HandshakeInfo{
-		UDPEnabled: authResp.UDPEnabled,
-		Tx:         actualTx,
+		UDPEnabled:         udpEnabled,
+		Tx:                 actualTx,
+		NegotiatedProtocol: alpn,
 	}, nil
 }
 
+// startUDP sets up the UDP session manager of the current connection if it
+// is not yet. It must be called with c.m held.
+func (c *clientImpl) startUDP() {
+	if c.udpSM != nil || c.udpIO == nil {
+		return
+	}
+	c.udpSM = newUDPSessionManager(c.udpIO, c.config.UDPBufferSize, c.config.UDPSessionQueueSize)
+	c.udpIO = nil
+	if c.config.UDPBatchWindow > 0 {
+		c.udpSM.setBatchWindow(c.config.UDPBatchWindow)
+	}
+	if c.config.MaxUDPSessions > 0 {
+		c.udpSM.setMaxSessions(c.config.MaxUDPSessions, c.config.EvictUDPSessions)
+	}
+	if c.config.UDPPacingBps > 0 {
+		c.udpSM.setPacing(c.config.UDPPacingBps)
+	}
+}
+
 func (c *clientImpl) active() bool {
 	if c.conn == nil {
 		return false
@@ -168,9 +507,145 @@ func (c *clientImpl) active() bool {
 	}
 }
 
-// openStream wraps the stream with QStream, which handles Close() properly
-func (c *clientImpl) openStream() (*utils.QStream, error) {
-	stream, err := c.conn.OpenStream()
+// reconnect dials a new connection and records the outcome in healthy. c.m
+// must be held.
+func (c *clientImpl) reconnect(ctx context.Context) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	policy := c.config.ReconnectPolicy
+	if policy != nil {
+		if err := policy.wait(ctx); err != nil {
+			c.healthy.Store(false)
+			return coreErrs.ConnectError{Err: err}
+		}
+	}
+	_, err := c.connectRetrying(ctx)
+	if policy != nil {
+		policy.done(err)
+	}
+	c.healthy.Store(err == nil)
+	return err
+}
+
+// monitor checks the connection every HealthCheckInterval until the client is
+// closed. A dead connection marks the client unhealthy and is re-dialed, so
+// that the client turns healthy again once the server is reachable. Clients
+// that have never connected are left alone.
+func (c *clientImpl) monitor() {
+	ticker := time.NewTicker(c.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		c.checkHealth()
+	}
+}
+
+func (c *clientImpl) checkHealth() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.conn == nil {
+		return
+	}
+	if c.active() {
+		c.healthy.Store(true)
+		return
+	}
+	c.healthy.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.HealthCheckInterval)
+	defer cancel()
+	_ = c.reconnect(ctx)
+}
+
+func (c *clientImpl) IsHealthy() bool {
+	return c.healthy.Load()
+}
+
+func (c *clientImpl) UDPSessionCount() int {
+	c.m.Lock()
+	udpSM := c.udpSM
+	c.m.Unlock()
+	if udpSM == nil {
+		return 0
+	}
+	return udpSM.Count()
+}
+
+func (c *clientImpl) ActiveConns() []ConnInfo {
+	conns := c.conns.snapshot()
+	c.m.Lock()
+	udpSM := c.udpSM
+	c.m.Unlock()
+	if udpSM != nil {
+		conns = append(conns, udpSM.sessions()...)
+	}
+	sortConnInfos(conns)
+	return conns
+}
+
+func (c *clientImpl) SetKeepAlivePeriod(d time.Duration) error {
+	if !validKeepAlivePeriod(d) {
+		return coreErrs.ConfigError{Field: "KeepAlivePeriod", Reason: "must be between 2s and 60s"}
+	}
+	c.keepAlive.Store(int64(d))
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.active() && c.connKeepAlive != d {
+		return coreErrs.ErrKeepAliveNotLive
+	}
+	return nil
+}
+
+func (c *clientImpl) KeepAlivePeriod() time.Duration {
+	return time.Duration(c.keepAlive.Load())
+}
+
+func (c *clientImpl) Stats() Stats {
+	return c.traffic.stats()
+}
+
+func (c *clientImpl) NegotiatedProtocol() string {
+	if alpn := c.alpn.Load(); alpn != nil {
+		return *alpn
+	}
+	return ""
+}
+
+func (c *clientImpl) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.conn != nil {
+			_ = c.conn.CloseWithError(closeErrCodeOK, "")
+			_ = c.pktConn.Close()
+		}
+	})
+	return nil
+}
+
+// openStream wraps the stream with QStream, which handles Close() properly.
+// With Config.StreamOpenTimeout set, it waits for the server to allow another
+// stream, for at most that long.
+func (c *clientImpl) openStream(ctx context.Context) (*utils.QStream, error) {
+	var stream quic.Stream
+	var err error
+	if c.config.StreamOpenTimeout > 0 {
+		ctx, cancel := context.WithTimeoutCause(ctx, c.config.StreamOpenTimeout, coreErrs.ErrStreamOpenTimeout)
+		defer cancel()
+		stream, err = c.conn.OpenStreamSync(ctx)
+		if err != nil && ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+	} else {
+		stream, err = c.conn.OpenStream()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +653,15 @@ func (c *clientImpl) openStream() (*utils.QStream, error) {
 }
 
 func (c *clientImpl) TCP(addr string, ctx context.Context) (netproxy.Conn, error) {
+	return c.tcp(addr, nil, ctx)
+}
+
+func (c *clientImpl) TCPWithInitialData(addr string, data []byte, ctx context.Context) (netproxy.Conn, error) {
+	return c.tcp(addr, data, ctx)
+}
+
+// tcp opens a stream to addr and sends data, if any, along with the request.
+func (c *clientImpl) tcp(addr string, data []byte, ctx context.Context) (netproxy.Conn, error) {
 	c.m.Lock()
 	select {
 	case <-ctx.Done():
@@ -186,7 +670,7 @@ func (c *clientImpl) TCP(addr string, ctx context.Context) (netproxy.Conn, error
 	default:
 	}
 	if !c.active() {
-		_, err := c.connect(ctx)
+		err := c.reconnect(ctx)
 		if err != nil {
 			c.m.Unlock()
 			return nil, err
@@ -194,53 +678,172 @@ func (c *clientImpl) TCP(addr string, ctx context.Context) (netproxy.Conn, error
 	}
 	c.m.Unlock()
 
-	stream, err := c.openStream()
+	stream, err := c.openStream(ctx)
 	if err != nil {
-		c.handleIfConnectionClosed(err)
-		return nil, err
+		if ctx.Err() != nil || errors.Is(err, coreErrs.ErrStreamOpenTimeout) {
+			// The connection is fine, keep it.
+			return nil, err
+		}
+		return nil, c.handleIfConnectionClosed(err)
 	}
+	_ = setStreamPriority(ctx, stream.Stream)
 	if deadline, ok := ctx.Deadline(); ok {
 		stream.SetDeadline(deadline)
 		defer stream.SetDeadline(time.Time{})
 	}
-	// Send request
-	err = protocol.WriteTCPRequest(stream, addr)
-	if err != nil {
-		stream.Close()
-		c.handleIfConnectionClosed(err)
-		return nil, err
-	}
 	if c.config.FastOpen {
-		// Don't wait for the response when fast open is enabled.
-		// Return the connection immediately, defer the response handling
-		// to the first Read() call.
-		return &tcpConn{
+		// Neither send the request nor wait for the response when fast
+		// open is enabled. Like data in the SYN of TCP Fast Open, the
+		// request goes out with the first Write, or on Flush, and the
+		// response is handled by the first Read() call.
+		var request bytes.Buffer
+		_ = protocol.WriteTCPRequest(&request, addr)
+		conn := &tcpConn{
 			Orig:             stream,
 			PseudoLocalAddr:  c.conn.LocalAddr(),
 			PseudoRemoteAddr: c.conn.RemoteAddr(),
-			Established:      false,
-		}, nil
+			request:          request.Bytes(),
+			traffic:          &c.traffic,
+			addr:             addr,
+			opened:           time.Now(),
+			registry:         &c.conns,
+		}
+		c.conns.add(conn)
+		if len(data) > 0 {
+			// The request held back goes out with data.
+			if _, err := conn.Write(data); err != nil {
+				_ = conn.Close()
+				return nil, c.handleIfConnectionClosed(err)
+			}
+		}
+		return conn, nil
 	}
+	// Send request, with data in the same write
+	var request bytes.Buffer
+	_ = protocol.WriteTCPRequest(&request, addr)
+	request.Write(data)
+	_, err = stream.Write(request.Bytes())
+	if err != nil {
+		stream.Close()
+		return nil, c.handleIfConnectionClosed(err)
+	}
+	c.traffic.addTCPTx(len(data))
 	// Read response
 	ok, msg, err := protocol.ReadTCPResponse(stream)
 	if err != nil {
 		_ = stream.Close()
-		c.handleIfConnectionClosed(err)
-		return nil, err
+		return nil, c.handleIfConnectionClosed(err)
 	}
 	if !ok {
 		_ = stream.Close()
 		return nil, coreErrs.DialError{Message: "from remote: " + msg}
 	}
-	return &tcpConn{
+	conn := &tcpConn{
 		Orig:             stream,
 		PseudoLocalAddr:  c.conn.LocalAddr(),
 		PseudoRemoteAddr: c.conn.RemoteAddr(),
-		Established:      true,
-	}, nil
+		traffic:          &c.traffic,
+		addr:             addr,
+		opened:           time.Now(),
+		registry:         &c.conns,
+	}
+	conn.established.Store(true)
+	c.conns.add(conn)
+	return conn, nil
+}
+
+func (c *clientImpl) AcceptStream(ctx context.Context) (netproxy.Conn, error) {
+	if !c.config.AcceptStreams {
+		return nil, errAcceptStreamsDisabled
+	}
+	c.m.Lock()
+	if !c.active() {
+		err := c.reconnect(ctx)
+		if err != nil {
+			c.m.Unlock()
+			return nil, err
+		}
+	}
+	conn := c.conn
+	c.m.Unlock()
+
+	for {
+		s, err := conn.AcceptStream(ctx)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, c.handleIfConnectionClosed(err)
+		}
+		stream := &utils.QStream{Stream: s}
+		target, err := readServerRequest(ctx, stream)
+		if err != nil {
+			// A bad stream must not stop the caller from accepting the
+			// next one.
+			_ = stream.Close()
+			continue
+		}
+		accepted := &acceptedConn{
+			tcpConn: &tcpConn{
+				Orig:             stream,
+				PseudoLocalAddr:  conn.LocalAddr(),
+				PseudoRemoteAddr: conn.RemoteAddr(),
+				traffic:          &c.traffic,
+				addr:             target,
+				opened:           time.Now(),
+				registry:         &c.conns,
+			},
+			target: target,
+		}
+		accepted.established.Store(true)
+		c.conns.add(accepted.tcpConn)
+		return accepted, nil
+	}
+}
+
+// readServerRequest reads the TCP request the server starts its streams with
+// and accepts it.
+func readServerRequest(ctx context.Context, stream *utils.QStream) (string, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+		defer stream.SetDeadline(time.Time{})
+	}
+	frameType, err := quicvarint.Read(quicvarint.NewReader(stream))
+	if err != nil {
+		return "", err
+	}
+	if frameType != protocol.FrameTypeTCPRequest {
+		return "", coreErrs.ProtocolError{Message: "unexpected frame type on server stream"}
+	}
+	target, err := protocol.ReadTCPRequest(stream)
+	if err != nil {
+		return "", err
+	}
+	if err := protocol.WriteTCPResponse(stream, true, ""); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// acceptedConn is a stream opened by the server.
+type acceptedConn struct {
+	*tcpConn
+	target string
+}
+
+// Target returns the address the server asked the stream to be relayed to.
+func (c *acceptedConn) Target() string {
+	return c.target
 }
 
 func (c *clientImpl) UDP(addr string, ctx context.Context) (netproxy.Conn, error) {
+	return c.UDPWithKey(addr, "", ctx)
+}
+
+func (c *clientImpl) UDPWithKey(addr string, key string, ctx context.Context) (netproxy.Conn, error) {
+	if !c.config.datagramsEnabled() {
+		return nil, errUDPDisabled
+	}
 	c.m.Lock()
 	select {
 	case <-ctx.Done():
@@ -249,31 +852,77 @@ func (c *clientImpl) UDP(addr string, ctx context.Context) (netproxy.Conn, error
 	default:
 	}
 	if !c.active() {
-		_, err := c.connect(ctx)
+		err := c.reconnect(ctx)
 		if err != nil {
 			c.m.Unlock()
 			return nil, err
 		}
 	}
+	c.startUDP()
+	udpSM := c.udpSM
 	c.m.Unlock()
 
-	if c.udpSM == nil {
+	if udpSM == nil {
 		return nil, coreErrs.DialError{Message: "UDP not enabled"}
 	}
-	conn, err := c.udpSM.NewUDP(addr)
-	c.handleIfConnectionClosed(err)
-	return conn, err
+	conn, err := udpSM.NewUDPWithKey(addr, key)
+	if errors.Is(err, errUDPKeyBound) || errors.Is(err, coreErrs.ErrTooManyUDPSessions) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, c.handleIfConnectionClosed(err)
+	}
+	return conn, nil
 }
 
-// wrapIfConnectionClosed checks if the error returned by quic-go
+// handleIfConnectionClosed checks if the error returned by quic-go
 // indicates that the QUIC connection has been permanently closed,
-// and if so, wraps the error with coreErrs.ClosedError.
+// and if so, closes the connection and wraps the error with
+// coreErrs.ClosedError, which carries the close reason when quic-go
+// reports one. Other errors are returned as is.
 // PITFALL: sometimes quic-go has "internal errors" that are not net.Error,
 // but we still need to treat them as ClosedError.
-func (c *clientImpl) handleIfConnectionClosed(err error) {
+func (c *clientImpl) handleIfConnectionClosed(err error) error {
 	if err == nil {
+		return nil
+	}
+	defer c.closeOnError(err)
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		return coreErrs.ClosedError{
+			Err:     err,
+			HasCode: true,
+			Code:    uint64(appErr.ErrorCode),
+			Message: appErr.ErrorMessage,
+			Remote:  appErr.Remote,
+		}
+	}
+	var idleErr *quic.IdleTimeoutError
+	if errors.As(err, &idleErr) {
+		return coreErrs.ClosedError{Err: err}
+	}
+	var resetErr *quic.StatelessResetError
+	if errors.As(err, &resetErr) {
+		return coreErrs.ClosedError{Err: err, Remote: true, StatelessReset: true}
+	}
+	return err
+}
+
+// watchStatelessReset calls Config.OnStatelessReset once conn is killed by a
+// stateless reset.
+func (c *clientImpl) watchStatelessReset(conn quic.Connection) {
+	if c.config.OnStatelessReset == nil {
 		return
 	}
+	context.AfterFunc(conn.Context(), func() {
+		var resetErr *quic.StatelessResetError
+		if errors.As(context.Cause(conn.Context()), &resetErr) {
+			c.config.OnStatelessReset()
+		}
+	})
+}
+
+func (c *clientImpl) closeOnError(err error) {
 	if _, ok := err.(coreErrs.ClosedError); ok {
 		c.conn.CloseWithError(closeErrCodeProtocolError, "")
 		c.pktConn.Close()
@@ -288,43 +937,263 @@ type tcpConn struct {
 	Orig             *utils.QStream
 	PseudoLocalAddr  net.Addr
 	PseudoRemoteAddr net.Addr
-	Established      bool
+	// established is set once the server accepted the TCP request.
+	established atomic.Bool
+
+	// request is the TCP request held back by fast open until the first
+	// write. It is protected by muRequest and set to nil once sent.
+	muRequest sync.Mutex
+	request   []byte
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    atomic.Bool
+
+	// writeDeadline is the write deadline set by the user, in Unix
+	// nanoseconds, or 0, for TryWrite to restore.
+	writeDeadline atomic.Int64
+
+	// traffic counts the payload of the stream in the Stats of the client.
+	traffic *trafficCounters
+
+	// addr is the target of the stream and opened when it was opened, for
+	// ActiveConns. registry lists the stream until it is closed.
+	addr     string
+	opened   time.Time
+	registry *connRegistry
+}
+
+// establish sends the request and reads the response deferred by fast open,
+// if any.
+func (c *tcpConn) establish() error {
+	if c.established.Load() {
+		return nil
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	ok, msg, err := protocol.ReadTCPResponse(c.Orig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return coreErrs.DialError{Message: msg}
+	}
+	c.established.Store(true)
+	return nil
+}
+
+// IsEstablished reports whether the server confirmed that it reached the
+// target. With fast open, it is false until the response deferred to the
+// first Read arrived: the data written so far may or may not have reached the
+// target, so it is not safe to send again elsewhere unless it is idempotent.
+func (c *tcpConn) IsEstablished() bool {
+	return c.established.Load()
 }
 
 func (c *tcpConn) Read(b []byte) (n int, err error) {
-	if !c.Established {
-		// Read response
-		ok, msg, err := protocol.ReadTCPResponse(c.Orig)
-		if err != nil {
-			return 0, err
+	if err := c.establish(); err != nil {
+		return 0, err
+	}
+	n, err = c.Orig.Read(b)
+	c.traffic.addTCPRx(n)
+	return n, err
+}
+
+func (c *tcpConn) Write(b []byte) (n int, err error) {
+	c.muRequest.Lock()
+	if c.request == nil {
+		c.muRequest.Unlock()
+		n, err = c.Orig.Write(b)
+		c.traffic.addTCPTx(n)
+		return n, err
+	}
+	defer c.muRequest.Unlock()
+	// Send the request held back by fast open and the first payload in one
+	// go.
+	request := c.request
+	n, err = c.Orig.Write(append(request, b...))
+	if n < len(request) {
+		// Keep what did not make it, e.g. at a write deadline, for the next
+		// write.
+		c.request = request[n:]
+		return 0, err
+	}
+	c.request = nil
+	c.traffic.addTCPTx(n - len(request))
+	return n - len(request), err
+}
+
+// tryWriteWait is how long TryWrite lets quic-go take the data.
+const tryWriteWait = time.Millisecond
+
+// TryWrite is like Write, but does not wait for flow or congestion control:
+// it returns after about a millisecond with what the stream took by then and,
+// if that is not all of b, os.ErrDeadlineExceeded, so that a latency-sensitive
+// caller can shed or reschedule the rest instead of stalling. The write
+// deadline still applies if it is earlier. It must not run concurrently with
+// Write or SetWriteDeadline.
+func (c *tcpConn) TryWrite(b []byte) (n int, err error) {
+	deadline := time.Now().Add(tryWriteWait)
+	var userDeadline time.Time
+	if d := c.writeDeadline.Load(); d != 0 {
+		userDeadline = time.Unix(0, d)
+		if userDeadline.Before(deadline) {
+			deadline = userDeadline
 		}
-		if !ok {
-			return 0, coreErrs.DialError{Message: msg}
+	}
+	if err := c.Orig.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+	defer c.Orig.SetWriteDeadline(userDeadline)
+	return c.Write(b)
+}
+
+// Flush sends the TCP request held back by fast open if no Write sent it yet,
+// so that the server connects to the target before the client has data to
+// send. Read and CloseWrite do the same. Written data is never held back:
+// quic-go sends it as soon as flow and congestion control allow.
+func (c *tcpConn) Flush() error {
+	c.muRequest.Lock()
+	defer c.muRequest.Unlock()
+	if c.request == nil {
+		return nil
+	}
+	n, err := c.Orig.Write(c.request)
+	if err != nil {
+		c.request = c.request[n:]
+		return err
+	}
+	c.request = nil
+	return nil
+}
+
+// relayBufferSize is the size of the pooled buffer used by ReadFrom and
+// WriteTo, the same as io.Copy uses.
+const relayBufferSize = 32 << 10
+
+// ReadFrom implements io.ReaderFrom, copying from r to the stream through a
+// pooled buffer. The write deadline of the stream applies to every write.
+func (c *tcpConn) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := pool.Get(relayBufferSize)
+	defer buf.Put()
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := c.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
 		}
-		c.Established = true
 	}
-	return c.Orig.Read(b)
 }
 
-func (c *tcpConn) Write(b []byte) (n int, err error) {
-	return c.Orig.Write(b)
+// WriteTo implements io.WriterTo, copying from the stream to w through a
+// pooled buffer after reading the response deferred by fast open. The read
+// deadline of the stream applies to every read.
+func (c *tcpConn) WriteTo(w io.Writer) (n int64, err error) {
+	if err := c.establish(); err != nil {
+		return 0, err
+	}
+	buf := pool.Get(relayBufferSize)
+	defer buf.Put()
+	for {
+		nr, rerr := c.Orig.Read(buf)
+		c.traffic.addTCPRx(nr)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+			if nw < nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
 }
 
+// Close closes the stream once. It is safe to call concurrently; later calls
+// return the result of the first one.
 func (c *tcpConn) Close() error {
-	return c.Orig.Close()
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+		c.registry.remove(c)
+		c.closeErr = c.Orig.Close()
+	})
+	return c.closeErr
+}
+
+// Reset aborts the stream in both directions with the error code code, so
+// that the server sees a RESET_STREAM and frees the connection to the target
+// at once, rather than the FIN of Close. A request still held back by fast
+// open is dropped. Reset after Close or Reset does nothing.
+func (c *tcpConn) Reset(code uint64) error {
+	c.closeOnce.Do(func() {
+		c.closed.Store(true)
+		c.registry.remove(c)
+		c.muRequest.Lock()
+		c.request = nil
+		c.muRequest.Unlock()
+		c.Orig.CancelRead(quic.StreamErrorCode(code))
+		c.Orig.CancelWrite(quic.StreamErrorCode(code))
+	})
+	return nil
 }
 
 func (c *tcpConn) CloseWrite() error {
+	if c.closed.Load() {
+		return nil
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
 	// quic-go's default close only closes the write side
 	// for more info, see comments in utils.QStream struct
 	return c.Orig.Stream.Close()
 }
 
+var (
+	_ netproxy.CloseWriter = (*tcpConn)(nil)
+	_ net.Conn             = (*tcpConn)(nil)
+)
+
 func (c *tcpConn) CloseRead() error {
+	if c.closed.Load() {
+		return nil
+	}
 	c.Orig.Stream.CancelRead(0)
 	return nil
 }
 
+// SetReadBuffer exists so that callers asserting for it, as they would on a
+// *net.TCPConn, keep working. It is a no-op: quic-go does not allow resizing the
+// flow control window of an open stream. The effective receive window is set
+// per client by QUICConfig.InitialStreamReceiveWindow and
+// QUICConfig.MaxStreamReceiveWindow.
+func (c *tcpConn) SetReadBuffer(bytes int) error {
+	return nil
+}
+
+// SetWriteBuffer is a no-op, see SetReadBuffer. How much may be sent is decided
+// by the receive window of the server and the congestion controller.
+func (c *tcpConn) SetWriteBuffer(bytes int) error {
+	return nil
+}
+
 func (c *tcpConn) LocalAddr() net.Addr {
 	return c.PseudoLocalAddr
 }
@@ -333,7 +1202,12 @@ func (c *tcpConn) RemoteAddr() net.Addr {
 	return c.PseudoRemoteAddr
 }
 
+func (c *tcpConn) IsStream() bool {
+	return true
+}
+
 func (c *tcpConn) SetDeadline(t time.Time) error {
+	c.storeWriteDeadline(t)
 	return c.Orig.SetDeadline(t)
 }
 
@@ -342,11 +1216,45 @@ func (c *tcpConn) SetReadDeadline(t time.Time) error {
 }
 
 func (c *tcpConn) SetWriteDeadline(t time.Time) error {
+	c.storeWriteDeadline(t)
 	return c.Orig.SetWriteDeadline(t)
 }
 
+func (c *tcpConn) storeWriteDeadline(t time.Time) {
+	if t.IsZero() {
+		c.writeDeadline.Store(0)
+	} else {
+		c.writeDeadline.Store(t.UnixNano())
+	}
+}
+
+// datagramConn is the part of quic.Connection used by udpIOImpl.
+type datagramConn interface {
+	ReceiveDatagram(context.Context) ([]byte, error)
+	SendDatagram([]byte) error
+}
+
+// maxUDPFragments is the largest number of datagrams a UDP message can be
+// split into, see frag.FragUDPMessage.
+const maxUDPFragments = 255
+
 type udpIOImpl struct {
-	Conn quic.Connection
+	Conn datagramConn
+	// datagramHint is QUICConfig.MaxDatagramSize.
+	datagramHint int
+
+	// maxMessage is the largest message the connection can carry, known once
+	// a message did not fit a single datagram. Zero means unknown.
+	maxMessage atomic.Int64
+	warnOnce   sync.Once
+
+	// traffic counts the payload of the messages in the Stats of the client.
+	traffic *trafficCounters
+
+	// maxParseErrors is Config.MaxUDPParseErrors. parseErrors counts the
+	// invalid messages received in a row; only ReceiveMessage uses it.
+	maxParseErrors int
+	parseErrors    int
 }
 
 func (io *udpIOImpl) ReceiveMessage() (*protocol.UDPMessage, error) {
@@ -358,18 +1266,64 @@ func (io *udpIOImpl) ReceiveMessage() (*protocol.UDPMessage, error) {
 		}
 		udpMsg, err := protocol.ParseUDPMessage(msg)
 		if err != nil {
-			// Invalid message, this is fine - just wait for the next
+			io.traffic.addUDPParseError()
+			io.parseErrors++
+			if io.maxParseErrors > 0 && io.parseErrors >= io.maxParseErrors {
+				return nil, fmt.Errorf("hysteria2: %d invalid UDP messages in a row: %w", io.parseErrors, err)
+			}
+			// Invalid message, drop it and wait for the next
 			continue
 		}
+		io.parseErrors = 0
+		io.traffic.addUDPRx(len(udpMsg.Data))
 		return udpMsg, nil
 	}
 }
 
 func (io *udpIOImpl) SendMessage(buf []byte, msg *protocol.UDPMessage) error {
+	buf = buf[:io.messageLimit(len(buf), msg.HeaderSize())]
 	msgN := msg.Serialize(buf)
 	if msgN < 0 {
 		// Message larger than buffer, silent drop
 		return nil
 	}
-	return io.Conn.SendDatagram(buf[:msgN])
+	err := io.Conn.SendDatagram(buf[:msgN])
+	if err == nil {
+		io.traffic.addUDPTx(len(msg.Data))
+	}
+	var errTooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &errTooLarge) {
+		io.clampBuffer(len(buf), int(errTooLarge.MaxDataLen), msg.HeaderSize())
+	}
+	return err
+}
+
+// messageLimit returns the size of the largest message with a header of
+// headerSize bytes that is sent from a buffer of bufSize bytes: larger ones
+// could not be carried by the connection even in fragments and are dropped.
+func (io *udpIOImpl) messageLimit(bufSize, headerSize int) int {
+	limit := bufSize
+	if l := int(io.maxMessage.Load()); l > 0 && l < limit {
+		limit = l
+	}
+	if io.datagramHint > headerSize {
+		limit = min(limit, headerSize+maxUDPFragments*(io.datagramHint-headerSize))
+	}
+	return limit
+}
+
+// clampBuffer limits the send buffer to the largest message that still fits
+// the datagrams of the connection once fragmented.
+func (io *udpIOImpl) clampBuffer(bufSize, maxDataLen, headerSize int) {
+	if maxDataLen <= headerSize {
+		return
+	}
+	limit := headerSize + maxUDPFragments*(maxDataLen-headerSize)
+	if bufSize <= limit {
+		return
+	}
+	io.maxMessage.Store(int64(limit))
+	io.warnOnce.Do(func() {
+		logger.Logger.Warnf("hysteria2: UDPBufferSize %d exceeds what the connection can carry, using %d", bufSize, limit)
+	})
 }
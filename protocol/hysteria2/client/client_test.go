@@ -0,0 +1,467 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/utils"
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/quicvarint"
+)
+
+func waitFor(t *testing.T, cond func() bool, what string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthMonitor(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr := serverConn.LocalAddr().(*net.UDPAddr)
+	server := startAuthServer(t, serverConn, nil)
+
+	c, err := NewClient(&Config{
+		ConnFactory:         &UdpConnFactory{},
+		ServerAddr:          serverAddr,
+		Auth:                "secret",
+		TLSConfig:           TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		HealthCheckInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	impl := c.(*clientImpl)
+	if !c.IsHealthy() {
+		t.Fatal("a new client should be healthy")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	impl.m.Lock()
+	err = impl.reconnect(ctx)
+	impl.m.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server goes away: the monitor notices without any TCP or UDP call.
+	server.Close()
+	serverConn.Close()
+	waitFor(t, func() bool { return !c.IsHealthy() }, "the client to turn unhealthy")
+
+	// The server comes back on the same address: the monitor re-dials.
+	serverConn, err = net.ListenUDP("udp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server = startAuthServer(t, serverConn, nil)
+	defer server.Close()
+	waitFor(t, c.IsHealthy, "the client to turn healthy again")
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.TCP("1.1.1.1:80", context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("TCP() after Close() = %v, want net.ErrClosed", err)
+	}
+}
+
+// pipeStream is a quic.Stream backed by one end of a net.Pipe.
+type pipeStream struct {
+	quic.Stream
+	conn net.Conn
+}
+
+func (s *pipeStream) Read(b []byte) (int, error)         { return s.conn.Read(b) }
+func (s *pipeStream) Write(b []byte) (int, error)        { return s.conn.Write(b) }
+func (s *pipeStream) Close() error                       { return s.conn.Close() }
+func (s *pipeStream) CancelRead(quic.StreamErrorCode)    {}
+func (s *pipeStream) SetDeadline(t time.Time) error      { return s.conn.SetDeadline(t) }
+func (s *pipeStream) SetReadDeadline(t time.Time) error  { return s.conn.SetReadDeadline(t) }
+func (s *pipeStream) SetWriteDeadline(t time.Time) error { return s.conn.SetWriteDeadline(t) }
+
+// acceptQUICConn hands out the streams sent on its channel as server streams.
+type acceptQUICConn struct {
+	fakeQUICConn
+	streams chan quic.Stream
+}
+
+func (c *acceptQUICConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	select {
+	case s := <-c.streams:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *acceptQUICConn) LocalAddr() net.Addr  { return &net.UDPAddr{} }
+func (c *acceptQUICConn) RemoteAddr() net.Addr { return &net.UDPAddr{} }
+
+func TestAcceptStream(t *testing.T) {
+	qc := &acceptQUICConn{streams: make(chan quic.Stream, 2)}
+	c := &clientImpl{config: &Config{}, conn: qc}
+	if _, err := c.AcceptStream(context.Background()); !errors.Is(err, errAcceptStreamsDisabled) {
+		t.Fatalf("AcceptStream() = %v, want errAcceptStreamsDisabled", err)
+	}
+	c.config.AcceptStreams = true
+
+	// A stream that does not start with a TCP request is dropped, the next
+	// one is accepted.
+	bad, badServer := net.Pipe()
+	qc.streams <- &pipeStream{conn: bad}
+	go badServer.Write(quicvarint.Append(nil, 0x402))
+	good, server := net.Pipe()
+	defer server.Close()
+	qc.streams <- &pipeStream{conn: good}
+	go func() {
+		if err := protocol.WriteTCPRequest(server, "10.0.0.1:22"); err != nil {
+			t.Error(err)
+			return
+		}
+		ok, _, err := protocol.ReadTCPResponse(server)
+		if err != nil || !ok {
+			t.Errorf("ReadTCPResponse() = %v, %v, want ok", ok, err)
+			return
+		}
+		_, _ = server.Write([]byte("ping"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := c.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.(interface{ Target() string }).Target(); got != "10.0.0.1:22" {
+		t.Errorf("Target() = %v, want 10.0.0.1:22", got)
+	}
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Read() = %q, %v, want ping", buf, err)
+	}
+	if _, err := badServer.Read(buf); err == nil {
+		t.Error("the bad stream should have been closed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.AcceptStream(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcceptStream() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestTCPConnCopy(t *testing.T) {
+	// WriteTo reads the response deferred by fast open first.
+	client, server := net.Pipe()
+	c := &tcpConn{Orig: &utils.QStream{Stream: &pipeStream{conn: client}}}
+	go func() {
+		_ = protocol.WriteTCPResponse(server, true, "")
+		_, _ = server.Write([]byte("hello"))
+		_ = server.Close()
+	}()
+	var got bytes.Buffer
+	if n, err := c.WriteTo(&got); err != nil || n != 5 || got.String() != "hello" {
+		t.Fatalf("WriteTo() = %v, %v, %q, want 5 bytes of hello", n, err, got.String())
+	}
+
+	// A rejected fast open dial fails WriteTo.
+	client, server = net.Pipe()
+	c = &tcpConn{Orig: &utils.QStream{Stream: &pipeStream{conn: client}}}
+	go protocol.WriteTCPResponse(server, false, "refused")
+	var dialErr coreErrs.DialError
+	if _, err := c.WriteTo(io.Discard); !errors.As(err, &dialErr) {
+		t.Errorf("WriteTo() = %v, want a DialError", err)
+	}
+
+	// ReadFrom copies until EOF and honors the write deadline.
+	client, server = net.Pipe()
+	c = &tcpConn{Orig: &utils.QStream{Stream: &pipeStream{conn: client}}}
+	c.established.Store(true)
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		done <- b
+	}()
+	payload := bytes.Repeat([]byte("x"), 3*relayBufferSize+1)
+	if n, err := c.ReadFrom(bytes.NewReader(payload)); err != nil || n != int64(len(payload)) {
+		t.Fatalf("ReadFrom() = %v, %v, want %v", n, err, len(payload))
+	}
+	_ = c.Close()
+	if b := <-done; !bytes.Equal(b, payload) {
+		t.Errorf("server read %v bytes, want %v", len(b), len(payload))
+	}
+
+	client, _ = net.Pipe()
+	c = &tcpConn{Orig: &utils.QStream{Stream: &pipeStream{conn: client}}}
+	c.established.Store(true)
+	_ = c.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.ReadFrom(bytes.NewReader(payload)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom() = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+// creditlessQUICConn never has stream credit for the client.
+type creditlessQUICConn struct {
+	fakeQUICConn
+	closed bool
+}
+
+func (c *creditlessQUICConn) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *creditlessQUICConn) CloseWithError(quic.ApplicationErrorCode, string) error {
+	c.closed = true
+	return nil
+}
+
+// cancelStream records how it was torn down.
+type cancelStream struct {
+	quic.Stream
+	readCode, writeCode quic.StreamErrorCode
+	canceled, closed    int
+}
+
+func (s *cancelStream) CancelRead(code quic.StreamErrorCode) {
+	s.readCode = code
+	s.canceled++
+}
+
+func (s *cancelStream) CancelWrite(code quic.StreamErrorCode) {
+	s.writeCode = code
+	s.canceled++
+}
+
+func (s *cancelStream) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestTCPConnReset(t *testing.T) {
+	stream := &cancelStream{}
+	c := &tcpConn{Orig: &utils.QStream{Stream: stream}, request: []byte("request")}
+	if err := c.Reset(42); err != nil {
+		t.Fatal(err)
+	}
+	if stream.readCode != 42 || stream.writeCode != 42 {
+		t.Errorf("canceled with read code %v and write code %v, want 42", stream.readCode, stream.writeCode)
+	}
+	if c.request != nil {
+		t.Error("the fast open request is still pending after Reset()")
+	}
+	// The stream is gone: neither a later Close nor Reset touch it again.
+	_ = c.Close()
+	_ = c.Reset(7)
+	if stream.closed != 0 || stream.canceled != 2 {
+		t.Errorf("stream closed %v times and canceled %v times after Reset(), want 0 and 2", stream.closed, stream.canceled)
+	}
+}
+
+func TestStreamOpenTimeout(t *testing.T) {
+	qc := &creditlessQUICConn{}
+	c := &clientImpl{config: &Config{StreamOpenTimeout: 20 * time.Millisecond}, conn: qc}
+	_, err := c.TCP("1.1.1.1:80", context.Background())
+	if !errors.Is(err, coreErrs.ErrStreamOpenTimeout) {
+		t.Fatalf("TCP() = %v, want ErrStreamOpenTimeout", err)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("TCP() = %v, want a net.Error timeout", err)
+	}
+
+	// The deadline of the dial context is kept.
+	c.config.StreamOpenTimeout = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.TCP("1.1.1.1:80", ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("TCP() = %v, want context.DeadlineExceeded", err)
+	}
+	if qc.closed {
+		t.Error("running out of stream credit closed the connection")
+	}
+}
+
+// shortStream takes up to window bytes, then fails writes like a write
+// deadline would while flow control holds the stream back.
+type shortStream struct {
+	quic.Stream
+	window  int
+	written []byte
+}
+
+func (s *shortStream) Write(b []byte) (int, error) {
+	n := min(len(b), s.window)
+	s.window -= n
+	s.written = append(s.written, b[:n]...)
+	if n < len(b) {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, nil
+}
+
+func (s *shortStream) SetWriteDeadline(time.Time) error { return nil }
+
+func TestTCPConnTryWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := &tcpConn{Orig: &utils.QStream{Stream: &pipeStream{conn: client}}}
+	_ = c.SetWriteDeadline(time.Now().Add(time.Minute))
+
+	// Nobody reads: TryWrite gives up at once.
+	start := time.Now()
+	if n, err := c.TryWrite([]byte("ping")); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("TryWrite() = %v, %v, want os.ErrDeadlineExceeded", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TryWrite() took %v", elapsed)
+	}
+	// The write deadline of the user is back.
+	go func() {
+		if n, err := c.Write([]byte("pong")); n != 4 || err != nil {
+			t.Errorf("Write() after TryWrite() = %v, %v", n, err)
+		}
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("read %q, %v, want pong", buf, err)
+	}
+
+	// A fast open request cut short is finished, not sent again.
+	stream := &shortStream{window: 3}
+	c = &tcpConn{Orig: &utils.QStream{Stream: stream}, request: []byte("request")}
+	if n, err := c.TryWrite([]byte("ping")); n != 0 || err == nil {
+		t.Errorf("TryWrite() = %v, %v, want 0 and an error", n, err)
+	}
+	stream.window = 100
+	if n, err := c.TryWrite([]byte("ping")); n != 4 || err != nil {
+		t.Errorf("TryWrite() = %v, %v, want 4", n, err)
+	}
+	if string(stream.written) != "requestping" {
+		t.Errorf("wrote %q, want requestping", stream.written)
+	}
+}
+
+// openQUICConn opens the streams sent on its channel.
+type openQUICConn struct {
+	acceptQUICConn
+}
+
+func (c *openQUICConn) OpenStream() (quic.Stream, error) {
+	return <-c.streams, nil
+}
+
+func TestTCPWithInitialData(t *testing.T) {
+	for _, fastOpen := range []bool{false, true} {
+		qc := &openQUICConn{acceptQUICConn{streams: make(chan quic.Stream, 1)}}
+		c := &clientImpl{config: &Config{FastOpen: fastOpen}, conn: qc}
+		client, server := net.Pipe()
+		qc.streams <- &pipeStream{conn: client}
+		go func() {
+			buf := make([]byte, 1024)
+			n, _ := server.Read(buf)
+			// The request is padded at random: parse it.
+			r := bytes.NewReader(buf[:n])
+			_, _ = quicvarint.Read(r)
+			addr, err := protocol.ReadTCPRequest(r)
+			if rest, _ := io.ReadAll(r); err != nil || addr != "10.0.0.1:80" || string(rest) != "GET /" {
+				t.Errorf("FastOpen %v: first write = %q, want the request to 10.0.0.1:80, then GET /", fastOpen, buf[:n])
+			}
+			_ = protocol.WriteTCPResponse(server, true, "")
+			_, _ = server.Write([]byte("200"))
+		}()
+		conn, err := c.TCPWithInitialData("10.0.0.1:80", []byte("GET /"), context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 3)
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != "200" {
+			t.Errorf("FastOpen %v: Read() = %q, %v, want 200", fastOpen, got, err)
+		}
+		if stats := c.Stats(); stats.TCPTx != 5 {
+			t.Errorf("FastOpen %v: TCPTx = %v, want the initial data", fastOpen, stats.TCPTx)
+		}
+		_ = conn.Close()
+		_ = server.Close()
+	}
+}
+
+func TestTCPConnFastOpenRequest(t *testing.T) {
+	var request bytes.Buffer
+	_ = protocol.WriteTCPRequest(&request, "10.0.0.1:22")
+	newConn := func() (*tcpConn, net.Conn) {
+		client, server := net.Pipe()
+		return &tcpConn{Orig: &utils.QStream{Stream: &pipeStream{conn: client}}, request: bytes.Clone(request.Bytes())}, server
+	}
+	buf := make([]byte, 1024)
+
+	// The request goes out with the first write.
+	c, server := newConn()
+	go func() {
+		if n, err := c.Write([]byte("ping")); n != 4 || err != nil {
+			t.Errorf("Write() = %v, %v, want 4", n, err)
+		}
+		_, _ = c.Write([]byte("!"))
+	}()
+	n, _ := server.Read(buf)
+	if want := request.String() + "ping"; string(buf[:n]) != want {
+		t.Errorf("first write = %q, want %q", buf[:n], want)
+	}
+	if n, _ := server.Read(buf); string(buf[:n]) != "!" {
+		t.Errorf("second write = %q, want !", buf[:n])
+	}
+
+	// Flush sends it on its own, once.
+	c, server = newConn()
+	go func() {
+		_ = c.Flush()
+		_ = c.Flush()
+		_, _ = c.Write([]byte("ping"))
+	}()
+	if n, _ := server.Read(buf); string(buf[:n]) != request.String() {
+		t.Errorf("Flush() sent %q, want the request", buf[:n])
+	}
+	if n, _ := server.Read(buf); string(buf[:n]) != "ping" {
+		t.Errorf("write after Flush() = %q, want ping", buf[:n])
+	}
+
+	// Reading first sends it before waiting for the response.
+	c, server = newConn()
+	go func() {
+		n, _ := server.Read(buf)
+		if string(buf[:n]) != request.String() {
+			t.Errorf("Read() sent %q, want the request", buf[:n])
+		}
+		_ = protocol.WriteTCPResponse(server, true, "")
+		_, _ = server.Write([]byte("banner"))
+	}()
+	if c.IsEstablished() {
+		t.Error("IsEstablished() = true before the response")
+	}
+	got := make([]byte, 6)
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "banner" {
+		t.Errorf("Read() = %q, %v, want banner", got, err)
+	}
+	if !c.IsEstablished() {
+		t.Error("IsEstablished() = false after the response")
+	}
+}
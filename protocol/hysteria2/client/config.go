@@ -2,12 +2,23 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"net"
+	"net/http"
+	"syscall"
 	"time"
 
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pkg/logger"
+	"github.com/daeuniverse/outbound/pkg/quicpacket"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/errors"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/pmtud"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+	"github.com/daeuniverse/outbound/protocol/tuic/common"
+
+	"github.com/daeuniverse/quic-go"
 )
 
 const (
@@ -15,6 +26,16 @@ const (
 	defaultConnReceiveWindow   = defaultStreamReceiveWindow * 5 / 2 // 20MB
 	defaultMaxIdleTimeout      = 30 * time.Second
 	defaultKeepAlivePeriod     = 10 * time.Second
+	defaultHandshakeRetryDelay = 250 * time.Millisecond
+
+	minUDPBufferSize = 1200
+	// maxUDPBufferSize fits the largest possible UDP payload and the message
+	// header. Anything above that could never be used.
+	maxUDPBufferSize = 65535 + 512
+
+	// maxAuthFallbacks caps Config.AuthFallbacks, so that a rejected client
+	// does not keep a server busy with guesses.
+	maxAuthFallbacks = 3
 )
 
 type Config struct {
@@ -26,10 +47,140 @@ type Config struct {
 	BandwidthConfig BandwidthConfig
 	UDPHopInterval  time.Duration
 	FastOpen        bool
+	// AuthTimestamp adds a monotonic timestamp and a random nonce to the auth
+	// request, so that servers supporting it can reject replayed requests.
+	// Servers that do not know about it ignore the extra headers.
+	AuthTimestamp bool
+	// UDPBufferSize is the size of the buffer UDP messages are serialized into
+	// before being sent, which bounds the largest UDP packet that can be sent:
+	// larger ones are dropped. Messages that fit the buffer but not the QUIC
+	// datagram are fragmented. Zero means protocol.MaxUDPSize; values outside
+	// [1200, 66047] are clamped with a warning. Once the max datagram size of
+	// the connection is known, the buffer is further clamped, with a warning,
+	// to the largest message the connection can carry in fragments.
+	UDPBufferSize int
+	// UDPSessionQueueSize is the per-session buffer budget: how many received
+	// UDP messages each session holds for its reader before dropping new ones.
+	// Lower it for workloads with many short sessions, e.g. DNS. Zero means
+	// 1024.
+	UDPSessionQueueSize int
+	// MaxUDPSessions, if positive, caps the number of UDP sessions open at
+	// once. At the cap, UDP fails with errors.ErrTooManyUDPSessions, or,
+	// with EvictUDPSessions, closes the least recently used session to make
+	// room. Zero means no cap.
+	MaxUDPSessions int
+	// EvictUDPSessions, see MaxUDPSessions.
+	EvictUDPSessions bool
+	// UDPBatchWindow, if positive, holds back UDP writes for up to this long,
+	// or until 64 are pending, and sends them as a burst, which raises the
+	// packet rate under load at the cost of that much added latency. Call
+	// Flush on a UDP conn to send its held back writes at once. Zero sends
+	// every write immediately.
+	UDPBatchWindow time.Duration
+	// UDPPacingBps, if positive, spaces out UDP writes so that all sessions
+	// together send at most this many bytes per second, headers included,
+	// in bursts of at most 10ms worth, to keep a high-rate source from
+	// tripping policers on the path. A write waits for its turn, or fails
+	// with net.ErrClosed if its session closes first. Zero sends writes as
+	// fast as they come.
+	UDPPacingBps uint64
+	// MaxUDPParseErrors, if positive, stops UDP after this many datagrams in
+	// a row that are not valid UDP messages, e.g. from a buggy or hostile
+	// server: the UDP sessions are closed and the next UDP call reconnects.
+	// Zero drops such datagrams and goes on. Either way they are counted in
+	// Stats.UDPParseErrors.
+	MaxUDPParseErrors int
+	// LazyUDP defers setting up UDP on a connection, including the goroutine
+	// receiving its datagrams, to the first UDP call on it, which saves them
+	// when UDP is seldom used. HandshakeInfo.UDPEnabled still tells whether
+	// the server supports UDP.
+	LazyUDP bool
+	// Trace, if not nil, is called while connecting, see ClientTrace. A
+	// trace set with WithClientTrace on the context of the call that
+	// connects replaces it.
+	Trace *ClientTrace
+	// HealthCheckInterval, if positive, starts a monitor that checks the
+	// connection at this interval, marks the client unhealthy as soon as the
+	// connection is found dead and re-dials it. Without it, a dead connection
+	// is only noticed, and IsHealthy updated, on the next TCP or UDP call.
+	HealthCheckInterval time.Duration
+	// ReconnectPolicy, if not nil, spreads out the reconnects of the client,
+	// including those of the health monitor, and those of the other clients
+	// sharing it, see ReconnectPolicy.
+	ReconnectPolicy *ReconnectPolicy
+	// BindInterface, if set, binds the packet conn of every connection to
+	// this network interface with SO_BINDTODEVICE before QUIC dials, so that
+	// policy routing sends hysteria2 traffic out the right link. The conn
+	// returned by ConnFactory must expose its socket through SyscallConn, or
+	// implement BindToDevice(string) error as udphop conns do to bind every
+	// hop. It is only supported on Linux.
+	BindInterface string
+	// AcceptStreams allows the server to open streams to the client, for
+	// reverse tunnels. Such streams start with a TCP request naming the
+	// target, like the ones the client sends, and are handed out by
+	// Client.AcceptStream. Most servers never open streams.
+	AcceptStreams bool
+	// OnStatelessReset, if not nil, is called from its own goroutine as soon
+	// as a connection of the client is killed by a stateless reset of the
+	// server, which typically means that the server restarted, e.g. to evict
+	// the client from a pool and reconnect at once. The calls that notice
+	// it fail with an errors.ClosedError with StatelessReset set. See
+	// QUICConfig.ConnectionIDLength.
+	OnStatelessReset func()
+	// AuthHeaders are added to the auth request, e.g. a User-Agent and
+	// Accept, so that it looks like one from a common HTTP/3 client to
+	// fronting CDNs and WAFs. Headers of the protocol (Hysteria-*) and Host
+	// are reserved and rejected.
+	AuthHeaders http.Header
+	// EnableDatagrams controls QUIC datagram support, which carries UDP.
+	// Setting it to false makes the client TCP only: datagrams are not
+	// negotiated and UDP fails with an error. Nil means true.
+	EnableDatagrams *bool
+	// StreamOpenTimeout, if positive, makes TCP wait up to this long for the
+	// server to allow another stream once the stream limit of the connection
+	// is reached, and then fail with errors.ErrStreamOpenTimeout, leaving the
+	// connection up. The deadline of the dial context still applies. Zero
+	// fails at once if no stream can be opened.
+	StreamOpenTimeout time.Duration
+	// AuthTimeout, if positive, is how long to wait for the auth response
+	// once the QUIC handshake is done, e.g. longer than the dial timeout for
+	// a server that is slow to answer under load. The deadline of the dial
+	// context then only bounds the handshake, canceling it still aborts the
+	// auth. Connect fails with errors.ErrAuthTimeout when it fires. Zero
+	// leaves the auth to the deadline of the dial context.
+	AuthTimeout time.Duration
+	// AuthFallbacks are credentials to try, in order, when the server rejects
+	// Auth, e.g. the old one while a new one is rolled out. Each is sent over
+	// the same connection; a network failure is not retried. Connect fails
+	// with the errors.AuthError of the last one if all are rejected. At most
+	// 3 are allowed. AuthTimeout, if set, bounds all attempts together.
+	AuthFallbacks []string
+	// HandshakeRetries is how many times to retry the QUIC dial and the auth
+	// of a connect that failed transiently, i.e. timed out, e.g. for packet
+	// loss during the handshake, or was reset. A rejected auth or a failed
+	// TLS handshake is not retried. Every attempt starts over with a new
+	// packet conn. Zero does not retry.
+	HandshakeRetries int
+	// HandshakeRetryDelay is the wait before the first retry, doubled for
+	// every next one. Zero means 250ms.
+	HandshakeRetryDelay time.Duration
 
 	filled bool // whether the fields have been verified and filled
 }
 
+// ValidateConfig checks config the way NewClient does and returns a copy with
+// the defaults filled in, without touching config or the network, e.g. to
+// reject a bad config when it is submitted rather than at the first dial. The
+// returned config can be passed to NewClient. Reference fields such as
+// AuthHeaders are shared with config.
+func ValidateConfig(config *Config) (*Config, error) {
+	c := *config
+	if err := c.verifyAndFill(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
 // verifyAndFill fills the fields that are not set by the user with default values when possible,
 // and returns an error if the user has not set a required field or has set an invalid value.
 func (c *Config) verifyAndFill() error {
@@ -42,6 +193,11 @@ func (c *Config) verifyAndFill() error {
 	if c.ServerAddr == nil {
 		return errors.ConfigError{Field: "ServerAddr", Reason: "must be set"}
 	}
+	for _, cert := range c.TLSConfig.Certificates {
+		if len(cert.Certificate) == 0 || cert.PrivateKey == nil {
+			return errors.ConfigError{Field: "TLSConfig.Certificates", Reason: "must have a certificate and a private key"}
+		}
+	}
 	if c.QUICConfig.InitialStreamReceiveWindow == 0 {
 		c.QUICConfig.InitialStreamReceiveWindow = defaultStreamReceiveWindow
 	} else if c.QUICConfig.InitialStreamReceiveWindow < 16384 {
@@ -69,25 +225,166 @@ func (c *Config) verifyAndFill() error {
 	}
 	if c.QUICConfig.KeepAlivePeriod == 0 {
 		c.QUICConfig.KeepAlivePeriod = defaultKeepAlivePeriod
-	} else if c.QUICConfig.KeepAlivePeriod < 2*time.Second || c.QUICConfig.KeepAlivePeriod > 60*time.Second {
+	} else if !validKeepAlivePeriod(c.QUICConfig.KeepAlivePeriod) {
 		return errors.ConfigError{Field: "QUICConfig.KeepAlivePeriod", Reason: "must be between 2s and 60s"}
 	}
+	for name := range c.AuthHeaders {
+		if protocol.IsReservedRequestHeader(name) {
+			return errors.ConfigError{Field: "AuthHeaders", Reason: fmt.Sprintf("%s is reserved", name)}
+		}
+	}
+	if len(c.AuthFallbacks) > maxAuthFallbacks {
+		return errors.ConfigError{Field: "AuthFallbacks", Reason: fmt.Sprintf("must have at most %d entries", maxAuthFallbacks)}
+	}
+	for _, auth := range c.AuthFallbacks {
+		if auth == "" {
+			return errors.ConfigError{Field: "AuthFallbacks", Reason: "must not have empty entries"}
+		}
+	}
+	if c.UDPSessionQueueSize < 0 {
+		return errors.ConfigError{Field: "UDPSessionQueueSize", Reason: "must not be negative"}
+	}
+	if c.MaxUDPSessions < 0 {
+		return errors.ConfigError{Field: "MaxUDPSessions", Reason: "must not be negative"}
+	}
+	if c.MaxUDPParseErrors < 0 {
+		return errors.ConfigError{Field: "MaxUDPParseErrors", Reason: "must not be negative"}
+	}
+	if c.UDPBatchWindow < 0 {
+		return errors.ConfigError{Field: "UDPBatchWindow", Reason: "must not be negative"}
+	}
+	if c.StreamOpenTimeout < 0 {
+		return errors.ConfigError{Field: "StreamOpenTimeout", Reason: "must not be negative"}
+	}
+	if c.AuthTimeout < 0 {
+		return errors.ConfigError{Field: "AuthTimeout", Reason: "must not be negative"}
+	}
+	if c.HandshakeRetries < 0 {
+		return errors.ConfigError{Field: "HandshakeRetries", Reason: "must not be negative"}
+	}
+	if c.HandshakeRetryDelay < 0 {
+		return errors.ConfigError{Field: "HandshakeRetryDelay", Reason: "must not be negative"}
+	} else if c.HandshakeRetryDelay == 0 {
+		c.HandshakeRetryDelay = defaultHandshakeRetryDelay
+	}
+	if c.BindInterface != "" && !netproxy.BindToDeviceSupported {
+		return errors.ConfigError{Field: "BindInterface", Reason: "only supported on Linux"}
+	}
 	c.QUICConfig.DisablePathMTUDiscovery = c.QUICConfig.DisablePathMTUDiscovery || pmtud.DisablePathMTUDiscovery
+	if c.QUICConfig.MaxDatagramSize < 0 || c.QUICConfig.MaxDatagramSize > 65535 {
+		return errors.ConfigError{Field: "QUICConfig.MaxDatagramSize", Reason: "must be between 0 and 65535"}
+	}
+	if c.QUICConfig.ConnectionIDLength < 0 || c.QUICConfig.ConnectionIDLength > maxConnectionIDLength {
+		return errors.ConfigError{Field: "QUICConfig.ConnectionIDLength", Reason: fmt.Sprintf("must be between 0 and %d", maxConnectionIDLength)}
+	}
+	if _, ok := c.ConnFactory.(*SharedConnFactory); ok && c.QUICConfig.ConnectionIDLength != 0 {
+		return errors.ConfigError{Field: "QUICConfig.ConnectionIDLength", Reason: "the connection IDs of a SharedConnFactory have a fixed length"}
+	} else if !ok && c.OnStatelessReset != nil && c.QUICConfig.ConnectionIDLength == 0 {
+		c.QUICConfig.ConnectionIDLength = defaultResetConnectionIDLength
+	}
+	for _, v := range c.QUICConfig.Versions {
+		if v != quic.Version1 && v != quic.Version2 {
+			return errors.ConfigError{Field: "QUICConfig.Versions", Reason: fmt.Sprintf("unsupported version %v", v)}
+		}
+	}
+	switch {
+	case c.UDPBufferSize == 0:
+		c.UDPBufferSize = max(protocol.MaxUDPSize, c.QUICConfig.MaxDatagramSize)
+	case c.UDPBufferSize < minUDPBufferSize:
+		logger.Logger.Warnf("hysteria2: UDPBufferSize %d is too small, using %d", c.UDPBufferSize, minUDPBufferSize)
+		c.UDPBufferSize = minUDPBufferSize
+	case c.UDPBufferSize > maxUDPBufferSize:
+		logger.Logger.Warnf("hysteria2: UDPBufferSize %d exceeds the largest UDP message, using %d", c.UDPBufferSize, maxUDPBufferSize)
+		c.UDPBufferSize = maxUDPBufferSize
+	}
 
 	c.filled = true
 	return nil
 }
 
+func (c *Config) datagramsEnabled() bool {
+	return c.EnableDatagrams == nil || *c.EnableDatagrams
+}
+
 type ConnFactory interface {
 	New(context.Context) (net.PacketConn, error)
 }
 
+// UdpConnFactory creates the packet conn used by the QUIC connection. If NewFunc
+// is nil, a UDP socket bound to LocalAddr is created instead; a nil LocalAddr
+// lets the system pick the address and port.
 type UdpConnFactory struct {
-	NewFunc func(ctx context.Context) (net.PacketConn, error)
+	NewFunc   func(ctx context.Context) (net.PacketConn, error)
+	LocalAddr *net.UDPAddr
+}
+
+// bindInterface binds pc to the network interface iface.
+func bindInterface(pc net.PacketConn, iface string) error {
+	if b, ok := pc.(interface{ BindToDevice(string) error }); ok {
+		return b.BindToDevice(iface)
+	}
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T does not expose its socket", pc)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return netproxy.BindToDeviceControl(rc, iface)
 }
 
 func (f *UdpConnFactory) New(ctx context.Context) (net.PacketConn, error) {
-	return f.NewFunc(ctx)
+	if f.NewFunc != nil {
+		return f.NewFunc(ctx)
+	}
+	conn, err := net.ListenUDP("udp", f.LocalAddr)
+	if err != nil {
+		return nil, fmt.Errorf("bind UDP to %v: %w", f.LocalAddr, err)
+	}
+	return conn, nil
+}
+
+// DialerConnFactory creates the packet conn by dialing "udp" through Dialer,
+// so that QUIC can be tunneled through another proxy, e.g. a SOCKS5 UDP
+// associate. QUIC only needs unreliable datagram delivery from the conn, so
+// extra framing or latency added by the upstream is fine, as long as the path
+// MTU it leaves is large enough for QUIC packets.
+type DialerConnFactory struct {
+	Dialer     netproxy.Dialer
+	ServerAddr net.Addr
+}
+
+func (f *DialerConnFactory) New(ctx context.Context) (net.PacketConn, error) {
+	return f.Dial(ctx, f.ServerAddr)
+}
+
+// Dial returns a packet conn to addr through f.Dialer.
+func (f *DialerConnFactory) Dial(ctx context.Context, addr net.Addr) (net.PacketConn, error) {
+	conn, err := f.Dialer.DialContext(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(netproxy.PacketConn)
+	if !ok {
+		_ = conn.Close()
+		return nil, fmt.Errorf("dialer returned %T, which is not a packet conn", conn)
+	}
+	return netproxy.NewFakeNetPacketConn(
+		pc,
+		net.UDPAddrFromAddrPort(common.GetUniqueFakeAddrPort()),
+		addr,
+	), nil
+}
+
+// SharedConnFactory takes the packet conns from Conn, so that the QUIC
+// connections of several clients share its UDP socket.
+type SharedConnFactory struct {
+	Conn *quicpacket.SharedConn
+}
+
+func (f *SharedConnFactory) New(ctx context.Context) (net.PacketConn, error) {
+	return f.Conn.NewPacketConn()
 }
 
 // TLSConfig contains the TLS configuration fields that we want to expose to the user.
@@ -96,6 +393,28 @@ type TLSConfig struct {
 	InsecureSkipVerify    bool
 	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 	RootCAs               *x509.CertPool
+	// VerifyConnection, if not nil, is called after the certificate checks
+	// with the state of the handshake, e.g. to enforce the server name
+	// negotiated for a backend. It runs even with InsecureSkipVerify.
+	VerifyConnection func(tls.ConnectionState) error
+	// ClientSessionCache, if not nil, keeps the session tickets of the server
+	// so that reconnecting resumes the TLS session, which is faster but lets
+	// the server link the connections.
+	ClientSessionCache tls.ClientSessionCache
+	// SessionTicketsDisabled makes every connection a full handshake, so the
+	// server cannot link it to an earlier one by its session ticket. It wins
+	// over ClientSessionCache, which is then not used at all.
+	SessionTicketsDisabled bool
+	// Certificates are presented to a server that asks for a client
+	// certificate, for mutual TLS on top of the auth. crypto/tls sends the
+	// first one that suits the request of the server, or else the first one.
+	Certificates []tls.Certificate
+	// GetClientCertificate, if not nil, is called instead of using
+	// Certificates when the server asks for a client certificate, e.g. to
+	// choose one per connection or to sign with a hardware-backed key.
+	// Returning no certificate fails the handshake, where crypto/tls would
+	// go on without one.
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
 }
 
 // QUICConfig contains the QUIC configuration fields that we want to expose to the user.
@@ -107,10 +426,41 @@ type QUICConfig struct {
 	MaxIdleTimeout                 time.Duration
 	KeepAlivePeriod                time.Duration
 	DisablePathMTUDiscovery        bool // The server may still override this to true on unsupported platforms.
+	// MaxDatagramSize is a hint of the largest QUIC datagram payload the path
+	// carries, e.g. more than the default on jumbo frames or less in a tight
+	// tunnel. UDP messages are limited to what fits in fragments of that size
+	// and, if UDPBufferSize is not set, the buffer grows to fit one datagram.
+	// quic-go still has the last word: once it reports a smaller limit, that
+	// one is used. Zero means no hint.
+	MaxDatagramSize int
+	// Versions are the QUIC versions to offer, in order of preference, e.g.
+	// only quic.Version2 to avoid QoS aimed at version 1. Empty means the
+	// default of quic-go. If the server supports none of them, connecting
+	// fails with a ConnectError wrapping a *quic.VersionNegotiationError.
+	Versions []quic.Version
+	// ConnectionIDLength, if not zero, is the length in bytes of the
+	// connection IDs the client picks for itself, up to 20, e.g. to look like
+	// another QUIC stack. Below 4, connection IDs are likely to collide on
+	// a shared server. Zero keeps the default of quic-go for a client that
+	// owns its socket: empty connection IDs. It cannot be set with a
+	// SharedConnFactory. With Config.OnStatelessReset, it defaults to 4, as
+	// quic-go only notices stateless resets on connections with IDs.
+	ConnectionIDLength int
 }
 
+// maxConnectionIDLength is the longest connection ID QUIC allows.
+const maxConnectionIDLength = 20
+
+// defaultResetConnectionIDLength is the ConnectionIDLength with
+// OnStatelessReset, the length quic-go picks for servers.
+const defaultResetConnectionIDLength = 4
+
 // BandwidthConfig describes the maximum bandwidth that the server can use, in bytes per second.
 type BandwidthConfig struct {
 	MaxTx uint64
 	MaxRx uint64
 }
+
+func validKeepAlivePeriod(d time.Duration) bool {
+	return d >= 2*time.Second && d <= 60*time.Second
+}
@@ -0,0 +1,1110 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/http3"
+)
+
+// framedDialer tunnels UDP through a relay, like a SOCKS5 UDP associate: every
+// packet is prefixed with its destination, or with its source on the way
+// back, and is delayed before being sent to the relay.
+type framedDialer struct {
+	relay  *net.UDPAddr
+	delay  time.Duration
+	frames *atomic.Int64
+}
+
+func (d *framedDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	if network != "udp" {
+		return nil, errors.New("framedDialer: udp only")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return &framedPacketConn{Conn: conn, udp: conn, d: d, target: addr}, nil
+}
+
+func appendFrame(b []byte, addr string, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addr)))
+	b = append(b, addr...)
+	return append(b, payload...)
+}
+
+func parseFrame(b []byte) (addr string, payload []byte, err error) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", nil, errors.New("short frame")
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	return string(b[2:n]), b[n:], nil
+}
+
+type framedPacketConn struct {
+	// Conn hides the methods of the socket that would let quic-go read and
+	// write it directly, past the framing, e.g. ReadMsgUDP.
+	net.Conn
+	udp    *net.UDPConn
+	d      *framedDialer
+	target string
+}
+
+func (c *framedPacketConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *framedPacketConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.target)
+}
+
+func (c *framedPacketConn) ReadFrom(p []byte) (int, netip.AddrPort, error) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.udp.Read(buf)
+		if err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+		addr, payload, err := parseFrame(buf[:n])
+		if err != nil {
+			continue
+		}
+		c.d.frames.Add(1)
+		return copy(p, payload), netip.MustParseAddrPort(addr), nil
+	}
+}
+
+func (c *framedPacketConn) WriteTo(p []byte, addr string) (int, error) {
+	frame := appendFrame(nil, addr, p)
+	c.d.frames.Add(1)
+	time.AfterFunc(c.d.delay, func() {
+		_, _ = c.udp.WriteTo(frame, c.d.relay)
+	})
+	return len(p), nil
+}
+
+// runRelay unwraps frames from the client and wraps replies to it.
+func runRelay(t *testing.T, relay *net.UDPConn) {
+	var client *net.UDPAddr
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			addr, payload, err := parseFrame(buf[:n])
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			to, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			_, _ = relay.WriteToUDP(payload, to)
+			continue
+		}
+		_, _ = relay.WriteToUDP(appendFrame(nil, from.String(), buf[:n]), client)
+	}
+}
+
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// startAuthServer serves the hysteria2 auth request on conn, accepting any
+// client, and nothing else. onAuth, if not nil, sees every auth request.
+func startAuthServer(t *testing.T, conn net.PacketConn, onAuth func(http.ResponseWriter, *http.Request)) *http3.Server {
+	t.Helper()
+	server := &http3.Server{
+		TLSConfig:  selfSignedTLSConfig(t),
+		QUICConfig: &quic.Config{EnableDatagrams: true},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host != protocol.URLHost || r.URL.Path != protocol.URLPath {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if onAuth != nil {
+				onAuth(w, r)
+			}
+			protocol.AuthResponseToHeader(w.Header(), protocol.AuthResponse{UDPEnabled: true, RxAuto: true})
+			w.WriteHeader(protocol.StatusAuthOK)
+		}),
+	}
+	go server.Serve(conn)
+	return server
+}
+
+func TestDialerConnFactoryHandshake(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayConn.Close()
+	go runRelay(t, relayConn)
+
+	var frames atomic.Int64
+	serverAddr := serverConn.LocalAddr()
+	c, err := NewClient(&Config{
+		ConnFactory: &DialerConnFactory{
+			Dialer:     &framedDialer{relay: relayConn.LocalAddr().(*net.UDPAddr), delay: 30 * time.Millisecond, frames: &frames},
+			ServerAddr: serverAddr,
+		},
+		ServerAddr: serverAddr,
+		Auth:       "secret",
+		TLSConfig:  TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	impl := c.(*clientImpl)
+	info, err := impl.connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impl.conn.CloseWithError(closeErrCodeOK, "")
+	if !info.UDPEnabled {
+		t.Error("UDPEnabled = false, want true")
+	}
+	// Both directions went through the framing conn.
+	if frames.Load() < 4 {
+		t.Errorf("only %v frames went through the framing conn", frames.Load())
+	}
+}
+
+func TestAuthHeaders(t *testing.T) {
+	_, err := NewClient(&Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  &net.UDPAddr{},
+		AuthHeaders: http.Header{"hysteria-auth": {"forged"}},
+	})
+	if err == nil {
+		t.Fatal("NewClient() accepted a reserved auth header")
+	}
+
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	headers := make(chan http.Header, 1)
+	server := startAuthServer(t, serverConn, func(_ http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	})
+	defer server.Close()
+
+	c, err := NewClient(&Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  serverConn.LocalAddr(),
+		Auth:        "secret",
+		TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		AuthHeaders: http.Header{"User-Agent": {"Mozilla/5.0"}, "Accept": {"*/*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	impl := c.(*clientImpl)
+	if _, err := impl.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := <-headers
+	if h.Get("User-Agent") != "Mozilla/5.0" || h.Get("Accept") != "*/*" {
+		t.Errorf("server saw User-Agent %q and Accept %q", h.Get("User-Agent"), h.Get("Accept"))
+	}
+	if h.Get(protocol.RequestHeaderAuth) != "secret" {
+		t.Errorf("server saw auth %q, want secret", h.Get(protocol.RequestHeaderAuth))
+	}
+}
+
+func TestDisableDatagrams(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	// SupportsDatagrams tells whether the peer offered datagrams, so ask the
+	// server.
+	serverDatagrams := make(chan bool, 1)
+	server := startAuthServer(t, serverConn, func(w http.ResponseWriter, _ *http.Request) {
+		serverDatagrams <- w.(http3.Hijacker).Connection().ConnectionState().SupportsDatagrams
+	})
+	defer server.Close()
+
+	enable := false
+	c, err := NewClient(&Config{
+		ConnFactory:     &UdpConnFactory{},
+		ServerAddr:      serverConn.LocalAddr(),
+		Auth:            "secret",
+		TLSConfig:       TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		EnableDatagrams: &enable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	impl := c.(*clientImpl)
+	info, err := impl.connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server offers UDP, but the client did not negotiate datagrams.
+	if info.UDPEnabled || impl.udpSM != nil {
+		t.Error("UDP enabled on a TCP only client")
+	}
+	if <-serverDatagrams {
+		t.Error("datagrams were negotiated")
+	}
+	if _, err := c.UDP("1.1.1.1:53", ctx); !errors.Is(err, errUDPDisabled) {
+		t.Errorf("UDP() = %v, want errUDPDisabled", err)
+	}
+}
+
+func TestNegotiatedProtocol(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	c, err := NewClient(&Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  serverConn.LocalAddr(),
+		Auth:        "secret",
+		TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.NegotiatedProtocol(); got != "" {
+		t.Errorf("NegotiatedProtocol() = %q before connecting, want empty", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	info, err := c.(*clientImpl).connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.NegotiatedProtocol(); got != "h3" {
+		t.Errorf("NegotiatedProtocol() = %q, want h3", got)
+	}
+	if info.NegotiatedProtocol != "h3" {
+		t.Errorf("HandshakeInfo.NegotiatedProtocol = %q, want h3", info.NegotiatedProtocol)
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	var events []string
+	var last time.Duration
+	record := func(event string, elapsed time.Duration) {
+		if elapsed < last {
+			t.Errorf("%v after %v, earlier than the previous event at %v", event, elapsed, last)
+		}
+		last = elapsed
+		events = append(events, event)
+	}
+	trace := &ClientTrace{
+		PacketConnCreated:  func(_ net.Addr, elapsed time.Duration) { record("conn", elapsed) },
+		QUICHandshakeStart: func(elapsed time.Duration) { record("handshake start", elapsed) },
+		QUICHandshakeDone: func(err error, elapsed time.Duration) {
+			record(fmt.Sprintf("handshake done %v", err), elapsed)
+		},
+		AuthRequestSent: func(elapsed time.Duration) { record("auth sent", elapsed) },
+		AuthResponseReceived: func(statusCode int, err error, elapsed time.Duration) {
+			record(fmt.Sprintf("auth %v %v", statusCode, err), elapsed)
+		},
+		CongestionControllerSelected: func(name string, tx uint64, elapsed time.Duration) {
+			record(fmt.Sprintf("%v %v", name, tx), elapsed)
+		},
+	}
+	unused := &ClientTrace{
+		PacketConnCreated: func(net.Addr, time.Duration) { t.Error("Config.Trace used over the trace of the context") },
+	}
+	c, err := NewClient(&Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  serverConn.LocalAddr(),
+		Auth:        "secret",
+		TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		Trace:       unused,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.(*clientImpl).connect(WithClientTrace(ctx, trace)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"conn", "handshake start", "handshake done <nil>", "auth sent", fmt.Sprintf("auth %v <nil>", protocol.StatusAuthOK), "bbr 0"}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("events %q, want %q", events, want)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	traced := false
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, info, timings, err := Connect(ctx, &Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  serverConn.LocalAddr(),
+		Auth:        "secret",
+		TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		Trace: &ClientTrace{
+			PacketConnCreated: func(net.Addr, time.Duration) { traced = true },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !traced {
+		t.Error("Config.Trace was not called")
+	}
+	if !info.UDPEnabled || info.NegotiatedProtocol != "h3" {
+		t.Errorf("HandshakeInfo = %+v", info)
+	}
+	if timings.QUICHandshake <= 0 || timings.Auth <= 0 ||
+		timings.PacketConn+timings.QUICHandshake+timings.Auth > timings.Total {
+		t.Errorf("ConnectTimings = %+v, want the steps to take time within the total", timings)
+	}
+
+	// A failed connect still has the timings of the steps it reached.
+	serverConn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, _, timings, err = Connect(ctx, &Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  serverConn.LocalAddr(),
+		Auth:        "secret",
+		TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err == nil {
+		t.Fatal("Connect() to a closed server succeeded")
+	}
+	if timings.Auth != 0 || timings.Total < 200*time.Millisecond {
+		t.Errorf("ConnectTimings of a failed connect = %+v", timings)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, func(http.ResponseWriter, *http.Request) { time.Sleep(300 * time.Millisecond) })
+	defer server.Close()
+
+	connect := func(authTimeout, dialTimeout time.Duration) error {
+		c, err := NewClient(&Config{
+			ConnFactory: &UdpConnFactory{},
+			ServerAddr:  serverConn.LocalAddr(),
+			Auth:        "secret",
+			TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+			AuthTimeout: authTimeout,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		_, err = c.(*clientImpl).connect(ctx)
+		return err
+	}
+	// The slow auth outlives the dial timeout, which only bounds the
+	// handshake.
+	if err := connect(5*time.Second, 200*time.Millisecond); err != nil {
+		t.Errorf("connect() = %v", err)
+	}
+	err = connect(100*time.Millisecond, 5*time.Second)
+	var netErr net.Error
+	if !errors.Is(err, coreErrs.ErrAuthTimeout) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("connect() = %v, want ErrAuthTimeout", err)
+	}
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	var auths, rejected atomic.Int64
+	var reject atomic.Bool
+	server := startAuthServer(t, serverConn, func(w http.ResponseWriter, _ *http.Request) {
+		if reject.Load() {
+			rejected.Add(1)
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if auths.Add(1) == 1 {
+			// The first auth response is lost.
+			time.Sleep(300 * time.Millisecond)
+		}
+	})
+	defer server.Close()
+
+	connect := func(retries int) error {
+		c, err := NewClientContext(context.Background(), &Config{
+			ConnFactory:         &UdpConnFactory{},
+			ServerAddr:          serverConn.LocalAddr(),
+			Auth:                "secret",
+			TLSConfig:           TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+			AuthTimeout:         100 * time.Millisecond,
+			HandshakeRetries:    retries,
+			HandshakeRetryDelay: 10 * time.Millisecond,
+		})
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := connect(1); err != nil {
+		t.Errorf("connect with a retry after a timeout = %v", err)
+	}
+	if got := auths.Load(); got != 2 {
+		t.Errorf("the server saw %v auths, want 2", got)
+	}
+
+	// A rejected auth is final.
+	reject.Store(true)
+	var authErr coreErrs.AuthError
+	if err := connect(3); !errors.As(err, &authErr) {
+		t.Errorf("connect with a rejected auth = %v, want an AuthError", err)
+	}
+	if got := rejected.Load(); got != 1 {
+		t.Errorf("the server rejected %v auths, want 1", got)
+	}
+}
+
+func TestAuthFallbacks(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	var mu sync.Mutex
+	var tried, remotes []string
+	server := &http3.Server{
+		TLSConfig:  selfSignedTLSConfig(t),
+		QUICConfig: &quic.Config{EnableDatagrams: true},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := protocol.AuthRequestFromHeader(r.Header).Auth
+			mu.Lock()
+			tried = append(tried, auth)
+			remotes = append(remotes, r.RemoteAddr)
+			mu.Unlock()
+			if auth != "current" {
+				// Like a hysteria2 server, which masquerades on failure.
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			protocol.AuthResponseToHeader(w.Header(), protocol.AuthResponse{UDPEnabled: true, RxAuto: true})
+			w.WriteHeader(protocol.StatusAuthOK)
+		}),
+	}
+	go server.Serve(serverConn)
+	defer server.Close()
+
+	// connect returns the credentials the server got and where from.
+	connect := func(auth string, fallbacks ...string) ([]string, []string, error) {
+		c, err := NewClient(&Config{
+			ConnFactory:   &UdpConnFactory{},
+			ServerAddr:    serverConn.LocalAddr(),
+			Auth:          auth,
+			AuthFallbacks: fallbacks,
+			TLSConfig:     TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = c.(*clientImpl).connect(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { tried, remotes = nil, nil }()
+		return tried, remotes, err
+	}
+	got, from, err := connect("next", "current", "old")
+	if err != nil {
+		t.Fatalf("connect() = %v", err)
+	}
+	if fmt.Sprint(got) != "[next current]" {
+		t.Errorf("server got %q, want next, then current", got)
+	}
+	if from[0] != from[1] {
+		t.Errorf("attempts came from %v, want a single connection", from)
+	}
+
+	got, _, err = connect("next", "old")
+	var authErr coreErrs.AuthError
+	if !errors.As(err, &authErr) || authErr.StatusCode != http.StatusNotFound {
+		t.Errorf("connect() = %v, want an AuthError with status 404", err)
+	}
+	if fmt.Sprint(got) != "[next old]" {
+		t.Errorf("server got %q, want next, then old", got)
+	}
+
+	_, err = NewClient(&Config{
+		ConnFactory:   &UdpConnFactory{},
+		ServerAddr:    serverConn.LocalAddr(),
+		AuthFallbacks: []string{"a", "b", "c", "d"},
+	})
+	var configErr coreErrs.ConfigError
+	if !errors.As(err, &configErr) || configErr.Field != "AuthFallbacks" {
+		t.Errorf("NewClient() with 4 fallbacks = %v, want a ConfigError", err)
+	}
+}
+
+func TestNewClientContext(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+	// silent drops everything, like a server that is down.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	config := func(addr net.Addr) *Config {
+		return &Config{
+			ConnFactory: &UdpConnFactory{},
+			ServerAddr:  addr,
+			Auth:        "secret",
+			TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := NewClientContext(ctx, config(serverConn.LocalAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.NegotiatedProtocol(); got != "h3" {
+		t.Errorf("NegotiatedProtocol() = %q right after NewClientContext(), want h3", got)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := NewClientContext(ctx, config(silent.LocalAddr())); err == nil {
+		t.Error("NewClientContext() of a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("NewClientContext() returned after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestVerifyConnection(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	errWrongBackend := errors.New("wrong backend")
+	for _, want := range []string{"example.com", "other.example.com"} {
+		var seen string
+		c, err := NewClient(&Config{
+			ConnFactory: &UdpConnFactory{},
+			ServerAddr:  serverConn.LocalAddr(),
+			Auth:        "secret",
+			TLSConfig: TLSConfig{
+				ServerName:         "example.com",
+				InsecureSkipVerify: true,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					seen = cs.ServerName
+					if cs.ServerName != want {
+						return errWrongBackend
+					}
+					return nil
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = c.(*clientImpl).connect(ctx)
+		cancel()
+		c.Close()
+		if seen != "example.com" {
+			t.Errorf("VerifyConnection saw server name %q, want example.com", seen)
+		}
+		if ok := want == "example.com"; ok != (err == nil) {
+			t.Errorf("connect() expecting %v = %v", want, err)
+		}
+	}
+}
+
+func TestSessionTicketsDisabled(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	for _, disabled := range []bool{false, true} {
+		cache := tls.NewLRUClientSessionCache(4)
+		var resumed []bool
+		for i := 0; i < 2; i++ {
+			c, err := NewClient(&Config{
+				ConnFactory: &UdpConnFactory{},
+				ServerAddr:  serverConn.LocalAddr(),
+				Auth:        "secret",
+				TLSConfig: TLSConfig{
+					ServerName:             "example.com",
+					InsecureSkipVerify:     true,
+					ClientSessionCache:     cache,
+					SessionTicketsDisabled: disabled,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			_, err = c.(*clientImpl).connect(ctx)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resumed = append(resumed, c.(*clientImpl).conn.ConnectionState().TLS.DidResume)
+			c.Close()
+		}
+		if resumed[0] || resumed[1] == disabled {
+			t.Errorf("SessionTicketsDisabled %v: resumed %v", disabled, resumed)
+		}
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	tlsConfig := selfSignedTLSConfig(t)
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	server := &http3.Server{
+		TLSConfig:  tlsConfig,
+		QUICConfig: &quic.Config{EnableDatagrams: true},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			protocol.AuthResponseToHeader(w.Header(), protocol.AuthResponse{UDPEnabled: true, RxAuto: true})
+			w.WriteHeader(protocol.StatusAuthOK)
+		}),
+	}
+	go server.Serve(serverConn)
+	defer server.Close()
+
+	cert := selfSignedTLSConfig(t).Certificates[0]
+	connect := func(tlsConfig TLSConfig) error {
+		tlsConfig.ServerName = "example.com"
+		tlsConfig.InsecureSkipVerify = true
+		c, err := NewClient(&Config{
+			ConnFactory: &UdpConnFactory{},
+			ServerAddr:  serverConn.LocalAddr(),
+			Auth:        "secret",
+			TLSConfig:   tlsConfig,
+		})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err = c.(*clientImpl).connect(ctx)
+		return err
+	}
+	if err := connect(TLSConfig{}); err == nil {
+		t.Error("connect() without a client certificate succeeded")
+	}
+	if err := connect(TLSConfig{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Errorf("connect() with Certificates = %v", err)
+	}
+	var asked atomic.Bool
+	err = connect(TLSConfig{GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		asked.Store(true)
+		return &cert, nil
+	}})
+	if err != nil || !asked.Load() {
+		t.Errorf("connect() with GetClientCertificate = %v, called %v", err, asked.Load())
+	}
+	err = connect(TLSConfig{GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{}, nil
+	}})
+	if !errors.Is(err, errNoClientCertificate) {
+		t.Errorf("connect() with GetClientCertificate returning none = %v, want errNoClientCertificate", err)
+	}
+
+	err = connect(TLSConfig{Certificates: []tls.Certificate{{}}})
+	var configErr coreErrs.ConfigError
+	if !errors.As(err, &configErr) || configErr.Field != "TLSConfig.Certificates" {
+		t.Errorf("NewClient() with an empty certificate = %v, want a ConfigError", err)
+	}
+}
+
+func TestOnStatelessReset(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// serve runs a server on conn that resets the connections it does not
+	// know with the same key, like a restarted server.
+	key := quic.StatelessResetKey{1}
+	serve := func(conn net.PacketConn) *quic.Transport {
+		tr := &quic.Transport{Conn: conn, StatelessResetKey: &key}
+		ln, err := tr.ListenEarly(http3.ConfigureTLSConfig(selfSignedTLSConfig(t)), &quic.Config{EnableDatagrams: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			protocol.AuthResponseToHeader(w.Header(), protocol.AuthResponse{UDPEnabled: true, RxAuto: true})
+			w.WriteHeader(protocol.StatusAuthOK)
+		})}
+		go server.ServeListener(ln)
+		return tr
+	}
+	tr := serve(serverConn)
+
+	reset := make(chan struct{}, 1)
+	c, err := NewClient(&Config{
+		ConnFactory:      &UdpConnFactory{},
+		ServerAddr:       serverConn.LocalAddr(),
+		Auth:             "secret",
+		TLSConfig:        TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		OnStatelessReset: func() { reset <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.(*clientImpl).connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server crashes without closing the connection and comes back.
+	_ = serverConn.Close()
+	_ = tr.Close()
+	serverConn, err = net.ListenUDP("udp", serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	defer serve(serverConn).Close()
+
+	// The next packet of the client gets a stateless reset.
+	_, _ = c.TCP("10.0.0.1:80", ctx)
+	select {
+	case <-reset:
+	case <-ctx.Done():
+		t.Fatal("OnStatelessReset was not called")
+	}
+
+	pktConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := &clientImpl{config: &Config{}, conn: fakeQUICConn{}, pktConn: pktConn}
+	err = impl.handleIfConnectionClosed(&quic.StatelessResetError{})
+	var closedErr coreErrs.ClosedError
+	if !errors.As(err, &closedErr) || !closedErr.StatelessReset {
+		t.Errorf("handleIfConnectionClosed() of a stateless reset = %#v, want a ClosedError with StatelessReset", err)
+	}
+}
+
+func TestQUICVersions(t *testing.T) {
+	_, err := NewClient(&Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  &net.UDPAddr{},
+		QUICConfig:  QUICConfig{Versions: []quic.Version{0x1234}},
+	})
+	var configErr coreErrs.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("NewClient() = %v, want a ConfigError for an unknown version", err)
+	}
+
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+	v1Conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1Conn.Close()
+	v1Server := &http3.Server{
+		TLSConfig:  selfSignedTLSConfig(t),
+		QUICConfig: &quic.Config{Versions: []quic.Version{quic.Version1}},
+	}
+	go v1Server.Serve(v1Conn)
+	defer v1Server.Close()
+
+	for _, tt := range []struct {
+		conn net.PacketConn
+		ok   bool
+	}{{serverConn, true}, {v1Conn, false}} {
+		c, err := NewClient(&Config{
+			ConnFactory: &UdpConnFactory{},
+			ServerAddr:  tt.conn.LocalAddr(),
+			Auth:        "secret",
+			TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+			QUICConfig:  QUICConfig{Versions: []quic.Version{quic.Version2}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = c.(*clientImpl).connect(ctx)
+		cancel()
+		if tt.ok {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := c.(*clientImpl).conn.ConnectionState().Version; v != quic.Version2 {
+				t.Errorf("negotiated %v, want %v", v, quic.Version2)
+			}
+		} else {
+			var versionErr *quic.VersionNegotiationError
+			if !errors.As(err, &versionErr) {
+				t.Errorf("connect() = %v, want a VersionNegotiationError", err)
+			}
+		}
+		c.Close()
+	}
+}
+
+// scidConnFactory records the source connection ID length of the first long
+// header packet the client sends.
+type scidConnFactory struct {
+	scidLen atomic.Int64
+}
+
+func (f *scidConnFactory) New(ctx context.Context) (net.PacketConn, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return &scidConn{PacketConn: conn, f: f}, nil
+}
+
+type scidConn struct {
+	net.PacketConn
+	f *scidConnFactory
+}
+
+func (c *scidConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// Long header: flags, version, DCID length, DCID, SCID length.
+	if len(b) > 6 && b[0]&0x80 != 0 && len(b) > 6+int(b[5]) {
+		c.f.scidLen.CompareAndSwap(-1, int64(b[6+int(b[5])]))
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestConnectionIDLength(t *testing.T) {
+	for _, tt := range []struct {
+		factory ConnFactory
+		n       int
+	}{{&UdpConnFactory{}, -1}, {&UdpConnFactory{}, 21}, {&SharedConnFactory{}, 8}} {
+		_, err := NewClient(&Config{
+			ConnFactory: tt.factory,
+			ServerAddr:  &net.UDPAddr{},
+			QUICConfig:  QUICConfig{ConnectionIDLength: tt.n},
+		})
+		var configErr coreErrs.ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != "QUICConfig.ConnectionIDLength" {
+			t.Errorf("NewClient() with %T and ConnectionIDLength %v = %v, want a ConfigError", tt.factory, tt.n, err)
+		}
+	}
+
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	factory := &scidConnFactory{}
+	factory.scidLen.Store(-1)
+	c, err := NewClient(&Config{
+		ConnFactory: factory,
+		ServerAddr:  serverConn.LocalAddr(),
+		Auth:        "secret",
+		TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		QUICConfig:  QUICConfig{ConnectionIDLength: 12},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.(*clientImpl).connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := factory.scidLen.Load(); got != 12 {
+		t.Errorf("source connection ID of %v bytes, want 12", got)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := &Config{ConnFactory: &UdpConnFactory{}, ServerAddr: &net.UDPAddr{}}
+	filled, err := ValidateConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filled.QUICConfig.MaxIdleTimeout != defaultMaxIdleTimeout || filled.UDPBufferSize != protocol.MaxUDPSize {
+		t.Errorf("ValidateConfig() did not fill the defaults: %+v", filled.QUICConfig)
+	}
+	if config.filled || config.QUICConfig.MaxIdleTimeout != 0 {
+		t.Error("ValidateConfig() modified its argument")
+	}
+
+	_, err = ValidateConfig(&Config{ConnFactory: &UdpConnFactory{}})
+	var configErr coreErrs.ConfigError
+	if !errors.As(err, &configErr) || configErr.Field != "ServerAddr" {
+		t.Errorf("ValidateConfig() = %v, want a ConfigError for ServerAddr", err)
+	}
+}
+
+func TestSetKeepAlivePeriod(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	server := startAuthServer(t, serverConn, nil)
+	defer server.Close()
+
+	c, err := NewClient(&Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  serverConn.LocalAddr(),
+		Auth:        "secret",
+		TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.KeepAlivePeriod(); got != defaultKeepAlivePeriod {
+		t.Errorf("KeepAlivePeriod() = %v, want %v", got, defaultKeepAlivePeriod)
+	}
+	if err := c.SetKeepAlivePeriod(time.Second); err == nil {
+		t.Error("SetKeepAlivePeriod(1s) succeeded, want an error")
+	}
+	if err := c.SetKeepAlivePeriod(5 * time.Second); err != nil {
+		t.Fatalf("SetKeepAlivePeriod() before connecting = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	impl := c.(*clientImpl)
+	if _, err := impl.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if impl.connKeepAlive != 5*time.Second {
+		t.Errorf("the connection keeps alive every %v, want 5s", impl.connKeepAlive)
+	}
+	if err := c.SetKeepAlivePeriod(5 * time.Second); err != nil {
+		t.Errorf("SetKeepAlivePeriod() with the period of the connection = %v", err)
+	}
+	if err := c.SetKeepAlivePeriod(30 * time.Second); !errors.Is(err, coreErrs.ErrKeepAliveNotLive) {
+		t.Errorf("SetKeepAlivePeriod() while connected = %v, want %v", err, coreErrs.ErrKeepAliveNotLive)
+	}
+	if got := c.KeepAlivePeriod(); got != 30*time.Second {
+		t.Errorf("KeepAlivePeriod() = %v, want 30s", got)
+	}
+}
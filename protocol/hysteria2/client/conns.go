@@ -0,0 +1,57 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes a TCP stream or UDP session carried by a client, see
+// Client.ActiveConns.
+type ConnInfo struct {
+	// Network is "tcp" or "udp".
+	Network string
+	// Target is the address the server relays to.
+	Target string
+	// Opened is when the stream or session was opened.
+	Opened time.Time
+	// LastActive is when a UDP session last sent or received. It is zero for
+	// TCP streams.
+	LastActive time.Time
+}
+
+// connRegistry tracks the TCP streams of a client until they are closed. It
+// is a sync.Map, keyed by *tcpConn, so that streams opening and closing
+// concurrently do not contend on a lock.
+type connRegistry struct {
+	m sync.Map
+}
+
+func (r *connRegistry) add(c *tcpConn) {
+	if r != nil {
+		r.m.Store(c, struct{}{})
+	}
+}
+
+func (r *connRegistry) remove(c *tcpConn) {
+	if r != nil {
+		r.m.Delete(c)
+	}
+}
+
+func (r *connRegistry) snapshot() []ConnInfo {
+	var conns []ConnInfo
+	r.m.Range(func(key, _ any) bool {
+		c := key.(*tcpConn)
+		conns = append(conns, ConnInfo{Network: "tcp", Target: c.addr, Opened: c.opened})
+		return true
+	})
+	return conns
+}
+
+// sortConnInfos sorts conns from the oldest to the newest.
+func sortConnInfos(conns []ConnInfo) {
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Opened.Before(conns[j].Opened)
+	})
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/utils"
+)
+
+func TestActiveConns(t *testing.T) {
+	mio := &chanUDPIO{ch: make(chan *protocol.UDPMessage, 8)}
+	defer close(mio.ch)
+	c := &clientImpl{config: &Config{}, conn: fakeQUICConn{}, udpSM: newUDPSessionManager(mio, protocol.MaxUDPSize, 0)}
+
+	client, _ := net.Pipe()
+	stream := &tcpConn{
+		Orig:     &utils.QStream{Stream: &pipeStream{conn: client}},
+		addr:     "10.0.0.1:22",
+		opened:   time.Now(),
+		registry: &c.conns,
+	}
+	c.conns.add(stream)
+	udp, err := c.UDP("1.1.1.1:53", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := c.ActiveConns()
+	if len(conns) != 2 {
+		t.Fatalf("ActiveConns() = %+v, want a stream and a session", conns)
+	}
+	if got := fmt.Sprintf("%s %s %s %s", conns[0].Network, conns[0].Target, conns[1].Network, conns[1].Target); got != "tcp 10.0.0.1:22 udp 1.1.1.1:53" {
+		t.Errorf("ActiveConns() = %v, want the stream, then the session", got)
+	}
+	if !conns[1].LastActive.Equal(conns[1].Opened) {
+		t.Errorf("LastActive = %v of a session that did nothing, want %v", conns[1].LastActive, conns[1].Opened)
+	}
+
+	_ = stream.Close()
+	_ = udp.Close()
+	if conns := c.ActiveConns(); len(conns) != 0 {
+		t.Errorf("ActiveConns() = %+v once closed, want none", conns)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pool"
+)
+
+const (
+	// dnsTimeout bounds DNSExchange when ctx has no deadline.
+	dnsTimeout = 5 * time.Second
+	// dnsHeaderSize is the size of the fixed header of a DNS message.
+	dnsHeaderSize = 12
+	// maxDNSMessageSize is the largest DNS message over UDP.
+	maxDNSMessageSize = 65535
+)
+
+var errDNSQueryTooShort = errors.New("hysteria2: DNS query is shorter than its header")
+
+// DNSExchange sends the DNS query over a new UDP session to server, a
+// host:port, and returns the response. The session is closed afterwards. If
+// ctx has no deadline, the exchange times out after 5 seconds. To send
+// several queries over one session, open it with Client.UDP and use
+// DNSExchangeConn.
+func DNSExchange(ctx context.Context, client Client, server string, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+	conn, err := client.UDP(server, ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return DNSExchangeConn(ctx, conn, query)
+}
+
+// DNSExchangeConn sends the DNS query over conn, a UDP session to a DNS
+// server, and returns the first response with the ID of the query. Other
+// responses, e.g. late ones to earlier queries, are skipped. Exchanges on the
+// same conn must not run concurrently. If ctx is done before the response
+// arrives, conn is closed to stop waiting and the error of ctx is returned.
+func DNSExchangeConn(ctx context.Context, conn netproxy.Conn, query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderSize {
+		return nil, errDNSQueryTooShort
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	if _, err := conn.Write(query); err != nil {
+		return nil, dnsError(ctx, err)
+	}
+	buf := pool.Get(maxDNSMessageSize)
+	defer buf.Put()
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, dnsError(ctx, err)
+		}
+		// Match the ID and the QR bit, which is set in responses.
+		if n >= dnsHeaderSize && buf[0] == query[0] && buf[1] == query[1] && buf[2]&0x80 != 0 {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+// dnsError returns the error of ctx if it caused err by closing the conn.
+func dnsError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
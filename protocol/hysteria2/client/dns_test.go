@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+// pipeClient hands out one end of a net.Pipe as its UDP session.
+type pipeClient struct {
+	Client
+	conn net.Conn
+	addr string
+}
+
+func (c *pipeClient) UDP(addr string, ctx context.Context) (netproxy.Conn, error) {
+	c.addr = addr
+	return c.conn, nil
+}
+
+func TestDNSExchange(t *testing.T) {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	conn, server := net.Pipe()
+	go func() {
+		buf := make([]byte, 512)
+		n, _ := server.Read(buf)
+		resp := append([]byte(nil), buf[:n]...)
+		resp[2] |= 0x80
+		// A late response to another query is skipped.
+		_, _ = server.Write(append([]byte{0x56, 0x78}, resp[2:]...))
+		_, _ = server.Write(resp)
+	}()
+	c := &pipeClient{conn: conn}
+	resp, err := DNSExchange(context.Background(), c, "8.8.8.8:53", query)
+	if err != nil || len(resp) != len(query) || resp[0] != 0x12 || resp[1] != 0x34 {
+		t.Fatalf("DNSExchange() = %x, %v", resp, err)
+	}
+	if c.addr != "8.8.8.8:53" {
+		t.Errorf("UDP() addr = %v, want 8.8.8.8:53", c.addr)
+	}
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Error("DNSExchange() did not close the session")
+	}
+
+	if _, err := DNSExchange(context.Background(), c, "8.8.8.8:53", query[:4]); !errors.Is(err, errDNSQueryTooShort) {
+		t.Errorf("DNSExchange(short query) = %v, want errDNSQueryTooShort", err)
+	}
+}
+
+func TestDNSExchangeTimeout(t *testing.T) {
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	conn, server := net.Pipe()
+	defer server.Close()
+	go server.Read(make([]byte, 512))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := DNSExchangeConn(ctx, conn, query); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DNSExchangeConn() = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/http3"
+)
+
+// maxMasqueradeBody is how much of a masquerade response is read before the
+// stream is closed.
+const maxMasqueradeBody = 64 << 10
+
+// VerifyMasquerade checks that the server of config hides behind its
+// masquerade, the way an active prober sees it: it connects without auth,
+// sends a plain GET for / of the server name, and an auth request without
+// credentials. It fails with errors.ErrMasqueradeLeak if a response gives the
+// proxy away, and with an error if the GET does not get expectStatus, unless
+// expectStatus is zero. It uses a connection of its own.
+func VerifyMasquerade(ctx context.Context, config *Config, expectStatus int) error {
+	config, err := ValidateConfig(config)
+	if err != nil {
+		return err
+	}
+	pktConn, err := config.ConnFactory.New(ctx)
+	if err != nil {
+		return err
+	}
+	defer pktConn.Close()
+	rt := &http3.Transport{
+		TLSClientConfig: config.tlsConfig(),
+		QUICConfig:      config.quicConfig(),
+		Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return config.dialQUIC(ctx, pktConn, tlsCfg, cfg)
+		},
+	}
+	defer rt.Close()
+
+	host := config.TLSConfig.ServerName
+	if host == "" {
+		host, _, _ = net.SplitHostPort(config.ServerAddr.String())
+	}
+	// Both requests have the URL host of the GET, as rt dials a connection
+	// for every URL host and pktConn can only carry one.
+	status, err := masqueradeRoundTrip(ctx, rt, http.MethodGet, &url.URL{Scheme: "https", Host: host, Path: "/"}, "")
+	if err != nil {
+		return err
+	}
+	if expectStatus != 0 && status != expectStatus {
+		return fmt.Errorf("masquerade answered %v, want %v", status, expectStatus)
+	}
+	_, err = masqueradeRoundTrip(ctx, rt, http.MethodPost, &url.URL{Scheme: "https", Host: host, Path: protocol.URLPath}, protocol.URLHost)
+	return err
+}
+
+// masqueradeRoundTrip sends a request without auth, for Host host if not
+// empty, and returns the status of the response, or ErrMasqueradeLeak if the
+// response is that of the proxy.
+func masqueradeRoundTrip(ctx context.Context, rt http.RoundTripper, method string, u *url.URL, host string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if host != "" {
+		req.Host = host
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return 0, coreErrs.ConnectError{Err: err}
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxMasqueradeBody))
+	_ = resp.Body.Close()
+	if resp.StatusCode == protocol.StatusAuthOK {
+		return 0, fmt.Errorf("%w: %v %v%v got status %v", coreErrs.ErrMasqueradeLeak, method, req.Host, u.Path, resp.StatusCode)
+	}
+	for name := range resp.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Hysteria-") {
+			return 0, fmt.Errorf("%w: %v %v%v got header %v", coreErrs.ErrMasqueradeLeak, method, req.Host, u.Path, name)
+		}
+	}
+	return resp.StatusCode, nil
+}
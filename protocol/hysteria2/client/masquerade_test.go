@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/http3"
+)
+
+func TestVerifyMasquerade(t *testing.T) {
+	// leaky answers every auth request, credentials or not.
+	leakyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leakyConn.Close()
+	leaky := startAuthServer(t, leakyConn, nil)
+	defer leaky.Close()
+
+	// masquerading serves a website unless it gets the right credentials.
+	masqueradingConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer masqueradingConn.Close()
+	masquerading := &http3.Server{
+		TLSConfig:  selfSignedTLSConfig(t),
+		QUICConfig: &quic.Config{EnableDatagrams: true},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host == protocol.URLHost && r.URL.Path == protocol.URLPath && r.Header.Get(protocol.RequestHeaderAuth) == "secret" {
+				w.WriteHeader(protocol.StatusAuthOK)
+				return
+			}
+			_, _ = w.Write([]byte("<html>welcome</html>"))
+		}),
+	}
+	go masquerading.Serve(masqueradingConn)
+	defer masquerading.Close()
+
+	config := func(addr net.Addr) *Config {
+		return &Config{
+			ConnFactory: &UdpConnFactory{},
+			ServerAddr:  addr,
+			TLSConfig:   TLSConfig{ServerName: "example.com", InsecureSkipVerify: true},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := VerifyMasquerade(ctx, config(masqueradingConn.LocalAddr()), http.StatusOK); err != nil {
+		t.Errorf("VerifyMasquerade() = %v", err)
+	}
+	err = VerifyMasquerade(ctx, config(masqueradingConn.LocalAddr()), http.StatusForbidden)
+	if err == nil || errors.Is(err, coreErrs.ErrMasqueradeLeak) {
+		t.Errorf("VerifyMasquerade() expecting another status = %v, want a status error", err)
+	}
+	if err := VerifyMasquerade(ctx, config(leakyConn.LocalAddr()), 0); !errors.Is(err, coreErrs.ErrMasqueradeLeak) {
+		t.Errorf("VerifyMasquerade() of a leaky server = %v, want ErrMasqueradeLeak", err)
+	}
+}
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	rand "github.com/daeuniverse/outbound/pkg/fastrand"
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+)
+
+var errPoolAcceptStream = errors.New("AcceptStream is not supported by a pool client")
+
+// NewPoolClient returns a Client that spreads TCP over clients by smooth
+// weighted round-robin: out of every sum(weights) calls, clients[i] gets
+// weights[i], interleaved rather than in bursts. UDP sessions go to a client
+// picked at random in proportion to weights, so that the datagrams of many
+// sessions are not capped by the pacing and flow control of one connection;
+// a session stays on its client. Unhealthy clients, see Client.IsHealthy, are
+// skipped until they recover; if all of them are unhealthy, all of them are
+// used.
+//
+// UDPWithKey sends a key to the same client for as long as that client stays
+// healthy, so that the handles of a key share a session. AcceptStream is not
+// supported. Close closes all the clients.
+func NewPoolClient(clients []Client, weights []int) (Client, error) {
+	return NewPoolClientWithUDPWeights(clients, weights, weights)
+}
+
+// NewPoolClientWithUDPWeights is like NewPoolClient, but weighs the clients
+// by udpWeights for UDP sessions, e.g. by the datagram throughput of their
+// servers.
+func NewPoolClientWithUDPWeights(clients []Client, weights []int, udpWeights []int) (Client, error) {
+	if len(clients) == 0 {
+		return nil, coreErrs.ConfigError{Field: "clients", Reason: "must not be empty"}
+	}
+	if len(weights) != len(clients) {
+		return nil, coreErrs.ConfigError{Field: "weights", Reason: "must have one weight per client"}
+	}
+	if len(udpWeights) != len(clients) {
+		return nil, coreErrs.ConfigError{Field: "udpWeights", Reason: "must have one weight per client"}
+	}
+	p := &poolClient{backends: make([]*poolBackend, len(clients))}
+	for i, c := range clients {
+		if weights[i] <= 0 {
+			return nil, coreErrs.ConfigError{Field: "weights", Reason: "must be positive"}
+		}
+		if udpWeights[i] <= 0 {
+			return nil, coreErrs.ConfigError{Field: "udpWeights", Reason: "must be positive"}
+		}
+		p.backends[i] = &poolBackend{Client: c, id: i, weight: weights[i], udpWeight: udpWeights[i]}
+	}
+	return p, nil
+}
+
+type poolBackend struct {
+	Client
+	// id is the index of the client, to hash keys with.
+	id        int
+	weight    int
+	udpWeight int
+	// current is the running score of smooth weighted round-robin.
+	current int
+}
+
+type poolClient struct {
+	mu       sync.Mutex
+	backends []*poolBackend
+}
+
+// candidates returns the healthy backends, or all of them if none is.
+func (p *poolClient) candidates() []*poolBackend {
+	healthy := make([]*poolBackend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.IsHealthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.backends
+	}
+	return healthy
+}
+
+// next picks a backend by smooth weighted round-robin.
+func (p *poolClient) next() Client {
+	candidates := p.candidates()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *poolBackend
+	total := 0
+	for _, b := range candidates {
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best.Client
+}
+
+// nextUDP picks a backend at random in proportion to the UDP weights.
+func (p *poolClient) nextUDP() Client {
+	candidates := p.candidates()
+	total := 0
+	for _, b := range candidates {
+		total += b.udpWeight
+	}
+	r := rand.Intn(total)
+	for _, b := range candidates {
+		if r -= b.udpWeight; r < 0 {
+			return b.Client
+		}
+	}
+	return candidates[len(candidates)-1].Client
+}
+
+// forKey picks a backend for key by rendezvous hashing, so that a key keeps
+// its backend unless that backend goes down.
+func (p *poolClient) forKey(key string) Client {
+	var best *poolBackend
+	var bestScore uint64
+	for _, b := range p.candidates() {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(strconv.Itoa(b.id)))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best.Client
+}
+
+func (p *poolClient) TCP(addr string, ctx context.Context) (netproxy.Conn, error) {
+	return p.next().TCP(addr, ctx)
+}
+
+func (p *poolClient) TCPWithPriority(addr string, priority int, ctx context.Context) (netproxy.Conn, error) {
+	return p.next().TCPWithPriority(addr, priority, ctx)
+}
+
+func (p *poolClient) TCPWithInitialData(addr string, data []byte, ctx context.Context) (netproxy.Conn, error) {
+	return p.next().TCPWithInitialData(addr, data, ctx)
+}
+
+func (p *poolClient) UDP(addr string, ctx context.Context) (netproxy.Conn, error) {
+	return p.nextUDP().UDP(addr, ctx)
+}
+
+func (p *poolClient) UDPWithKey(addr string, key string, ctx context.Context) (netproxy.Conn, error) {
+	if key == "" {
+		return p.UDP(addr, ctx)
+	}
+	return p.forKey(key).UDPWithKey(addr, key, ctx)
+}
+
+func (p *poolClient) AcceptStream(ctx context.Context) (netproxy.Conn, error) {
+	return nil, errPoolAcceptStream
+}
+
+// IsHealthy reports whether any client is healthy.
+func (p *poolClient) IsHealthy() bool {
+	for _, b := range p.backends {
+		if b.IsHealthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiatedProtocol returns "": the clients have one each.
+func (p *poolClient) NegotiatedProtocol() string {
+	return ""
+}
+
+// ProbeBandwidth returns the sum of the bandwidths of the healthy clients,
+// probed one after another.
+func (p *poolClient) ProbeBandwidth(ctx context.Context) (tx, rx uint64, err error) {
+	for _, b := range p.backends {
+		if !b.IsHealthy() {
+			continue
+		}
+		btx, brx, err := b.ProbeBandwidth(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		tx += btx
+		rx += brx
+	}
+	return tx, rx, nil
+}
+
+func (p *poolClient) UDPSessionCount() int {
+	n := 0
+	for _, b := range p.backends {
+		n += b.UDPSessionCount()
+	}
+	return n
+}
+
+func (p *poolClient) ActiveConns() []ConnInfo {
+	var conns []ConnInfo
+	for _, b := range p.backends {
+		conns = append(conns, b.ActiveConns()...)
+	}
+	sortConnInfos(conns)
+	return conns
+}
+
+func (p *poolClient) Stats() Stats {
+	var stats Stats
+	for _, b := range p.backends {
+		s := b.Stats()
+		stats.TCPTx += s.TCPTx
+		stats.TCPRx += s.TCPRx
+		stats.UDPTx += s.UDPTx
+		stats.UDPRx += s.UDPRx
+	}
+	return stats
+}
+
+// SetKeepAlivePeriod sets the keep-alive period of all the clients. The
+// error is errors.ErrKeepAliveNotLive if any of them is connected.
+func (p *poolClient) SetKeepAlivePeriod(d time.Duration) error {
+	var err error
+	for _, b := range p.backends {
+		if e := b.SetKeepAlivePeriod(d); e != nil && (err == nil || !errors.Is(e, coreErrs.ErrKeepAliveNotLive)) {
+			err = e
+		}
+	}
+	return err
+}
+
+// KeepAlivePeriod returns the keep-alive period of the first client.
+func (p *poolClient) KeepAlivePeriod() time.Duration {
+	return p.backends[0].KeepAlivePeriod()
+}
+
+func (p *poolClient) Close() error {
+	var errs []error
+	for _, b := range p.backends {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
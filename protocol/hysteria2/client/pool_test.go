@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+)
+
+// countingClient counts its dials and fails them, so the test needs no
+// server.
+type countingClient struct {
+	Client
+	name    string
+	dials   int
+	healthy atomic.Bool
+}
+
+func newCountingClient(name string) *countingClient {
+	c := &countingClient{name: name}
+	c.healthy.Store(true)
+	return c
+}
+
+func (c *countingClient) TCP(addr string, ctx context.Context) (netproxy.Conn, error) {
+	c.dials++
+	return nil, fmt.Errorf("dialed %v", c.name)
+}
+
+func (c *countingClient) UDPWithKey(addr string, key string, ctx context.Context) (netproxy.Conn, error) {
+	c.dials++
+	return nil, fmt.Errorf("dialed %v", c.name)
+}
+
+func (c *countingClient) UDP(addr string, ctx context.Context) (netproxy.Conn, error) {
+	c.dials++
+	return nil, fmt.Errorf("dialed %v", c.name)
+}
+
+func (c *countingClient) IsHealthy() bool {
+	return c.healthy.Load()
+}
+
+func TestPoolClient(t *testing.T) {
+	for _, tt := range []struct {
+		clients []Client
+		weights []int
+	}{
+		{nil, nil},
+		{[]Client{newCountingClient("a")}, []int{1, 2}},
+		{[]Client{newCountingClient("a")}, []int{0}},
+	} {
+		var configErr coreErrs.ConfigError
+		if _, err := NewPoolClient(tt.clients, tt.weights); !errors.As(err, &configErr) {
+			t.Errorf("NewPoolClient(%v clients, %v) = %v, want a ConfigError", len(tt.clients), tt.weights, err)
+		}
+	}
+
+	a, b := newCountingClient("a"), newCountingClient("b")
+	p, err := NewPoolClient([]Client{a, b}, []int{3, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order string
+	for i := 0; i < 8; i++ {
+		_, err := p.TCP("example.com:443", context.Background())
+		order += err.Error()[len("dialed "):]
+	}
+	// Smooth: b is not left for the end of the round.
+	if order != "aabaaaba" {
+		t.Errorf("dialed in order %v, want aabaaaba", order)
+	}
+
+	// Unhealthy clients are skipped, until none is healthy.
+	a.dials, b.dials = 0, 0
+	a.healthy.Store(false)
+	for i := 0; i < 4; i++ {
+		_, _ = p.TCP("example.com:443", context.Background())
+	}
+	if a.dials != 0 || b.dials != 4 {
+		t.Errorf("a dialed %v times and b %v times with a unhealthy, want 0 and 4", a.dials, b.dials)
+	}
+	b.healthy.Store(false)
+	if p.IsHealthy() {
+		t.Error("IsHealthy() = true with no healthy client")
+	}
+	if _, err := p.TCP("example.com:443", context.Background()); err == nil {
+		t.Error("TCP() did not dial with no healthy client")
+	}
+	a.healthy.Store(true)
+	b.healthy.Store(true)
+
+	// A key sticks to its client.
+	_, first := p.UDPWithKey("1.1.1.1:3478", "stun", context.Background())
+	for i := 0; i < 4; i++ {
+		if _, err := p.UDPWithKey("1.1.1.1:3478", "stun", context.Background()); err.Error() != first.Error() {
+			t.Fatalf("key moved from %v to %v", first, err)
+		}
+	}
+}
+
+func TestPoolClientUDP(t *testing.T) {
+	a, b := newCountingClient("a"), newCountingClient("b")
+	var configErr coreErrs.ConfigError
+	if _, err := NewPoolClientWithUDPWeights([]Client{a, b}, []int{1, 1}, []int{1, 0}); !errors.As(err, &configErr) {
+		t.Errorf("NewPoolClientWithUDPWeights() with a zero UDP weight = %v, want a ConfigError", err)
+	}
+	p, err := NewPoolClientWithUDPWeights([]Client{a, b}, []int{1, 1}, []int{3, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 4000
+	for i := 0; i < n; i++ {
+		_, _ = p.UDP("1.1.1.1:53", context.Background())
+	}
+	// 3000 expected, with a standard deviation of about 27.
+	if a.dials < 2800 || a.dials > 3200 || a.dials+b.dials != n {
+		t.Errorf("a got %v and b %v of %v UDP sessions, want about 3:1", a.dials, b.dials, n)
+	}
+
+	a.dials, b.dials = 0, 0
+	a.healthy.Store(false)
+	for i := 0; i < 8; i++ {
+		_, _ = p.UDP("1.1.1.1:53", context.Background())
+	}
+	if a.dials != 0 || b.dials != 8 {
+		t.Errorf("a got %v and b %v UDP sessions with a unhealthy, want 0 and 8", a.dials, b.dials)
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+
+	"github.com/daeuniverse/outbound/netproxy"
+
+	"github.com/daeuniverse/quic-go"
+)
+
+type streamPriorityKey struct{}
+
+// WithStreamPriority returns a copy of ctx that makes TCP give the stream it
+// opens the priority priority, see Client.TCPWithPriority. It also works
+// through the hysteria2 dialer, which passes ctx on.
+func WithStreamPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, streamPriorityKey{}, priority)
+}
+
+// prioritizer is implemented by the streams of quic-go versions with stream
+// priorities.
+type prioritizer interface {
+	SetPriority(priority int)
+}
+
+// setStreamPriority applies the priority set on ctx, if any, to stream. It
+// returns false if the stream does not support priorities, in which case all
+// streams are scheduled alike.
+func setStreamPriority(ctx context.Context, stream quic.Stream) bool {
+	priority, ok := ctx.Value(streamPriorityKey{}).(int)
+	if !ok {
+		return true
+	}
+	p, ok := stream.(prioritizer)
+	if !ok {
+		return false
+	}
+	p.SetPriority(priority)
+	return true
+}
+
+func (c *clientImpl) TCPWithPriority(addr string, priority int, ctx context.Context) (netproxy.Conn, error) {
+	return c.TCP(addr, WithStreamPriority(ctx, priority))
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/daeuniverse/quic-go"
+)
+
+type priorityStream struct {
+	quic.Stream
+	priority *int
+}
+
+func (s *priorityStream) SetPriority(priority int) {
+	s.priority = &priority
+}
+
+func TestSetStreamPriority(t *testing.T) {
+	ctx := WithStreamPriority(context.Background(), 7)
+	s := &priorityStream{}
+	if !setStreamPriority(ctx, s) || s.priority == nil || *s.priority != 7 {
+		t.Errorf("priority = %v, want 7", s.priority)
+	}
+
+	// Without a priority, the stream is left alone.
+	s = &priorityStream{}
+	if !setStreamPriority(context.Background(), s) || s.priority != nil {
+		t.Error("priority set without WithStreamPriority")
+	}
+
+	// Streams without priorities degrade to a no-op.
+	if setStreamPriority(ctx, &pipeStream{}) {
+		t.Error("setStreamPriority() = true on a stream without priorities")
+	}
+}
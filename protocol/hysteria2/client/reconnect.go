@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	rand "github.com/daeuniverse/outbound/pkg/fastrand"
+)
+
+const (
+	// DefaultReconnectBaseDelay is used by ReconnectPolicy if BaseDelay is
+	// not set.
+	DefaultReconnectBaseDelay = 500 * time.Millisecond
+	// DefaultReconnectMaxDelay is used by ReconnectPolicy if MaxDelay is not
+	// set.
+	DefaultReconnectMaxDelay = 30 * time.Second
+)
+
+// ReconnectPolicy spreads out the reconnects of the clients that share it,
+// e.g. all the clients of a pool to one server, so that they do not stampede
+// the server when it comes back. Every reconnect takes a turn: turns are at
+// least Interval apart across the clients, and once reconnects fail, the
+// next turn is pushed back by a delay that doubles with every failure in a
+// row, up to MaxDelay, until one succeeds. A reconnect waits for its turn
+// within the context of the call that reconnects. A ReconnectPolicy must not
+// be copied after first use.
+type ReconnectPolicy struct {
+	// Interval is the least time between two reconnects of the clients.
+	// Zero lets them reconnect together as long as none failed.
+	Interval time.Duration
+	// BaseDelay is the delay after the first failure. Zero means
+	// DefaultReconnectBaseDelay.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay after failures. Zero means
+	// DefaultReconnectMaxDelay.
+	MaxDelay time.Duration
+	// Jitter randomizes the interval and the delays by up to this fraction
+	// in both directions, e.g. 0.2 gives between 80% and 120% of the nominal
+	// one, so that clients do not fall into step.
+	Jitter float64
+
+	mu sync.Mutex
+	// failures is the number of reconnects that failed in a row.
+	failures int
+	// next is when the next turn starts.
+	next time.Time
+}
+
+func (p *ReconnectPolicy) jitter(d time.Duration) time.Duration {
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+func (p *ReconnectPolicy) delay(failures int) time.Duration {
+	base, maxDelay := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = DefaultReconnectBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultReconnectMaxDelay
+	}
+	d := base << min(failures-1, 30)
+	if d <= 0 || d > maxDelay {
+		d = maxDelay
+	}
+	return p.jitter(d)
+}
+
+// wait takes the next turn and waits for it, or returns ctx.Err() if ctx is
+// done first.
+func (p *ReconnectPolicy) wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	turn := p.next
+	if turn.Before(now) {
+		turn = now
+	}
+	p.next = turn.Add(p.jitter(p.Interval))
+	p.mu.Unlock()
+
+	if !turn.After(now) {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(turn.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// done records the outcome of a reconnect.
+func (p *ReconnectPolicy) done(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if next := time.Now().Add(p.delay(p.failures)); next.After(p.next) {
+		p.next = next
+	}
+}
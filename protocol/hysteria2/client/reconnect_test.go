@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicy(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	p := &ReconnectPolicy{Interval: interval, BaseDelay: 200 * time.Millisecond}
+	ctx := context.Background()
+
+	// Turns are spread out by the interval.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := p.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("three turns took %v, want at least %v", elapsed, 2*interval)
+	}
+	p.done(nil)
+
+	// A failure pushes the next turn back by BaseDelay.
+	p.done(errors.New("failed"))
+	start = time.Now()
+	if err := p.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("the turn after a failure took %v, want the base delay", elapsed)
+	}
+
+	// The context ends the wait.
+	p.done(errors.New("failed again"))
+	shortCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := p.wait(shortCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() with an expiring context = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A success resets the delay.
+	p.done(nil)
+	if p.failures != 0 {
+		t.Errorf("failures after a success = %v, want 0", p.failures)
+	}
+	if d := p.delay(1); d != p.BaseDelay {
+		t.Errorf("delay(1) = %v, want %v", d, p.BaseDelay)
+	}
+	if d := p.delay(100); d != DefaultReconnectMaxDelay {
+		t.Errorf("delay(100) = %v, want %v", d, DefaultReconnectMaxDelay)
+	}
+}
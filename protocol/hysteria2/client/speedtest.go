@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pool"
+)
+
+// The speed test of the server is reached with a TCP request to
+// speedTestAddr. The client asks for a download or an upload of a size:
+//
+//	direction (1 byte) | size (uint32)
+//
+// and the server answers:
+//
+//	status (1 byte, 0 is OK) | message length (uint16) | message
+//
+// before the data flows.
+const (
+	speedTestAddr     = "@SpeedTest:0"
+	speedTestDownload = 0x1
+	speedTestUpload   = 0x2
+
+	// probeDuration is how long ProbeBandwidth sends, and then receives.
+	probeDuration  = 2 * time.Second
+	probeChunkSize = 64 << 10
+	// probeSize is the size asked for. The probe stops after probeDuration
+	// long before it is reached.
+	probeSize = math.MaxUint32
+)
+
+func (c *clientImpl) ProbeBandwidth(ctx context.Context) (tx, rx uint64, err error) {
+	tx, err = c.probe(ctx, speedTestUpload)
+	if err != nil {
+		return 0, 0, fmt.Errorf("probe upload: %w", err)
+	}
+	rx, err = c.probe(ctx, speedTestDownload)
+	if err != nil {
+		return 0, 0, fmt.Errorf("probe download: %w", err)
+	}
+	return tx, rx, nil
+}
+
+// probe runs the speed test in direction for probeDuration and returns the
+// bytes per second that went through.
+func (c *clientImpl) probe(ctx context.Context, direction byte) (uint64, error) {
+	conn, err := c.TCP(speedTestAddr, ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// Stop the server at once rather than let it finish the size.
+		if r, ok := conn.(interface{ Reset(uint64) error }); ok {
+			_ = r.Reset(0)
+		} else {
+			_ = conn.Close()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	n, elapsed, err := speedTest(conn, direction, probeDuration)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return 0, ctxErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if elapsed <= 0 {
+		return 0, nil
+	}
+	return uint64(float64(n) / elapsed.Seconds()), nil
+}
+
+// speedTest asks the speed test behind conn for data in direction and moves
+// it for d. It returns how many bytes were moved and how long it took.
+func speedTest(conn netproxy.Conn, direction byte, d time.Duration) (n int64, elapsed time.Duration, err error) {
+	var request [5]byte
+	request[0] = direction
+	binary.BigEndian.PutUint32(request[1:], probeSize)
+	if _, err := conn.Write(request[:]); err != nil {
+		return 0, 0, err
+	}
+	if err := readSpeedTestResponse(conn); err != nil {
+		return 0, 0, err
+	}
+	buf := pool.Get(probeChunkSize)
+	defer buf.Put()
+	start := time.Now()
+	_ = conn.SetDeadline(start.Add(d))
+	defer conn.SetDeadline(time.Time{})
+	for {
+		var m int
+		if direction == speedTestUpload {
+			m, err = conn.Write(buf)
+		} else {
+			m, err = conn.Read(buf)
+		}
+		n += int64(m)
+		if err != nil {
+			break
+		}
+	}
+	elapsed = time.Since(start)
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		err = nil
+	}
+	return n, elapsed, err
+}
+
+func readSpeedTestResponse(r io.Reader) error {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return err
+	}
+	if header[0] != 0 {
+		return fmt.Errorf("speed test refused: %s", msg)
+	}
+	return nil
+}
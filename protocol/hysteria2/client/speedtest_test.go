@@ -0,0 +1,63 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveSpeedTest answers the speed test request on conn with status and msg
+// and, if accepted, sends or discards data until conn is closed.
+func serveSpeedTest(t *testing.T, conn net.Conn, status byte, msg string) {
+	defer conn.Close()
+	var request [5]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		t.Error(err)
+		return
+	}
+	if size := binary.BigEndian.Uint32(request[1:]); size != probeSize {
+		t.Errorf("asked for %v bytes, want %v", size, uint32(probeSize))
+	}
+	response := append([]byte{status, 0, byte(len(msg))}, msg...)
+	if _, err := conn.Write(response); err != nil || status != 0 {
+		return
+	}
+	switch request[0] {
+	case speedTestUpload:
+		_, _ = io.Copy(io.Discard, conn)
+	case speedTestDownload:
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	default:
+		t.Errorf("unknown direction %v", request[0])
+	}
+}
+
+func TestSpeedTest(t *testing.T) {
+	for _, direction := range []byte{speedTestUpload, speedTestDownload} {
+		client, server := net.Pipe()
+		go serveSpeedTest(t, server, 0, "")
+		n, elapsed, err := speedTest(client, direction, 50*time.Millisecond)
+		client.Close()
+		if err != nil {
+			t.Fatalf("direction %v: %v", direction, err)
+		}
+		if n == 0 || elapsed < 50*time.Millisecond {
+			t.Errorf("direction %v: moved %v bytes in %v", direction, n, elapsed)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveSpeedTest(t, server, 1, "speed test disabled")
+	if _, _, err := speedTest(client, speedTestDownload, time.Second); err == nil || !strings.Contains(err.Error(), "speed test disabled") {
+		t.Errorf("speedTest() = %v, want the refusal of the server", err)
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import "sync/atomic"
+
+// Stats is the payload a client relayed since it was created, over all its
+// connections, split between TCP streams and UDP datagrams. Both share the
+// QUIC connection and its congestion control, so comparing them shows
+// whether one crowds out the other. Headers and retransmissions are not
+// counted.
+type Stats struct {
+	TCPTx uint64
+	TCPRx uint64
+	UDPTx uint64
+	UDPRx uint64
+	// UDPParseErrors is the number of datagrams dropped because they were
+	// not valid UDP messages, see Config.MaxUDPParseErrors.
+	UDPParseErrors uint64
+}
+
+// trafficCounters are the counters behind Stats, shared with the conns of a
+// client. A nil *trafficCounters counts nothing.
+type trafficCounters struct {
+	tcpTx atomic.Uint64
+	tcpRx atomic.Uint64
+	udpTx atomic.Uint64
+	udpRx atomic.Uint64
+
+	udpParseErrors atomic.Uint64
+}
+
+func (t *trafficCounters) add(counter *atomic.Uint64, n int) {
+	if n > 0 {
+		counter.Add(uint64(n))
+	}
+}
+
+func (t *trafficCounters) addTCPTx(n int) {
+	if t != nil {
+		t.add(&t.tcpTx, n)
+	}
+}
+
+func (t *trafficCounters) addTCPRx(n int) {
+	if t != nil {
+		t.add(&t.tcpRx, n)
+	}
+}
+
+func (t *trafficCounters) addUDPTx(n int) {
+	if t != nil {
+		t.add(&t.udpTx, n)
+	}
+}
+
+func (t *trafficCounters) addUDPRx(n int) {
+	if t != nil {
+		t.add(&t.udpRx, n)
+	}
+}
+
+func (t *trafficCounters) addUDPParseError() {
+	if t != nil {
+		t.udpParseErrors.Add(1)
+	}
+}
+
+func (t *trafficCounters) stats() Stats {
+	return Stats{
+		TCPTx: t.tcpTx.Load(),
+		TCPRx: t.tcpRx.Load(),
+		UDPTx: t.udpTx.Load(),
+		UDPRx: t.udpRx.Load(),
+
+		UDPParseErrors: t.udpParseErrors.Load(),
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/utils"
+)
+
+// echoDatagramConn receives what it sent.
+type echoDatagramConn struct {
+	datagrams chan []byte
+}
+
+func (c *echoDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return <-c.datagrams, nil
+}
+
+func (c *echoDatagramConn) SendDatagram(b []byte) error {
+	c.datagrams <- bytes.Clone(b)
+	return nil
+}
+
+func TestStats(t *testing.T) {
+	var traffic trafficCounters
+
+	// TCP counts the payload, not the request held back by fast open.
+	var request bytes.Buffer
+	_ = protocol.WriteTCPRequest(&request, "10.0.0.1:22")
+	client, server := net.Pipe()
+	c := &tcpConn{Orig: &utils.QStream{Stream: &pipeStream{conn: client}}, request: request.Bytes(), traffic: &traffic}
+	go func() {
+		_, _ = io.ReadFull(server, make([]byte, request.Len()+4))
+		_ = protocol.WriteTCPResponse(server, true, "")
+		_, _ = server.Write([]byte("banner"))
+	}()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	// UDP counts the payload of the messages, not their headers.
+	uio := &udpIOImpl{Conn: &echoDatagramConn{datagrams: make(chan []byte, 1)}, traffic: &traffic}
+	msg := &protocol.UDPMessage{SessionID: 1, Addr: "10.0.0.1:53", Data: []byte("query")}
+	if err := uio.SendMessage(make([]byte, protocol.MaxUDPSize), msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uio.ReceiveMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Stats{TCPTx: 4, TCPRx: 6, UDPTx: 5, UDPRx: 5}
+	if got := traffic.stats(); got != want {
+		t.Errorf("stats() = %+v, want %+v", got, want)
+	}
+}
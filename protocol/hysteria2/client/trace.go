@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ClientTrace is a set of hooks called while the client connects, like
+// httptrace.ClientTrace, e.g. to see where the time of a slow connect goes.
+// Every hook gets the time elapsed since the connect started. Any hook may be
+// nil. A connect that fails stops calling hooks after the failing step.
+type ClientTrace struct {
+	// PacketConnCreated is called once Config.ConnFactory returned the
+	// packet conn, which includes resolving and dialing for a
+	// DialerConnFactory.
+	PacketConnCreated func(localAddr net.Addr, elapsed time.Duration)
+	// QUICHandshakeStart is called before the QUIC handshake.
+	QUICHandshakeStart func(elapsed time.Duration)
+	// QUICHandshakeDone is called once the QUIC connection can send, or
+	// failed with err.
+	QUICHandshakeDone func(err error, elapsed time.Duration)
+	// AuthRequestSent is called once the auth request is handed to the QUIC
+	// connection.
+	AuthRequestSent func(elapsed time.Duration)
+	// AuthResponseReceived is called with the status code of the auth
+	// response, or with the error that prevented getting one.
+	AuthResponseReceived func(statusCode int, err error, elapsed time.Duration)
+	// CongestionControllerSelected is called with the congestion controller
+	// chosen after auth, "bbr" or "brutal", and the send rate of brutal in
+	// bytes per second.
+	CongestionControllerSelected func(name string, tx uint64, elapsed time.Duration)
+}
+
+type clientTraceKey struct{}
+
+// ConnectTimings is the time a connect spent in each step, see Connect. A
+// step that was not reached is zero.
+type ConnectTimings struct {
+	// PacketConn is the time Config.ConnFactory took to return the packet
+	// conn.
+	PacketConn time.Duration
+	// QUICHandshake is the time until the QUIC connection could send. With
+	// 0-RTT, it does not wait for the handshake to complete.
+	QUICHandshake time.Duration
+	// Auth is the time from sending the auth request to getting the
+	// response, over all the attempts with Config.AuthFallbacks.
+	Auth time.Duration
+	// Total is the time of the whole connect.
+	Total time.Duration
+}
+
+type connectTimingsKey struct{}
+
+// connectTimings records the ConnectTimings of a connect from the elapsed
+// times its steps are traced at. The QUIC dial runs in a goroutine of its own
+// that may outlive a failed connect, hence the lock.
+type connectTimings struct {
+	mu             sync.Mutex
+	timings        ConnectTimings
+	handshakeStart time.Duration
+	authStart      time.Duration
+	authSent       bool
+}
+
+// record calls f with the lock held, if t is not nil.
+func (t *connectTimings) record(f func(t *connectTimings)) {
+	if t != nil {
+		t.mu.Lock()
+		f(t)
+		t.mu.Unlock()
+	}
+}
+
+func (t *connectTimings) get() ConnectTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timings
+}
+
+func withConnectTimings(ctx context.Context, timings *connectTimings) context.Context {
+	return context.WithValue(ctx, connectTimingsKey{}, timings)
+}
+
+// WithClientTrace returns a copy of ctx that makes the connect it causes, if
+// any, call the hooks of trace instead of those of Config.Trace.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// connectTrace calls the hooks of a ClientTrace, if any, with the time
+// elapsed since start.
+type connectTrace struct {
+	*ClientTrace
+	start   time.Time
+	timings *connectTimings
+}
+
+func (c *clientImpl) newConnectTrace(ctx context.Context) connectTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	if trace == nil {
+		trace = c.config.Trace
+	}
+	timings, _ := ctx.Value(connectTimingsKey{}).(*connectTimings)
+	return connectTrace{ClientTrace: trace, start: time.Now(), timings: timings}
+}
+
+func (t connectTrace) packetConnCreated(localAddr net.Addr) {
+	elapsed := time.Since(t.start)
+	t.timings.record(func(ct *connectTimings) { ct.timings.PacketConn = elapsed })
+	if t.ClientTrace != nil && t.PacketConnCreated != nil {
+		t.PacketConnCreated(localAddr, time.Since(t.start))
+	}
+}
+
+func (t connectTrace) quicHandshakeStart() {
+	elapsed := time.Since(t.start)
+	t.timings.record(func(ct *connectTimings) { ct.handshakeStart = elapsed })
+	if t.ClientTrace != nil && t.QUICHandshakeStart != nil {
+		t.QUICHandshakeStart(time.Since(t.start))
+	}
+}
+
+func (t connectTrace) quicHandshakeDone(err error) {
+	elapsed := time.Since(t.start)
+	t.timings.record(func(ct *connectTimings) { ct.timings.QUICHandshake = elapsed - ct.handshakeStart })
+	if t.ClientTrace != nil && t.QUICHandshakeDone != nil {
+		t.QUICHandshakeDone(err, time.Since(t.start))
+	}
+}
+
+func (t connectTrace) authRequestSent() {
+	elapsed := time.Since(t.start)
+	t.timings.record(func(ct *connectTimings) {
+		if !ct.authSent {
+			ct.authStart, ct.authSent = elapsed, true
+		}
+	})
+	if t.ClientTrace != nil && t.AuthRequestSent != nil {
+		t.AuthRequestSent(time.Since(t.start))
+	}
+}
+
+func (t connectTrace) authResponseReceived(statusCode int, err error) {
+	elapsed := time.Since(t.start)
+	t.timings.record(func(ct *connectTimings) {
+		if ct.authSent {
+			ct.timings.Auth = elapsed - ct.authStart
+		}
+	})
+	if t.ClientTrace != nil && t.AuthResponseReceived != nil {
+		t.AuthResponseReceived(statusCode, err, time.Since(t.start))
+	}
+}
+
+func (t connectTrace) congestionControllerSelected(name string, tx uint64) {
+	if t.ClientTrace != nil && t.CongestionControllerSelected != nil {
+		t.CongestionControllerSelected(name, tx, time.Since(t.start))
+	}
+}
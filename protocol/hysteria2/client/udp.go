@@ -1,10 +1,14 @@
 package client
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	rand "github.com/daeuniverse/outbound/pkg/fastrand"
@@ -12,15 +16,21 @@ import (
 	"github.com/daeuniverse/quic-go"
 
 	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pkg/tokenbucket"
+	"github.com/daeuniverse/outbound/pool"
 	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/frag"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
 )
 
 const (
-	udpMessageChanSize = 1024
+	// defaultUDPSessionQueueSize is how many received messages a UDP session
+	// buffers for its reader by default.
+	defaultUDPSessionQueueSize = 1024
 )
 
+var errUDPKeyBound = errors.New("UDP session key is bound to another address")
+
 type udpIO interface {
 	ReceiveMessage() (*protocol.UDPMessage, error)
 	SendMessage([]byte, *protocol.UDPMessage) error
@@ -30,14 +40,31 @@ type udpConn struct {
 	ID        uint32
 	D         *frag.Defragger
 	ReceiveCh chan *protocol.UDPMessage
-	SendBuf   []byte
-	SendFunc  func([]byte, *protocol.UDPMessage) error
-	CloseFunc func()
-	Closed    bool
+	// BufSize is the size of the send buffers, which are taken from the pool
+	// for every write instead of being held by the session.
+	BufSize int
+	Closed  bool
+
+	// mgr and defragger are kept in the session rather than in closures
+	// and separate allocations, which adds up with many short sessions.
+	mgr       *udpSessionManager
+	defragger frag.Defragger
 
 	muTimer sync.Mutex
 	timer   *time.Timer
 	target  string
+	opened  time.Time
+	// done is closed with the session to wake up writes waiting for the
+	// pacer. It is only made with pacing on.
+	done chan struct{}
+	// lastUsed is when the session last sent or received, in Unix
+	// nanoseconds, to find the least recently used one.
+	lastUsed atomic.Int64
+
+	// Key and refs are only used by sessions created with NewUDPWithKey and
+	// are protected by the mutex of the session manager.
+	Key  string
+	refs []*udpConnRef
 }
 
 func (u *udpConn) Read(b []byte) (n int, err error) {
@@ -50,26 +77,58 @@ func (u *udpConn) Write(b []byte) (n int, err error) {
 }
 
 func (u *udpConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	return readUDPMessage(context.Background(), u.ReceiveCh, u.D, p)
+}
+
+// ReadContext is like Read, but gives up with ctx.Err() once ctx is done,
+// leaving the session open for the next read, e.g. to retry a DNS query.
+func (u *udpConn) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	n, _, err = readUDPMessage(ctx, u.ReceiveCh, u.D, p)
+	return n, err
+}
+
+func readUDPMessage(ctx context.Context, ch chan *protocol.UDPMessage, d *frag.Defragger, p []byte) (n int, addr netip.AddrPort, err error) {
 	for {
-		msg := <-u.ReceiveCh
+		var msg *protocol.UDPMessage
+		select {
+		case msg = <-ch:
+		case <-ctx.Done():
+			return 0, netip.AddrPort{}, ctx.Err()
+		}
 		if msg == nil {
 			// Closed
 			return 0, netip.AddrPort{}, io.EOF
 		}
-		dfMsg := u.D.Feed(msg)
+		fragmented := msg.FragCount > 1
+		dfMsg := d.Feed(msg)
 		if dfMsg == nil {
 			// Incomplete message, wait for more
 			continue
 		}
 		netipAddr, err := netip.ParseAddrPort(dfMsg.Addr)
-		if err != nil {
-			return 0, netipAddr, err
+		if err == nil {
+			n = copy(p, dfMsg.Data)
+		}
+		if fragmented {
+			// The defragger assembled the data into a pooled buffer.
+			pool.Put(dfMsg.Data)
 		}
-		return copy(p, dfMsg.Data), netipAddr, nil
+		return n, netipAddr, err
 	}
 }
 
 func (u *udpConn) WriteTo(b []byte, addr string) (n int, err error) {
+	u.lastUsed.Store(time.Now().UnixNano())
+	if u.mgr.pacer != nil {
+		if err := u.mgr.pace(u.done, (&protocol.UDPMessage{Addr: addr}).HeaderSize()+len(b)); err != nil {
+			return 0, err
+		}
+	}
+	if u.mgr.batch != nil {
+		return u.mgr.batch.add(u.ID, addr, b)
+	}
+	buf := pool.Get(u.BufSize)
+	defer pool.Put(buf)
 	// Try no frag first
 	msg := &protocol.UDPMessage{
 		SessionID: u.ID,
@@ -79,29 +138,61 @@ func (u *udpConn) WriteTo(b []byte, addr string) (n int, err error) {
 		Addr:      addr,
 		Data:      b,
 	}
-	err = u.SendFunc(u.SendBuf, msg)
+	if err = sendUDPMessage(u.mgr.io, buf, msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sendUDPMessage sends msg, serialized into buf, and falls back to fragments
+// if it does not fit a datagram.
+func sendUDPMessage(io udpIO, buf []byte, msg *protocol.UDPMessage) error {
+	err := io.SendMessage(buf, msg)
 	var errTooLarge *quic.DatagramTooLargeError
-	if errors.As(err, &errTooLarge) {
-		// Message too large, try fragmentation
-		msg.PacketID = uint16(rand.Intn(0xFFFF)) + 1
-		fMsgs := frag.FragUDPMessage(msg, int(errTooLarge.MaxDataLen))
-		for _, fMsg := range fMsgs {
-			err := u.SendFunc(u.SendBuf, &fMsg)
-			if err != nil {
-				return 0, err
-			}
+	if !errors.As(err, &errTooLarge) {
+		return err
+	}
+	// Message too large, try fragmentation
+	msg.PacketID = uint16(rand.Intn(0xFFFF)) + 1
+	fMsgs := frag.FragUDPMessage(msg, int(errTooLarge.MaxDataLen))
+	for _, fMsg := range fMsgs {
+		if err := io.SendMessage(buf, &fMsg); err != nil {
+			return err
 		}
-		return len(b), nil
-	} else {
-		return len(b), err
 	}
+	return nil
+}
+
+// MaxUDPPayload returns the largest payload a write to the target of the
+// session can carry; larger ones are dropped. Payloads above the datagram
+// size of the connection are fragmented. The value may shrink once the
+// connection turns out to carry less than expected.
+func (u *udpConn) MaxUDPPayload() int {
+	headerSize := (&protocol.UDPMessage{Addr: u.target}).HeaderSize()
+	limit := u.BufSize
+	if l, ok := u.mgr.io.(interface{ messageLimit(int, int) int }); ok {
+		limit = l.messageLimit(limit, headerSize)
+	}
+	return max(limit-headerSize, 0)
+}
+
+// Flush sends the messages written but held back by the batching window, see
+// Config.UDPBatchWindow. It returns the first error of sending them.
+func (u *udpConn) Flush() error {
+	return u.mgr.Flush()
 }
 
 func (u *udpConn) Close() error {
-	u.CloseFunc()
+	u.mgr.mutex.Lock()
+	defer u.mgr.mutex.Unlock()
+	u.mgr.close(u)
 	return nil
 }
 
+func (u *udpConn) IsStream() bool {
+	return false
+}
+
 func (u *udpConn) SetDeadline(t time.Time) error {
 	u.muTimer.Lock()
 	defer u.muTimer.Unlock()
@@ -129,21 +220,99 @@ func (u *udpConn) SetWriteDeadline(t time.Time) error {
 	return u.SetDeadline(t)
 }
 
+// udpConnRef is a handle to a keyed session shared by several callers. Every
+// handle receives its own copy of each reply. Closing it releases the
+// reference; the session closes with its last reference.
+type udpConnRef struct {
+	*udpConn
+	receiveCh chan *protocol.UDPMessage
+	d         *frag.Defragger
+
+	closeOnce sync.Once
+	closeFunc func()
+	muTimer   sync.Mutex
+	timer     *time.Timer
+}
+
+func (r *udpConnRef) Read(b []byte) (n int, err error) {
+	n, _, err = r.ReadFrom(b)
+	return n, err
+}
+
+func (r *udpConnRef) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	return readUDPMessage(context.Background(), r.receiveCh, r.d, p)
+}
+
+func (r *udpConnRef) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	n, _, err = readUDPMessage(ctx, r.receiveCh, r.d, p)
+	return n, err
+}
+
+func (r *udpConnRef) Close() error {
+	r.closeOnce.Do(r.closeFunc)
+	return nil
+}
+
+func (r *udpConnRef) SetDeadline(t time.Time) error {
+	r.muTimer.Lock()
+	defer r.muTimer.Unlock()
+	dur := time.Until(t)
+	if r.timer != nil {
+		r.timer.Reset(dur)
+	} else {
+		r.timer = time.AfterFunc(dur, func() {
+			r.Close()
+		})
+	}
+	return nil
+}
+
+func (r *udpConnRef) SetReadDeadline(t time.Time) error {
+	// FIXME: Single direction.
+	return r.SetDeadline(t)
+}
+
+func (r *udpConnRef) SetWriteDeadline(t time.Time) error {
+	// FIXME: Single direction.
+	return r.SetDeadline(t)
+}
+
 type udpSessionManager struct {
-	io udpIO
+	io        udpIO
+	bufSize   int
+	queueSize int
+	// batch, if not nil, holds back writes to send them in bursts.
+	batch *udpBatch
+	// maxSessions, if positive, caps the number of sessions. At the cap, a
+	// new session evicts the least recently used one if evict is set, or
+	// fails.
+	maxSessions int
+	evict       bool
+	// pacer, if not nil, spaces out writes, see Config.UDPPacingBps.
+	pacer *tokenbucket.Bucket
 
 	mutex  sync.RWMutex
 	m      map[uint32]*udpConn
+	keyed  map[string]*udpConn
 	nextID uint32
 
 	closed bool
 }
 
-func newUDPSessionManager(io udpIO) *udpSessionManager {
+// newUDPSessionManager creates a session manager sending through io with
+// buffers of bufSize bytes. Every session buffers up to queueSize received
+// messages; zero means defaultUDPSessionQueueSize.
+func newUDPSessionManager(io udpIO, bufSize int, queueSize int) *udpSessionManager {
+	if queueSize <= 0 {
+		queueSize = defaultUDPSessionQueueSize
+	}
 	m := &udpSessionManager{
-		io:     io,
-		m:      make(map[uint32]*udpConn),
-		nextID: 1,
+		io:        io,
+		bufSize:   bufSize,
+		queueSize: queueSize,
+		m:         make(map[uint32]*udpConn),
+		keyed:     make(map[string]*udpConn),
+		nextID:    1,
 	}
 	go m.run()
 	return m
@@ -179,7 +348,19 @@ func (m *udpSessionManager) feed(msg *protocol.UDPMessage) {
 		// Ignore message from unknown session
 		return
 	}
-
+	conn.lastUsed.Store(time.Now().UnixNano())
+
+	if conn.Key != "" {
+		for _, ref := range conn.refs {
+			// The defragger of each handle modifies the message.
+			msg := *msg
+			select {
+			case ref.receiveCh <- &msg:
+			default:
+			}
+		}
+		return
+	}
 	select {
 	case conn.ReceiveCh <- msg:
 		// OK
@@ -196,40 +377,296 @@ func (m *udpSessionManager) NewUDP(addr string) (netproxy.Conn, error) {
 	if m.closed {
 		return nil, coreErrs.ClosedError{}
 	}
+	if err := m.makeRoom(); err != nil {
+		return nil, err
+	}
+
+	return m.newUDP(addr), nil
+}
+
+// NewUDPWithKey returns a handle to the UDP session identified by key, creating
+// the session if needed. Callers using the same key share one session, so the
+// server sees a single stable flow for them. A key belongs to one destination:
+// asking for it with another addr fails. Every handle receives all replies.
+// The session is closed once all handles are closed. An empty key is the same
+// as NewUDP.
+func (m *udpSessionManager) NewUDPWithKey(addr string, key string) (netproxy.Conn, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil, coreErrs.ClosedError{}
+	}
+	if key == "" {
+		if err := m.makeRoom(); err != nil {
+			return nil, err
+		}
+		return m.newUDP(addr), nil
+	}
 
+	conn, ok := m.keyed[key]
+	if !ok {
+		if err := m.makeRoom(); err != nil {
+			return nil, err
+		}
+		conn = m.newUDP(addr)
+		conn.Key = key
+		m.keyed[key] = conn
+	} else if conn.target != addr {
+		return nil, fmt.Errorf("%w: key %q, %v, not %v", errUDPKeyBound, key, conn.target, addr)
+	}
+	ref := &udpConnRef{
+		udpConn:   conn,
+		receiveCh: make(chan *protocol.UDPMessage, m.queueSize),
+		d:         &frag.Defragger{},
+	}
+	ref.closeFunc = func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.release(conn, ref)
+	}
+	conn.refs = append(conn.refs, ref)
+	return ref, nil
+}
+
+// release drops ref from its session and closes the session with its last
+// handle. m.mutex must be held.
+func (m *udpSessionManager) release(conn *udpConn, ref *udpConnRef) {
+	for i, r := range conn.refs {
+		if r == ref {
+			conn.refs = append(conn.refs[:i], conn.refs[i+1:]...)
+			close(ref.receiveCh)
+			break
+		}
+	}
+	if len(conn.refs) == 0 {
+		m.close(conn)
+	}
+}
+
+// makeRoom makes sure that one more session fits under maxSessions, evicting
+// the least recently used session if allowed. m.mutex must be held.
+func (m *udpSessionManager) makeRoom() error {
+	if m.maxSessions <= 0 || len(m.m) < m.maxSessions {
+		return nil
+	}
+	if !m.evict {
+		return coreErrs.ErrTooManyUDPSessions
+	}
+	var lru *udpConn
+	for _, conn := range m.m {
+		if lru == nil || conn.lastUsed.Load() < lru.lastUsed.Load() {
+			lru = conn
+		}
+	}
+	m.close(lru)
+	return nil
+}
+
+// newUDP creates a new session. m.mutex must be held.
+func (m *udpSessionManager) newUDP(addr string) *udpConn {
 	id := m.nextID
 	m.nextID++
 
 	conn := &udpConn{
 		ID:        id,
-		D:         &frag.Defragger{},
-		ReceiveCh: make(chan *protocol.UDPMessage, udpMessageChanSize),
-		SendBuf:   make([]byte, protocol.MaxUDPSize),
-		SendFunc:  m.io.SendMessage,
+		ReceiveCh: make(chan *protocol.UDPMessage, m.queueSize),
+		BufSize:   m.bufSize,
 
 		muTimer: sync.Mutex{},
 		target:  addr,
+		opened:  time.Now(),
+		mgr:     m,
 	}
-	conn.CloseFunc = func() {
-		m.mutex.Lock()
-		defer m.mutex.Unlock()
-		m.close(conn)
+	conn.D = &conn.defragger
+	conn.lastUsed.Store(conn.opened.UnixNano())
+	if m.pacer != nil {
+		conn.done = make(chan struct{})
 	}
 	m.m[id] = conn
 
-	return conn, nil
+	return conn
 }
 
 func (m *udpSessionManager) close(conn *udpConn) {
 	if !conn.Closed {
 		conn.Closed = true
 		close(conn.ReceiveCh)
+		if conn.done != nil {
+			close(conn.done)
+		}
+		for _, ref := range conn.refs {
+			close(ref.receiveCh)
+		}
+		conn.refs = nil
 		delete(m.m, conn.ID)
+		if conn.Key != "" && m.keyed[conn.Key] == conn {
+			delete(m.keyed, conn.Key)
+		}
+	}
+}
+
+// setBatchWindow makes writes wait up to window, or until udpBatchSize of
+// them are pending, to be sent back to back. It must be called before the
+// first session is created.
+func (m *udpSessionManager) setBatchWindow(window time.Duration) {
+	m.batch = &udpBatch{
+		io:     m.io,
+		buf:    make([]byte, m.bufSize),
+		window: window,
 	}
 }
 
+// setMaxSessions caps the number of sessions at max, see
+// Config.MaxUDPSessions. It must be called before the first session is
+// created.
+func (m *udpSessionManager) setMaxSessions(max int, evict bool) {
+	m.maxSessions = max
+	m.evict = evict
+}
+
+// udpPacingBurst is how much of the pacing rate may be sent back to back.
+const udpPacingBurst = 10 * time.Millisecond
+
+// setPacing limits the writes of all sessions to bps bytes per second, see
+// Config.UDPPacingBps. It must be called before the first session is
+// created.
+func (m *udpSessionManager) setPacing(bps uint64) {
+	burst := max(bps*uint64(udpPacingBurst)/uint64(time.Second), 1)
+	m.pacer = tokenbucket.New(bps, burst)
+}
+
+// pace waits until the pacer lets n bytes go, or fails with net.ErrClosed
+// once done is closed.
+func (m *udpSessionManager) pace(done <-chan struct{}, n int) error {
+	delay := m.pacer.Take(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		m.pacer.Refund(n)
+		return net.ErrClosed
+	}
+}
+
+// Flush sends the writes held back by the batching window, if any.
+func (m *udpSessionManager) Flush() error {
+	if m.batch == nil {
+		return nil
+	}
+	return m.batch.Flush()
+}
+
+// sessions describes the open sessions for ActiveConns.
+func (m *udpSessionManager) sessions() []ConnInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	conns := make([]ConnInfo, 0, len(m.m))
+	for _, conn := range m.m {
+		conns = append(conns, ConnInfo{
+			Network:    "udp",
+			Target:     conn.target,
+			Opened:     conn.opened,
+			LastActive: time.Unix(0, conn.lastUsed.Load()),
+		})
+	}
+	return conns
+}
+
 func (m *udpSessionManager) Count() int {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 	return len(m.m)
 }
+
+const (
+	// udpBatchSize is how many pending writes trigger sending a batch before
+	// its window is over.
+	udpBatchSize = 64
+)
+
+// udpBatch collects the writes of all sessions and sends them back to back,
+// once udpBatchSize of them are pending or the window since the first one
+// is over. Handing quic-go a burst of datagrams lets its send loop pack them
+// in one wake up instead of waking up for each, and messages are serialized
+// into one reused buffer instead of one from the pool per write.
+type udpBatch struct {
+	io     udpIO
+	window time.Duration
+
+	mu      sync.Mutex
+	buf     []byte // serialization buffer
+	data    []byte // payloads of the pending writes, back to back
+	pending []pendingUDPMessage
+	timer   *time.Timer
+}
+
+type pendingUDPMessage struct {
+	sessionID  uint32
+	addr       string
+	start, end int // payload in data
+}
+
+func (b *udpBatch) add(sessionID uint32, addr string, p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, pendingUDPMessage{
+		sessionID: sessionID,
+		addr:      addr,
+		start:     len(b.data),
+		end:       len(b.data) + len(p),
+	})
+	b.data = append(b.data, p...)
+	if len(b.pending) >= udpBatchSize {
+		// Errors of a batch that was not flushed explicitly are dropped, as
+		// for lost packets.
+		_ = b.flushLocked()
+		return len(p), nil
+	}
+	if len(b.pending) == 1 {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.window, func() {
+				_ = b.Flush()
+			})
+		} else {
+			b.timer.Reset(b.window)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *udpBatch) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked()
+}
+
+func (b *udpBatch) flushLocked() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	var firstErr error
+	for _, pm := range b.pending {
+		msg := protocol.UDPMessage{
+			SessionID: pm.sessionID,
+			FragCount: 1,
+			Addr:      pm.addr,
+			Data:      b.data[pm.start:pm.end],
+		}
+		if err := sendUDPMessage(b.io, b.buf, &msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	clear(b.pending)
+	b.pending = b.pending[:0]
+	b.data = b.data[:0]
+	return firstErr
+}
@@ -0,0 +1,727 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	coreErrs "github.com/daeuniverse/outbound/protocol/hysteria2/errors"
+	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
+	"github.com/daeuniverse/quic-go"
+)
+
+// recvDatagramConn receives the datagrams sent to its channel.
+type recvDatagramConn struct {
+	datagrams chan []byte
+}
+
+func (c *recvDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return <-c.datagrams, nil
+}
+
+func (c *recvDatagramConn) SendDatagram([]byte) error {
+	return nil
+}
+
+func TestUDPEmptyPayload(t *testing.T) {
+	conn := &recvDatagramConn{datagrams: make(chan []byte, 8)}
+	m := newUDPSessionManager(&udpIOImpl{Conn: conn}, protocol.MaxUDPSize, 0)
+	a, err := m.NewUDP("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := m.NewUDP("8.8.8.8:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	idA, idB := a.(*udpConn).ID, b.(*udpConn).ID
+
+	replies := []*protocol.UDPMessage{
+		{SessionID: idA, FragCount: 1, Addr: "1.1.1.1:53", Data: []byte("a1")},
+		{SessionID: idB, FragCount: 1, Addr: "8.8.8.8:53", Data: []byte("b1")},
+		{SessionID: 0xdead, FragCount: 1, Addr: "9.9.9.9:53", Data: []byte("x")},
+		{SessionID: idA, FragCount: 1, Addr: "1.1.1.1:53", Data: []byte("a2")},
+		{SessionID: idB, FragCount: 1, Addr: "8.8.8.8:53", Data: []byte{}},
+		{SessionID: idB, FragCount: 1, Addr: "8.8.8.8:53", Data: []byte("b3")},
+	}
+	for _, msg := range replies {
+		buf := make([]byte, protocol.MaxUDPSize)
+		conn.datagrams <- buf[:msg.Serialize(buf)]
+	}
+
+	read := func(c interface {
+		Read([]byte) (int, error)
+	}, want string) {
+		t.Helper()
+		done := make(chan struct{})
+		var got string
+		var err error
+		go func() {
+			defer close(done)
+			p := make([]byte, 16)
+			var n int
+			n, err = c.Read(p)
+			got = string(p[:n])
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Read() timed out, want %q", want)
+		}
+		if err != nil {
+			t.Fatalf("Read() error = %v, want %q", err, want)
+		}
+		if got != want {
+			t.Fatalf("Read() = %q, want %q", got, want)
+		}
+	}
+	read(a, "a1")
+	read(a, "a2")
+	read(b, "b1")
+	read(b, "")
+	read(b, "b3")
+}
+
+type chanUDPIO struct {
+	ch chan *protocol.UDPMessage
+}
+
+func (io *chanUDPIO) ReceiveMessage() (*protocol.UDPMessage, error) {
+	msg, ok := <-io.ch
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return msg, nil
+}
+
+func (io *chanUDPIO) SendMessage([]byte, *protocol.UDPMessage) error {
+	return nil
+}
+
+type fakeQUICConn struct {
+	quic.Connection
+}
+
+func (fakeQUICConn) Context() context.Context {
+	return context.Background()
+}
+
+func TestUDPWithKey(t *testing.T) {
+	mio := &chanUDPIO{ch: make(chan *protocol.UDPMessage, 8)}
+	defer close(mio.ch)
+	m := newUDPSessionManager(mio, protocol.MaxUDPSize, 0)
+	c := &clientImpl{config: &Config{}, conn: fakeQUICConn{}, udpSM: m}
+
+	a, err := c.UDPWithKey("1.1.1.1:3478", "stun", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.UDPWithKey("1.1.1.1:3478", "stun", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UDPWithKey("8.8.8.8:3478", "stun", context.Background()); err == nil {
+		t.Error("UDPWithKey() with another addr for the same key should fail")
+	}
+	other, err := c.UDP("1.1.1.1:3478", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := a.(*udpConnRef).ID
+	if b.(*udpConnRef).ID != id || other.(*udpConn).ID == id {
+		t.Fatal("handles of the same key must share a session, plain UDP must not")
+	}
+	if got := m.Count(); got != 2 {
+		t.Errorf("Count() = %v, want 2", got)
+	}
+
+	// Both handles see the reply; neither steals it from the other.
+	mio.ch <- &protocol.UDPMessage{SessionID: id, FragCount: 1, Addr: "1.1.1.1:3478", Data: []byte("pong")}
+	for _, h := range []netproxy.Conn{a, b} {
+		buf := make([]byte, 16)
+		n, err := h.Read(buf)
+		if err != nil || string(buf[:n]) != "pong" {
+			t.Fatalf("Read() = %q, %v, want pong", buf[:n], err)
+		}
+	}
+
+	// The session lives until its last handle is closed.
+	a.Close()
+	a.Close()
+	if got := m.Count(); got != 2 {
+		t.Errorf("Count() = %v, want 2", got)
+	}
+	b.Close()
+	if got := m.Count(); got != 1 {
+		t.Errorf("Count() = %v, want 1", got)
+	}
+	if _, err := b.Read(make([]byte, 16)); err == nil {
+		t.Error("Read() on a closed handle should fail")
+	}
+	other.Close()
+}
+
+func TestMaxUDPSessions(t *testing.T) {
+	mio := &chanUDPIO{ch: make(chan *protocol.UDPMessage, 8)}
+	defer close(mio.ch)
+	m := newUDPSessionManager(mio, protocol.MaxUDPSize, 0)
+	m.setMaxSessions(2, false)
+	c := &clientImpl{config: &Config{}, conn: fakeQUICConn{}, udpSM: m}
+
+	a, err := c.UDP("1.1.1.1:53", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.UDPWithKey("1.1.1.1:3478", "stun", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UDP("8.8.8.8:53", context.Background()); !errors.Is(err, coreErrs.ErrTooManyUDPSessions) {
+		t.Fatalf("UDP() at the cap = %v, want ErrTooManyUDPSessions", err)
+	}
+	// Another handle of an open key needs no new session.
+	b2, err := c.UDPWithKey("1.1.1.1:3478", "stun", context.Background())
+	if err != nil {
+		t.Fatalf("UDPWithKey() of an open key at the cap = %v", err)
+	}
+	if got := c.UDPSessionCount(); got != 2 {
+		t.Errorf("UDPSessionCount() = %v, want 2", got)
+	}
+
+	// With eviction, the least recently used session makes room.
+	m.setMaxSessions(2, true)
+	b.(*udpConnRef).lastUsed.Store(time.Now().Add(-time.Minute).UnixNano())
+	d, err := c.UDP("8.8.8.8:53", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got := c.UDPSessionCount(); got != 2 {
+		t.Errorf("UDPSessionCount() = %v, want 2", got)
+	}
+	for _, h := range []netproxy.Conn{b, b2} {
+		if _, err := h.Read(make([]byte, 16)); err == nil {
+			t.Error("Read() on an evicted session should fail")
+		}
+	}
+	a.Close()
+	if got := c.UDPSessionCount(); got != 1 {
+		t.Errorf("UDPSessionCount() = %v, want 1", got)
+	}
+}
+
+// smallDatagramConn only carries datagrams of up to max bytes.
+type smallDatagramConn struct {
+	max  int
+	sent [][]byte
+}
+
+func (c *smallDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *smallDatagramConn) SendDatagram(b []byte) error {
+	if len(b) > c.max {
+		return &quic.DatagramTooLargeError{MaxDataLen: int64(c.max)}
+	}
+	c.sent = append(c.sent, append([]byte(nil), b...))
+	return nil
+}
+
+func TestUDPBufferClampedToConnection(t *testing.T) {
+	dc := &smallDatagramConn{max: 100}
+	uio := &udpIOImpl{Conn: dc}
+	// The buffer is larger than what 255 fragments of 100 bytes can carry.
+	buf := make([]byte, maxUDPBufferSize)
+	msg := &protocol.UDPMessage{SessionID: 1, FragCount: 1, Addr: "1.1.1.1:53", Data: make([]byte, 200)}
+	limit := msg.HeaderSize() + maxUDPFragments*(100-msg.HeaderSize())
+
+	// The first oversized message teaches the io the datagram limit.
+	var errTooLarge *quic.DatagramTooLargeError
+	if err := uio.SendMessage(buf, msg); !errors.As(err, &errTooLarge) {
+		t.Fatalf("SendMessage() = %v, want DatagramTooLargeError", err)
+	}
+	if got := int(uio.maxMessage.Load()); got != limit {
+		t.Fatalf("maxMessage = %v, want %v", got, limit)
+	}
+
+	// Messages the connection could never carry, even in fragments, are
+	// dropped before reaching it.
+	msg.Data = make([]byte, limit)
+	if err := uio.SendMessage(buf, msg); err != nil {
+		t.Fatalf("SendMessage() = %v, want a silent drop", err)
+	}
+	msg.Data = make([]byte, 10)
+	if err := uio.SendMessage(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.sent) != 1 {
+		t.Errorf("sent %v datagrams, want 1", len(dc.sent))
+	}
+}
+
+func TestMaxUDPPayload(t *testing.T) {
+	dc := &smallDatagramConn{max: 100}
+	m := newUDPSessionManager(&udpIOImpl{Conn: dc, datagramHint: 100}, maxUDPBufferSize, 0)
+	c, err := m.NewUDP("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	hs := (&protocol.UDPMessage{Addr: "1.1.1.1:53"}).HeaderSize()
+	payload := c.(*udpConn).MaxUDPPayload()
+	if want := maxUDPFragments * (100 - hs); payload != want {
+		t.Fatalf("MaxUDPPayload() = %v, want %v", payload, want)
+	}
+
+	// The largest payload goes out in fragments, anything larger is dropped.
+	if _, err := c.Write(make([]byte, payload)); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.sent) != maxUDPFragments {
+		t.Fatalf("sent %v datagrams, want %v fragments", len(dc.sent), maxUDPFragments)
+	}
+	dc.sent = nil
+	if _, err := c.Write(make([]byte, payload+1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.sent) != 0 {
+		t.Errorf("sent %v datagrams of a payload above MaxUDPPayload", len(dc.sent))
+	}
+
+	// Without a hint the buffer is the limit.
+	m = newUDPSessionManager(&udpIOImpl{Conn: dc}, protocol.MaxUDPSize, 0)
+	c, err = m.NewUDP("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, want := c.(*udpConn).MaxUDPPayload(), protocol.MaxUDPSize-hs; got != want {
+		t.Errorf("MaxUDPPayload() = %v, want %v", got, want)
+	}
+}
+
+func TestMaxDatagramSizeGrowsBuffer(t *testing.T) {
+	config := &Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  &net.UDPAddr{},
+		QUICConfig:  QUICConfig{MaxDatagramSize: 9000},
+	}
+	if err := config.verifyAndFill(); err != nil {
+		t.Fatal(err)
+	}
+	if config.UDPBufferSize != 9000 {
+		t.Errorf("UDPBufferSize = %v, want 9000", config.UDPBufferSize)
+	}
+	config = &Config{
+		ConnFactory: &UdpConnFactory{},
+		ServerAddr:  &net.UDPAddr{},
+		QUICConfig:  QUICConfig{MaxDatagramSize: -1},
+	}
+	if err := config.verifyAndFill(); err == nil {
+		t.Error("verifyAndFill() accepted a negative MaxDatagramSize")
+	}
+}
+
+// echoUDPIO answers every message it is sent with the same message.
+type echoUDPIO struct {
+	ch chan *protocol.UDPMessage
+}
+
+func (io *echoUDPIO) ReceiveMessage() (*protocol.UDPMessage, error) {
+	msg, ok := <-io.ch
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return msg, nil
+}
+
+func (io *echoUDPIO) SendMessage(buf []byte, msg *protocol.UDPMessage) error {
+	n := msg.Serialize(buf)
+	reply, err := protocol.ParseUDPMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	io.ch <- reply
+	return nil
+}
+
+func TestUDPSessionQueueSize(t *testing.T) {
+	mio := &chanUDPIO{ch: make(chan *protocol.UDPMessage)}
+	defer close(mio.ch)
+	m := newUDPSessionManager(mio, protocol.MaxUDPSize, 2)
+	c, err := m.NewUDP("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := c.(*udpConn).ID
+	for _, data := range []string{"a", "b", "c"} {
+		mio.ch <- &protocol.UDPMessage{SessionID: id, FragCount: 1, Addr: "1.1.1.1:53", Data: []byte(data)}
+	}
+	// Wait until the manager took the last message off the io.
+	mio.ch <- &protocol.UDPMessage{SessionID: 0xdead}
+	if got := len(c.(*udpConn).ReceiveCh); got != 2 {
+		t.Errorf("%v messages queued, want the budget of 2", got)
+	}
+}
+
+// BenchmarkUDPShortSessions models a DNS relay: every session sends one query,
+// reads one reply and is closed.
+// BenchmarkUDPShortSessions runs sessions of one query and one reply, as with
+// DNS. The unpooled sessions send from a buffer allocated for the session, as
+// sessions did before taking their send buffers from the pool.
+func BenchmarkUDPShortSessions(b *testing.B) {
+	for _, queueSize := range []int{defaultUDPSessionQueueSize, 16} {
+		for _, pooled := range []bool{true, false} {
+			b.Run(fmt.Sprintf("queue=%v/pooled=%v", queueSize, pooled), func(b *testing.B) {
+				mio := &echoUDPIO{ch: make(chan *protocol.UDPMessage, 1)}
+				defer close(mio.ch)
+				m := newUDPSessionManager(mio, protocol.MaxUDPSize, queueSize)
+				query := make([]byte, 64)
+				reply := make([]byte, 512)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					c, err := m.NewUDP("1.1.1.1:53")
+					if err != nil {
+						b.Fatal(err)
+					}
+					if pooled {
+						_, err = c.Write(query)
+					} else {
+						err = m.io.SendMessage(make([]byte, m.bufSize), &protocol.UDPMessage{
+							SessionID: c.(*udpConn).ID,
+							FragCount: 1,
+							Addr:      "1.1.1.1:53",
+							Data:      query,
+						})
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := c.Read(reply); err != nil {
+						b.Fatal(err)
+					}
+					c.Close()
+				}
+			})
+		}
+	}
+}
+
+// loopDatagramConn models the send path of quic-go: SendDatagram queues the
+// datagram, blocking while the queue is full, and wakes up a send loop that
+// sends everything queued with one syscall, as with GSO.
+type loopDatagramConn struct {
+	mu    sync.Mutex
+	queue [][]byte
+	space *sync.Cond
+	wake  chan struct{}
+	out   *net.UDPConn
+	sent  atomic.Int64
+}
+
+const loopDatagramQueueLen = 32
+
+func newLoopDatagramConn(t testing.TB) *loopDatagramConn {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	out, err := net.DialUDP("udp", nil, sink.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &loopDatagramConn{wake: make(chan struct{}, 1), out: out}
+	c.space = sync.NewCond(&c.mu)
+	t.Cleanup(func() {
+		close(c.wake)
+		out.Close()
+	})
+	go c.loop()
+	return c
+}
+
+func (c *loopDatagramConn) loop() {
+	for range c.wake {
+		c.mu.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.space.Broadcast()
+		c.mu.Unlock()
+		if len(queue) == 0 {
+			continue
+		}
+		_, _ = c.out.Write(queue[0])
+		c.sent.Add(int64(len(queue)))
+	}
+}
+
+func (c *loopDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *loopDatagramConn) SendDatagram(b []byte) error {
+	c.mu.Lock()
+	for len(c.queue) >= loopDatagramQueueLen {
+		c.space.Wait()
+	}
+	c.queue = append(c.queue, append([]byte(nil), b...))
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func TestUDPBatch(t *testing.T) {
+	dc := &smallDatagramConn{max: 1200}
+	m := newUDPSessionManager(&udpIOImpl{Conn: dc}, protocol.MaxUDPSize, 0)
+	m.setBatchWindow(time.Hour)
+	c, err := m.NewUDP("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p := []byte("query")
+	if _, err := c.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	// The caller may reuse its buffer right away.
+	copy(p, "xxxxx")
+	if len(dc.sent) != 0 {
+		t.Fatalf("sent %v datagrams before the window is over, want 0", len(dc.sent))
+	}
+	if _, err := c.Write(make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(*udpConn).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The large message was fragmented on flush.
+	if len(dc.sent) < 4 {
+		t.Fatalf("sent %v datagrams, want the query and at least 3 fragments", len(dc.sent))
+	}
+	msg, err := protocol.ParseUDPMessage(dc.sent[0])
+	if err != nil || string(msg.Data) != "query" {
+		t.Errorf("first datagram = %q, %v, want query", msg.Data, err)
+	}
+
+	// A full batch is sent without waiting for the window.
+	dc.sent = nil
+	for i := 0; i < udpBatchSize; i++ {
+		if _, err := c.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dc.sent) != udpBatchSize {
+		t.Errorf("sent %v datagrams, want %v", len(dc.sent), udpBatchSize)
+	}
+}
+
+func TestUDPBatchWindow(t *testing.T) {
+	mio := &echoUDPIO{ch: make(chan *protocol.UDPMessage, 1)}
+	defer close(mio.ch)
+	m := newUDPSessionManager(mio, protocol.MaxUDPSize, 0)
+	m.setBatchWindow(10 * time.Millisecond)
+	c, err := m.NewUDP("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	// The reply arrives once the window is over.
+	buf := make([]byte, 16)
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read() = %q, %v, want ping", buf[:n], err)
+	}
+}
+
+func TestUDPPacing(t *testing.T) {
+	mio := &chanUDPIO{ch: make(chan *protocol.UDPMessage)}
+	defer close(mio.ch)
+	m := newUDPSessionManager(mio, protocol.MaxUDPSize, 0)
+	m.setPacing(100_000)
+	c, err := m.NewUDP("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10kB, headers included, take about 90ms after the 1kB burst.
+	payload := make([]byte, 500-(&protocol.UDPMessage{Addr: "1.1.1.1:53"}).HeaderSize())
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if _, err := c.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond || elapsed > time.Second {
+		t.Errorf("20 writes took %v, want about 90ms", elapsed)
+	}
+
+	// Closing the session ends a write waiting for its turn.
+	time.AfterFunc(20*time.Millisecond, func() { c.Close() })
+	start = time.Now()
+	if _, err := c.Write(make([]byte, 100_000)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() = %v, want net.ErrClosed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Write() returned %v after the close", elapsed)
+	}
+}
+
+// BenchmarkUDPSend measures the packet rate of one session writing as fast as
+// it can.
+func BenchmarkUDPSend(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			dc := newLoopDatagramConn(b)
+			m := newUDPSessionManager(&udpIOImpl{Conn: dc}, protocol.MaxUDPSize, 0)
+			if window > 0 {
+				m.setBatchWindow(window)
+			}
+			c, err := m.NewUDP("1.1.1.1:443")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			p := make([]byte, 1200)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+			_ = m.Flush()
+			for dc.sent.Load() < int64(b.N) {
+				time.Sleep(10 * time.Microsecond)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pps")
+		})
+	}
+}
+
+func TestUDPParseErrors(t *testing.T) {
+	dc := &echoDatagramConn{datagrams: make(chan []byte, 8)}
+	var traffic trafficCounters
+	uio := &udpIOImpl{Conn: dc, traffic: &traffic, maxParseErrors: 3}
+	msg := &protocol.UDPMessage{SessionID: 1, Addr: "1.1.1.1:53", Data: []byte("query")}
+
+	// A valid message resets the count of invalid ones in a row.
+	dc.datagrams <- []byte{0}
+	dc.datagrams <- []byte{0}
+	if err := uio.SendMessage(make([]byte, protocol.MaxUDPSize), msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uio.ReceiveMessage(); err != nil {
+		t.Fatalf("ReceiveMessage() = %v, want the valid message", err)
+	}
+	for i := 0; i < 3; i++ {
+		dc.datagrams <- []byte{0}
+	}
+	if _, err := uio.ReceiveMessage(); err == nil {
+		t.Error("ReceiveMessage() after 3 invalid messages succeeded, want an error")
+	}
+	if got := traffic.stats().UDPParseErrors; got != 5 {
+		t.Errorf("UDPParseErrors = %v, want 5", got)
+	}
+}
+
+// receiveCountUDPIO counts the calls to ReceiveMessage.
+type receiveCountUDPIO struct {
+	chanUDPIO
+	receives atomic.Int32
+}
+
+func (io *receiveCountUDPIO) ReceiveMessage() (*protocol.UDPMessage, error) {
+	io.receives.Add(1)
+	return io.chanUDPIO.ReceiveMessage()
+}
+
+func TestLazyUDP(t *testing.T) {
+	mio := &receiveCountUDPIO{chanUDPIO: chanUDPIO{ch: make(chan *protocol.UDPMessage)}}
+	defer close(mio.ch)
+	// As left by connect with LazyUDP.
+	c := &clientImpl{config: &Config{LazyUDP: true}, conn: fakeQUICConn{}, udpIO: mio}
+
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.UDP("1.1.1.1:53", context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// A second manager would have lost the sessions of the first.
+	if got := c.UDPSessionCount(); got != n {
+		t.Errorf("UDPSessionCount() = %v, want %v", got, n)
+	}
+	waitFor(t, func() bool { return mio.receives.Load() == 1 }, "the receive loop")
+}
+
+func TestUDPReadContext(t *testing.T) {
+	mio := &chanUDPIO{ch: make(chan *protocol.UDPMessage, 8)}
+	defer close(mio.ch)
+	m := newUDPSessionManager(mio, protocol.MaxUDPSize, 0)
+	c := &clientImpl{config: &Config{}, conn: fakeQUICConn{}, udpSM: m}
+
+	plain, err := c.UDP("1.1.1.1:53", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	keyed, err := c.UDPWithKey("1.1.1.1:53", "dns", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyed.Close()
+
+	for _, conn := range []netproxy.Conn{plain, keyed} {
+		reader := conn.(interface {
+			ReadContext(ctx context.Context, p []byte) (int, error)
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := reader.ReadContext(ctx, make([]byte, 16))
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("ReadContext() with nothing to read = %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		// The session still reads after the abandoned read.
+		var id uint32
+		switch conn := conn.(type) {
+		case *udpConn:
+			id = conn.ID
+		case *udpConnRef:
+			id = conn.ID
+		}
+		mio.ch <- &protocol.UDPMessage{SessionID: id, FragCount: 1, Addr: "1.1.1.1:53", Data: []byte("answer")}
+		buf := make([]byte, 16)
+		n, err := reader.ReadContext(context.Background(), buf)
+		if err != nil || string(buf[:n]) != "answer" {
+			t.Errorf("ReadContext() after a timeout = %q, %v, want answer", buf[:n], err)
+		}
+	}
+}
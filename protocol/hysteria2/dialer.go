@@ -11,7 +11,6 @@ import (
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/client"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/udphop"
-	"github.com/daeuniverse/outbound/protocol/tuic/common"
 )
 
 func init() {
@@ -41,6 +40,8 @@ func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dia
 			InsecureSkipVerify:    header.TlsConfig.InsecureSkipVerify,
 			VerifyPeerCertificate: header.TlsConfig.VerifyPeerCertificate,
 			RootCAs:               header.TlsConfig.RootCAs,
+			Certificates:          header.TlsConfig.Certificates,
+			GetClientCertificate:  header.TlsConfig.GetClientCertificate,
 		},
 		Auth:     header.User,
 		FastOpen: true,
@@ -66,37 +67,21 @@ func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dia
 		return nil, err
 	}
 
+	dialerConnFactory := &client.DialerConnFactory{
+		Dialer:     nextDialer,
+		ServerAddr: config.ServerAddr,
+	}
 	if config.ServerAddr.Network() == "udphop" {
 		config.ConnFactory = &client.UdpConnFactory{
 			NewFunc: func(ctx context.Context) (net.PacketConn, error) {
 				dialFunc := func(addr net.Addr) (net.PacketConn, error) {
-					conn, err := nextDialer.DialContext(ctx, "udp", addr.String())
-					if err != nil {
-						return nil, err
-					}
-					return netproxy.NewFakeNetPacketConn(
-						conn.(netproxy.PacketConn),
-						net.UDPAddrFromAddrPort(common.GetUniqueFakeAddrPort()),
-						addr,
-					), nil
+					return dialerConnFactory.Dial(ctx, addr)
 				}
 				return udphop.NewUDPHopPacketConn(config.ServerAddr.(*udphop.UDPHopAddr), config.UDPHopInterval, dialFunc)
 			},
 		}
 	} else {
-		config.ConnFactory = &client.UdpConnFactory{
-			NewFunc: func(ctx context.Context) (net.PacketConn, error) {
-				conn, err := nextDialer.DialContext(ctx, "udp", config.ServerAddr.String())
-				if err != nil {
-					return nil, err
-				}
-				return netproxy.NewFakeNetPacketConn(
-					conn.(netproxy.PacketConn),
-					net.UDPAddrFromAddrPort(common.GetUniqueFakeAddrPort()),
-					config.ServerAddr,
-				), nil
-			},
-		}
+		config.ConnFactory = dialerConnFactory
 	}
 
 	client, err := client.NewClient(config)
@@ -141,3 +126,58 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (netp
 		return nil, fmt.Errorf("unsupported network: %s", network)
 	}
 }
+
+// DialTcpWithInitialData dials addr over TCP and sends data in the same write
+// as the request, see client.Client.TCPWithInitialData.
+func (d *Dialer) DialTcpWithInitialData(ctx context.Context, addr string, data []byte) (netproxy.Conn, error) {
+	return d.client.TCPWithInitialData(addr, data, ctx)
+}
+
+// IsHealthy reports whether the underlying client is healthy, see
+// client.Client.
+func (d *Dialer) IsHealthy() bool {
+	return d.client.IsHealthy()
+}
+
+// NegotiatedProtocol returns the ALPN protocol of the current connection, see
+// client.Client.
+func (d *Dialer) NegotiatedProtocol() string {
+	return d.client.NegotiatedProtocol()
+}
+
+// ProbeBandwidth measures the bandwidth to and from the server, see
+// client.Client.
+func (d *Dialer) ProbeBandwidth(ctx context.Context) (tx, rx uint64, err error) {
+	return d.client.ProbeBandwidth(ctx)
+}
+
+// UDPSessionCount returns the number of UDP sessions open, see client.Client.
+func (d *Dialer) UDPSessionCount() int {
+	return d.client.UDPSessionCount()
+}
+
+// ActiveConns returns the TCP streams and UDP sessions carried, see
+// client.Client.
+func (d *Dialer) ActiveConns() []client.ConnInfo {
+	return d.client.ActiveConns()
+}
+
+// Stats returns the payload relayed so far, split between TCP and UDP, see
+// client.Client.
+func (d *Dialer) Stats() client.Stats {
+	return d.client.Stats()
+}
+
+// SetKeepAlivePeriod changes the QUIC keep-alive period, see client.Client.
+func (d *Dialer) SetKeepAlivePeriod(period time.Duration) error {
+	return d.client.SetKeepAlivePeriod(period)
+}
+
+// KeepAlivePeriod returns the QUIC keep-alive period, see client.Client.
+func (d *Dialer) KeepAlivePeriod() time.Duration {
+	return d.client.KeepAlivePeriod()
+}
+
+func (d *Dialer) Close() error {
+	return d.client.Close()
+}
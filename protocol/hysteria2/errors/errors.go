@@ -48,8 +48,19 @@ func (c DialError) Error() string {
 }
 
 // ClosedError is returned when the client attempts to use a closed connection.
+// If the connection was closed with a QUIC application error, HasCode is set
+// and Code, Message and Remote describe it, e.g. the reason the server gave.
 type ClosedError struct {
 	Err error // Can be nil
+
+	HasCode bool
+	Code    uint64
+	Message string
+	Remote  bool // whether the peer closed the connection
+	// StatelessReset is set when the server reset the connection because it
+	// no longer knows it, typically after a restart: it is worth
+	// reconnecting at once rather than backing off.
+	StatelessReset bool
 }
 
 func (c ClosedError) Error() string {
@@ -73,3 +84,56 @@ type ProtocolError struct {
 func (p ProtocolError) Error() string {
 	return "protocol error: " + p.Message
 }
+
+// ErrStreamOpenTimeout is returned when the server did not allow another
+// stream within Config.StreamOpenTimeout. Unlike a ClosedError, it does not
+// mean that the connection is dead, only that it is out of stream credit for
+// now. It is a net.Error reporting a timeout.
+var ErrStreamOpenTimeout error = streamOpenTimeoutError{}
+
+type streamOpenTimeoutError struct{}
+
+func (streamOpenTimeoutError) Error() string   { return "timed out waiting to open a stream" }
+func (streamOpenTimeoutError) Timeout() bool   { return true }
+func (streamOpenTimeoutError) Temporary() bool { return true }
+
+// ErrTooManyUDPSessions is returned when opening a UDP session while
+// Config.MaxUDPSessions are open. The connection is fine: a session can be
+// opened once another one is closed.
+var ErrTooManyUDPSessions error = tooManyUDPSessionsError{}
+
+type tooManyUDPSessionsError struct{}
+
+func (tooManyUDPSessionsError) Error() string { return "too many UDP sessions" }
+
+// ErrAuthTimeout is returned, wrapped in a ConnectError, when the QUIC
+// handshake succeeded but the auth response did not arrive within
+// Config.AuthTimeout. It is a net.Error reporting a timeout.
+var ErrAuthTimeout error = authTimeoutError{}
+
+type authTimeoutError struct{}
+
+func (authTimeoutError) Error() string   { return "timed out waiting for the auth response" }
+func (authTimeoutError) Timeout() bool   { return true }
+func (authTimeoutError) Temporary() bool { return true }
+
+// ErrKeepAliveNotLive is returned by SetKeepAlivePeriod when the client is
+// connected: quic-go fixes the keep-alive period of a connection once it is
+// established, so the new period only applies from the next connection on.
+var ErrKeepAliveNotLive error = keepAliveNotLiveError{}
+
+type keepAliveNotLiveError struct{}
+
+func (keepAliveNotLiveError) Error() string {
+	return "keep-alive period cannot change on a live connection"
+}
+
+// ErrMasqueradeLeak is returned by VerifyMasquerade when the server answered
+// a request without auth in a way that gives the proxy away.
+var ErrMasqueradeLeak error = masqueradeLeakError{}
+
+type masqueradeLeakError struct{}
+
+func (masqueradeLeakError) Error() string {
+	return "server does not masquerade: the proxy answered a request without auth"
+}
@@ -1,6 +1,7 @@
 package frag
 
 import (
+	"github.com/daeuniverse/outbound/pool"
 	"github.com/daeuniverse/outbound/protocol/hysteria2/internal/protocol"
 )
 
@@ -52,7 +53,12 @@ func (d *Defragger) Feed(m *protocol.UDPMessage) *protocol.UDPMessage {
 	if m.PacketID != d.pktID || m.FragCount != uint8(len(d.frags)) {
 		// new message, clear previous state
 		d.pktID = m.PacketID
-		d.frags = make([]*protocol.UDPMessage, m.FragCount)
+		if cap(d.frags) >= int(m.FragCount) {
+			d.frags = d.frags[:m.FragCount]
+			clear(d.frags)
+		} else {
+			d.frags = make([]*protocol.UDPMessage, m.FragCount)
+		}
 		d.frags[m.FragID] = m
 		d.count = 1
 		d.size = len(m.Data)
@@ -61,8 +67,9 @@ func (d *Defragger) Feed(m *protocol.UDPMessage) *protocol.UDPMessage {
 		d.count++
 		d.size += len(m.Data)
 		if int(d.count) == len(d.frags) {
-			// all fragments received, assemble
-			data := make([]byte, d.size)
+			// all fragments received, assemble into a pooled buffer, which
+			// the caller may return with pool.Put once done with it
+			data := pool.Get(d.size)
 			off := 0
 			for _, frag := range d.frags {
 				off += copy(data[off:], frag.Data)
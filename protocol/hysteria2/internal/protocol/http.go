@@ -1,8 +1,14 @@
 package protocol
 
 import (
+	"encoding/hex"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	rand "github.com/daeuniverse/outbound/pkg/fastrand"
 )
 
 const (
@@ -10,6 +16,8 @@ const (
 	URLPath = "/auth"
 
 	RequestHeaderAuth        = "Hysteria-Auth"
+	RequestHeaderTimestamp   = "Hysteria-Timestamp"
+	RequestHeaderNonce       = "Hysteria-Nonce"
 	ResponseHeaderUDPEnabled = "Hysteria-UDP"
 	CommonHeaderCCRX         = "Hysteria-CC-RX"
 	CommonHeaderPadding      = "Hysteria-Padding"
@@ -17,10 +25,46 @@ const (
 	StatusAuthOK = 233
 )
 
+// IsReservedRequestHeader reports whether the header name is set by the
+// protocol or the transport, so that user supplied headers must not set it.
+func IsReservedRequestHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return strings.HasPrefix(name, "Hysteria-") || name == "Host"
+}
+
 // AuthRequest is what client sends to server for authentication.
 type AuthRequest struct {
 	Auth string
 	Rx   uint64 // 0 = unknown, client asks server to use bandwidth detection
+
+	// Timestamp and Nonce let a server that supports them reject replayed
+	// requests. They are only sent when Timestamp is non-zero.
+	Timestamp int64 // unix milliseconds, see NewAuthTimestamp
+	Nonce     string
+}
+
+var lastAuthTimestamp atomic.Int64
+
+// NewAuthTimestamp returns the current unix time in milliseconds, bumped if
+// needed so that it is strictly greater than any value returned before.
+func NewAuthTimestamp() int64 {
+	for {
+		last := lastAuthTimestamp.Load()
+		ts := time.Now().UnixMilli()
+		if ts <= last {
+			ts = last + 1
+		}
+		if lastAuthTimestamp.CompareAndSwap(last, ts) {
+			return ts
+		}
+	}
+}
+
+// NewAuthNonce returns a random nonce for AuthRequest.Nonce.
+func NewAuthNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 // AuthResponse is what server sends to client when authentication is passed.
@@ -32,15 +76,22 @@ type AuthResponse struct {
 
 func AuthRequestFromHeader(h http.Header) AuthRequest {
 	rx, _ := strconv.ParseUint(h.Get(CommonHeaderCCRX), 10, 64)
+	ts, _ := strconv.ParseInt(h.Get(RequestHeaderTimestamp), 10, 64)
 	return AuthRequest{
-		Auth: h.Get(RequestHeaderAuth),
-		Rx:   rx,
+		Auth:      h.Get(RequestHeaderAuth),
+		Rx:        rx,
+		Timestamp: ts,
+		Nonce:     h.Get(RequestHeaderNonce),
 	}
 }
 
 func AuthRequestToHeader(h http.Header, req AuthRequest) {
 	h.Set(RequestHeaderAuth, req.Auth)
 	h.Set(CommonHeaderCCRX, strconv.FormatUint(req.Rx, 10))
+	if req.Timestamp != 0 {
+		h.Set(RequestHeaderTimestamp, strconv.FormatInt(req.Timestamp, 10))
+		h.Set(RequestHeaderNonce, req.Nonce)
+	}
 	h.Set(CommonHeaderPadding, authRequestPadding.String())
 }
 
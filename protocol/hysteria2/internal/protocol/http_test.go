@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthRequestTimestamp(t *testing.T) {
+	t.Run("off by default", func(t *testing.T) {
+		h := make(http.Header)
+		AuthRequestToHeader(h, AuthRequest{Auth: "pass", Rx: 100})
+		if h.Get(RequestHeaderTimestamp) != "" || h.Get(RequestHeaderNonce) != "" {
+			t.Error("timestamp headers set without a timestamp")
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		req := AuthRequest{
+			Auth:      "pass",
+			Rx:        100,
+			Timestamp: NewAuthTimestamp(),
+			Nonce:     NewAuthNonce(),
+		}
+		h := make(http.Header)
+		AuthRequestToHeader(h, req)
+		if got := AuthRequestFromHeader(h); got != req {
+			t.Errorf("AuthRequestFromHeader() = %v, want %v", got, req)
+		}
+	})
+
+	t.Run("monotonic", func(t *testing.T) {
+		last := NewAuthTimestamp()
+		for i := 0; i < 1000; i++ {
+			ts := NewAuthTimestamp()
+			if ts <= last {
+				t.Fatalf("timestamp went backwards: %v <= %v", ts, last)
+			}
+			last = ts
+		}
+	})
+}
+
+func TestIsReservedRequestHeader(t *testing.T) {
+	for name, want := range map[string]bool{
+		RequestHeaderAuth:  true,
+		"hysteria-cc-rx":   true,
+		"Hysteria-Unknown": true,
+		"host":             true,
+		"User-Agent":       false,
+		"Accept":           false,
+	} {
+		if got := IsReservedRequestHeader(name); got != want {
+			t.Errorf("IsReservedRequestHeader(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
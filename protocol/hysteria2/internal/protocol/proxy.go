@@ -212,8 +212,9 @@ func ParseUDPMessage(msg []byte) (*UDPMessage, error) {
 		return nil, errors.ProtocolError{Message: "invalid address length"}
 	}
 	bs := buf.Bytes()
-	if len(bs) <= int(lAddr) {
-		// We use <= instead of < here as we expect at least one byte of data after the address
+	if len(bs) < int(lAddr) {
+		// Empty payloads are valid UDP datagrams, so a message may end
+		// right after the address.
 		return nil, errors.ProtocolError{Message: "invalid message length"}
 	}
 	m.Addr = string(bs[:lAddr])
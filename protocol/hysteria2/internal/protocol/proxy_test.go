@@ -48,6 +48,16 @@ func TestUDPMessage(t *testing.T) {
 			},
 			want: []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x0, 0x1, 0xe, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x63, 0x6f, 0x6d, 0x3a, 0x38, 0x30, 0x47, 0x45, 0x54, 0x20, 0x2f, 0x6e, 0x6f, 0x74, 0x68, 0x69, 0x6e, 0x67, 0x20, 0x48, 0x54, 0x54, 0x50, 0x2f, 0x31, 0x2e, 0x31, 0xd, 0xa},
 		},
+		{
+			name: "empty payload",
+			fields: fields{
+				SessionID: 2,
+				FragCount: 1,
+				Addr:      "1.1.1.1:53",
+				Data:      []byte{},
+			},
+			want: []byte{0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x1, 0xa, 0x31, 0x2e, 0x31, 0x2e, 0x31, 0x2e, 0x31, 0x3a, 0x35, 0x33},
+		},
 		{
 			name: "test 2",
 			fields: fields{
@@ -144,6 +154,12 @@ func TestReadTCPRequest(t *testing.T) {
 			want:    "holy.cc:443",
 			wantErr: false,
 		},
+		{
+			name:    "zoned IPv6",
+			data:    []byte("\x11[fe80::1%eth0]:80\x00"),
+			want:    "[fe80::1%eth0]:80",
+			wantErr: false,
+		},
 		{
 			name:    "incomplete 1",
 			data:    []byte("\x0bhoho"),
@@ -191,6 +207,12 @@ func TestWriteTCPRequest(t *testing.T) {
 			wantW:   "\x44\x01\x1eclient-api.arkoselabs.com:8080",
 			wantErr: false,
 		},
+		{
+			name:    "zoned IPv6",
+			addr:    "[fe80::1%eth0]:80",
+			wantW:   "\x44\x01\x11[fe80::1%eth0]:80",
+			wantErr: false,
+		},
 		{
 			name:    "empty",
 			addr:    "",
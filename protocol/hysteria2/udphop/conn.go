@@ -2,11 +2,14 @@ package udphop
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
 	"net"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
 )
 
 const (
@@ -28,6 +31,7 @@ type udpHopPacketConn struct {
 
 	readBufferSize  int
 	writeBufferSize int
+	bindInterface   string
 
 	recvQueue chan *udpPacket
 	closeChan chan struct{}
@@ -131,6 +135,13 @@ func (u *udpHopPacketConn) hop() {
 		// Could be temporary, just skip this hop
 		return
 	}
+	if u.bindInterface != "" {
+		if err := tryBindToDevice(newConn, u.bindInterface); err != nil {
+			// Sending from an unbound socket would escape the interface.
+			_ = newConn.Close()
+			return
+		}
+	}
 	// We need to keep receiving packets from the previous connection,
 	// because otherwise there will be packet loss due to the time gap
 	// between we hop to a new port and the server acknowledges this change.
@@ -257,6 +268,19 @@ func (u *udpHopPacketConn) SetWriteBuffer(bytes int) error {
 	return trySetWriteBuffer(u.currentConn, bytes)
 }
 
+// BindToDevice binds the current socket, and every socket dialed by later
+// hops, to the network interface iface. A hop whose socket cannot be bound is
+// skipped.
+func (u *udpHopPacketConn) BindToDevice(iface string) error {
+	u.connMutex.Lock()
+	defer u.connMutex.Unlock()
+	u.bindInterface = iface
+	if u.prevConn != nil {
+		_ = tryBindToDevice(u.prevConn, iface)
+	}
+	return tryBindToDevice(u.currentConn, iface)
+}
+
 func (u *udpHopPacketConn) SyscallConn() (syscall.RawConn, error) {
 	u.connMutex.RLock()
 	defer u.connMutex.RUnlock()
@@ -286,3 +310,15 @@ func trySetWriteBuffer(pc net.PacketConn, bytes int) error {
 	}
 	return nil
 }
+
+func tryBindToDevice(pc net.PacketConn, iface string) error {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T does not expose its socket", pc)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return netproxy.BindToDeviceControl(rc, iface)
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
+
+	"github.com/daeuniverse/outbound/protocol"
 )
 
 // SOCKS auth type
@@ -143,6 +146,9 @@ func ParseAddr(s string) (Addr, error) {
 		return nil, err
 	}
 
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Zone() != "" {
+		return nil, fmt.Errorf("%w: %v", protocol.ErrZonedAddr, s)
+	}
 	if ip := net.ParseIP(host); ip != nil {
 		if ip4 := ip.To4(); ip4 != nil {
 			addr = make([]byte, 1+net.IPv4len+2)
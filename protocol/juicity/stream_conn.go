@@ -117,7 +117,10 @@ func (c *Conn) close() error {
 	return c.Stream.Close()
 }
 
-var _ netproxy.Conn = &Conn{}
+var (
+	_ netproxy.Conn        = &Conn{}
+	_ netproxy.CloseWriter = &Conn{}
+)
 
 func NewConn(stream quic.Stream, mdata *trojanc.Metadata, closeDeferFn func()) *Conn {
 	if mdata == nil {
@@ -71,6 +71,8 @@ func ParseMetadata(tgt string) (mdata Metadata, err error) {
 	var typ MetadataType
 	if err != nil {
 		typ = MetadataTypeDomain
+	} else if tgtIP.Zone() != "" {
+		return mdata, fmt.Errorf("%w: %v", ErrZonedAddr, tgt)
 	} else if tgtIP.Is4() {
 		typ = MetadataTypeIPv4
 	} else {
@@ -0,0 +1,19 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseMetadataZonedAddr(t *testing.T) {
+	if _, err := ParseMetadata("[fe80::1%eth0]:80"); !errors.Is(err, ErrZonedAddr) {
+		t.Errorf("ParseMetadata() of a zoned address = %v, want ErrZonedAddr", err)
+	}
+	m, err := ParseMetadata("[fe80::1]:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != MetadataTypeIPv6 || m.Hostname != "fe80::1" || m.Port != 80 {
+		t.Errorf("ParseMetadata() = %+v, want fe80::1 port 80", m)
+	}
+}
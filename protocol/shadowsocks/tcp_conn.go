@@ -102,6 +102,10 @@ func (c *TCPConn) Close() error {
 	return c.Conn.Close()
 }
 
+func (c *TCPConn) IsStream() bool {
+	return true
+}
+
 func (c *TCPConn) Read(b []byte) (n int, err error) {
 	c.readMutex.Lock()
 	defer c.readMutex.Unlock()
@@ -60,6 +60,10 @@ func (c *UdpConn) Read(b []byte) (n int, err error) {
 	return
 }
 
+func (c *UdpConn) IsStream() bool {
+	return false
+}
+
 func (c *UdpConn) Write(b []byte) (n int, err error) {
 	if err != nil {
 		return 0, err
@@ -92,6 +92,10 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	return c.Conn.Read(b)
 }
 
+func (c *Conn) IsStream() bool {
+	return true
+}
+
 func (c *Conn) ReadReqHeader() (err error) {
 	buf := pool.Get(56)
 	defer pool.Put(buf)
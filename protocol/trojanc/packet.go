@@ -26,6 +26,10 @@ func (c *PacketConn) Read(b []byte) (n int, err error) {
 	return n, err
 }
 
+func (c *PacketConn) IsStream() bool {
+	return false
+}
+
 func (c *PacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
 	m := Metadata{}
 	if _, err = m.Unpack(c.Conn); err != nil {
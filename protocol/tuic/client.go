@@ -9,6 +9,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daeuniverse/outbound/netproxy"
@@ -31,6 +32,19 @@ type ClientOption struct {
 	CongestionController  string
 	ReduceRtt             bool
 	CWND                  int
+	// UdpFragmentTimeout is how long the fragments of a UDP packet wait for
+	// the missing ones before the packet is discarded. Zero means 10 seconds.
+	UdpFragmentTimeout time.Duration
+	// Credentials, if set, is called on every (re)connect and overrides Uuid
+	// and Password, which allows rotating them on a live client.
+	Credentials func() (uuid [16]byte, password string)
+}
+
+func (o *ClientOption) credentials() ([16]byte, string) {
+	if o.Credentials != nil {
+		return o.Credentials()
+	}
+	return o.Uuid, o.Password
 }
 
 type clientImpl struct {
@@ -44,6 +58,9 @@ type clientImpl struct {
 	closed bool
 
 	udpIncomingPacketsMap sync.Map
+	// droppedUdpPackets, if not nil, counts the UDP packets discarded because
+	// a fragment was missing.
+	droppedUdpPackets *atomic.Uint64
 
 	onClose func()
 }
@@ -100,11 +117,12 @@ func (t *clientImpl) sendAuthentication(quicConn quic.Connection) (err error) {
 	}
 	buf := pool.GetBuffer()
 	defer pool.PutBuffer(buf)
-	token, err := GenToken(quicConn.ConnectionState(), t.Uuid, t.Password)
+	id, password := t.credentials()
+	token, err := GenToken(quicConn.ConnectionState(), id, password)
 	if err != nil {
 		return err
 	}
-	err = NewAuthenticate(t.Uuid, token, Ver5).WriteTo(buf)
+	err = NewAuthenticate(id, token, Ver5).WriteTo(buf)
 	if err != nil {
 		return err
 	}
@@ -272,7 +290,9 @@ func (t *clientImpl) Close() error {
 	return nil
 }
 
-func (t *clientImpl) DialContextWithDialer(ctx context.Context, metadata *protocol.Metadata, dialer netproxy.Dialer, dialFn common.DialFunc) (netproxy.Conn, error) {
+// DialContextWithDialer opens a stream to metadata, sending initialData, if
+// any, in the same write as the connect command.
+func (t *clientImpl) DialContextWithDialer(ctx context.Context, metadata *protocol.Metadata, initialData []byte, dialer netproxy.Dialer, dialFn common.DialFunc) (netproxy.Conn, error) {
 	if t.closed {
 		return nil, common.ErrClientClosed
 	}
@@ -285,12 +305,14 @@ func (t *clientImpl) DialContextWithDialer(ctx context.Context, metadata *protoc
 			t.deferQuicConn(quicConn, err)
 		}()
 		connect := NewConnect(NewAddress(metadata), Ver5)
-		buf := pool.Get(connect.BytesLen())
+		buf := pool.Get(connect.BytesLen() + len(initialData))
 		defer buf.Put()
 		n := connect.WriteToBytes(buf)
-		if n != len(buf) {
-			return nil, fmt.Errorf("n != len(buf)")
+		if n != connect.BytesLen() {
+			return nil, fmt.Errorf("n != connect.BytesLen()")
 		}
+		// Initial data goes out in the same write as the connect.
+		copy(buf[n:], initialData)
 		quicStream, err := quicConn.OpenStream()
 		if err != nil {
 			return nil, err
@@ -338,6 +360,7 @@ func (t *clientImpl) ListenPacketWithDialer(ctx context.Context, metadata *proto
 		incomingPackets:       incomingPackets,
 		udpRelayMode:          t.UdpRelayMode,
 		maxUdpRelayPacketSize: t.MaxUdpRelayPacketSize,
+		deFraggers:            newDeFraggers(t.UdpFragmentTimeout, t.droppedUdpPackets),
 		deferQuicConnFn:       t.deferQuicConn,
 		closeDeferFn:          nil,
 	}
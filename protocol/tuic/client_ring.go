@@ -37,7 +37,7 @@ func newClientRing(newClient func(capabilityCallback func(n int64)) *clientImpl,
 	}
 }
 
-func (r *clientRing) DialContextWithDialer(ctx context.Context, metadata *protocol.Metadata, dialer netproxy.Dialer, dialFn common.DialFunc) (conn netproxy.Conn, err error) {
+func (r *clientRing) DialContextWithDialer(ctx context.Context, metadata *protocol.Metadata, initialData []byte, dialer netproxy.Dialer, dialFn common.DialFunc) (conn netproxy.Conn, err error) {
 	defer func() {
 		r.ring.Len()
 	}()
@@ -48,7 +48,7 @@ func (r *clientRing) DialContextWithDialer(ctx context.Context, metadata *protoc
 		if node.capability != -1 && node.capability <= r.reserved {
 			return common.ErrHoldOn
 		}
-		conn, err = node.cli.DialContextWithDialer(ctx, metadata, dialer, dialFn)
+		conn, err = node.cli.DialContextWithDialer(ctx, metadata, initialData, dialer, dialFn)
 		return err
 	})
 	r.current = newCurrent
@@ -1,6 +1,8 @@
 package common
 
 import (
+	"fmt"
+
 	"github.com/daeuniverse/outbound/protocol/tuic/congestion"
 	"github.com/daeuniverse/quic-go"
 )
@@ -12,11 +14,25 @@ const (
 	MaxConnectionReceiveWindow     = 64 * 1024 * 1024 // 64 MB
 )
 
+// CheckCongestionController returns an error unless cc names a congestion
+// controller SetCongestionController knows: "bbr", "cubic" or "new_reno".
+// Empty means BBR.
+func CheckCongestionController(cc string) error {
+	switch cc {
+	case "", "bbr", "cubic", "new_reno":
+		return nil
+	default:
+		return fmt.Errorf("unknown congestion controller %q, want bbr, cubic or new_reno", cc)
+	}
+}
+
 func SetCongestionController(quicConn quic.Connection, cc string, cwnd int) {
 	switch cc {
+	case "cubic":
+		// quic-go's own CUBIC sender, which every connection starts with.
+	case "new_reno":
+		congestion.UseNewReno(quicConn)
 	default:
-		fallthrough
-	case "bbr":
 		congestion.UseBBR(quicConn)
 	}
 }
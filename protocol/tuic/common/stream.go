@@ -45,6 +45,10 @@ func (s *safeStreamConn) CloseWrite() error {
 	return s.Stream.Close()
 }
 
+func (s *safeStreamConn) IsStream() bool {
+	return true
+}
+
 func (q *safeStreamConn) close() error {
 	if q.closeDeferFn != nil {
 		defer q.closeDeferFn()
@@ -72,7 +76,10 @@ func (q *safeStreamConn) RemoteAddr() net.Addr {
 	return q.rAddr
 }
 
-var _ netproxy.Conn = &safeStreamConn{}
+var (
+	_ netproxy.Conn        = &safeStreamConn{}
+	_ netproxy.CloseWriter = &safeStreamConn{}
+)
 
 func NewSafeStreamConn(stream quic.Stream, lAddr, rAddr net.Addr, closeDeferFn func()) *safeStreamConn {
 	return &safeStreamConn{Stream: stream, lAddr: lAddr, rAddr: rAddr, closeDeferFn: closeDeferFn}
@@ -19,7 +19,7 @@ var (
 type DialFunc func(ctx context.Context, dialer netproxy.Dialer) (transport *quic.Transport, addr net.Addr, err error)
 
 type Client interface {
-	DialContextWithDialer(ctx context.Context, metadata *protocol.Metadata, dialer netproxy.Dialer, dialFn DialFunc) (netproxy.Conn, error)
+	DialContextWithDialer(ctx context.Context, metadata *protocol.Metadata, initialData []byte, dialer netproxy.Dialer, dialFn DialFunc) (netproxy.Conn, error)
 	ListenPacketWithDialer(ctx context.Context, metadata *protocol.Metadata, dialer netproxy.Dialer, dialFn DialFunc) (netproxy.PacketConn, error)
 	OpenStreams() int64
 	Close()
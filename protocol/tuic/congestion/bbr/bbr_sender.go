@@ -563,7 +563,10 @@ func (b *bbrSender) getMinRtt() time.Duration {
 	// min_rtt could be available if the handshake packet gets neutered then
 	// gets acknowledged. This could only happen for QUIC crypto where we do not
 	// drop keys.
-	minRtt := b.rttStats.MinRTT()
+	var minRtt time.Duration
+	if b.rttStats != nil {
+		minRtt = b.rttStats.MinRTT()
+	}
 	if minRtt == 0 {
 		return 100 * time.Millisecond
 	} else {
@@ -0,0 +1,85 @@
+package brutal
+
+import (
+	"time"
+
+	"github.com/daeuniverse/quic-go/congestion"
+)
+
+const (
+	adaptiveLossThreshold    = 0.1  // back off when more than 10% of the sampled packets are lost
+	adaptiveRecoverThreshold = 0.02 // grow again once loss drops below 2%
+	adaptiveDecreaseFactor   = 0.85
+	adaptiveIncreaseDivisor  = 20 // additive increase of target/20 per second
+)
+
+var _ congestion.CongestionControl = &AdaptiveBrutalSender{}
+
+// AdaptiveBrutalSender is a BrutalSender whose send rate follows the measured
+// loss rate. It starts at the target rate, backs off multiplicatively when loss
+// exceeds adaptiveLossThreshold and recovers additively when loss subsides.
+// The rate always stays within [min, max].
+type AdaptiveBrutalSender struct {
+	*BrutalSender
+
+	minBps   congestion.ByteCount
+	maxBps   congestion.ByteCount
+	stepBps  congestion.ByteCount
+	lastTune int64
+}
+
+func NewAdaptiveBrutalSender(min, max, target uint64) *AdaptiveBrutalSender {
+	if max < min {
+		min, max = max, min
+	}
+	if target < min {
+		target = min
+	}
+	if target > max {
+		target = max
+	}
+	step := target / adaptiveIncreaseDivisor
+	if step == 0 {
+		step = 1
+	}
+	return &AdaptiveBrutalSender{
+		BrutalSender: NewBrutalSender(target),
+		minBps:       congestion.ByteCount(min),
+		maxBps:       congestion.ByteCount(max),
+		stepBps:      congestion.ByteCount(step),
+	}
+}
+
+func (b *AdaptiveBrutalSender) OnCongestionEventEx(priorInFlight congestion.ByteCount, eventTime time.Time, ackedPackets []congestion.AckedPacketInfo, lostPackets []congestion.LostPacketInfo) {
+	b.BrutalSender.OnCongestionEventEx(priorInFlight, eventTime, ackedPackets, lostPackets)
+
+	// Tune at most once per second, which matches the sampling granularity.
+	currentTimestamp := eventTime.Unix()
+	if currentTimestamp == b.lastTune {
+		return
+	}
+	b.lastTune = currentTimestamp
+
+	ackCount, lossCount := b.sampleCounts(currentTimestamp)
+	if ackCount+lossCount < minSampleCount {
+		return
+	}
+	lossRate := float64(lossCount) / float64(ackCount+lossCount)
+	switch {
+	case lossRate > adaptiveLossThreshold:
+		b.bps = congestion.ByteCount(float64(b.bps) * adaptiveDecreaseFactor)
+	case lossRate < adaptiveRecoverThreshold:
+		b.bps += b.stepBps
+	default:
+		return
+	}
+	if b.bps < b.minBps {
+		b.bps = b.minBps
+	}
+	if b.bps > b.maxBps {
+		b.bps = b.maxBps
+	}
+	if b.debug {
+		b.debugPrint("Adaptive rate: %d bps (loss=%.2f)", b.bps, lossRate)
+	}
+}
@@ -56,6 +56,11 @@ func NewBrutalSender(bps uint64) *BrutalSender {
 	return bs
 }
 
+// Bps returns the current send rate in bytes per second.
+func (b *BrutalSender) Bps() uint64 {
+	return uint64(b.bps)
+}
+
 func (b *BrutalSender) SetRTTStatsProvider(rttStats congestion.RTTStatsProvider) {
 	b.rttStats = rttStats
 }
@@ -73,7 +78,10 @@ func (b *BrutalSender) CanSend(bytesInFlight congestion.ByteCount) bool {
 }
 
 func (b *BrutalSender) GetCongestionWindow() congestion.ByteCount {
-	rtt := b.rttStats.SmoothedRTT()
+	var rtt time.Duration
+	if b.rttStats != nil {
+		rtt = b.rttStats.SmoothedRTT()
+	}
 	if rtt <= 0 {
 		return 10240
 	}
@@ -125,9 +133,8 @@ func (b *BrutalSender) SetMaxDatagramSize(size congestion.ByteCount) {
 	}
 }
 
-func (b *BrutalSender) updateAckRate(currentTimestamp int64) {
+func (b *BrutalSender) sampleCounts(currentTimestamp int64) (ackCount, lossCount uint64) {
 	minTimestamp := currentTimestamp - pktInfoSlotCount
-	var ackCount, lossCount uint64
 	for _, info := range b.pktInfoSlots {
 		if info.Timestamp < minTimestamp {
 			continue
@@ -135,6 +142,11 @@ func (b *BrutalSender) updateAckRate(currentTimestamp int64) {
 		ackCount += info.AckCount
 		lossCount += info.LossCount
 	}
+	return ackCount, lossCount
+}
+
+func (b *BrutalSender) updateAckRate(currentTimestamp int64) {
+	ackCount, lossCount := b.sampleCounts(currentTimestamp)
 	if ackCount+lossCount < minSampleCount {
 		b.ackRate = 1
 		if b.canPrintAckRate(currentTimestamp) {
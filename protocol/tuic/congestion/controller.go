@@ -0,0 +1,122 @@
+package congestion
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/outbound/protocol/tuic/congestion/bbr"
+	"github.com/daeuniverse/outbound/protocol/tuic/congestion/brutal"
+	"github.com/daeuniverse/outbound/protocol/tuic/congestion/reno"
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/congestion"
+)
+
+// Controller is a congestion control algorithm installed on a quic.Connection
+// that also reports live statistics. The statistics are snapshotted when the
+// controller is created and on every congestion event, so they are safe to
+// read from any goroutine.
+type Controller interface {
+	congestion.CongestionControl
+
+	// Pacing returns the current pacing rate in bytes per second.
+	Pacing() uint64
+	// CWND returns the current congestion window in bytes.
+	CWND() uint64
+	// LossRate returns the ratio of lost packets to all packets that have been
+	// acknowledged or declared lost since the controller was created.
+	LossRate() float64
+}
+
+type controller struct {
+	congestion.CongestionControl
+	pacing func() uint64
+
+	pacingBps atomic.Uint64
+	cwnd      atomic.Uint64
+	acked     atomic.Uint64
+	lost      atomic.Uint64
+}
+
+func newController(cc congestion.CongestionControl, pacing func() uint64) *controller {
+	c := &controller{
+		CongestionControl: cc,
+		pacing:            pacing,
+	}
+	c.snapshot()
+	return c
+}
+
+func (c *controller) snapshot() {
+	c.pacingBps.Store(c.pacing())
+	c.cwnd.Store(uint64(c.CongestionControl.GetCongestionWindow()))
+}
+
+func (c *controller) SetRTTStatsProvider(provider congestion.RTTStatsProvider) {
+	c.CongestionControl.SetRTTStatsProvider(provider)
+	c.snapshot()
+}
+
+func (c *controller) OnCongestionEventEx(priorInFlight congestion.ByteCount, eventTime time.Time, ackedPackets []congestion.AckedPacketInfo, lostPackets []congestion.LostPacketInfo) {
+	c.CongestionControl.OnCongestionEventEx(priorInFlight, eventTime, ackedPackets, lostPackets)
+	c.acked.Add(uint64(len(ackedPackets)))
+	c.lost.Add(uint64(len(lostPackets)))
+	c.snapshot()
+}
+
+func (c *controller) Pacing() uint64 {
+	return c.pacingBps.Load()
+}
+
+func (c *controller) CWND() uint64 {
+	return c.cwnd.Load()
+}
+
+func (c *controller) LossRate() float64 {
+	lost := c.lost.Load()
+	total := c.acked.Load() + lost
+	if total == 0 {
+		return 0
+	}
+	return float64(lost) / float64(total)
+}
+
+// NewBBRController creates a BBR controller sized for the remote address of conn.
+func NewBBRController(conn quic.Connection) Controller {
+	sender := bbr.NewBbrSender(
+		bbr.DefaultClock{},
+		bbr.GetInitialPacketSize(conn.RemoteAddr()),
+	)
+	return newController(sender, func() uint64 {
+		rate := sender.PacingRate()
+		if rate == math.MaxUint64 {
+			return math.MaxUint64
+		}
+		return uint64(rate / bbr.BytesPerSecond)
+	})
+}
+
+// NewBrutalController creates a Brutal controller with a fixed send rate of tx
+// bytes per second.
+func NewBrutalController(tx uint64) Controller {
+	sender := brutal.NewBrutalSender(tx)
+	return newController(sender, sender.Bps)
+}
+
+// NewAdaptiveBrutalController creates an adaptive Brutal controller, see
+// brutal.AdaptiveBrutalSender.
+func NewAdaptiveBrutalController(min, max, target uint64) Controller {
+	sender := brutal.NewAdaptiveBrutalSender(min, max, target)
+	return newController(sender, sender.Bps)
+}
+
+// NewRenoController creates a NewReno controller, see reno.RenoSender.
+func NewRenoController() Controller {
+	sender := reno.NewRenoSender()
+	return newController(sender, sender.Bps)
+}
+
+// Replace installs c on a live connection, replacing the current algorithm.
+func Replace(conn quic.Connection, c Controller) {
+	conn.SetCongestionControl(c)
+}
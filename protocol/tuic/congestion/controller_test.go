@@ -0,0 +1,153 @@
+package congestion
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/quic-go"
+	"github.com/daeuniverse/quic-go/congestion"
+)
+
+type fakeRTTStats struct {
+	congestion.RTTStatsProvider
+	rtt time.Duration
+}
+
+func (s *fakeRTTStats) MinRTT() time.Duration      { return s.rtt }
+func (s *fakeRTTStats) SmoothedRTT() time.Duration { return s.rtt }
+func (s *fakeRTTStats) LatestRTT() time.Duration   { return s.rtt }
+
+type fakeConn struct {
+	quic.Connection
+}
+
+func (fakeConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+}
+
+func feed(c Controller, now time.Time, acked, lost int) {
+	c.OnCongestionEventEx(0, now, make([]congestion.AckedPacketInfo, acked), make([]congestion.LostPacketInfo, lost))
+}
+
+func TestBrutalController(t *testing.T) {
+	c := NewBrutalController(1_000_000)
+	// Seeded before any event and before the RTT stats are installed.
+	if got := c.Pacing(); got != 1_000_000 {
+		t.Errorf("Pacing() = %v, want 1000000", got)
+	}
+	if got := c.CWND(); got != 10240 {
+		t.Errorf("CWND() = %v, want 10240", got)
+	}
+	if got := c.LossRate(); got != 0 {
+		t.Errorf("LossRate() = %v, want 0", got)
+	}
+
+	c.SetRTTStatsProvider(&fakeRTTStats{rtt: 100 * time.Millisecond})
+	// bps * rtt * 2 with a perfect ack rate.
+	if got := c.CWND(); got != 200_000 {
+		t.Errorf("CWND() = %v, want 200000", got)
+	}
+
+	feed(c, time.Unix(1000, 0), 90, 10)
+	if got := c.LossRate(); got != 0.1 {
+		t.Errorf("LossRate() = %v, want 0.1", got)
+	}
+	// The window grows by 1/ackRate to make up for the loss.
+	if got := c.CWND(); got != 222_222 {
+		t.Errorf("CWND() = %v, want 222222", got)
+	}
+	if got := c.Pacing(); got != 1_000_000 {
+		t.Errorf("Pacing() = %v, want 1000000", got)
+	}
+}
+
+func TestAdaptiveBrutalController(t *testing.T) {
+	c := NewAdaptiveBrutalController(100_000, 2_000_000, 1_000_000)
+	c.SetRTTStatsProvider(&fakeRTTStats{rtt: 100 * time.Millisecond})
+	if got := c.Pacing(); got != 1_000_000 {
+		t.Errorf("Pacing() = %v, want 1000000", got)
+	}
+
+	// 20% loss backs off.
+	feed(c, time.Unix(1000, 0), 80, 20)
+	if got := c.Pacing(); got != 850_000 {
+		t.Errorf("Pacing() = %v, want 850000", got)
+	}
+	if got := c.LossRate(); got != 0.2 {
+		t.Errorf("LossRate() = %v, want 0.2", got)
+	}
+
+	// Once the lossy second ages out of the sample window, the rate grows
+	// again by target/20.
+	feed(c, time.Unix(1010, 0), 100, 0)
+	if got := c.Pacing(); got != 900_000 {
+		t.Errorf("Pacing() = %v, want 900000", got)
+	}
+	if got := c.LossRate(); got != 0.1 {
+		t.Errorf("LossRate() = %v, want 0.1", got)
+	}
+}
+
+func TestBBRController(t *testing.T) {
+	c := NewBBRController(fakeConn{})
+	if got, want := c.CWND(), uint64(32*congestion.InitialPacketSizeIPv4); got != want {
+		t.Errorf("CWND() = %v, want %v", got, want)
+	}
+	if c.Pacing() == 0 {
+		t.Error("Pacing() = 0 before the first congestion event")
+	}
+}
+
+func TestRenoController(t *testing.T) {
+	c := NewRenoController()
+	c.SetRTTStatsProvider(&fakeRTTStats{rtt: 100 * time.Millisecond})
+	initial := uint64(10 * congestion.InitialPacketSizeIPv4)
+	if got := c.CWND(); got != initial {
+		t.Fatalf("CWND() = %v, want %v", got, initial)
+	}
+	// Pacing spreads 1.25 windows over a round trip.
+	if got, want := c.Pacing(), initial*125/10; got != want {
+		t.Errorf("Pacing() = %v, want %v", got, want)
+	}
+
+	// Slow start grows the window by what is acknowledged.
+	ack := func(pn congestion.PacketNumber) congestion.AckedPacketInfo {
+		return congestion.AckedPacketInfo{PacketNumber: pn, BytesAcked: congestion.InitialPacketSizeIPv4}
+	}
+	now := time.Unix(1000, 0)
+	for pn := congestion.PacketNumber(0); pn < 20; pn++ {
+		c.OnPacketSent(now, 0, pn, congestion.InitialPacketSizeIPv4, true)
+	}
+	c.OnCongestionEventEx(0, now, []congestion.AckedPacketInfo{ack(0), ack(1)}, nil)
+	if got, want := c.CWND(), initial+2*uint64(congestion.InitialPacketSizeIPv4); got != want {
+		t.Fatalf("CWND() = %v after 2 acks, want %v", got, want)
+	}
+
+	// A loss halves the window once for all packets in flight.
+	lost := []congestion.LostPacketInfo{{PacketNumber: 2, BytesLost: congestion.InitialPacketSizeIPv4}}
+	c.OnCongestionEventEx(0, now, nil, lost)
+	halved := (initial + 2*uint64(congestion.InitialPacketSizeIPv4)) / 2
+	if got := c.CWND(); got != halved {
+		t.Fatalf("CWND() = %v after a loss, want %v", got, halved)
+	}
+	lost[0].PacketNumber = 3
+	c.OnCongestionEventEx(0, now, []congestion.AckedPacketInfo{ack(4)}, lost)
+	if got := c.CWND(); got != halved {
+		t.Errorf("CWND() = %v after a loss in the same round trip, want %v", got, halved)
+	}
+	if got := c.LossRate(); got == 0 {
+		t.Error("LossRate() = 0 after losses")
+	}
+
+	// Past recovery, the window grows by a datagram per window acknowledged.
+	c.OnPacketSent(now, 0, 20, congestion.InitialPacketSizeIPv4, true)
+	pn := congestion.PacketNumber(20)
+	for acked := uint64(0); acked < halved; acked += uint64(congestion.InitialPacketSizeIPv4) {
+		c.OnCongestionEventEx(0, now, []congestion.AckedPacketInfo{ack(pn)}, nil)
+		pn++
+	}
+	if got, want := c.CWND(), halved+uint64(congestion.InitialPacketSizeIPv4); got != want {
+		t.Errorf("CWND() = %v after a window of acks, want %v", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+// Package reno implements the NewReno congestion controller of RFC 9002,
+// Section 7: the window doubles every round trip in slow start, grows by one
+// datagram per round trip afterwards and is halved, at most once per round
+// trip, when packets are lost.
+package reno
+
+import (
+	"time"
+
+	"github.com/daeuniverse/outbound/protocol/tuic/congestion/common"
+
+	"github.com/daeuniverse/quic-go/congestion"
+)
+
+const (
+	initialWindowPackets = 10
+	minWindowPackets     = 2
+	lossReductionFactor  = 0.5
+	// pacingGain paces a window over less than a round trip, so that pacing
+	// does not slow down a sender that is allowed a full window.
+	pacingGain = 1.25
+	// initialRTT is assumed until the first RTT sample, like quic-go does.
+	initialRTT = 333 * time.Millisecond
+)
+
+var _ congestion.CongestionControl = &RenoSender{}
+
+type RenoSender struct {
+	rttStats        congestion.RTTStatsProvider
+	maxDatagramSize congestion.ByteCount
+	pacer           *common.Pacer
+
+	cwnd     congestion.ByteCount
+	ssthresh congestion.ByteCount
+	// bytesAcked counts acknowledged bytes in congestion avoidance until a
+	// whole window was acknowledged.
+	bytesAcked congestion.ByteCount
+	// largestSent is the largest packet number sent, and recoveryStart the
+	// value it had when the window was last reduced: losses of packets sent
+	// before do not reduce it again.
+	largestSent   congestion.PacketNumber
+	recoveryStart congestion.PacketNumber
+	inRecovery    bool
+}
+
+func NewRenoSender() *RenoSender {
+	r := &RenoSender{
+		maxDatagramSize: congestion.InitialPacketSizeIPv4,
+		ssthresh:        congestion.ByteCount(1<<62 - 1),
+		largestSent:     -1,
+		recoveryStart:   -1,
+	}
+	r.cwnd = initialWindowPackets * r.maxDatagramSize
+	r.pacer = common.NewPacer(r.bandwidth)
+	return r
+}
+
+// bandwidth returns the pacing rate in bytes per second.
+func (r *RenoSender) bandwidth() congestion.ByteCount {
+	rtt := initialRTT
+	if r.rttStats != nil && r.rttStats.SmoothedRTT() > 0 {
+		rtt = r.rttStats.SmoothedRTT()
+	}
+	return congestion.ByteCount(float64(r.cwnd) * pacingGain * float64(time.Second) / float64(rtt))
+}
+
+// Bps returns the current pacing rate in bytes per second.
+func (r *RenoSender) Bps() uint64 {
+	return uint64(r.bandwidth())
+}
+
+func (r *RenoSender) SetRTTStatsProvider(rttStats congestion.RTTStatsProvider) {
+	r.rttStats = rttStats
+}
+
+func (r *RenoSender) TimeUntilSend(bytesInFlight congestion.ByteCount) time.Time {
+	return r.pacer.TimeUntilSend()
+}
+
+func (r *RenoSender) HasPacingBudget(now time.Time) bool {
+	return r.pacer.Budget(now) >= r.maxDatagramSize
+}
+
+func (r *RenoSender) CanSend(bytesInFlight congestion.ByteCount) bool {
+	return bytesInFlight < r.cwnd
+}
+
+func (r *RenoSender) GetCongestionWindow() congestion.ByteCount {
+	return r.cwnd
+}
+
+func (r *RenoSender) OnPacketSent(sentTime time.Time, bytesInFlight congestion.ByteCount,
+	packetNumber congestion.PacketNumber, bytes congestion.ByteCount, isRetransmittable bool,
+) {
+	r.pacer.SentPacket(sentTime, bytes)
+	if isRetransmittable && packetNumber > r.largestSent {
+		r.largestSent = packetNumber
+	}
+}
+
+func (r *RenoSender) OnPacketAcked(number congestion.PacketNumber, ackedBytes congestion.ByteCount,
+	priorInFlight congestion.ByteCount, eventTime time.Time,
+) {
+	// Handled by OnCongestionEventEx.
+}
+
+func (r *RenoSender) OnCongestionEvent(number congestion.PacketNumber, lostBytes congestion.ByteCount,
+	priorInFlight congestion.ByteCount,
+) {
+	// Handled by OnCongestionEventEx.
+}
+
+func (r *RenoSender) OnCongestionEventEx(priorInFlight congestion.ByteCount, eventTime time.Time, ackedPackets []congestion.AckedPacketInfo, lostPackets []congestion.LostPacketInfo) {
+	for _, p := range lostPackets {
+		if r.inRecovery && p.PacketNumber <= r.recoveryStart {
+			continue
+		}
+		// A new loss: back off once for this round trip.
+		r.inRecovery = true
+		r.recoveryStart = r.largestSent
+		r.cwnd = max(congestion.ByteCount(float64(r.cwnd)*lossReductionFactor), r.minWindow())
+		r.ssthresh = r.cwnd
+		r.bytesAcked = 0
+	}
+	for _, p := range ackedPackets {
+		if r.inRecovery {
+			if p.PacketNumber <= r.recoveryStart {
+				// Sent before the reduction, the window stays.
+				continue
+			}
+			r.inRecovery = false
+		}
+		if r.cwnd < r.ssthresh {
+			r.cwnd += p.BytesAcked
+			continue
+		}
+		r.bytesAcked += p.BytesAcked
+		if r.bytesAcked >= r.cwnd {
+			r.bytesAcked -= r.cwnd
+			r.cwnd += r.maxDatagramSize
+		}
+	}
+}
+
+func (r *RenoSender) minWindow() congestion.ByteCount {
+	return minWindowPackets * r.maxDatagramSize
+}
+
+func (r *RenoSender) SetMaxDatagramSize(size congestion.ByteCount) {
+	wasMin := r.cwnd == r.minWindow()
+	r.maxDatagramSize = size
+	if wasMin || r.cwnd < r.minWindow() {
+		r.cwnd = r.minWindow()
+	}
+	r.pacer.SetMaxDatagramSize(size)
+}
+
+func (r *RenoSender) InSlowStart() bool {
+	return r.cwnd < r.ssthresh
+}
+
+func (r *RenoSender) InRecovery() bool {
+	return r.inRecovery
+}
+
+func (r *RenoSender) MaybeExitSlowStart() {}
+
+// OnRetransmissionTimeout collapses the window to the minimum when packets
+// had to be retransmitted after a timeout.
+func (r *RenoSender) OnRetransmissionTimeout(packetsRetransmitted bool) {
+	if !packetsRetransmitted {
+		return
+	}
+	r.ssthresh = max(r.cwnd/2, r.minWindow())
+	r.cwnd = r.minWindow()
+	r.bytesAcked = 0
+	r.inRecovery = false
+}
@@ -1,18 +1,31 @@
 package congestion
 
 import (
-	"github.com/daeuniverse/outbound/protocol/tuic/congestion/bbr"
-	"github.com/daeuniverse/outbound/protocol/tuic/congestion/brutal"
 	"github.com/daeuniverse/quic-go"
 )
 
-func UseBBR(conn quic.Connection) {
-	conn.SetCongestionControl(bbr.NewBbrSender(
-		bbr.DefaultClock{},
-		bbr.GetInitialPacketSize(conn.RemoteAddr()),
-	))
+func UseBBR(conn quic.Connection) Controller {
+	c := NewBBRController(conn)
+	conn.SetCongestionControl(c)
+	return c
 }
 
-func UseBrutal(conn quic.Connection, tx uint64) {
-	conn.SetCongestionControl(brutal.NewBrutalSender(tx))
+func UseNewReno(conn quic.Connection) Controller {
+	c := NewRenoController()
+	conn.SetCongestionControl(c)
+	return c
+}
+
+func UseBrutal(conn quic.Connection, tx uint64) Controller {
+	c := NewBrutalController(tx)
+	conn.SetCongestionControl(c)
+	return c
+}
+
+// UseAdaptiveBrutal installs a Brutal sender that starts at target bytes per
+// second and adapts to the observed loss rate within [min, max].
+func UseAdaptiveBrutal(conn quic.Connection, min, max, target uint64) Controller {
+	c := NewAdaptiveBrutalController(min, max, target)
+	conn.SetCongestionControl(c)
+	return c
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pkg/quicpacket"
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/tuic/common"
 	"github.com/daeuniverse/quic-go"
@@ -19,12 +21,22 @@ func init() {
 
 type Dialer struct {
 	clientRing *clientRing
+	auth       atomic.Pointer[auth]
+	sharedConn atomic.Pointer[quicpacket.SharedConn]
+
+	udpFragmentTimeout atomic.Int64
+	droppedUdpPackets  atomic.Uint64
 
 	proxyAddress string
 	nextDialer   netproxy.Dialer
 	metadata     protocol.Metadata
 }
 
+type auth struct {
+	uuid     uuid.UUID
+	password string
+}
+
 func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
 	metadata := protocol.Metadata{
 		IsClient: header.IsClient,
@@ -34,6 +46,10 @@ func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dia
 	if err != nil {
 		return nil, fmt.Errorf("parse UUID: %w", err)
 	}
+	congestionController, _ := header.Feature1.(string)
+	if err := common.CheckCongestionController(congestionController); err != nil {
+		return nil, err
+	}
 	// ensure server's incoming stream can handle correctly, increase to 1.1x
 	maxDatagramFrameSize := 1400
 	udpRelayMode := common.NATIVE
@@ -41,43 +57,93 @@ func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dia
 		// FIXME: QUIC has severe performance problems.
 		// udpRelayMode = common.QUIC
 	}
-	return &Dialer{
-		clientRing: newClientRing(func(capabilityCallback func(n int64)) *clientImpl {
-			return &clientImpl{
-				ClientOption: &ClientOption{
-					TlsConfig: header.TlsConfig,
-					QuicConfig: &quic.Config{
-						InitialStreamReceiveWindow:     common.InitialStreamReceiveWindow,
-						MaxStreamReceiveWindow:         common.MaxStreamReceiveWindow,
-						InitialConnectionReceiveWindow: common.InitialConnectionReceiveWindow,
-						MaxConnectionReceiveWindow:     common.MaxConnectionReceiveWindow,
-						KeepAlivePeriod:                3 * time.Second,
-						DisablePathMTUDiscovery:        false,
-						EnableDatagrams:                true,
-						HandshakeIdleTimeout:           8 * time.Second,
-						CapabilityCallback:             capabilityCallback,
-					},
-					Uuid:                  id,
-					Password:              header.Password,
-					UdpRelayMode:          udpRelayMode,
-					CongestionController:  header.Feature1.(string),
-					ReduceRtt:             false,
-					CWND:                  10,
-					MaxUdpRelayPacketSize: maxDatagramFrameSize,
-				},
-				udp: true,
-			}
-		}, 10),
+	d := &Dialer{
 		proxyAddress: header.ProxyAddress,
 		nextDialer:   nextDialer,
 		metadata:     metadata,
-	}, nil
+	}
+	d.auth.Store(&auth{uuid: id, password: header.Password})
+	d.clientRing = newClientRing(func(capabilityCallback func(n int64)) *clientImpl {
+		return &clientImpl{
+			ClientOption: &ClientOption{
+				TlsConfig: header.TlsConfig,
+				QuicConfig: &quic.Config{
+					InitialStreamReceiveWindow:     common.InitialStreamReceiveWindow,
+					MaxStreamReceiveWindow:         common.MaxStreamReceiveWindow,
+					InitialConnectionReceiveWindow: common.InitialConnectionReceiveWindow,
+					MaxConnectionReceiveWindow:     common.MaxConnectionReceiveWindow,
+					KeepAlivePeriod:                3 * time.Second,
+					DisablePathMTUDiscovery:        false,
+					EnableDatagrams:                true,
+					HandshakeIdleTimeout:           8 * time.Second,
+					CapabilityCallback:             capabilityCallback,
+				},
+				Uuid:                  id,
+				Password:              header.Password,
+				Credentials:           d.credentials,
+				UdpRelayMode:          udpRelayMode,
+				CongestionController:  congestionController,
+				ReduceRtt:             false,
+				CWND:                  10,
+				MaxUdpRelayPacketSize: maxDatagramFrameSize,
+				UdpFragmentTimeout:    time.Duration(d.udpFragmentTimeout.Load()),
+			},
+			udp:               true,
+			droppedUdpPackets: &d.droppedUdpPackets,
+		}
+	}, 10)
+	return d, nil
+}
+
+func (d *Dialer) credentials() ([16]byte, string) {
+	a := d.auth.Load()
+	return a.uuid, a.password
+}
+
+// UpdateAuth replaces the UUID and password used to authenticate. Established
+// connections keep working with the credentials they were authenticated with;
+// the new ones are used from the next connect or reconnect on.
+func (d *Dialer) UpdateAuth(id string, password string) error {
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return fmt.Errorf("parse UUID: %w", err)
+	}
+	d.auth.Store(&auth{uuid: u, password: password})
+	return nil
+}
+
+// UseSharedConn makes the connections dialed from now on share the UDP socket
+// of conn with other QUIC connections, instead of a packet conn of their own
+// dialed through the next dialer. Nil goes back to the next dialer.
+func (d *Dialer) UseSharedConn(conn *quicpacket.SharedConn) {
+	d.sharedConn.Store(conn)
+}
+
+// SetUdpFragmentTimeout sets how long the fragments of a UDP packet wait for
+// the missing ones before the packet is discarded, see
+// ClientOption.UdpFragmentTimeout. It applies to the connections dialed from
+// now on.
+func (d *Dialer) SetUdpFragmentTimeout(timeout time.Duration) {
+	d.udpFragmentTimeout.Store(int64(timeout))
+}
+
+// DroppedUdpPackets returns the number of UDP packets received incomplete and
+// discarded after the fragment timeout, e.g. because of a lossy link.
+func (d *Dialer) DroppedUdpPackets() uint64 {
+	return d.droppedUdpPackets.Load()
 }
 
 func (d *Dialer) DialTcp(ctx context.Context, addr string) (c netproxy.Conn, err error) {
 	return d.DialContext(ctx, "tcp", addr)
 }
 
+// DialTcpWithInitialData is like DialTcp, but sends data in the same write as
+// the connect command, so that the server gets both in the first flight and a
+// small request, e.g. an HTTP GET, saves a round trip.
+func (d *Dialer) DialTcpWithInitialData(ctx context.Context, addr string, data []byte) (c netproxy.Conn, err error) {
+	return d.dialContext(ctx, "tcp", addr, data)
+}
+
 func (d *Dialer) DialUdp(ctx context.Context, addr string) (c netproxy.PacketConn, err error) {
 	pktConn, err := d.DialContext(ctx, "udp", addr)
 	if err != nil {
@@ -88,6 +154,13 @@ func (d *Dialer) DialUdp(ctx context.Context, addr string) (c netproxy.PacketCon
 
 func (d *Dialer) dialFuncFactory(udpNetwork string, rAddr net.Addr) common.DialFunc {
 	return func(ctx context.Context, dialer netproxy.Dialer) (transport *quic.Transport, addr net.Addr, err error) {
+		if shared := d.sharedConn.Load(); shared != nil {
+			pc, err := shared.NewPacketConn()
+			if err != nil {
+				return nil, nil, err
+			}
+			return pc.Transport(), rAddr, nil
+		}
 		conn, err := dialer.DialContext(ctx, udpNetwork, d.proxyAddress)
 		if err != nil {
 			return nil, nil, err
@@ -103,6 +176,12 @@ func (d *Dialer) dialFuncFactory(udpNetwork string, rAddr net.Addr) common.DialF
 }
 
 func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (c netproxy.Conn, err error) {
+	return d.dialContext(ctx, network, addr, nil)
+}
+
+// dialContext is DialContext sending initialData, if any, with the connect
+// command of a TCP dial.
+func (d *Dialer) dialContext(ctx context.Context, network string, addr string, initialData []byte) (c netproxy.Conn, err error) {
 	magicNetwork, err := netproxy.ParseMagicNetwork(network)
 	if err != nil {
 		return nil, err
@@ -124,7 +203,7 @@ func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (
 				Network: "udp",
 				Mark:    magicNetwork.Mark,
 			}.Encode()
-			tcpConn, err := d.clientRing.DialContextWithDialer(ctx, &mdata, d.nextDialer,
+			tcpConn, err := d.clientRing.DialContextWithDialer(ctx, &mdata, initialData, d.nextDialer,
 				d.dialFuncFactory(udpNetwork, proxyAddr),
 			)
 			if err != nil {
@@ -13,6 +13,7 @@ import (
 	"github.com/daeuniverse/outbound/netproxy"
 	"github.com/daeuniverse/outbound/protocol"
 	"github.com/daeuniverse/outbound/protocol/direct"
+	"github.com/daeuniverse/quic-go"
 )
 
 type Params struct {
@@ -97,3 +98,79 @@ func TestUdp(t *testing.T) {
 	}
 	t.Log(ips)
 }
+
+func TestCongestionControllerValidation(t *testing.T) {
+	header := protocol.Header{
+		ProxyAddress: "example.com:10383",
+		TlsConfig:    &tls.Config{ServerName: "example.com"},
+		User:         "00000000-0000-0000-0000-000000000000",
+		IsClient:     true,
+	}
+	for _, cc := range []string{"", "bbr", "cubic", "new_reno"} {
+		header.Feature1 = cc
+		if _, err := NewDialer(direct.SymmetricDirect, header); err != nil {
+			t.Errorf("NewDialer(%q) = %v", cc, err)
+		}
+	}
+	header.Feature1 = "vegas"
+	if _, err := NewDialer(direct.SymmetricDirect, header); err == nil {
+		t.Error("NewDialer() accepted an unknown congestion controller")
+	}
+}
+
+// writesStream records every write to it.
+type writesStream struct {
+	quic.Stream
+	writes [][]byte
+}
+
+func (s *writesStream) Write(p []byte) (int, error) {
+	s.writes = append(s.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+// streamQUICConn opens stream.
+type streamQUICConn struct {
+	quic.Connection
+	stream *writesStream
+}
+
+func (c *streamQUICConn) OpenStream() (quic.Stream, error) {
+	return c.stream, nil
+}
+
+func (c *streamQUICConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *streamQUICConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func TestDialTcpWithInitialData(t *testing.T) {
+	stream := &writesStream{}
+	d := &Dialer{
+		proxyAddress: "127.0.0.1:10383",
+		metadata:     protocol.Metadata{IsClient: true},
+	}
+	d.clientRing = newClientRing(func(func(n int64)) *clientImpl {
+		return &clientImpl{ClientOption: &ClientOption{}, quicConn: &streamQUICConn{stream: stream}}
+	}, 10)
+
+	data := []byte("GET / HTTP/1.1\r\n\r\n")
+	if _, err := d.DialTcpWithInitialData(context.Background(), "1.1.1.1:80", data); err != nil {
+		t.Fatal(err)
+	}
+	mdata, err := protocol.ParseMetadata("1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdata.IsClient = true
+	connect := NewConnect(NewAddress(&mdata), Ver5)
+	want := make([]byte, connect.BytesLen())
+	connect.WriteToBytes(want)
+	want = append(want, data...)
+	if len(stream.writes) != 1 || !bytes.Equal(stream.writes[0], want) {
+		t.Errorf("stream writes = %q, want the connect command and the data in one write %q", stream.writes, want)
+	}
+}
@@ -2,6 +2,8 @@ package tuic
 
 import (
 	"net/netip"
+	"sync/atomic"
+	"time"
 
 	"github.com/daeuniverse/outbound/pool/bytes"
 	"github.com/daeuniverse/quic-go"
@@ -42,10 +44,64 @@ func fragWriteNative(quicConn quic.Connection, packet *Packet, buf *bytes.Buffer
 	return
 }
 
+// defaultUdpFragmentTimeout is how long the fragments of a UDP packet wait
+// for the missing ones if ClientOption.UdpFragmentTimeout is zero.
+const defaultUdpFragmentTimeout = 10 * time.Second
+
+// deFraggers reassembles the fragmented UDP packets of a conn, one deFragger
+// per PKT_ID. A packet still incomplete after timeout, e.g. because a
+// fragment was lost, is discarded and counted in dropped. Expired packets are
+// discarded when the next packet arrives. It is not safe for concurrent use.
+type deFraggers struct {
+	timeout time.Duration
+	pending map[uint16]*deFragger
+	dropped *atomic.Uint64
+}
+
+func newDeFraggers(timeout time.Duration, dropped *atomic.Uint64) *deFraggers {
+	if timeout <= 0 {
+		timeout = defaultUdpFragmentTimeout
+	}
+	return &deFraggers{
+		timeout: timeout,
+		pending: make(map[uint16]*deFragger),
+		dropped: dropped,
+	}
+}
+
+func (s *deFraggers) Feed(m *Packet, p []byte) (n int, addrPort netip.AddrPort, assembled bool) {
+	if m.FRAG_TOTAL <= 1 {
+		return copy(p, m.DATA), m.ADDR.UDPAddr().AddrPort(), true
+	}
+	now := time.Now()
+	s.discardExpired(now)
+	d, ok := s.pending[m.PKT_ID]
+	if !ok {
+		d = &deFragger{expires: now.Add(s.timeout)}
+		s.pending[m.PKT_ID] = d
+	}
+	if n, addrPort, assembled = d.Feed(m, p); assembled {
+		delete(s.pending, m.PKT_ID)
+	}
+	return n, addrPort, assembled
+}
+
+func (s *deFraggers) discardExpired(now time.Time) {
+	for id, d := range s.pending {
+		if now.After(d.expires) {
+			delete(s.pending, id)
+			if s.dropped != nil {
+				s.dropped.Add(1)
+			}
+		}
+	}
+}
+
 type deFragger struct {
-	pkgID uint16
-	frags []*Packet
-	count uint8
+	pkgID   uint16
+	frags   []*Packet
+	count   uint8
+	expires time.Time
 }
 
 func (d *deFragger) Feed(m *Packet, p []byte) (n int, addrPort netip.AddrPort, assembled bool) {
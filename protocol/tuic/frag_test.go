@@ -0,0 +1,45 @@
+package tuic
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeFraggersTimeout(t *testing.T) {
+	var dropped atomic.Uint64
+	d := newDeFraggers(50*time.Millisecond, &dropped)
+	addrPort := netip.MustParseAddrPort("1.1.1.1:53")
+	addr := NewAddressAddrPort(addrPort)
+	buf := make([]byte, 16)
+
+	// The second fragment of packet 1 is lost.
+	if _, _, assembled := d.Feed(NewPacket(0, 1, 2, 0, 2, addr, []byte("ab"), Ver5), buf); assembled {
+		t.Fatal("Feed() assembled half a packet")
+	}
+	// Packet 2 arrives whole, in two fragments.
+	if _, _, assembled := d.Feed(NewPacket(0, 2, 2, 0, 2, addr, []byte("cd"), Ver5), buf); assembled {
+		t.Fatal("Feed() assembled half a packet")
+	}
+	n, got, assembled := d.Feed(NewPacket(0, 2, 2, 1, 2, &Address{TYPE: AtypNone}, []byte("ef"), Ver5), buf)
+	if !assembled || string(buf[:n]) != "cdef" || got != addrPort {
+		t.Fatalf("Feed() = %q, %v, %v, want cdef, %v, true", buf[:n], got, assembled, addrPort)
+	}
+	if len(d.pending) != 1 || dropped.Load() != 0 {
+		t.Fatalf("%v pending and %v dropped before the timeout, want 1 and 0", len(d.pending), dropped.Load())
+	}
+
+	// The next packet after the timeout reclaims packet 1.
+	time.Sleep(60 * time.Millisecond)
+	n, _, assembled = d.Feed(NewPacket(0, 3, 1, 0, 2, addr, []byte("gh"), Ver5), buf)
+	if !assembled || string(buf[:n]) != "gh" {
+		t.Fatalf("Feed() = %q, %v, want gh, true", buf[:n], assembled)
+	}
+	if _, _, assembled := d.Feed(NewPacket(0, 4, 2, 0, 2, addr, []byte("ij"), Ver5), buf); assembled {
+		t.Fatal("Feed() assembled half a packet")
+	}
+	if len(d.pending) != 1 || d.pending[4] == nil || dropped.Load() != 1 {
+		t.Errorf("%v pending and %v dropped after the timeout, want packet 4 and 1", len(d.pending), dropped.Load())
+	}
+}
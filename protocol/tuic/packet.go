@@ -98,8 +98,8 @@ type quicStreamPacketConn struct {
 	closeErr  error
 	closed    bool
 
-	// TODO: multiple defraggers for different PKT_ID
-	deFraggers sync.Map
+	// deFraggers is only used by ReadFrom, under mu.
+	deFraggers *deFraggers
 
 	muTimer       sync.Mutex
 	deadlineTimer *time.Timer
@@ -187,16 +187,9 @@ func (q *quicStreamPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, e
 				err = net.ErrClosed
 				return
 			}
-			_d, _ := q.deFraggers.LoadOrStore(packet.PKT_ID, &deFragger{})
-			d := _d.(*deFragger)
 			var assembled bool
-			// Feed packet into this deFragger.
-			// Return if this PKT_ID is ready and assembled.
-			if n, addr, assembled = d.Feed(packet, p); assembled {
-				q.deFraggers.Delete(packet.PKT_ID)
+			if n, addr, assembled = q.deFraggers.Feed(packet, p); assembled {
 				return
-			} else {
-				// FIXME: Timeout to clean deFraggers.
 			}
 		}
 	} else {
@@ -282,4 +275,8 @@ func (conn *quicStreamPacketConn) Write(b []byte) (n int, err error) {
 	return conn.WriteTo(b, conn.target)
 }
 
+func (conn *quicStreamPacketConn) IsStream() bool {
+	return false
+}
+
 var _ netproxy.PacketConn = (*quicStreamPacketConn)(nil)
@@ -461,11 +461,17 @@ func NewAddress(metadata *protocol.Metadata) *Address {
 func NewAddressNetAddr(addr net.Addr) (*Address, error) {
 	if addr, ok := addr.(interface{ AddrPort() netip.AddrPort }); ok {
 		if addrPort := addr.AddrPort(); addrPort.IsValid() { // sing's M.Socksaddr maybe return an invalid AddrPort if it's a DomainName
+			if addrPort.Addr().Zone() != "" {
+				return &Address{}, fmt.Errorf("%w: %v", protocol.ErrZonedAddr, addrPort)
+			}
 			return NewAddressAddrPort(addrPort), nil
 		}
 	}
 	addrStr := addr.String()
 	if addrPort, err := netip.ParseAddrPort(addrStr); err == nil {
+		if addrPort.Addr().Zone() != "" {
+			return &Address{}, fmt.Errorf("%w: %v", protocol.ErrZonedAddr, addrStr)
+		}
 		return NewAddressAddrPort(addrPort), nil
 	}
 	metadata, err := protocol.ParseMetadata(addrStr)
@@ -0,0 +1,119 @@
+package grpc
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errDraining is returned to the Tun streams opened while the server drains.
+var errDraining = status.Error(codes.Unavailable, "server is draining")
+
+// ConnTracker keeps track of the live ServerConns of a Server so that they can
+// be drained. The zero value is ready to use.
+type ConnTracker struct {
+	mu       sync.Mutex
+	conns    map[*ServerConn]struct{}
+	draining bool
+	// idle is closed once the tracker drains and no conn is left.
+	idle chan struct{}
+}
+
+// add tracks c, unless the tracker drains.
+func (t *ConnTracker) add(c *ServerConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[*ServerConn]struct{})
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+// remove stops tracking c. It may be called more than once.
+func (t *ConnTracker) remove(c *ServerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+	if t.draining && len(t.conns) == 0 && t.idle != nil {
+		select {
+		case <-t.idle:
+		default:
+			close(t.idle)
+		}
+	}
+}
+
+// Len returns the number of live conns.
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Drain refuses new conns and waits for the live ones to be closed. Once ctx
+// is done, it closes those left and returns ctx.Err().
+func (t *ConnTracker) Drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if len(t.conns) == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+	t.mu.Lock()
+	conns := make([]*ServerConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	return ctx.Err()
+}
+
+// Drain shuts the server down without cutting the conns in flight: it stops
+// accepting connections and Tun streams, then waits for the live conns to be
+// closed and the handlers to return. Once ctx is done, it closes what is left
+// and returns ctx.Err(). Conns are only waited for if Conns is set.
+func (g Server) Drain(ctx context.Context) error {
+	var stopped chan struct{}
+	if g.Server != nil {
+		stopped = make(chan struct{})
+		go func() {
+			g.Server.GracefulStop()
+			close(stopped)
+		}()
+	}
+	var err error
+	if g.Conns != nil {
+		err = g.Conns.Drain(ctx)
+	}
+	if stopped == nil {
+		return err
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		g.Server.Stop()
+		<-stopped
+		err = ctx.Err()
+	}
+	return err
+}
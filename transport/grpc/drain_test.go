@@ -0,0 +1,88 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startTun runs a Tun of g in the background and returns its conn and the
+// result of Tun.
+func startTun(t *testing.T, g Server, conns chan net.Conn) (net.Conn, chan error) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Tun(&fakeTunServer{hunks: make(chan *proto.Hunk)})
+	}()
+	select {
+	case c := <-conns:
+		return c, done
+	case err := <-done:
+		t.Fatalf("Tun() = %v before HandleConn", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleConn was not called")
+	}
+	return nil, nil
+}
+
+func TestServerDrain(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	g := Server{
+		Conns: &ConnTracker{},
+		HandleConn: func(conn net.Conn) error {
+			conns <- conn
+			_, err := io.Copy(io.Discard, conn)
+			return err
+		},
+	}
+
+	// The conns closed before the deadline are waited for.
+	c, tunDone := startTun(t, g, conns)
+	if got := g.Conns.Len(); got != 1 {
+		t.Fatalf("Len() = %v, want 1", got)
+	}
+	drained := make(chan error, 1)
+	go func() {
+		drained <- g.Drain(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain() = %v with a live conn", err)
+	default:
+	}
+	if err := g.Tun(&fakeTunServer{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Tun() while draining = %v, want Unavailable", err)
+	}
+	c.Close()
+	if err := <-drained; err != nil {
+		t.Errorf("Drain() = %v", err)
+	}
+	if err := <-tunDone; err != nil {
+		t.Errorf("Tun() = %v", err)
+	}
+
+	// The conns left at the deadline are closed.
+	g.Conns = &ConnTracker{}
+	_, tunDone = startTun(t, g, conns)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := g.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Drain() = %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case <-tunDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tun() still running after Drain()")
+	}
+	if got := g.Conns.Len(); got != 0 {
+		t.Errorf("Len() = %v after Drain(), want 0", got)
+	}
+}
@@ -0,0 +1,392 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	"github.com/daeuniverse/outbound/pool"
+)
+
+// Flow control framing on top of a gun stream.
+//
+// Every frame is type(1) | length(4) | payload. DATA frames carry application
+// data and consume the sender's credit. The receiver grants credit back with
+// WINDOW_UPDATE frames whose 4-byte payload is the increment, after the
+// application has read half of the window. A sender therefore never has more
+// than one window of unread data in flight, no matter how slow the reader is.
+const (
+	flowFrameData         = 0
+	flowFrameWindowUpdate = 1
+
+	flowHeaderSize   = 5
+	flowMaxFrameSize = 16 << 10
+
+	// DefaultFlowWindow is the per-direction window used if none is given.
+	DefaultFlowWindow = 4 << 20
+)
+
+var (
+	_ net.Conn             = (*FlowConn)(nil)
+	_ netproxy.CloseWriter = (*FlowConn)(nil)
+)
+
+// FlowConn is a credit-based flow controlled conn over a gun stream. Both ends
+// must use it with the same window size.
+type FlowConn struct {
+	conn   netproxy.Conn
+	window uint32
+
+	muWrite sync.Mutex // muWrite serializes frames written to conn
+
+	mu       sync.Mutex
+	credit   uint32
+	recvBuf  [][]byte
+	recvOff  int // read offset into recvBuf[0]
+	recvLen  uint32
+	consumed uint32
+	err      error
+	closed   bool
+	readable chan struct{}
+	writable chan struct{}
+	// done is closed once on the first terminal error or on Close, waking up
+	// every blocked Read and Write.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	readDeadline  *flowDeadline
+	writeDeadline *flowDeadline
+}
+
+// NewFlowConn wraps conn, which is usually a *ClientConn or a *ServerConn, with
+// window bytes of credit per direction. A zero window means DefaultFlowWindow.
+func NewFlowConn(conn netproxy.Conn, window uint32) *FlowConn {
+	if window == 0 {
+		window = DefaultFlowWindow
+	}
+	c := &FlowConn{
+		conn:          conn,
+		window:        window,
+		credit:        window,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		readDeadline:  newFlowDeadline(),
+		writeDeadline: newFlowDeadline(),
+	}
+	go c.readLoop()
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *FlowConn) readLoop() {
+	var header [flowHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			c.fail(err)
+			return
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		switch header[0] {
+		case flowFrameData:
+			if length > flowMaxFrameSize {
+				c.fail(fmt.Errorf("flow control: frame too large: %v", length))
+				return
+			}
+			buf := pool.Get(int(length))
+			if _, err := io.ReadFull(c.conn, buf); err != nil {
+				pool.Put(buf)
+				c.fail(err)
+				return
+			}
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				pool.Put(buf)
+				return
+			}
+			if c.recvLen+length > c.window {
+				c.mu.Unlock()
+				pool.Put(buf)
+				c.fail(fmt.Errorf("flow control: peer exceeded the window"))
+				return
+			}
+			c.recvBuf = append(c.recvBuf, buf)
+			c.recvLen += length
+			c.mu.Unlock()
+			notify(c.readable)
+		case flowFrameWindowUpdate:
+			if length != 4 {
+				c.fail(fmt.Errorf("flow control: bad window update length: %v", length))
+				return
+			}
+			var increment [4]byte
+			if _, err := io.ReadFull(c.conn, increment[:]); err != nil {
+				c.fail(err)
+				return
+			}
+			c.mu.Lock()
+			c.credit += binary.BigEndian.Uint32(increment[:])
+			c.mu.Unlock()
+			notify(c.writable)
+		default:
+			c.fail(fmt.Errorf("flow control: unknown frame type: %v", header[0]))
+			return
+		}
+	}
+}
+
+// fail records the first terminal error and wakes up blocked callers.
+func (c *FlowConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.finish()
+}
+
+// finish wakes up every blocked Read and Write for good.
+func (c *FlowConn) finish() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+func (c *FlowConn) writeFrame(typ byte, payload []byte) error {
+	buf := pool.Get(flowHeaderSize + len(payload))
+	defer pool.Put(buf)
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	copy(buf[flowHeaderSize:], payload)
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *FlowConn) Read(p []byte) (n int, err error) {
+	for {
+		c.mu.Lock()
+		if c.recvLen > 0 {
+			for n < len(p) && len(c.recvBuf) > 0 {
+				m := copy(p[n:], c.recvBuf[0][c.recvOff:])
+				n += m
+				c.recvOff += m
+				if c.recvOff == len(c.recvBuf[0]) {
+					pool.Put(c.recvBuf[0])
+					c.recvBuf = c.recvBuf[1:]
+					c.recvOff = 0
+				}
+			}
+			c.recvLen -= uint32(n)
+			c.consumed += uint32(n)
+			var increment uint32
+			if c.consumed >= c.window/2 {
+				increment, c.consumed = c.consumed, 0
+			}
+			left := c.recvLen > 0
+			c.mu.Unlock()
+			if left {
+				// Pass the wakeup on to the next blocked Read.
+				notify(c.readable)
+			}
+			if increment > 0 {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], increment)
+				if err := c.writeFrame(flowFrameWindowUpdate, b[:]); err != nil {
+					c.fail(err)
+				}
+			}
+			return n, nil
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.err != nil {
+			err = c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.readable:
+		case <-c.done:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *FlowConn) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if c.err != nil {
+			err = c.err
+			c.mu.Unlock()
+			return n, err
+		}
+		if c.credit == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.writable:
+			case <-c.done:
+			case <-c.writeDeadline.wait():
+				return n, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		size := uint32(len(p) - n)
+		if size > c.credit {
+			size = c.credit
+		}
+		if size > flowMaxFrameSize {
+			size = flowMaxFrameSize
+		}
+		c.credit -= size
+		left := c.credit > 0
+		c.mu.Unlock()
+		if left {
+			// Pass the wakeup on to the next blocked Write.
+			notify(c.writable)
+		}
+
+		if err = c.writeFrame(flowFrameData, p[n:n+int(size)]); err != nil {
+			c.fail(err)
+			return n, err
+		}
+		n += int(size)
+	}
+	return n, nil
+}
+
+func (c *FlowConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	for _, buf := range c.recvBuf {
+		pool.Put(buf)
+	}
+	c.recvBuf = nil
+	c.recvOff = 0
+	c.recvLen = 0
+	c.mu.Unlock()
+	c.finish()
+	return c.conn.Close()
+}
+
+func (c *FlowConn) CloseWrite() error {
+	if cw, ok := c.conn.(netproxy.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *FlowConn) LocalAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *FlowConn) RemoteAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *FlowConn) IsStream() bool {
+	return true
+}
+
+func (c *FlowConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *FlowConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *FlowConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// flowDeadline is a resettable deadline, modelled after the one of net.Pipe.
+type flowDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline is exceeded
+}
+
+func newFlowDeadline() *flowDeadline {
+	return &flowDeadline{cancel: make(chan struct{})}
+}
+
+func (d *flowDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *flowDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,93 @@
+package grpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFlowConnTransfer(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewFlowConn(a, 64<<10)
+	server := NewFlowConn(b, 64<<10)
+	defer client.Close()
+	defer server.Close()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		if _, err := client.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestFlowConnBlocksWithoutCredit(t *testing.T) {
+	a, b := net.Pipe()
+	const window = 1024
+	client := NewFlowConn(a, window)
+	server := NewFlowConn(b, window)
+	defer client.Close()
+	defer server.Close()
+
+	// The server never reads, so only one window can be written.
+	_ = client.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := client.Write(make([]byte, 4*window))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if n != window {
+		t.Fatalf("expected %v bytes written before blocking, got %v", window, n)
+	}
+}
+
+func TestFlowConnCloseWakesEveryCaller(t *testing.T) {
+	a, b := net.Pipe()
+	const window = 1024
+	client := NewFlowConn(a, window)
+	server := NewFlowConn(b, window)
+	defer server.Close()
+
+	// The server never reads, so the client has no credit left.
+	if _, err := client.Write(make([]byte, window)); err != nil {
+		t.Fatal(err)
+	}
+	const callers = 3
+	errs := make(chan error, 2*callers)
+	for range callers {
+		go func() {
+			_, err := client.Read(make([]byte, 1))
+			errs <- err
+		}()
+		go func() {
+			_, err := client.Write(make([]byte, 1))
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	_ = client.Close()
+	timeout := time.After(time.Second)
+	for range 2 * callers {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("blocked call after Close = %v, want net.ErrClosed", err)
+			}
+		case <-timeout:
+			t.Fatal("Close did not wake up every blocked Read and Write")
+		}
+	}
+}
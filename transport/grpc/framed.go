@@ -0,0 +1,122 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+// Packet framing on top of a gun stream, until TunDatagram is implemented.
+//
+// Every packet is length(2) | payload, so that the packets of a UDP flow keep
+// their boundaries over the byte stream.
+const (
+	framedHeaderSize = 2
+
+	// MaxFramedSize is the largest packet a FramedConn carries.
+	MaxFramedSize = 1<<16 - 1
+)
+
+var _ net.Conn = (*FramedConn)(nil)
+
+// FramedConn carries packets over a gun stream: every Write is sent as one
+// packet and every Read returns one packet. Both ends must use it.
+type FramedConn struct {
+	conn netproxy.Conn
+
+	muRead sync.Mutex // muRead keeps the packets read whole
+	// muWrite keeps the header and the payload of a packet together on
+	// conns that split a Write, e.g. a FlowConn.
+	muWrite sync.Mutex
+}
+
+// NewFramedConn wraps conn, which is usually a *ClientConn, a *ServerConn or a
+// *FlowConn over one of them.
+func NewFramedConn(conn netproxy.Conn) *FramedConn {
+	return &FramedConn{conn: conn}
+}
+
+// Read reads one packet into p. Like a UDP socket, it drops what does not
+// fit into p.
+func (c *FramedConn) Read(p []byte) (n int, err error) {
+	c.muRead.Lock()
+	defer c.muRead.Unlock()
+	var header [framedHeaderSize]byte
+	if _, err = io.ReadFull(c.conn, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	n = min(size, len(p))
+	if _, err = io.ReadFull(c.conn, p[:n]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if _, err = io.CopyN(io.Discard, c.conn, int64(size-n)); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return n, nil
+}
+
+// unexpectedEOF turns the EOF in the middle of a packet into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Write sends p as one packet.
+func (c *FramedConn) Write(p []byte) (n int, err error) {
+	if len(p) > MaxFramedSize {
+		return 0, fmt.Errorf("packet of %d bytes exceeds %d", len(p), MaxFramedSize)
+	}
+	// Not pooled: the conn may still hold buf after a Write that timed out.
+	buf := make([]byte, framedHeaderSize+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[framedHeaderSize:], p)
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+	if _, err = c.conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *FramedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *FramedConn) LocalAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (c *FramedConn) RemoteAddr() net.Addr {
+	if conn, ok := c.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *FramedConn) IsStream() bool {
+	return false
+}
+
+func (c *FramedConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *FramedConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *FramedConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,54 @@
+package grpc
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// chunkConn delivers what is written to it a few bytes at a time, like a
+// stream that splits and merges hunks.
+type chunkConn struct {
+	net.Conn
+}
+
+func (c chunkConn) Read(p []byte) (int, error) {
+	return c.Conn.Read(p[:min(len(p), 3)])
+}
+
+func TestFramedConn(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewFramedConn(a)
+	server := NewFramedConn(chunkConn{b})
+	defer client.Close()
+	defer server.Close()
+
+	packets := []string{"query", "", "a longer answer", "truncated"}
+	go func() {
+		for _, p := range packets {
+			if _, err := client.Write([]byte(p)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		client.Close()
+	}()
+	for i, want := range packets {
+		buf := make([]byte, 64)
+		if i == len(packets)-1 {
+			buf = buf[:5]
+			want = want[:5]
+		}
+		n, err := server.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read() = %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+	if _, err := server.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("Read() after the last packet = %v, want EOF", err)
+	}
+
+	if _, err := client.Write(make([]byte, MaxFramedSize+1)); err == nil {
+		t.Error("Write() of an oversized packet succeeded")
+	}
+}
@@ -3,15 +3,18 @@ package grpc
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daeuniverse/outbound/netproxy"
 	"github.com/daeuniverse/outbound/pkg/cert"
+	"github.com/daeuniverse/outbound/pkg/fastrand"
 	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
 	"github.com/daeuniverse/outbound/pool"
 	"google.golang.org/grpc"
@@ -185,6 +188,12 @@ func (c *ClientConn) CloseWrite() error {
 	return c.tun.CloseSend()
 }
 
+var _ netproxy.CloseWriter = (*ClientConn)(nil)
+
+func (c *ClientConn) IsStream() bool {
+	return true
+}
+
 func (c *ClientConn) SetDeadline(t time.Time) error {
 	c.deadlineMu.Lock()
 	defer c.deadlineMu.Unlock()
@@ -311,6 +320,92 @@ type Dialer struct {
 	ServiceName   string
 	ServerName    string
 	AllowInsecure bool
+	// FlowControlWindow enables credit-based flow control with the given
+	// window in bytes; see FlowConn. The server must enable it too. Zero
+	// disables it.
+	FlowControlWindow uint32
+	// Framed keeps the boundaries of the writes, e.g. to carry UDP over the
+	// stream; see FramedConn. The server must enable it too.
+	Framed bool
+	// RetryPolicy retries transient failures when opening the Tun stream.
+	RetryPolicy RetryPolicy
+	// MaxRecvMsgSize and MaxSendMsgSize cap the size of one message of the
+	// Tun stream in bytes, that is one Write plus a few bytes of protobuf
+	// framing. A larger message fails the stream with ResourceExhausted on
+	// receive, and the Write with it on send. Zero means DefaultMaxMsgSize.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+}
+
+// DefaultMaxMsgSize is the default message size cap of Dialer and Server in
+// both directions. It is the default receive cap of gRPC, so that a hunk the
+// peer would reject already fails on send.
+const DefaultMaxMsgSize = 4 << 20
+
+// msgSize returns size, or DefaultMaxMsgSize if size is not set.
+func msgSize(size int) int {
+	if size <= 0 {
+		return DefaultMaxMsgSize
+	}
+	return size
+}
+
+// DefaultRetryBaseDelay is used by RetryPolicy if BaseDelay is not set.
+const DefaultRetryBaseDelay = 50 * time.Millisecond
+
+// RetryPolicy describes how to retry opening a Tun stream. Only Unavailable and
+// ResourceExhausted errors are retried. The zero value disables retries.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles on every
+	// following retry. Zero means DefaultRetryBaseDelay.
+	BaseDelay time.Duration
+	// Jitter randomizes every delay by up to this fraction in both directions,
+	// e.g. 0.2 gives delays between 80% and 120% of the nominal one.
+	Jitter float64
+}
+
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = DefaultRetryBaseDelay
+	}
+	d := float64(base) * float64(uint64(1)<<min(retry, 30))
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*fastrand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// do calls open until it succeeds, fails with an error that is not retryable,
+// runs out of attempts or ctx is done.
+func (p *RetryPolicy) do(ctx context.Context, open func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := open()
+		if err == nil {
+			return nil
+		}
+		if attempt+1 >= p.MaxAttempts || !isRetryableStreamError(err) {
+			return err
+		}
+		timer := time.NewTimer(p.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: last error: %v", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+func isRetryableStreamError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
 }
 
 func (d *Dialer) DialContext(ctx context.Context, network string, address string) (netproxy.Conn, error) {
@@ -323,30 +418,116 @@ func (d *Dialer) DialContext(ctx context.Context, network string, address string
 		cancel()
 		return nil, err
 	}
-	client := proto.NewGunServiceClient(meta.cc)
+	return d.openTun(ctx, meta.cc, nil)
+}
+
+// DialConn runs one Tun stream over conn, a connection to the server
+// established beforehand, e.g. through a WebSocket or an obfuscation layer,
+// instead of dialing NextDialer. address is the address of the server, for the
+// :authority of the stream. conn is used once: if it breaks, gRPC does not
+// reconnect and the returned conn fails. Closing the returned conn closes
+// conn.
+func (d *Dialer) DialConn(ctx context.Context, conn netproxy.Conn, address string) (netproxy.Conn, error) {
+	certOption, err := tlsCredentials(d.ServerName, d.AllowInsecure)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	var used atomic.Bool
+	cc, err := grpc.DialContext(ctx, "passthrough:///"+address,
+		certOption,
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			if used.Swap(true) {
+				return nil, errConnUsed
+			}
+			return &netproxy.FakeNetConn{Conn: conn}, nil
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c, err := d.openTun(ctx, cc, func() { _ = cc.Close() })
+	if err != nil {
+		_ = cc.Close()
+		// gRPC may not have dialed yet.
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// errConnUsed fails the redials of the ClientConn of DialConn.
+var errConnUsed = errors.New("grpc: the conn of DialConn was already used")
+
+// openTun opens a Tun stream on cc. onClose, if not nil, is called when the
+// returned conn is closed.
+func (d *Dialer) openTun(ctx context.Context, cc *grpc.ClientConn, onClose func()) (netproxy.Conn, error) {
+	client := proto.NewGunServiceClient(cc)
 
 	clientX := client.(proto.GunServiceClientX)
 	serviceName := d.ServiceName
 	if serviceName == "" {
 		serviceName = "GunService"
 	}
-	// ctx is the lifetime of the tun
-	ctxStream, streamCloser := context.WithCancel(context.Background())
-	tun, err := clientX.TunCustomName(ctxStream, serviceName)
+	var (
+		tun          proto.GunService_TunClient
+		streamCloser context.CancelFunc
+	)
+	err := d.RetryPolicy.do(ctx, func() (err error) {
+		// ctx is the lifetime of the tun
+		var ctxStream context.Context
+		ctxStream, streamCloser = context.WithCancel(context.Background())
+		ctxStream = appendOriginalAddrs(ctxStream, ctx)
+		tun, err = clientX.TunCustomName(ctxStream, serviceName,
+			grpc.MaxCallRecvMsgSize(msgSize(d.MaxRecvMsgSize)),
+			grpc.MaxCallSendMsgSize(msgSize(d.MaxSendMsgSize)),
+		)
+		if err != nil {
+			streamCloser()
+		}
+		return err
+	})
 	if err != nil {
-		streamCloser()
 		return nil, err
 	}
-	return NewClientConn(tun, streamCloser), nil
+	closer := streamCloser
+	if onClose != nil {
+		closer = func() {
+			streamCloser()
+			onClose()
+		}
+	}
+	var conn netproxy.Conn = NewClientConn(tun, closer)
+	if d.FlowControlWindow > 0 {
+		conn = NewFlowConn(conn, d.FlowControlWindow)
+	}
+	if d.Framed {
+		conn = NewFramedConn(conn)
+	}
+	return conn, nil
+}
+
+// tlsCredentials returns the TLS credentials to connect to serverName.
+func tlsCredentials(serverName string, allowInsecure bool) (grpc.DialOption, error) {
+	roots, err := cert.GetSystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system certificate pool")
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{ServerName: serverName, RootCAs: roots, InsecureSkipVerify: allowInsecure})), nil
 }
 
 func getGrpcClientConn(ctx context.Context, tcpDialer netproxy.Dialer, serverName string, address string, allowInsecure bool, somark uint32, mptcp bool) (*clientConnMeta, ccCanceller, error) {
 	// allowInsecure?
-	roots, err := cert.GetSystemCertPool()
+	certOption, err := tlsCredentials(serverName, allowInsecure)
 	if err != nil {
-		return nil, func() {}, fmt.Errorf("failed to get system certificate pool")
+		return nil, func() {}, err
 	}
-	certOption := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{ServerName: serverName, RootCAs: roots, InsecureSkipVerify: allowInsecure}))
 
 	globalCCAccess.Lock()
 	if globalCCMap == nil {
@@ -0,0 +1,244 @@
+package grpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "backend restarting")
+
+	t.Run("retries transient errors", func(t *testing.T) {
+		p := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+		attempts := 0
+		err := p.do(context.Background(), func() error {
+			attempts++
+			if attempts < 3 {
+				return unavailable
+			}
+			return nil
+		})
+		if err != nil || attempts != 3 {
+			t.Errorf("do() = %v after %v attempts, want success after 3", err, attempts)
+		}
+	})
+
+	t.Run("gives up after MaxAttempts", func(t *testing.T) {
+		p := RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+		attempts := 0
+		err := p.do(context.Background(), func() error {
+			attempts++
+			return unavailable
+		})
+		if status.Code(err) != codes.Unavailable || attempts != 2 {
+			t.Errorf("do() = %v after %v attempts, want Unavailable after 2", err, attempts)
+		}
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		p := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+		attempts := 0
+		err := p.do(context.Background(), func() error {
+			attempts++
+			return status.Error(codes.PermissionDenied, "no")
+		})
+		if status.Code(err) != codes.PermissionDenied || attempts != 1 {
+			t.Errorf("do() = %v after %v attempts, want PermissionDenied after 1", err, attempts)
+		}
+	})
+
+	t.Run("zero value does not retry", func(t *testing.T) {
+		var p RetryPolicy
+		attempts := 0
+		_ = p.do(context.Background(), func() error {
+			attempts++
+			return unavailable
+		})
+		if attempts != 1 {
+			t.Errorf("%v attempts, want 1", attempts)
+		}
+	})
+
+	t.Run("zero BaseDelay backs off", func(t *testing.T) {
+		p := RetryPolicy{MaxAttempts: 2}
+		start := time.Now()
+		_ = p.do(context.Background(), func() error {
+			return unavailable
+		})
+		if elapsed := time.Since(start); elapsed < DefaultRetryBaseDelay {
+			t.Errorf("retried after %v, want at least %v", elapsed, DefaultRetryBaseDelay)
+		}
+	})
+
+	t.Run("respects the context", func(t *testing.T) {
+		p := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := p.do(ctx, func() error {
+			return unavailable
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("do() = %v, want context.DeadlineExceeded", err)
+		}
+	})
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, Jitter: 0.2}
+	for retry, nominal := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		for i := 0; i < 100; i++ {
+			d := p.delay(retry)
+			if d < nominal*8/10 || d > nominal*12/10 {
+				t.Fatalf("delay(%v) = %v, want within 20%% of %v", retry, d, nominal)
+			}
+		}
+	}
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// connListener accepts conn once, then blocks until closed.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	l.conns <- conn
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestDialConn(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})))
+	proto.RegisterGunServiceServerX(s, Server{HandleConn: func(conn net.Conn) error {
+		_, err := io.Copy(conn, conn)
+		return err
+	}}, "GunService")
+	go s.Serve(newConnListener(serverConn))
+	defer s.Stop()
+
+	d := &Dialer{ServerName: "example.com", AllowInsecure: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := d.DialConn(ctx, clientConn, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v, want hello", buf, err)
+	}
+
+	// Closing the tun closes the conn it runs over.
+	c.Close()
+	_ = serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := serverConn.Read(buf); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("the conn is still open after Close()")
+			}
+			break
+		}
+	}
+}
+
+func TestMaxMsgSize(t *testing.T) {
+	g := Server{MaxRecvMsgSize: 1024, HandleConn: func(conn net.Conn) error {
+		_, err := io.Copy(conn, conn)
+		return err
+	}}
+	// dial runs d over a fresh echo server with g's limits.
+	dial := func(d *Dialer) netproxy.Conn {
+		clientConn, serverConn := net.Pipe()
+		s := grpc.NewServer(append(g.ServerOptions(), grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}})))...)
+		proto.RegisterGunServiceServerX(s, g, "GunService")
+		go s.Serve(newConnListener(serverConn))
+		t.Cleanup(s.Stop)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := d.DialConn(ctx, clientConn, "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		return c
+	}
+
+	c := dial(&Dialer{ServerName: "example.com", AllowInsecure: true, MaxSendMsgSize: 1024})
+	// The hunk takes a few bytes more than the Write.
+	if _, err := c.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("Write() of 1000 bytes = %v", err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(make([]byte, 2048)); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Write() of 2048 bytes = %v, want ResourceExhausted", err)
+	}
+
+	// Without the cap on send, the server rejects the hunk.
+	c = dial(&Dialer{ServerName: "example.com", AllowInsecure: true})
+	_, _ = c.Write(make([]byte, 2048))
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() after an oversized hunk = %v, want the stream to fail", err)
+	}
+}
@@ -6,10 +6,10 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
-	"github.com/daeuniverse/outbound/pool"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
@@ -23,18 +23,39 @@ type ServerConn struct {
 	muWriting sync.Mutex // muWriting protects writing
 	muRecv    sync.Mutex // muReading protects recv
 	muSend    sync.Mutex // muWriting protects send
+	muBuf     sync.Mutex // muBuf protects buf and offset
 	buf       []byte
 	offset    int
+	pool      BufferPool
+	// maxReadSize, if positive, caps the bytes returned by one Read.
+	maxReadSize int
+	// codeToError translates the errors of Recv and Send, see SetCodeToError.
+	codeToError CodeToError
 
 	deadlineMu    sync.Mutex
-	readDeadline  *time.Timer
-	writeDeadline *time.Timer
+	clock         Clock
+	readDeadline  Timer
+	writeDeadline Timer
 	ctxRead       context.Context
 	cancelRead    func()
 	ctxWrite      context.Context
 	cancelWrite   func()
 	ctx           context.Context
 	cancel        func()
+
+	muCtx      sync.Mutex
+	stopParent func() bool // stops watching the context of SetContext
+	ctxErr     error       // the error of that context once it closed the conn
+
+	// onClose, if not nil, is called by the first Close.
+	onClose func()
+	// onCloseTraffic, if not nil, is called by the first Close after
+	// onClose, see SetOnClose.
+	onCloseTraffic func(tx, rx uint64)
+	closeOnce      sync.Once
+	// tx and rx count the bytes written and read.
+	tx atomic.Uint64
+	rx atomic.Uint64
 }
 
 func NewServerConn(tun proto.GunService_TunServer, localAddr net.Addr) *ServerConn {
@@ -50,6 +71,8 @@ func NewServerConn(tun proto.GunService_TunServer, localAddr net.Addr) *ServerCo
 		cancelRead:  cancelRead,
 		ctxWrite:    ctxWrite,
 		cancelWrite: cancelWrite,
+		pool:        sharedPool{},
+		clock:       realClock{},
 	}
 }
 
@@ -58,19 +81,14 @@ func (c *ServerConn) Read(p []byte) (n int, err error) {
 	case <-c.ctxRead.Done():
 		return 0, os.ErrDeadlineExceeded
 	case <-c.ctx.Done():
-		return 0, io.EOF
+		return 0, c.closedErr()
 	default:
 	}
 
 	c.muReading.Lock()
 	defer c.muReading.Unlock()
-	if c.buf != nil {
-		n = copy(p, c.buf[c.offset:])
-		c.offset += n
-		if c.offset == len(c.buf) {
-			pool.Put(c.buf)
-			c.buf = nil
-		}
+	p = c.capRead(p)
+	if n, ok := c.readBuffered(p); ok {
 		return n, nil
 	}
 	// set 1 to avoid channel leak
@@ -90,29 +108,68 @@ func (c *ServerConn) Read(p []byte) (n int, err error) {
 	case <-c.ctxRead.Done():
 		return 0, os.ErrDeadlineExceeded
 	case <-c.ctx.Done():
-		return 0, io.EOF
+		return 0, c.closedErr()
 	case recvResp := <-readDone:
 		err = recvResp.err
 		if err != nil {
-			if code := status.Code(err); code == codes.Unavailable || status.Code(err) == codes.OutOfRange {
-				err = io.EOF
-			}
-			return 0, err
+			return 0, c.codeToError.translate(err)
 		}
 		n = copy(p, recvResp.hunk.Data)
-		c.buf = pool.Get(len(recvResp.hunk.Data) - n)
-		copy(c.buf, recvResp.hunk.Data[n:])
-		c.offset = 0
+		c.rx.Add(uint64(n))
+		if rest := recvResp.hunk.Data[n:]; len(rest) > 0 {
+			c.muBuf.Lock()
+			c.buf = c.pool.Get(len(rest))
+			copy(c.buf, rest)
+			c.offset = 0
+			c.muBuf.Unlock()
+		}
 		return n, nil
 	}
 }
 
+// readBuffered copies what is left of the last received hunk into p. ok is
+// false if nothing is buffered.
+func (c *ServerConn) readBuffered(p []byte) (n int, ok bool) {
+	c.muBuf.Lock()
+	defer c.muBuf.Unlock()
+	if c.buf == nil {
+		return 0, false
+	}
+	n = copy(p, c.buf[c.offset:])
+	c.offset += n
+	c.rx.Add(uint64(n))
+	if c.offset == len(c.buf) {
+		c.pool.Put(c.buf)
+		c.buf = nil
+	}
+	return n, true
+}
+
+// Buffered returns the number of bytes already received but not yet read.
+// It does not wait for a Read in progress.
+func (c *ServerConn) Buffered() int {
+	c.muBuf.Lock()
+	defer c.muBuf.Unlock()
+	if c.buf == nil {
+		return 0
+	}
+	return len(c.buf) - c.offset
+}
+
+// ReadBuffered reads from the bytes already received without waiting for the
+// next message, and returns 0 if there are none. Use it with Buffered to
+// drain the conn before Close.
+func (c *ServerConn) ReadBuffered(p []byte) int {
+	n, _ := c.readBuffered(c.capRead(p))
+	return n
+}
+
 func (c *ServerConn) Write(p []byte) (n int, err error) {
 	select {
 	case <-c.ctxWrite.Done():
 		return 0, os.ErrDeadlineExceeded
 	case <-c.ctx.Done():
-		return 0, io.EOF
+		return 0, c.closedErr()
 	default:
 	}
 
@@ -132,12 +189,12 @@ func (c *ServerConn) Write(p []byte) (n int, err error) {
 	case <-c.ctxWrite.Done():
 		return 0, os.ErrDeadlineExceeded
 	case <-c.ctx.Done():
-		return 0, io.EOF
+		return 0, c.closedErr()
 	case err = <-sendDone:
-		if code := status.Code(err); code == codes.Unavailable || status.Code(err) == codes.OutOfRange {
-			err = io.EOF
+		if err == nil {
+			c.tx.Add(uint64(len(p)))
 		}
-		return len(p), err
+		return len(p), c.codeToError.translate(err)
 	}
 }
 
@@ -147,8 +204,134 @@ func (c *ServerConn) Close() error {
 	default:
 		c.cancel()
 	}
+	c.muCtx.Lock()
+	if c.stopParent != nil {
+		c.stopParent()
+	}
+	c.muCtx.Unlock()
+	// Give back what was received but not read.
+	c.muBuf.Lock()
+	if c.buf != nil {
+		c.pool.Put(c.buf)
+		c.buf = nil
+	}
+	c.muBuf.Unlock()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+		if c.onCloseTraffic != nil {
+			c.onCloseTraffic(c.Traffic())
+		}
+	})
 	return nil
 }
+
+// Traffic returns the bytes written to and read from the conn so far.
+func (c *ServerConn) Traffic() (tx, rx uint64) {
+	return c.tx.Load(), c.rx.Load()
+}
+
+// SetOnClose makes the conn call f with its final Traffic once it is
+// closed, by Close or by the end of the context of SetContext, e.g. for
+// per-tunnel accounting. f is called exactly once, however many times and
+// from however many goroutines the conn is closed. Call it before the first
+// Read or Write.
+func (c *ServerConn) SetOnClose(f func(tx, rx uint64)) {
+	c.onCloseTraffic = f
+}
+
+// SetContext ties the conn to ctx: once ctx is done, the conn is closed and
+// Read and Write, including those in progress, fail with ctx.Err() instead
+// of io.EOF. Deadlines keep working until then. A later call replaces ctx.
+func (c *ServerConn) SetContext(ctx context.Context) {
+	c.muCtx.Lock()
+	defer c.muCtx.Unlock()
+	if c.stopParent != nil {
+		c.stopParent()
+	}
+	c.stopParent = context.AfterFunc(ctx, func() {
+		c.muCtx.Lock()
+		closing := false
+		select {
+		case <-c.ctx.Done():
+		default:
+			c.ctxErr = ctx.Err()
+			closing = true
+		}
+		c.muCtx.Unlock()
+		if closing {
+			_ = c.Close()
+		}
+	})
+}
+
+// SetMaxReadSize makes a Read return at most n bytes, however large its
+// buffer, keeping the rest of the received message for the next Read, e.g.
+// for a consumer with fixed-size frames. Zero removes the cap. Call it before
+// the first Read.
+func (c *ServerConn) SetMaxReadSize(n int) {
+	c.maxReadSize = n
+}
+
+// Clock is the source of time of the deadlines of a ServerConn.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed, unless the
+	// returned timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing and reports whether it did.
+	Stop() bool
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// SetClock makes the deadlines of the conn follow clk instead of the real
+// time, e.g. a synthetic clock that tests advance by hand to check when
+// reads and writes time out without sleeping. Nil restores the real clock.
+// Call it before the first deadline is set.
+func (c *ServerConn) SetClock(clk Clock) {
+	if clk == nil {
+		clk = realClock{}
+	}
+	c.clock = clk
+}
+
+// SetCodeToError makes Read and Write return f(code) when the stream fails
+// with a gRPC status of code, e.g. to treat Canceled as io.EOF too, or to
+// surface ResourceExhausted as a retryable error. Where f returns nil, the
+// status error is returned as is. Nil restores DefaultCodeToError. Call it
+// before the first Read or Write.
+func (c *ServerConn) SetCodeToError(f CodeToError) {
+	c.codeToError = f
+}
+
+// capRead shortens p to the max read size.
+func (c *ServerConn) capRead(p []byte) []byte {
+	if c.maxReadSize > 0 && len(p) > c.maxReadSize {
+		return p[:c.maxReadSize]
+	}
+	return p
+}
+
+// closedErr returns the error of reads and writes on the closed conn.
+func (c *ServerConn) closedErr() error {
+	c.muCtx.Lock()
+	defer c.muCtx.Unlock()
+	if c.ctxErr != nil {
+		return c.ctxErr
+	}
+	return io.EOF
+}
 func (c *ServerConn) LocalAddr() net.Addr {
 	return c.localAddr
 }
@@ -157,10 +340,19 @@ func (c *ServerConn) RemoteAddr() net.Addr {
 	return p.Addr
 }
 
+func (c *ServerConn) IsStream() bool {
+	return true
+}
+
 func (c *ServerConn) SetDeadline(t time.Time) error {
 	c.deadlineMu.Lock()
 	defer c.deadlineMu.Unlock()
-	if now := time.Now(); t.After(now) {
+	if t.IsZero() {
+		c.clearReadDeadline()
+		c.clearWriteDeadline()
+		return nil
+	}
+	if now := c.clock.Now(); t.After(now) {
 		// refresh the deadline if the deadline has been exceeded
 		select {
 		case <-c.ctxRead.Done():
@@ -176,7 +368,7 @@ func (c *ServerConn) SetDeadline(t time.Time) error {
 		if c.readDeadline != nil {
 			c.readDeadline.Stop()
 		}
-		c.readDeadline = time.AfterFunc(t.Sub(now), func() {
+		c.readDeadline = c.clock.AfterFunc(t.Sub(now), func() {
 			c.deadlineMu.Lock()
 			defer c.deadlineMu.Unlock()
 			select {
@@ -188,7 +380,7 @@ func (c *ServerConn) SetDeadline(t time.Time) error {
 		if c.writeDeadline != nil {
 			c.writeDeadline.Stop()
 		}
-		c.writeDeadline = time.AfterFunc(t.Sub(now), func() {
+		c.writeDeadline = c.clock.AfterFunc(t.Sub(now), func() {
 			c.deadlineMu.Lock()
 			defer c.deadlineMu.Unlock()
 			select {
@@ -215,7 +407,11 @@ func (c *ServerConn) SetDeadline(t time.Time) error {
 func (c *ServerConn) SetReadDeadline(t time.Time) error {
 	c.deadlineMu.Lock()
 	defer c.deadlineMu.Unlock()
-	if now := time.Now(); t.After(now) {
+	if t.IsZero() {
+		c.clearReadDeadline()
+		return nil
+	}
+	if now := c.clock.Now(); t.After(now) {
 		// refresh the deadline if the deadline has been exceeded
 		select {
 		case <-c.ctxRead.Done():
@@ -226,7 +422,7 @@ func (c *ServerConn) SetReadDeadline(t time.Time) error {
 		if c.readDeadline != nil {
 			c.readDeadline.Stop()
 		}
-		c.readDeadline = time.AfterFunc(t.Sub(now), func() {
+		c.readDeadline = c.clock.AfterFunc(t.Sub(now), func() {
 			c.deadlineMu.Lock()
 			defer c.deadlineMu.Unlock()
 			select {
@@ -248,7 +444,11 @@ func (c *ServerConn) SetReadDeadline(t time.Time) error {
 func (c *ServerConn) SetWriteDeadline(t time.Time) error {
 	c.deadlineMu.Lock()
 	defer c.deadlineMu.Unlock()
-	if now := time.Now(); t.After(now) {
+	if t.IsZero() {
+		c.clearWriteDeadline()
+		return nil
+	}
+	if now := c.clock.Now(); t.After(now) {
 		// refresh the deadline if the deadline has been exceeded
 		select {
 		case <-c.ctxWrite.Done():
@@ -258,7 +458,7 @@ func (c *ServerConn) SetWriteDeadline(t time.Time) error {
 		if c.writeDeadline != nil {
 			c.writeDeadline.Stop()
 		}
-		c.writeDeadline = time.AfterFunc(t.Sub(now), func() {
+		c.writeDeadline = c.clock.AfterFunc(t.Sub(now), func() {
 			c.deadlineMu.Lock()
 			defer c.deadlineMu.Unlock()
 			select {
@@ -277,14 +477,131 @@ func (c *ServerConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// clearReadDeadline lifts the read deadline, so that the zero time clears it
+// like for a net.Conn instead of failing reads at once.
+func (c *ServerConn) clearReadDeadline() {
+	if c.readDeadline != nil {
+		c.readDeadline.Stop()
+		c.readDeadline = nil
+	}
+	select {
+	case <-c.ctxRead.Done():
+		c.ctxRead, c.cancelRead = context.WithCancel(context.Background())
+	default:
+	}
+}
+
+// clearWriteDeadline is clearReadDeadline for writes.
+func (c *ServerConn) clearWriteDeadline() {
+	if c.writeDeadline != nil {
+		c.writeDeadline.Stop()
+		c.writeDeadline = nil
+	}
+	select {
+	case <-c.ctxWrite.Done():
+		c.ctxWrite, c.cancelWrite = context.WithCancel(context.Background())
+	default:
+	}
+}
+
 type Server struct {
 	*grpc.Server
 	LocalAddr  net.Addr
 	HandleConn func(conn net.Conn) error
+	// FlowControlWindow enables credit-based flow control, see
+	// Dialer.FlowControlWindow.
+	FlowControlWindow uint32
+	// Framed keeps the boundaries of the writes, see Dialer.Framed.
+	Framed bool
+	// BufferPool, if set, is where the conns take their receive buffers
+	// from, e.g. an InstrumentedPool to watch them. Nil means the shared
+	// pool.
+	BufferPool BufferPool
+	// MaxReadSize caps the bytes returned by one Read of the conns, see
+	// ServerConn.SetMaxReadSize.
+	MaxReadSize int
+	// Conns, if set, tracks the live conns so that Drain waits for them.
+	Conns *ConnTracker
+	// CodeToError translates the gRPC status of a failing stream into the
+	// error of Read and Write of the conns, see ServerConn.SetCodeToError.
+	// Nil means DefaultCodeToError.
+	CodeToError CodeToError
+	// OnClose, if not nil, is called once for every conn when it is closed,
+	// at the latest when its stream ends, with the bytes written to and read
+	// from it, see ServerConn.SetOnClose.
+	OnClose func(conn *ServerConn, tx, rx uint64)
+	// MaxRecvMsgSize and MaxSendMsgSize cap the size of one message, see
+	// Dialer.MaxRecvMsgSize. gRPC applies them to the whole grpc.Server, so
+	// they only take effect through ServerOptions.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+}
+
+// ServerOptions returns the options to create the embedded grpc.Server with
+// for the fields that gRPC applies server-wide, MaxRecvMsgSize and
+// MaxSendMsgSize.
+func (g Server) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(msgSize(g.MaxRecvMsgSize)),
+		grpc.MaxSendMsgSize(msgSize(g.MaxSendMsgSize)),
+	}
+}
+
+// CodeToError returns the error that Read or Write return when the stream
+// fails with a gRPC status of code, or nil to return the status error.
+type CodeToError func(code codes.Code) error
+
+// DefaultCodeToError treats Unavailable and OutOfRange as the end of the
+// stream, io.EOF, and returns the status error for the other codes.
+func DefaultCodeToError(code codes.Code) error {
+	switch code {
+	case codes.Unavailable, codes.OutOfRange:
+		return io.EOF
+	}
+	return nil
+}
+
+// translate returns the error to return for err, an error of Recv or Send.
+func (f CodeToError) translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	if f == nil {
+		f = DefaultCodeToError
+	}
+	if translated := f(status.Code(err)); translated != nil {
+		return translated
+	}
+	return err
 }
 
 func (g Server) Tun(tun proto.GunService_TunServer) error {
-	if err := g.HandleConn(NewServerConn(tun, g.LocalAddr)); err != nil {
+	serverConn := NewServerConn(tun, g.LocalAddr)
+	if g.BufferPool != nil {
+		serverConn.pool = g.BufferPool
+	}
+	serverConn.SetMaxReadSize(g.MaxReadSize)
+	serverConn.SetCodeToError(g.CodeToError)
+	if g.OnClose != nil {
+		serverConn.SetOnClose(func(tx, rx uint64) { g.OnClose(serverConn, tx, rx) })
+	}
+	// The stream ends when Tun returns.
+	defer serverConn.Close()
+	if g.Conns != nil {
+		serverConn.onClose = func() { g.Conns.remove(serverConn) }
+		if !g.Conns.add(serverConn) {
+			return errDraining
+		}
+		defer g.Conns.remove(serverConn)
+	}
+	var conn net.Conn = serverConn
+	if g.FlowControlWindow > 0 {
+		conn = NewFlowConn(conn, g.FlowControlWindow)
+	}
+	if g.Framed {
+		conn = NewFramedConn(conn)
+	}
+	if err := g.HandleConn(conn); err != nil {
 		return err
 	}
 	return nil
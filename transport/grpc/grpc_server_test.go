@@ -0,0 +1,467 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+	proto "github.com/daeuniverse/outbound/pkg/gun_proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeTunServer hands out hunks from a channel and counts Recv calls.
+type fakeTunServer struct {
+	grpc.ServerStream
+	hunks chan *proto.Hunk
+	recvs int
+	// ctx is the stream context, context.Background() if nil.
+	ctx context.Context
+}
+
+func (s *fakeTunServer) Recv() (*proto.Hunk, error) {
+	s.recvs++
+	hunk, ok := <-s.hunks
+	if !ok {
+		return nil, io.EOF
+	}
+	return hunk, nil
+}
+
+func (s *fakeTunServer) Send(*proto.Hunk) error {
+	return nil
+}
+
+func (s *fakeTunServer) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+func TestServerConnReadBuffered(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk, 1)}
+	c := NewServerConn(tun, nil)
+	defer c.Close()
+
+	if got := c.Buffered(); got != 0 {
+		t.Fatalf("Buffered() = %v, want 0", got)
+	}
+	tun.hunks <- &proto.Hunk{Data: []byte("hello world")}
+	p := make([]byte, 5)
+	if n, err := c.Read(p); err != nil || string(p[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v, want hello", p[:n], err)
+	}
+	if got := c.Buffered(); got != 6 {
+		t.Fatalf("Buffered() = %v, want 6", got)
+	}
+
+	p = make([]byte, 4)
+	if n := c.ReadBuffered(p); string(p[:n]) != " wor" {
+		t.Fatalf("ReadBuffered() = %q, want \" wor\"", p[:n])
+	}
+	if n := c.ReadBuffered(p); string(p[:n]) != "ld" {
+		t.Fatalf("ReadBuffered() = %q, want ld", p[:n])
+	}
+	if n := c.ReadBuffered(p); n != 0 {
+		t.Fatalf("ReadBuffered() = %v with nothing buffered, want 0", n)
+	}
+	if got := c.Buffered(); got != 0 {
+		t.Errorf("Buffered() = %v after draining, want 0", got)
+	}
+	if tun.recvs != 1 {
+		t.Errorf("Recv called %v times, want 1", tun.recvs)
+	}
+}
+
+func TestServerConnMaxReadSize(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk, 1)}
+	c := NewServerConn(tun, nil)
+	defer c.Close()
+	c.SetMaxReadSize(4)
+
+	tun.hunks <- &proto.Hunk{Data: []byte("hello world")}
+	p := make([]byte, 16)
+	var got []string
+	for len(got) < 3 {
+		n, err := c.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(p[:n]))
+	}
+	if want := []string{"hell", "o wo", "rld"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Read() returned %q, want %q", got, want)
+	}
+	if tun.recvs != 1 {
+		t.Errorf("Recv called %v times, want 1", tun.recvs)
+	}
+}
+
+func TestServerConnReadFull(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk, 2)}
+	defer close(tun.hunks)
+	c := NewServerConn(tun, nil)
+	defer c.Close()
+
+	tun.hunks <- &proto.Hunk{Data: []byte("hello wo")}
+	tun.hunks <- &proto.Hunk{Data: []byte("rld")}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p := make([]byte, 5)
+	if n, err := netproxy.ReadFull(ctx, c, p); err != nil || string(p[:n]) != "hello" {
+		t.Fatalf("ReadFull() = %q, %v, want hello", p[:n], err)
+	}
+	// The rest of the first message is taken before waiting for the next.
+	p = make([]byte, 6)
+	if n, err := netproxy.ReadFull(ctx, c, p); err != nil || string(p[:n]) != " world" {
+		t.Fatalf("ReadFull() = %q, %v, want \" world\"", p[:n], err)
+	}
+	if tun.recvs != 2 {
+		t.Errorf("Recv called %v times, want 2", tun.recvs)
+	}
+
+	// ReadFull clears the deadline on return, which must not fail the next
+	// Read.
+	tun.hunks <- &proto.Hunk{Data: []byte("!")}
+	if n, err := c.Read(p); err != nil || string(p[:n]) != "!" {
+		t.Errorf("Read() after ReadFull() = %q, %v, want !", p[:n], err)
+	}
+}
+
+func TestServerConnOnClose(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk, 1)}
+	defer close(tun.hunks)
+	c := NewServerConn(tun, nil)
+	var calls atomic.Int32
+	var traffic string
+	c.SetOnClose(func(tx, rx uint64) {
+		calls.Add(1)
+		traffic = fmt.Sprint(tx, rx)
+	})
+
+	tun.hunks <- &proto.Hunk{Data: []byte("hello")}
+	p := make([]byte, 3)
+	for range 2 {
+		if _, err := c.Read(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if tx, rx := c.Traffic(); tx != 2 || rx != 5 {
+		t.Errorf("Traffic() = %v, %v, want 2, 5", tx, rx)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = c.Close()
+		}()
+	}
+	wg.Wait()
+	if calls.Load() != 1 || traffic != "2 5" {
+		t.Errorf("OnClose called %v times with %v, want once with 2 5", calls.Load(), traffic)
+	}
+
+	// The end of the context closes the conn too.
+	c = NewServerConn(tun, nil)
+	done := make(chan struct{})
+	c.SetOnClose(func(tx, rx uint64) { close(done) })
+	ctx, cancel := context.WithCancel(context.Background())
+	c.SetContext(ctx)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called once the context is done")
+	}
+}
+
+func TestServerOnClose(t *testing.T) {
+	type result struct {
+		conn   *ServerConn
+		tx, rx uint64
+	}
+	results := make(chan result, 1)
+	g := Server{
+		HandleConn: func(conn net.Conn) error {
+			// Returns without closing conn.
+			_, err := conn.Write([]byte("hello"))
+			return err
+		},
+		OnClose: func(conn *ServerConn, tx, rx uint64) { results <- result{conn, tx, rx} },
+	}
+	if err := g.Tun(&fakeTunServer{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-results:
+		if r.conn == nil || r.tx != 5 || r.rx != 0 {
+			t.Errorf("OnClose(%p, %v, %v), want the conn, 5, 0", r.conn, r.tx, r.rx)
+		}
+	default:
+		t.Error("OnClose not called once Tun returned")
+	}
+}
+
+// failingTunServer fails every Recv and Send with err.
+type failingTunServer struct {
+	fakeTunServer
+	err error
+}
+
+func (s *failingTunServer) Recv() (*proto.Hunk, error) { return nil, s.err }
+func (s *failingTunServer) Send(*proto.Hunk) error     { return s.err }
+
+func TestServerConnCodeToError(t *testing.T) {
+	errRetry := errors.New("retry later")
+	custom := func(code codes.Code) error {
+		switch code {
+		case codes.Unavailable, codes.OutOfRange, codes.Canceled:
+			return io.EOF
+		case codes.ResourceExhausted:
+			return errRetry
+		}
+		return nil
+	}
+	for _, tt := range []struct {
+		codeToError CodeToError
+		code        codes.Code
+		want        error
+	}{
+		{nil, codes.Unavailable, io.EOF},
+		{nil, codes.OutOfRange, io.EOF},
+		{nil, codes.Canceled, nil},
+		{custom, codes.Canceled, io.EOF},
+		{custom, codes.ResourceExhausted, errRetry},
+		{custom, codes.Internal, nil},
+	} {
+		statusErr := status.Error(tt.code, "failed")
+		want := tt.want
+		if want == nil {
+			want = statusErr
+		}
+		c := NewServerConn(&failingTunServer{err: statusErr}, nil)
+		c.SetCodeToError(tt.codeToError)
+		if _, err := c.Read(make([]byte, 1)); err != want {
+			t.Errorf("Read() failing with %v = %v, want %v", tt.code, err, want)
+		}
+		if _, err := c.Write([]byte("x")); err != want {
+			t.Errorf("Write() failing with %v = %v, want %v", tt.code, err, want)
+		}
+		_ = c.Close()
+	}
+}
+
+func TestServerConnSetContext(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk)}
+	defer close(tun.hunks)
+	c := NewServerConn(tun, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.SetContext(ctx)
+
+	// Deadlines still work while ctx is alive.
+	_ = c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() = %v, want os.ErrDeadlineExceeded", err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Hour))
+
+	// Cancelling ctx unblocks a Read waiting for a message.
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Read() = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read() did not return after cancel")
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write() = %v, want context.Canceled", err)
+	}
+	// Closing afterwards does not change the error.
+	_ = c.Close()
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() after Close() = %v, want context.Canceled", err)
+	}
+}
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	when    time.Time
+	f       func()
+	stopped bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock by d and fires the timers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.when.After(c.now):
+			due = append(due, t.f)
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	for _, f := range due {
+		f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasPending := !t.stopped && t.clock.now.Before(t.when)
+	t.stopped = true
+	return wasPending
+}
+
+func TestServerConnClock(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk, 1)}
+	defer close(tun.hunks)
+	c := NewServerConn(tun, nil)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c.SetClock(clock)
+
+	// The zero time clears a deadline.
+	_ = c.SetReadDeadline(clock.Now().Add(time.Second))
+	_ = c.SetReadDeadline(time.Time{})
+	clock.Advance(time.Hour)
+	tun.hunks <- &proto.Hunk{Data: []byte("x")}
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Read() after clearing the deadline = %v", err)
+	}
+
+	// A deadline fails a blocked Read once the clock reaches it.
+	_ = c.SetReadDeadline(clock.Now().Add(time.Second))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	clock.Advance(time.Second - time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Read() = %v before the deadline", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Read() = %v, want os.ErrDeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read() did not return at the deadline")
+	}
+
+	// Deadlines not after Now() expire at once.
+	_ = c.SetWriteDeadline(clock.Now())
+	if _, err := c.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestServerConnCloseBeforeContext(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk)}
+	defer close(tun.hunks)
+	c := NewServerConn(tun, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.SetContext(ctx)
+	_ = c.Close()
+	cancel()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() = %v, want io.EOF", err)
+	}
+}
+
+func TestServerConnBufferPool(t *testing.T) {
+	tun := &fakeTunServer{hunks: make(chan *proto.Hunk, 2)}
+	p := &InstrumentedPool{}
+	c := NewServerConn(tun, nil)
+	c.pool = p
+
+	tun.hunks <- &proto.Hunk{Data: []byte("hello world")}
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Stats(); s.Gets != 1 || s.InUse == 0 || s.Outstanding() != 1 {
+		t.Fatalf("Stats() = %+v after a partial read", s)
+	}
+	c.ReadBuffered(make([]byte, 16))
+	if s := p.Stats(); s.Puts != 1 || s.InUse != 0 || s.Peak == 0 {
+		t.Fatalf("Stats() = %+v after draining", s)
+	}
+
+	// A hunk that fits the read takes no buffer.
+	tun.hunks <- &proto.Hunk{Data: []byte("hi")}
+	if _, err := c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Stats(); s.Gets != 1 {
+		t.Errorf("Stats() = %+v, want no buffer for a whole read", s)
+	}
+
+	// What is left when a read times out is given back on Close.
+	tun.hunks <- &proto.Hunk{Data: []byte("hello world")}
+	if _, err := c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now())
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() = %v, want os.ErrDeadlineExceeded", err)
+	}
+	_ = c.Close()
+	close(tun.hunks)
+	if s := p.Stats(); s.Outstanding() != 0 || s.InUse != 0 {
+		t.Errorf("Stats() = %+v after Close, want every buffer given back", s)
+	}
+}
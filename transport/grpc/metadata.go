@@ -0,0 +1,80 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The metadata keys carrying the original addresses on the Tun stream.
+const (
+	originalSrcKey = "x-gun-original-src"
+	originalDstKey = "x-gun-original-dst"
+)
+
+type originalAddrsKey struct{}
+
+type originalAddrs struct {
+	src, dst netip.AddrPort
+}
+
+// WithOriginalAddrs returns a copy of ctx that makes Dialer send src and dst,
+// the addresses of the connection being relayed, as metadata of the Tun
+// stream, like the PROXY protocol does in front of a TCP stream. The server
+// reads them with ServerConn.OriginalSrc and OriginalDst. An invalid address
+// is not sent.
+func WithOriginalAddrs(ctx context.Context, src, dst netip.AddrPort) context.Context {
+	return context.WithValue(ctx, originalAddrsKey{}, originalAddrs{src: src, dst: dst})
+}
+
+// appendOriginalAddrs adds the addresses set on ctx by WithOriginalAddrs, if
+// any, to the outgoing metadata of ctxStream.
+func appendOriginalAddrs(ctxStream context.Context, ctx context.Context) context.Context {
+	addrs, ok := ctx.Value(originalAddrsKey{}).(originalAddrs)
+	if !ok {
+		return ctxStream
+	}
+	var kv []string
+	if addrs.src.IsValid() {
+		kv = append(kv, originalSrcKey, addrs.src.String())
+	}
+	if addrs.dst.IsValid() {
+		kv = append(kv, originalDstKey, addrs.dst.String())
+	}
+	if len(kv) == 0 {
+		return ctxStream
+	}
+	return metadata.AppendToOutgoingContext(ctxStream, kv...)
+}
+
+// OriginalSrc returns the source address the client sent with
+// WithOriginalAddrs, or nil if it sent none. Any client can send it: only
+// trust it from clients that are trusted.
+func (c *ServerConn) OriginalSrc() net.Addr {
+	return c.originalAddr(originalSrcKey)
+}
+
+// OriginalDst returns the destination address the client sent with
+// WithOriginalAddrs, or nil if it sent none. Any client can send it: only
+// trust it from clients that are trusted.
+func (c *ServerConn) OriginalDst() net.Addr {
+	return c.originalAddr(originalDstKey)
+}
+
+func (c *ServerConn) originalAddr(key string) net.Addr {
+	md, ok := metadata.FromIncomingContext(c.tun.Context())
+	if !ok {
+		return nil
+	}
+	values := md.Get(key)
+	if len(values) == 0 {
+		return nil
+	}
+	addr, err := netip.ParseAddrPort(values[0])
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addr)
+}
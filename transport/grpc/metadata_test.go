@@ -0,0 +1,44 @@
+package grpc
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestOriginalAddrs(t *testing.T) {
+	src := netip.MustParseAddrPort("[2001:db8::1]:51234")
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	ctx := WithOriginalAddrs(context.Background(), src, dst)
+	out, _ := metadata.FromOutgoingContext(appendOriginalAddrs(context.Background(), ctx))
+
+	// What the client sends is what the server sees.
+	c := NewServerConn(&fakeTunServer{ctx: metadata.NewIncomingContext(context.Background(), out)}, nil)
+	defer c.Close()
+	if got := c.OriginalSrc(); got == nil || got.String() != src.String() {
+		t.Errorf("OriginalSrc() = %v, want %v", got, src)
+	}
+	if got := c.OriginalDst(); got == nil || got.String() != dst.String() {
+		t.Errorf("OriginalDst() = %v, want %v", got, dst)
+	}
+
+	// Nothing is sent without WithOriginalAddrs, or for invalid addresses.
+	if _, ok := metadata.FromOutgoingContext(appendOriginalAddrs(context.Background(), context.Background())); ok {
+		t.Error("metadata sent without WithOriginalAddrs")
+	}
+	ctx = WithOriginalAddrs(context.Background(), netip.AddrPort{}, dst)
+	out, _ = metadata.FromOutgoingContext(appendOriginalAddrs(context.Background(), ctx))
+	c = NewServerConn(&fakeTunServer{ctx: metadata.NewIncomingContext(context.Background(), out)}, nil)
+	defer c.Close()
+	if got := c.OriginalSrc(); got != nil {
+		t.Errorf("OriginalSrc() = %v, want nil", got)
+	}
+	if got := c.OriginalDst(); got == nil || got.String() != dst.String() {
+		t.Errorf("OriginalDst() = %v, want %v", got, dst)
+	}
+	if got := NewServerConn(&fakeTunServer{}, nil).OriginalDst(); got != nil {
+		t.Errorf("OriginalDst() = %v without metadata, want nil", got)
+	}
+}
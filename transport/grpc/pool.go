@@ -0,0 +1,78 @@
+package grpc
+
+import (
+	"sync/atomic"
+
+	"github.com/daeuniverse/outbound/pool"
+)
+
+// BufferPool is where ServerConn takes the buffers holding the rest of a
+// received message that did not fit the Read. Every buffer taken with Get is
+// given back with Put once read or when the conn is closed.
+type BufferPool interface {
+	Get(size int) []byte
+	Put(buf []byte)
+}
+
+// sharedPool is the BufferPool of the pool package, used by default.
+type sharedPool struct{}
+
+func (sharedPool) Get(size int) []byte { return pool.Get(size) }
+func (sharedPool) Put(buf []byte)      { pool.Put(buf) }
+
+// PoolStats is a snapshot of the counters of an InstrumentedPool.
+type PoolStats struct {
+	Gets uint64
+	Puts uint64
+	// InUse is the capacity in bytes of the buffers taken and not given back.
+	InUse int64
+	// Peak is the highest InUse seen.
+	Peak int64
+}
+
+// Outstanding returns how many buffers were taken and not given back. If it
+// keeps growing while the number of open conns does not, some path forgets
+// to give buffers back.
+func (s PoolStats) Outstanding() int64 {
+	return int64(s.Gets) - int64(s.Puts)
+}
+
+// InstrumentedPool is a BufferPool over the shared pool that counts the
+// buffers going through it, to tell how much memory the conns hold and to
+// find leaks. Set it as Server.BufferPool. It is safe for concurrent use.
+type InstrumentedPool struct {
+	gets  atomic.Uint64
+	puts  atomic.Uint64
+	inUse atomic.Int64
+	peak  atomic.Int64
+}
+
+func (p *InstrumentedPool) Get(size int) []byte {
+	buf := pool.Get(size)
+	p.gets.Add(1)
+	inUse := p.inUse.Add(int64(cap(buf)))
+	for {
+		peak := p.peak.Load()
+		if inUse <= peak || p.peak.CompareAndSwap(peak, inUse) {
+			break
+		}
+	}
+	return buf
+}
+
+func (p *InstrumentedPool) Put(buf []byte) {
+	p.puts.Add(1)
+	p.inUse.Add(-int64(cap(buf)))
+	pool.Put(buf)
+}
+
+// Stats returns the current counters. They are read one by one, so they may
+// be slightly inconsistent while buffers are moving.
+func (p *InstrumentedPool) Stats() PoolStats {
+	return PoolStats{
+		Gets:  p.gets.Load(),
+		Puts:  p.puts.Load(),
+		InUse: p.inUse.Load(),
+		Peak:  p.peak.Load(),
+	}
+}
@@ -0,0 +1,114 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+// SessionDialer carries every TCP dial as a stream of one Session over a
+// single connection to Addr, so that the handshake and connection cost of
+// NextDialer is paid once. The peer must run Server on its side and treat
+// every accepted stream as a new connection; the dialed addr is not sent, so
+// a protocol that needs it opts in by dialing through SessionDialer and
+// writing its own request header on the stream. A new session is dialed when
+// the previous one dies; dials arriving meanwhile wait for it.
+type SessionDialer struct {
+	NextDialer     netproxy.Dialer
+	Addr           string
+	PassthroughUdp bool
+
+	mu      sync.Mutex
+	session *Session
+	dialing *sessionDial // dialing is the dial of the next session, if any
+}
+
+// sessionDial is a dial of a session, shared by the dials waiting for it.
+type sessionDial struct {
+	done    chan struct{}
+	session *Session
+	err     error // err is set before done is closed
+}
+
+func (d *SessionDialer) DialContext(ctx context.Context, network, addr string) (c netproxy.Conn, err error) {
+	magicNetwork, err := netproxy.ParseMagicNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	switch magicNetwork.Network {
+	case "tcp":
+		sess, err := d.getSession(ctx, network)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := sess.OpenStreamContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("[Mux]: open stream to %s: %w", d.Addr, err)
+		}
+		return stream, nil
+	case "udp":
+		if d.PassthroughUdp {
+			return d.NextDialer.DialContext(ctx, network, addr)
+		}
+		return nil, fmt.Errorf("%w: mux+udp", netproxy.UnsupportedTunnelTypeError)
+	default:
+		return nil, fmt.Errorf("%w: %v", netproxy.UnsupportedTunnelTypeError, network)
+	}
+}
+
+func (d *SessionDialer) getSession(ctx context.Context, network string) (*Session, error) {
+	for {
+		d.mu.Lock()
+		if d.session != nil && !d.session.IsClosed() {
+			sess := d.session
+			d.mu.Unlock()
+			return sess, nil
+		}
+		if dial := d.dialing; dial != nil {
+			d.mu.Unlock()
+			select {
+			case <-dial.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if dial.err != nil && (errors.Is(dial.err, context.Canceled) || errors.Is(dial.err, context.DeadlineExceeded)) {
+				// Given up by the dial that started it, not by
+				// NextDialer: try again.
+				continue
+			}
+			return dial.session, dial.err
+		}
+		dial := &sessionDial{done: make(chan struct{})}
+		d.dialing = dial
+		d.mu.Unlock()
+
+		// Not under d.mu, so that the other dials can give up waiting.
+		conn, err := d.NextDialer.DialContext(ctx, network, d.Addr)
+		d.mu.Lock()
+		if err != nil {
+			dial.err = fmt.Errorf("[Mux]: dial to %s: %w", d.Addr, err)
+		} else {
+			dial.session = Client(conn)
+			d.session = dial.session
+		}
+		d.dialing = nil
+		d.mu.Unlock()
+		close(dial.done)
+		return dial.session, dial.err
+	}
+}
+
+// Close closes the current session and all streams on it.
+func (d *SessionDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil {
+		return nil
+	}
+	err := d.session.Close()
+	d.session = nil
+	return err
+}
@@ -0,0 +1,499 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+// Session multiplexes streams over one connection with the frame format of
+// smux version 1 (github.com/xtaci/smux), so either side may be a stock smux
+// peer. Every frame starts with an 8 byte header:
+//
+//	| version (1) | cmd (1) | length (2, LE) | stream id (4, LE) |
+//
+// followed by length bytes of payload for PSH frames. Version 1 has no per
+// stream flow control, so a stream that is not read buffers what its peer
+// sends, up to MaxStreamBuffer.
+
+const (
+	smuxVersion = 1
+	headerSize  = 8
+
+	cmdSYN byte = 0 // open a stream
+	cmdFIN byte = 1 // close a stream
+	cmdPSH byte = 2 // data
+	cmdNOP byte = 3 // keep-alive, ignored
+
+	// MaxFrameSize is the largest payload of a frame. Writes are split into
+	// frames of up to this size.
+	MaxFrameSize = 32768
+
+	// MaxStreamBuffer is the most unread bytes a stream buffers. A stream
+	// whose peer sends more is reset, failing its reads and writes with
+	// ErrStreamBufferFull.
+	MaxStreamBuffer = 4 << 20
+
+	// acceptBacklog is the most streams opened by the peer waiting for
+	// AcceptStream. Streams beyond it are refused with a FIN.
+	acceptBacklog = 1024
+)
+
+var (
+	ErrSessionClosed    = errors.New("mux: session closed")
+	ErrStreamClosed     = errors.New("mux: stream closed")
+	ErrStreamBufferFull = errors.New("mux: stream buffer full")
+)
+
+type Session struct {
+	conn netproxy.Conn
+
+	mu           sync.Mutex
+	nextStreamID uint32
+	streams      map[uint32]*Stream
+
+	accept chan *Stream
+	writes chan *writeRequest
+
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error // set before die is closed
+}
+
+type writeRequest struct {
+	frame  []byte
+	result chan error
+}
+
+// Client starts the client side of a session on conn. Client streams have odd
+// IDs.
+func Client(conn netproxy.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server starts the server side of a session on conn. Server streams have even
+// IDs.
+func Server(conn netproxy.Conn) *Session {
+	return newSession(conn, 0)
+}
+
+func newSession(conn netproxy.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:         conn,
+		nextStreamID: firstID,
+		streams:      make(map[uint32]*Stream),
+		accept:       make(chan *Stream, acceptBacklog),
+		writes:       make(chan *writeRequest),
+		die:          make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.sendLoop()
+	return s
+}
+
+// OpenStream opens a new stream to the peer.
+func (s *Session) OpenStream() (netproxy.Conn, error) {
+	return s.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext opens a new stream to the peer, giving up when ctx is
+// done before the stream is opened.
+func (s *Session) OpenStreamContext(ctx context.Context) (netproxy.Conn, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextStreamID
+	s.nextStreamID += 2
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(ctx, cmdSYN, id, nil, nil); err != nil {
+		s.removeStream(id)
+		if ctx.Err() != nil {
+			// The SYN may still be written, so that the peer opens the
+			// stream.
+			go s.writeFrame(context.Background(), cmdFIN, id, nil, nil)
+		}
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (s *Session) AcceptStream() (netproxy.Conn, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.die:
+		return nil, s.err
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports whether the session is closed, either by Close or because
+// the underlying connection failed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the session, the underlying connection and all of its streams.
+func (s *Session) Close() error {
+	if !s.closeWithError(ErrSessionClosed) {
+		return ErrSessionClosed
+	}
+	return nil
+}
+
+func (s *Session) closeWithError(err error) (first bool) {
+	s.dieOnce.Do(func() {
+		first = true
+		s.err = err
+		close(s.die)
+		_ = s.conn.Close()
+	})
+	return first
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) recvLoop() {
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			s.closeWithError(fmt.Errorf("%w: %w", ErrSessionClosed, err))
+			return
+		}
+		if header[0] != smuxVersion {
+			s.closeWithError(fmt.Errorf("%w: unsupported version %v", ErrSessionClosed, header[0]))
+			return
+		}
+		length := binary.LittleEndian.Uint16(header[2:])
+		id := binary.LittleEndian.Uint32(header[4:])
+		switch header[1] {
+		case cmdSYN:
+			s.mu.Lock()
+			if _, ok := s.streams[id]; ok {
+				s.mu.Unlock()
+				break
+			}
+			stream := newStream(id, s)
+			s.streams[id] = stream
+			s.mu.Unlock()
+			select {
+			case s.accept <- stream:
+			default:
+				// Refused rather than stall the other streams until
+				// AcceptStream catches up.
+				s.removeStream(id)
+				go s.writeFrame(context.Background(), cmdFIN, id, nil, nil)
+			}
+		case cmdFIN:
+			s.mu.Lock()
+			stream := s.streams[id]
+			s.mu.Unlock()
+			if stream != nil {
+				stream.finReceived()
+			}
+		case cmdPSH:
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, buf); err != nil {
+				s.closeWithError(fmt.Errorf("%w: %w", ErrSessionClosed, err))
+				return
+			}
+			s.mu.Lock()
+			stream := s.streams[id]
+			s.mu.Unlock()
+			if stream != nil {
+				stream.push(buf)
+			}
+		case cmdNOP:
+		default:
+			s.closeWithError(fmt.Errorf("%w: unknown command %v", ErrSessionClosed, header[1]))
+			return
+		}
+	}
+}
+
+func (s *Session) sendLoop() {
+	for {
+		select {
+		case req := <-s.writes:
+			_, err := s.conn.Write(req.frame)
+			if err != nil {
+				s.closeWithError(fmt.Errorf("%w: %w", ErrSessionClosed, err))
+			}
+			req.result <- err
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// writeFrame queues a frame and waits until it is written, the session dies,
+// ctx is done or deadline, if not nil, fires.
+func (s *Session) writeFrame(ctx context.Context, cmd byte, id uint32, payload []byte, deadline <-chan time.Time) error {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = smuxVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	copy(frame[headerSize:], payload)
+
+	req := &writeRequest{frame: frame, result: make(chan error, 1)}
+	select {
+	case s.writes <- req:
+	case <-s.die:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-deadline:
+		return os.ErrDeadlineExceeded
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-s.die:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-deadline:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Stream is a stream of a Session. It implements netproxy.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu       sync.Mutex
+	buffers  [][]byte
+	buffered int // buffered is the number of bytes in buffers
+	fin      bool
+	notify   chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // err is set before closed is closed
+
+	readDeadline  atomic.Value // time.Time
+	writeDeadline atomic.Value // time.Time
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	s := &Stream{
+		id:     id,
+		sess:   sess,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	s.readDeadline.Store(time.Time{})
+	s.writeDeadline.Store(time.Time{})
+	return s
+}
+
+// ID returns the stream ID.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) wakeup() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) push(b []byte) {
+	s.mu.Lock()
+	if s.buffered+len(b) > MaxStreamBuffer {
+		s.mu.Unlock()
+		s.reset(ErrStreamBufferFull)
+		return
+	}
+	s.buffers = append(s.buffers, b)
+	s.buffered += len(b)
+	s.mu.Unlock()
+	s.wakeup()
+}
+
+// reset closes the stream with err without waiting for the FIN to be written,
+// as the receive loop must not block.
+func (s *Stream) reset(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.closed)
+		s.sess.removeStream(s.id)
+		s.mu.Lock()
+		s.buffers = nil
+		s.buffered = 0
+		s.mu.Unlock()
+		go s.sess.writeFrame(context.Background(), cmdFIN, s.id, nil, nil)
+	})
+}
+
+func (s *Stream) finReceived() {
+	s.mu.Lock()
+	s.fin = true
+	s.mu.Unlock()
+	s.wakeup()
+}
+
+// deadlineTimer returns a channel that fires at t, or nil if t is zero.
+func deadlineTimer(t time.Time) (<-chan time.Time, func() bool, error) {
+	if t.IsZero() {
+		return nil, func() bool { return false }, nil
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		return nil, nil, os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop, nil
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-s.closed:
+			return 0, s.err
+		default:
+		}
+		s.mu.Lock()
+		if len(s.buffers) > 0 {
+			n := copy(b, s.buffers[0])
+			s.buffered -= n
+			s.buffers[0] = s.buffers[0][n:]
+			if len(s.buffers[0]) == 0 {
+				s.buffers[0] = nil
+				s.buffers = s.buffers[1:]
+			}
+			s.mu.Unlock()
+			return n, nil
+		}
+		fin := s.fin
+		s.mu.Unlock()
+		if fin {
+			return 0, io.EOF
+		}
+
+		timeout, stop, err := deadlineTimer(s.readDeadline.Load().(time.Time))
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-s.notify:
+			stop()
+		case <-s.closed:
+			stop()
+			return 0, s.err
+		case <-s.sess.die:
+			stop()
+			return 0, s.sess.err
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (n int, err error) {
+	select {
+	case <-s.closed:
+		return 0, s.err
+	default:
+	}
+	timeout, stop, err := deadlineTimer(s.writeDeadline.Load().(time.Time))
+	if err != nil {
+		return 0, err
+	}
+	defer stop()
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		if err := s.sess.writeFrame(context.Background(), cmdPSH, s.id, chunk, timeout); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close closes the stream and tells the peer with a FIN. Reads and writes on
+// the stream fail afterwards.
+func (s *Stream) Close() error {
+	err := ErrStreamClosed
+	s.closeOnce.Do(func() {
+		s.err = ErrStreamClosed
+		close(s.closed)
+		s.sess.removeStream(s.id)
+		err = s.sess.writeFrame(context.Background(), cmdFIN, s.id, nil, nil)
+	})
+	return err
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Store(t)
+	s.wakeup()
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline. A frame that is already being
+// written to the underlying connection when the deadline fires may still be
+// sent.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Store(t)
+	return nil
+}
+
+func (s *Stream) IsStream() bool {
+	return true
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	if c, ok := s.sess.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	if c, ok := s.sess.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
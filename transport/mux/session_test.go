@@ -0,0 +1,369 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+func echo(t *testing.T, server *Session) {
+	for {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			_, _ = io.Copy(stream, stream)
+		}()
+	}
+}
+
+func TestSession(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer client.Close()
+	defer server.Close()
+	go echo(t, server)
+
+	payloads := [][]byte{[]byte("hello"), bytes.Repeat([]byte("0123456789"), 10000)}
+	streams := make([]netproxy.Conn, len(payloads))
+	for i := range payloads {
+		s, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = s
+	}
+	if streams[0].(*Stream).ID() == streams[1].(*Stream).ID() {
+		t.Fatal("streams share an ID")
+	}
+	for i, p := range payloads {
+		go streams[i].Write(p)
+	}
+	for i, p := range payloads {
+		got := make([]byte, len(p))
+		if _, err := io.ReadFull(streams[i], got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, p) {
+			t.Errorf("stream %v echoed %v bytes that differ from what was sent", i, len(got))
+		}
+	}
+
+	// Closing a stream ends the peer's copy, whose FIN ends our reads.
+	_ = streams[0].Close()
+	if _, err := streams[0].Read(make([]byte, 1)); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("Read() after Close() = %v, want ErrStreamClosed", err)
+	}
+	if got := client.NumStreams(); got != 1 {
+		t.Errorf("NumStreams() = %v, want 1", got)
+	}
+}
+
+func TestSessionFIN(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer client.Close()
+	defer server.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	_ = peer.Close()
+	got, err := io.ReadAll(s)
+	if err != nil || string(got) != "bye" {
+		t.Errorf("ReadAll() = %q, %v, want bye", got, err)
+	}
+}
+
+// TestSessionFrameFormat checks the frames on the wire against the smux v1
+// format.
+func TestSessionFrameFormat(t *testing.T) {
+	a, b := net.Pipe()
+	client := Client(a)
+	defer client.Close()
+	defer b.Close()
+
+	done := make(chan netproxy.Conn)
+	go func() {
+		s, err := client.OpenStream()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- s
+	}()
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(b, header); err != nil {
+		t.Fatal(err)
+	}
+	s := <-done
+	id := s.(*Stream).ID()
+	if id%2 != 1 {
+		t.Errorf("client stream ID %v is not odd", id)
+	}
+	want := []byte{1, cmdSYN, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(want[4:], id)
+	if !bytes.Equal(header, want) {
+		t.Errorf("SYN = %v, want %v", header, want)
+	}
+
+	go s.Write([]byte("hi"))
+	frame := make([]byte, headerSize+2)
+	if _, err := io.ReadFull(b, frame); err != nil {
+		t.Fatal(err)
+	}
+	want = append([]byte{1, cmdPSH, 2, 0, 0, 0, 0, 0}, "hi"...)
+	binary.LittleEndian.PutUint32(want[4:], id)
+	if !bytes.Equal(frame, want) {
+		t.Errorf("PSH = %v, want %v", frame, want)
+	}
+
+	// Frames from the peer are accepted, NOPs ignored.
+	go func() {
+		_, _ = b.Write([]byte{1, cmdNOP, 0, 0, 0, 0, 0, 0})
+		psh := append([]byte{1, cmdPSH, 3, 0, 0, 0, 0, 0}, "abc"...)
+		binary.LittleEndian.PutUint32(psh[4:], id)
+		_, _ = b.Write(psh)
+	}()
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "abc" {
+		t.Errorf("Read() = %q, %v, want abc", buf, err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer server.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	if _, err := s.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Read() = %v, want ErrSessionClosed", err)
+	}
+	if _, err := client.OpenStream(); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("OpenStream() = %v, want ErrSessionClosed", err)
+	}
+	// The peer notices the connection is gone.
+	if _, err := server.AcceptStream(); err != nil {
+		if _, err := server.AcceptStream(); !errors.Is(err, ErrSessionClosed) {
+			t.Errorf("AcceptStream() = %v, want ErrSessionClosed", err)
+		}
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer client.Close()
+	defer server.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+type pipeDialer struct {
+	dials   int
+	servers []*Session
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	d.dials++
+	a, b := net.Pipe()
+	d.servers = append(d.servers, Server(b))
+	return a, nil
+}
+
+func TestSessionDialer(t *testing.T) {
+	next := &pipeDialer{}
+	d := &SessionDialer{NextDialer: next, Addr: "example.com:443"}
+	defer d.Close()
+
+	for i := 0; i < 3; i++ {
+		c, err := d.DialContext(context.Background(), "tcp", "1.1.1.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	if next.dials != 1 {
+		t.Fatalf("dialed %v connections, want 1", next.dials)
+	}
+
+	// A dead session is replaced.
+	_ = next.servers[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for !d.session.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "1.1.1.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	if next.dials != 2 {
+		t.Errorf("dialed %v connections, want 2", next.dials)
+	}
+	for _, s := range next.servers {
+		s.Close()
+	}
+}
+
+func TestOpenStreamContext(t *testing.T) {
+	// Nothing reads the other end, so the SYN is never written.
+	a, b := net.Pipe()
+	defer b.Close()
+	client := Client(a)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.OpenStreamContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("OpenStreamContext() = %v, want context.DeadlineExceeded", err)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("NumStreams() = %v, want 0", n)
+	}
+}
+
+func TestSessionAcceptBacklog(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer client.Close()
+	defer server.Close()
+
+	// Nothing accepts, so the stream beyond the backlog is refused instead of
+	// blocking the session.
+	var last netproxy.Conn
+	for i := 0; i <= acceptBacklog; i++ {
+		s, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = s
+	}
+	_ = last.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := last.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() on the refused stream = %v, want io.EOF", err)
+	}
+	if n := server.NumStreams(); n != acceptBacklog {
+		t.Errorf("NumStreams() = %v, want %v", n, acceptBacklog)
+	}
+}
+
+func TestStreamBufferFull(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer client.Close()
+	defer server.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The accepted stream is not read while its peer sends more than it
+	// buffers.
+	if _, err := s.Write(make([]byte, MaxStreamBuffer+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, ErrStreamBufferFull) {
+		t.Errorf("Read() on the overflowing stream = %v, want ErrStreamBufferFull", err)
+	}
+	_ = s.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() on the peer of the overflowing stream = %v, want io.EOF", err)
+	}
+	if server.IsClosed() {
+		t.Error("the session was closed with the stream")
+	}
+}
+
+// blockingDialer dials once release is closed.
+type blockingDialer struct {
+	pipeDialer
+	release chan struct{}
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, addr string) (netproxy.Conn, error) {
+	select {
+	case <-d.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return d.pipeDialer.DialContext(ctx, network, addr)
+}
+
+func TestSessionDialerWaitingDial(t *testing.T) {
+	next := &blockingDialer{release: make(chan struct{})}
+	d := &SessionDialer{NextDialer: next, Addr: "example.com:443"}
+	defer d.Close()
+
+	first := make(chan error, 1)
+	go func() {
+		c, err := d.DialContext(context.Background(), "tcp", "1.1.1.1:80")
+		if err == nil {
+			c.Close()
+		}
+		first <- err
+	}()
+	for {
+		d.mu.Lock()
+		dialing := d.dialing != nil
+		d.mu.Unlock()
+		if dialing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A dial waiting for the session gives up with its own context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "1.1.1.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext() while the session is dialed = %v, want context.DeadlineExceeded", err)
+	}
+
+	close(next.release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", "1.1.1.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if next.dials != 1 {
+		t.Errorf("dialed %v connections, want 1", next.dials)
+	}
+	for _, s := range next.servers {
+		s.Close()
+	}
+}
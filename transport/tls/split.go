@@ -0,0 +1,126 @@
+package tls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/daeuniverse/outbound/netproxy"
+)
+
+// SplitAtSNI makes SplitConn find the split position in the ClientHello.
+const SplitAtSNI = 0
+
+// parseSplit parses the TlsSplit option: "sni" or "auto" to split in the
+// middle of the SNI, or a byte offset into the first write.
+func parseSplit(str string) (int, error) {
+	switch str {
+	case "sni", "auto":
+		return SplitAtSNI, nil
+	}
+	position, err := strconv.Atoi(str)
+	if err != nil || position <= 0 {
+		return 0, fmt.Errorf("invalid split position: %s", str)
+	}
+	return position, nil
+}
+
+// SplitConn writes the first Write in two pieces, so that the ClientHello
+// reaches the wire in two TCP segments and middleboxes matching the SNI of a
+// single segment do not see it whole. Later writes go through unchanged.
+type SplitConn struct {
+	netproxy.Conn
+	position int
+	split    atomic.Bool
+}
+
+// NewSplitConn returns a SplitConn splitting the first write at position, or
+// in the middle of the server name if position is SplitAtSNI. A first write
+// that is shorter than position, or that has no SNI to split at, is written
+// whole.
+func NewSplitConn(rawConn netproxy.Conn, position int) *SplitConn {
+	return &SplitConn{Conn: rawConn, position: position}
+}
+
+func (s *SplitConn) Write(b []byte) (n int, err error) {
+	if !s.split.CompareAndSwap(false, true) {
+		return s.Conn.Write(b)
+	}
+	position := s.position
+	if position == SplitAtSNI {
+		offset, length, ok := findSNI(b)
+		if !ok {
+			return s.Conn.Write(b)
+		}
+		position = offset + length/2
+	}
+	if position <= 0 || position >= len(b) {
+		return s.Conn.Write(b)
+	}
+	n, err = s.Conn.Write(b[:position])
+	if err != nil {
+		return n, err
+	}
+	m, err := s.Conn.Write(b[position:])
+	return n + m, err
+}
+
+// findSNI returns the offset and length of the server name in b, which must
+// start with a TLS record holding a ClientHello.
+func findSNI(b []byte) (offset, length int, ok bool) {
+	// Record header: type (22 = handshake), version, length.
+	if len(b) < 5 || b[0] != 22 {
+		return 0, 0, false
+	}
+	end := 5 + int(binary.BigEndian.Uint16(b[3:]))
+	if end > len(b) {
+		end = len(b)
+	}
+	// Handshake header: type (1 = ClientHello), length (3 bytes).
+	p := 5
+	if end < p+4 || b[p] != 1 {
+		return 0, 0, false
+	}
+	// Client version and random.
+	p += 4 + 2 + 32
+	// Session ID, cipher suites and compression methods.
+	for _, lenSize := range []int{1, 2, 1} {
+		if end < p+lenSize {
+			return 0, 0, false
+		}
+		l := int(b[p])
+		if lenSize == 2 {
+			l = int(binary.BigEndian.Uint16(b[p:]))
+		}
+		p += lenSize + l
+	}
+	if end < p+2 {
+		return 0, 0, false
+	}
+	extEnd := p + 2 + int(binary.BigEndian.Uint16(b[p:]))
+	if extEnd > end {
+		extEnd = end
+	}
+	p += 2
+	for p+4 <= extEnd {
+		extType := binary.BigEndian.Uint16(b[p:])
+		extLen := int(binary.BigEndian.Uint16(b[p+2:]))
+		p += 4
+		if extType != 0 {
+			p += extLen
+			continue
+		}
+		// server_name: list length, name type (0 = host_name), name length.
+		if extEnd < p+5 || b[p+2] != 0 {
+			return 0, 0, false
+		}
+		length = int(binary.BigEndian.Uint16(b[p+3:]))
+		offset = p + 5
+		if offset+length > extEnd {
+			return 0, 0, false
+		}
+		return offset, length, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,97 @@
+package tls
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// recordConn remembers every write.
+type recordConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// clientHello returns the first write of a crypto/tls client.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go tls.Client(clientConn, &tls.Config{ServerName: serverName}).Handshake()
+	buf := make([]byte, 16<<10)
+	n, err := serverConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestFindSNI(t *testing.T) {
+	hello := clientHello(t, "blocked.example.com")
+	offset, length, ok := findSNI(hello)
+	if !ok {
+		t.Fatal("findSNI() found no SNI")
+	}
+	if got := string(hello[offset : offset+length]); got != "blocked.example.com" {
+		t.Errorf("findSNI() points at %q", got)
+	}
+	for _, b := range [][]byte{nil, []byte("GET / HTTP/1.1\r\n"), hello[:40]} {
+		if _, _, ok := findSNI(b); ok {
+			t.Errorf("findSNI(%q) = ok", b)
+		}
+	}
+}
+
+func TestSplitConn(t *testing.T) {
+	hello := clientHello(t, "blocked.example.com")
+	offset, length, _ := findSNI(hello)
+	for _, tc := range []struct {
+		position int
+		want     int
+	}{
+		{SplitAtSNI, offset + length/2},
+		{3, 3},
+		{len(hello) + 1, len(hello)},
+	} {
+		rc := &recordConn{}
+		c := NewSplitConn(rc, tc.position)
+		if n, err := c.Write(hello); err != nil || n != len(hello) {
+			t.Fatalf("Write() = %v, %v", n, err)
+		}
+		if _, err := c.Write([]byte("next")); err != nil {
+			t.Fatal(err)
+		}
+		if len(rc.writes[0]) != tc.want {
+			t.Errorf("position %v: first segment has %v bytes, want %v", tc.position, len(rc.writes[0]), tc.want)
+		}
+		// Only the first write is split.
+		if last := rc.writes[len(rc.writes)-1]; string(last) != "next" {
+			t.Errorf("position %v: last write = %q, want next", tc.position, last)
+		}
+	}
+}
+
+func TestParseSplit(t *testing.T) {
+	for _, tc := range []struct {
+		str  string
+		want int
+		ok   bool
+	}{
+		{"sni", SplitAtSNI, true},
+		{"auto", SplitAtSNI, true},
+		{"10", 10, true},
+		{"0", 0, false},
+		{"x", 0, false},
+	} {
+		got, err := parseSplit(tc.str)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseSplit(%q) = %v, %v", tc.str, got, err)
+		}
+	}
+}
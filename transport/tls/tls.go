@@ -10,7 +10,6 @@ import (
 
 	"github.com/daeuniverse/outbound/dialer"
 	"github.com/daeuniverse/outbound/netproxy"
-	utls "github.com/refraction-networking/utls"
 )
 
 // Tls is a base Tls struct
@@ -27,6 +26,8 @@ type Tls struct {
 	fragmentMaxLength   int64
 	fragmentMinInterval int64
 	fragmentMaxInterval int64
+	split               bool
+	splitPosition       int
 
 	tlsConfig *tls.Config
 }
@@ -46,6 +47,11 @@ func NewTls(option *dialer.ExtraOption, nextDialer netproxy.Dialer, link string)
 		tlsImplentation = option.TlsImplementation
 		utlsImitate = option.UtlsImitate
 	}
+	// An explicit fingerprint always takes precedence.
+	if fp := Fingerprint(query.Get("fp")); fp != "" {
+		tlsImplentation = "utls"
+		utlsImitate = fp
+	}
 	t := &Tls{
 		dialer:          nextDialer,
 		addr:            u.Host,
@@ -77,6 +83,9 @@ func NewTls(option *dialer.ExtraOption, nextDialer netproxy.Dialer, link string)
 	if len(query.Get("alpn")) > 0 {
 		t.tlsConfig.NextProtos = strings.Split(query.Get("alpn"), ",")
 	}
+	if err := ApplyVersionOption(t.tlsConfig, option); err != nil {
+		return nil, nil, err
+	}
 
 	if option.TlsFragment {
 		t.fragmentation = true
@@ -94,6 +103,13 @@ func NewTls(option *dialer.ExtraOption, nextDialer netproxy.Dialer, link string)
 		t.fragmentMaxInterval = maxInterval
 	}
 
+	if option.TlsSplit != "" {
+		t.split = true
+		if t.splitPosition, err = parseSplit(option.TlsSplit); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	return t, &dialer.Property{
 		Name:     u.Fragment,
 		Address:  t.addr,
@@ -114,6 +130,9 @@ func (s *Tls) DialContext(ctx context.Context, network, addr string) (c netproxy
 			return nil, fmt.Errorf("[Tls]: dial to %s: %w", s.addr, err)
 		}
 
+		if s.split {
+			rc = NewSplitConn(rc, s.splitPosition)
+		}
 		if s.fragmentation {
 			rc = NewFragmentConn(rc, s.fragmentMinLength, s.fragmentMaxLength, s.fragmentMinInterval, s.fragmentMaxInterval)
 		}
@@ -132,16 +151,14 @@ func (s *Tls) DialContext(ctx context.Context, network, addr string) (c netproxy
 			}, s.tlsConfig)
 
 		case "utls":
-			clientHelloID, err := nameToUtlsClientHelloID(s.utlsImitate)
-			if err != nil {
-				return nil, err
-			}
-
-			tlsConn = utls.UClient(&netproxy.FakeNetConn{
+			tlsConn, err = UClient(&netproxy.FakeNetConn{
 				Conn:  rc,
 				LAddr: nil,
 				RAddr: nil,
-			}, uTLSConfigFromTLSConfig(s.tlsConfig), *clientHelloID)
+			}, s.tlsConfig, s.utlsImitate)
+			if err != nil {
+				return nil, err
+			}
 
 		default:
 			return nil, fmt.Errorf("unknown tls implementation: %v", s.tlsImplentation)
@@ -3,17 +3,63 @@ package tls
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
+	"strings"
 
+	"github.com/daeuniverse/outbound/pkg/logger"
 	utls "github.com/refraction-networking/utls"
 )
 
 func uTLSConfigFromTLSConfig(config *tls.Config) *utls.Config {
 	return &utls.Config{
-		ServerName:         config.ServerName,
-		InsecureSkipVerify: config.InsecureSkipVerify,
+		ServerName:            config.ServerName,
+		InsecureSkipVerify:    config.InsecureSkipVerify,
+		NextProtos:            config.NextProtos,
+		RootCAs:               config.RootCAs,
+		VerifyPeerCertificate: config.VerifyPeerCertificate,
+		MinVersion:            config.MinVersion,
+		MaxVersion:            config.MaxVersion,
+		CipherSuites:          config.CipherSuites,
 	}
 }
 
+// UClient returns a uTLS client on conn whose ClientHello mimics the browser
+// named by fingerprint (see clientHelloIDMap). SNI, ALPN and certificate
+// verification settings are taken from config. The returned conn can be used
+// in place of tls.Client.
+func UClient(conn net.Conn, config *tls.Config, fingerprint string) (*utls.UConn, error) {
+	clientHelloID, err := nameToUtlsClientHelloID(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	uConn := utls.UClient(conn, uTLSConfigFromTLSConfig(config), *clientHelloID)
+	if len(config.NextProtos) == 0 {
+		return uConn, nil
+	}
+
+	// The fingerprint presets come with their own ALPN list. Build the hello
+	// first, override ALPN and then marshal it again.
+	if err := uConn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	hasALPN := false
+	for _, extension := range uConn.Extensions {
+		if alpn, ok := extension.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = config.NextProtos
+			hasALPN = true
+			break
+		}
+	}
+	if !hasALPN {
+		// Prepend rather than append: pre_shared_key must stay the last one.
+		uConn.Extensions = append([]utls.TLSExtension{&utls.ALPNExtension{AlpnProtocols: config.NextProtos}}, uConn.Extensions...)
+	}
+	if err := uConn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	return uConn, nil
+}
+
 var clientHelloIDMap = map[string]*utls.ClientHelloID{
 	"random":            &utls.HelloRandomized,
 	"randomized":        &utls.HelloRandomized,
@@ -45,6 +91,7 @@ var clientHelloIDMap = map[string]*utls.ClientHelloID{
 	"ios_12_1":          &utls.HelloIOS_12_1,
 	"ios_13":            &utls.HelloIOS_13,
 	"ios_14":            &utls.HelloIOS_14,
+	"android":           &utls.HelloAndroid_11_OkHttp,
 	"android_11_okhttp": &utls.HelloAndroid_11_OkHttp,
 	"edge":              &utls.HelloEdge_Auto,
 	"edge_auto":         &utls.HelloEdge_Auto,
@@ -62,6 +109,22 @@ var clientHelloIDMap = map[string]*utls.ClientHelloID{
 	"qq_11_1":           &utls.HelloQQ_11_1,
 }
 
+// Fingerprint returns the name of the uTLS fingerprint fp as accepted by
+// UClient; fp is matched case-insensitively. Links are shared between clients
+// that support different fingerprints, so an unknown fp is ignored with a
+// warning and "" is returned instead of failing every dial later.
+func Fingerprint(fp string) string {
+	if fp == "" {
+		return ""
+	}
+	name := strings.ToLower(fp)
+	if _, ok := clientHelloIDMap[name]; !ok {
+		logger.Logger.Warnf("ignoring unknown TLS fingerprint %q", fp)
+		return ""
+	}
+	return name
+}
+
 func nameToUtlsClientHelloID(name string) (*utls.ClientHelloID, error) {
 	clientHelloID, ok := clientHelloIDMap[name]
 	if !ok {
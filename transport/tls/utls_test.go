@@ -0,0 +1,69 @@
+package tls
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	for _, tc := range []struct {
+		fp   string
+		want string
+	}{
+		{"", ""},
+		{"chrome", "chrome"},
+		{"Firefox", "firefox"},
+		{"android", "android"},
+		{"no_such_browser", ""},
+	} {
+		if got := Fingerprint(tc.fp); got != tc.want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", tc.fp, got, tc.want)
+		}
+	}
+}
+
+func TestUClientOverridesALPN(t *testing.T) {
+	for _, tc := range []struct {
+		fingerprint string
+		alpn        []string
+	}{
+		{"chrome", []string{"http/1.1"}},
+		{"firefox", []string{"h2", "http/1.1"}},
+		// randomizednoalpn has no ALPN extension, so one is added.
+		{"randomizednoalpn", []string{"x-custom"}},
+	} {
+		t.Run(tc.fingerprint, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			uConn, err := UClient(clientConn, &tls.Config{
+				ServerName: "example.com",
+				NextProtos: tc.alpn,
+			}, tc.fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go uConn.Handshake()
+
+			// Abort the handshake once the ClientHello has been seen.
+			errAbort := errors.New("abort")
+			var got []string
+			server := tls.Server(serverConn, &tls.Config{
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					got = hello.SupportedProtos
+					return nil, errAbort
+				},
+			})
+			if err := server.Handshake(); !errors.Is(err, errAbort) {
+				t.Fatalf("server handshake: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.alpn) {
+				t.Errorf("ALPN = %v, want %v", got, tc.alpn)
+			}
+		})
+	}
+}
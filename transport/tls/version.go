@@ -0,0 +1,73 @@
+package tls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/daeuniverse/outbound/dialer"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseVersion(str string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(str), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version: %s", str)
+	}
+	return version, nil
+}
+
+func parseCipherSuites(str string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(tls.CipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name })
+		if i < 0 {
+			i = slices.IndexFunc(tls.InsecureCipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name })
+			if i < 0 {
+				return nil, fmt.Errorf("unknown cipher suite: %s", name)
+			}
+			ids = append(ids, tls.InsecureCipherSuites()[i].ID)
+			continue
+		}
+		suite := tls.CipherSuites()[i]
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return nil, fmt.Errorf("cipher suite %s is TLS 1.3 only, whose suites cannot be chosen", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// ApplyVersionOption sets the TLS version range and the cipher suites of
+// option on config, and returns an error for a version or a cipher suite it
+// does not know. With a uTLS fingerprint, the fingerprint still decides what
+// the ClientHello offers.
+func ApplyVersionOption(config *tls.Config, option *dialer.ExtraOption) (err error) {
+	if option.TlsMinVersion != "" {
+		if config.MinVersion, err = parseVersion(option.TlsMinVersion); err != nil {
+			return err
+		}
+	}
+	if option.TlsMaxVersion != "" {
+		if config.MaxVersion, err = parseVersion(option.TlsMaxVersion); err != nil {
+			return err
+		}
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return fmt.Errorf("invalid TLS version range: %s-%s", option.TlsMinVersion, option.TlsMaxVersion)
+	}
+	if option.TlsCipherSuites != "" {
+		if config.CipherSuites, err = parseCipherSuites(option.TlsCipherSuites); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package tls
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+
+	"github.com/daeuniverse/outbound/dialer"
+)
+
+func TestApplyVersionOption(t *testing.T) {
+	for _, tc := range []struct {
+		option   dialer.ExtraOption
+		min, max uint16
+		suites   []uint16
+		wantErr  bool
+	}{
+		{option: dialer.ExtraOption{}},
+		{
+			option: dialer.ExtraOption{TlsMinVersion: "1.3"},
+			min:    tls.VersionTLS13,
+		},
+		{
+			option: dialer.ExtraOption{TlsMinVersion: "tls1.1", TlsMaxVersion: "1.2"},
+			min:    tls.VersionTLS11,
+			max:    tls.VersionTLS12,
+		},
+		{
+			option: dialer.ExtraOption{TlsCipherSuites: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_AES_128_CBC_SHA256"},
+			suites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA256},
+		},
+		{option: dialer.ExtraOption{TlsMinVersion: "1.4"}, wantErr: true},
+		{option: dialer.ExtraOption{TlsMinVersion: "1.3", TlsMaxVersion: "1.2"}, wantErr: true},
+		{option: dialer.ExtraOption{TlsCipherSuites: "TLS_NO_SUCH_SUITE"}, wantErr: true},
+		{option: dialer.ExtraOption{TlsCipherSuites: "TLS_AES_128_GCM_SHA256"}, wantErr: true},
+	} {
+		var config tls.Config
+		err := ApplyVersionOption(&config, &tc.option)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ApplyVersionOption(%+v) succeeded, want an error", tc.option)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ApplyVersionOption(%+v) = %v", tc.option, err)
+			continue
+		}
+		if config.MinVersion != tc.min || config.MaxVersion != tc.max || !reflect.DeepEqual(config.CipherSuites, tc.suites) {
+			t.Errorf("ApplyVersionOption(%+v) set versions %x-%x and suites %x, want %x-%x and %x", tc.option,
+				config.MinVersion, config.MaxVersion, config.CipherSuites, tc.min, tc.max, tc.suites)
+		}
+	}
+}
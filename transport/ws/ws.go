@@ -38,6 +38,7 @@ type Ws struct {
 	wsAddr              string
 	header              http.Header
 	tlsClientConfig     *tls.Config
+	fingerprint         string
 	passthroughUdp      bool
 	tlsFragmentation    bool
 	fragmentMinLength   int64
@@ -83,7 +84,6 @@ func NewWs(option *dialer.ExtraOption, nextDialer netproxy.Dialer, link string)
 		if !allowInsecure {
 			allowInsecure, _ = strconv.ParseBool(u.Query().Get("skipVerify"))
 		}
-		// TODO: utls
 		t.tlsClientConfig = &tls.Config{
 			ServerName:         query.Get("sni"),
 			InsecureSkipVerify: allowInsecure || option.AllowInsecure,
@@ -91,6 +91,19 @@ func NewWs(option *dialer.ExtraOption, nextDialer netproxy.Dialer, link string)
 		if len(query.Get("alpn")) > 0 {
 			t.tlsClientConfig.NextProtos = strings.Split(query.Get("alpn"), ",")
 		}
+		if err := transportTls.ApplyVersionOption(t.tlsClientConfig, option); err != nil {
+			return nil, nil, err
+		}
+		t.fingerprint = transportTls.Fingerprint(query.Get("fp"))
+		if t.fingerprint != "" {
+			if t.tlsClientConfig.ServerName == "" {
+				t.tlsClientConfig.ServerName = u.Hostname()
+			}
+			// Browser fingerprints offer h2, which websocket cannot use.
+			if len(t.tlsClientConfig.NextProtos) == 0 {
+				t.tlsClientConfig.NextProtos = []string{"http/1.1"}
+			}
+		}
 
 		if option.TlsFragment {
 			t.tlsFragmentation = true
@@ -142,6 +155,24 @@ func (s *Ws) DialContext(ctx context.Context, network, addr string) (c netproxy.
 			},
 			TLSClientConfig: s.tlsClientConfig,
 		}
+		if s.fingerprint != "" {
+			wsDialer.NetDialTLSContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+				c, err := wsDialer.NetDial("tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn, err := transportTls.UClient(c, s.tlsClientConfig, s.fingerprint)
+				if err != nil {
+					_ = c.Close()
+					return nil, err
+				}
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					_ = c.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			}
+		}
 		rc, _, err := wsDialer.DialContext(ctx, s.wsAddr, s.header)
 		if err != nil {
 			return nil, fmt.Errorf("[Ws]: dial to %s: %w", s.wsAddr, err)